@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"time"
+)
+
+// maxAdminBody limits the size of request bodies accepted by the admin API.
+const maxAdminBody = 1 << 20
+
+// serveAdmin serves the admin API, which has metrics, stats, diagnostics
+// and optionally profiles, on its own listener. It listens on loopback
+// unless exposed explicitly, which is logged as a warning.
+func serveAdmin(p *forwardProxy, cfg *Config) {
+	addr := cfg.adminListenAddress()
+	if cfg.adminExposed() {
+		log.Printf("WARNING: the admin API on %s is reachable from other hosts, keep its tokens and client certificates safe", addr)
+	}
+	ln, err := net.Listen(cfg.network(), addr)
+	if err != nil {
+		log.Fatal("admin Listen:", err)
+	}
+	if cfg.AdminTLSCertFile != "" {
+		tlsConfig, err := newAdminTLSConfig(cfg)
+		if err != nil {
+			log.Fatal("admin TLS:", err)
+		}
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	handler := newAdminAuth(cfg).wrap(newAdminHandler(p, cfg.AdminPprof))
+	if cfg.AdminPAC {
+		// Browsers fetch the PAC file without admin credentials.
+		_, port, _ := net.SplitHostPort(cfg.HTTPAddress)
+		mux := http.NewServeMux()
+		mux.HandleFunc(cfg.PACPath, p.adminPACHandler(port))
+		mux.Handle("/", handler)
+		handler = mux
+	}
+	if err := http.Serve(ln, handler); err != nil {
+		log.Fatal("admin Serve:", err)
+	}
+}
+
+func newAdminHandler(p *forwardProxy, profiles bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config/validate", p.handleValidateConfig)
+	mux.HandleFunc("/metrics", p.handleMetrics)
+	mux.HandleFunc("/stats/upstream", p.handleUpstreamStats)
+	mux.HandleFunc("/stats/cluster", p.handleClusterStats)
+	mux.HandleFunc("/stats/domains", p.handleDomainStats)
+	mux.HandleFunc("/diag/upstream", p.handleUpstreamDiag)
+	mux.HandleFunc("/upstream/flush", p.handleFlushUpstream)
+	if profiles {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// handleUpstreamStats reports how requests are spread over the pooled
+// upstream connections.
+func (p *forwardProxy) handleUpstreamStats(w http.ResponseWriter, _ *http.Request) {
+	stats := p.stats.upstream()
+	stats.Generations = p.upstreams.stats()
+	writeJSON(w, http.StatusOK, stats)
+}
+
+type validateConfigResponse struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// handleValidateConfig checks a candidate config posted as JSON without
+// applying it. Files the config refers to aren't read. With probe=true the
+// configured SOCKS upstream is also test-dialed, so a config pushed
+// afterwards is known to work; its credentials and TLS files must then be
+// those of the running upstream.
+func (p *forwardProxy) handleValidateConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var probe bool
+	if v := req.URL.Query().Get("probe"); v != "" {
+		var err error
+		if probe, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "probe must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxAdminBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := validateConfigResponse{Valid: true}
+	cfg, cfgErr := parseConfigJSON(data)
+	if cfgErr != nil {
+		resp.Errors = append(resp.Errors, cfgErr.Error())
+	} else if probe {
+		resp.Errors = append(resp.Errors, p.probeConfig(req.Context(), cfg)...)
+	}
+	resp.Valid = len(resp.Errors) == 0
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// probeConfig test-dials the SOCKS upstream of cfg and returns the errors.
+// Of the files cfg refers to only those the running upstream uses are read.
+func (p *forwardProxy) probeConfig(ctx context.Context, cfg *Config) []string {
+	u := p.upstreams.current.Load()
+	credentialsFile := ""
+	if p.credentials != nil {
+		credentialsFile = p.credentials.path
+	}
+	for _, f := range []struct{ name, path, running string }{
+		{"socks_credentials_file", cfg.SocksCredentialsFile, credentialsFile},
+		{"socks_ca_file", cfg.SocksCAFile, u.tlsCAFile},
+		{"socks_tls_cert_file", cfg.SocksTLSCertFile, u.tlsCertFile},
+		{"socks_tls_key_file", cfg.SocksTLSKeyFile, u.tlsKeyFile},
+	} {
+		if f.path != "" && f.path != f.running {
+			return []string{f.name + " must be the running one to probe the upstream"}
+		}
+	}
+	if err := cfg.readCredentials(); err != nil {
+		return []string{err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	// The config is validated, so the proxies and hops parse.
+	endpoints, _ := parseSocksProxies(cfg)
+	via, _ := parseProxyChain(cfg.SocksVia)
+	tlsConfig, err := newUpstreamTLSConfig(cfg.SocksCAFile, cfg.SocksTLSCertFile, cfg.SocksTLSKeyFile)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var errs []string
+	for _, endpoint := range endpoints {
+		if dialErr := probeSocks(ctx, via, endpoint, tlsConfig); dialErr != nil {
+			errs = append(errs, "upstream proxy "+endpoint.server+": "+dialErr.Error())
+		}
+	}
+	return errs
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("admin write response error: %+v", err)
+	}
+}
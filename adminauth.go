@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Roles of admin API clients. Reading (GET and HEAD) is allowed to both,
+// all other requests need the write role.
+const (
+	adminRoleRead  = "read"
+	adminRoleWrite = "write"
+)
+
+// adminAuth authenticates admin API clients with static bearer tokens or
+// TLS client certificates, independently of proxy users.
+type adminAuth struct {
+	readToken  string
+	writeToken string
+
+	clientCerts bool
+	writers     map[string]struct{}
+}
+
+// newAdminAuth returns the admin API auth of cfg, nil when the admin API is
+// open.
+func newAdminAuth(cfg *Config) *adminAuth {
+	if cfg.AdminReadToken == "" && cfg.AdminWriteToken == "" && cfg.AdminClientCAFile == "" {
+		return nil
+	}
+
+	a := &adminAuth{
+		readToken:   cfg.AdminReadToken,
+		writeToken:  cfg.AdminWriteToken,
+		clientCerts: cfg.AdminClientCAFile != "",
+		writers:     make(map[string]struct{}, len(cfg.AdminClientWriters)),
+	}
+	for _, name := range cfg.AdminClientWriters {
+		a.writers[name] = struct{}{}
+	}
+	return a
+}
+
+// role returns the role of the client of req. It reports false when the
+// client isn't authenticated.
+func (a *adminAuth) role(req *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		switch {
+		case a.writeToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.writeToken)) == 1:
+			return adminRoleWrite, true
+		case a.readToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.readToken)) == 1:
+			return adminRoleRead, true
+		}
+		return "", false
+	}
+
+	if a.clientCerts && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		cert := req.TLS.VerifiedChains[0][0]
+		for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+			if _, ok := a.writers[name]; ok {
+				return adminRoleWrite, true
+			}
+		}
+		return adminRoleRead, true
+	}
+	return "", false
+}
+
+func (a *adminAuth) wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		role, ok := a.role(req)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+authRealm+` admin"`)
+			http.Error(w, "admin authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		if role != adminRoleWrite && req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(w, "admin write role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// newAdminTLSConfig returns the TLS config of the admin listener. With a
+// client CA, clients present certificates signed by it; they are optional
+// when tokens are configured too.
+func newAdminTLSConfig(cfg *Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.AdminTLSCertFile, cfg.AdminTLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.AdminClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.AdminClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", cfg.AdminClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if cfg.AdminReadToken != "" || cfg.AdminWriteToken != "" {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// hostAliases maps equivalent destination names to one canonical name, so
+// rules don't need to list every alias, e.g. www.example.com and
+// example.co.uk to example.com. Aliases are hosts or *.domain wildcards;
+// the longest matching wildcard applies.
+type hostAliases struct {
+	exact    map[string]string
+	suffixes []hostAlias
+}
+
+type hostAlias struct {
+	suffix    string
+	canonical string
+}
+
+// newHostAliases parses alias:canonical pairs, nil when there are none.
+func newHostAliases(pairs map[string]string) (*hostAliases, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	a := &hostAliases{exact: make(map[string]string)}
+	for alias, canonical := range pairs {
+		host, _, err := normalizeHost(canonical)
+		if err != nil || strings.HasPrefix(canonical, "*") {
+			return nil, fmt.Errorf("host alias %s: bad canonical host %q", alias, canonical)
+		}
+		if domain, ok := strings.CutPrefix(alias, "*."); ok {
+			domain, _, err := normalizeHost(domain)
+			if err != nil {
+				return nil, fmt.Errorf("host alias %s: %w", alias, err)
+			}
+			a.suffixes = append(a.suffixes, hostAlias{suffix: "." + domain, canonical: host})
+			continue
+		}
+		name, _, err := normalizeHost(alias)
+		if err != nil {
+			return nil, fmt.Errorf("host alias %s: %w", alias, err)
+		}
+		a.exact[name] = host
+	}
+	sort.Slice(a.suffixes, func(i, j int) bool { return len(a.suffixes[i].suffix) > len(a.suffixes[j].suffix) })
+	return a, nil
+}
+
+// canonical returns the canonical name of host (as returned by
+// normalizeHost), host itself when it's no alias. Nil-safe.
+func (a *hostAliases) canonical(host string) string {
+	if a == nil {
+		return host
+	}
+	if canonical, ok := a.exact[host]; ok {
+		return canonical
+	}
+	for _, s := range a.suffixes {
+		if strings.HasSuffix(host, s.suffix) {
+			return s.canonical
+		}
+	}
+	return host
+}
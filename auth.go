@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const authRealm = "http2socks"
+
+var errAuthRequired = errors.New("proxy authentication required")
+
+// proxyUsers verifies proxy credentials (Proxy-Authorization: Basic) against
+// bcrypt hashes from a htpasswd-style file.
+//
+// Verifying bcrypt is slow by design, so successful results are cached on
+// the client connection and, when a TTL is set, per client IP. Cached
+// results are keyed by the hash of the credentials sent and are dropped
+// when the users file is reloaded.
+type proxyUsers struct {
+	file     string
+	cacheTTL time.Duration
+
+	users      atomic.Pointer[map[string][]byte]
+	generation atomic.Uint64
+
+	mu     sync.Mutex
+	byIP   map[string]*authEntry
+	lastGC time.Time
+
+	hits     atomic.Int64
+	misses   atomic.Int64
+	failures atomic.Int64
+}
+
+// authEntry is a cached successful authentication.
+type authEntry struct {
+	key        [sha256.Size]byte
+	user       string
+	generation uint64
+	expires    time.Time
+}
+
+func newProxyUsers(file string, cacheTTL time.Duration) (*proxyUsers, error) {
+	u := &proxyUsers{
+		file:     file,
+		cacheTTL: cacheTTL,
+		byIP:     make(map[string]*authEntry),
+	}
+	if err := u.reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// reload reads the users file again. Cached authentications made with the
+// previous credentials are invalidated.
+func (u *proxyUsers) reload() error {
+	users, err := readUsersFile(u.file)
+	if err != nil {
+		return err
+	}
+
+	u.users.Store(&users)
+	u.generation.Add(1)
+
+	u.mu.Lock()
+	u.byIP = make(map[string]*authEntry)
+	u.mu.Unlock()
+	return nil
+}
+
+func readUsersFile(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", file, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported: %w", file, n, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// authenticate checks the proxy credentials of req and returns the user name.
+func (u *proxyUsers) authenticate(req *http.Request) (string, error) {
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", errAuthRequired
+	}
+	key := sha256.Sum256([]byte(header))
+	gen := u.generation.Load()
+	now := time.Now()
+
+	session := sessionFromContext(req.Context())
+	if session != nil {
+		if e := session.auth.Load(); e != nil && e.key == key && e.generation == gen {
+			u.hits.Add(1)
+			return e.user, nil
+		}
+	}
+
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if u.cacheTTL > 0 {
+		u.mu.Lock()
+		e := u.byIP[ip]
+		u.mu.Unlock()
+		if e != nil && e.key == key && e.generation == gen && now.Before(e.expires) {
+			u.hits.Add(1)
+			if session != nil {
+				session.auth.Store(e)
+			}
+			return e.user, nil
+		}
+	}
+
+	u.misses.Add(1)
+	user, password, ok := parseBasicAuth(header)
+	if !ok {
+		u.failures.Add(1)
+		return "", errAuthRequired
+	}
+	hash, ok := (*u.users.Load())[user]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		u.failures.Add(1)
+		return "", fmt.Errorf("invalid credentials for user %q", user)
+	}
+
+	e := &authEntry{key: key, user: user, generation: gen, expires: now.Add(u.cacheTTL)}
+	if session != nil {
+		session.auth.Store(e)
+	}
+	if u.cacheTTL > 0 {
+		u.mu.Lock()
+		u.byIP[ip] = e
+		u.gcLocked(now)
+		u.mu.Unlock()
+	}
+	return user, nil
+}
+
+// gcLocked drops expired per-IP entries once in a TTL.
+func (u *proxyUsers) gcLocked(now time.Time) {
+	if now.Sub(u.lastGC) < u.cacheTTL {
+		return
+	}
+	u.lastGC = now
+	for ip, e := range u.byIP {
+		if now.After(e.expires) {
+			delete(u.byIP, ip)
+		}
+	}
+}
+
+// parseBasicAuth parses a Basic Proxy-Authorization header value.
+func parseBasicAuth(header string) (string, string, bool) {
+	// http.Request.BasicAuth understands only the Authorization header, so
+	// a fake request is used to reuse its parsing.
+	r := http.Request{Header: http.Header{"Authorization": {header}}}
+	return r.BasicAuth()
+}
+
+// requireAuth responds with 407 asking the client for credentials.
+func requireAuth(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", `Basic realm="`+authRealm+`"`)
+	http.Error(w, errAuthRequired.Error(), http.StatusProxyAuthRequired)
+}
+
+func (u *proxyUsers) writeMetrics(pw metricsWriter) {
+	if u == nil {
+		return
+	}
+	pw.counter("http2socks_auth_cache_hits_total", "Proxy authentications answered from the cache.", u.hits.Load())
+	pw.counter("http2socks_auth_cache_misses_total", "Proxy authentications verified against the users file.", u.misses.Load())
+	pw.counter("http2socks_auth_failures_total", "Failed proxy authentications.", u.failures.Load())
+}
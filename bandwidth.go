@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// bandwidthMaxDomains bounds the destinations bytes are kept apart
+	// for, further ones are counted as bandwidthOther.
+	bandwidthMaxDomains = 10000
+	// bandwidthOther is how bytes of destinations beyond
+	// bandwidthMaxDomains are reported.
+	bandwidthOther = "other"
+)
+
+// domainBandwidth counts the bytes to and from each destination host, the
+// server name (SNI) of TLS tunnels to IP addresses when the client sent
+// one, so the destinations consuming the upstream link can be found.
+type domainBandwidth struct {
+	// top is how many destinations metrics report.
+	top int
+
+	mu      sync.Mutex
+	domains map[string]*domainBytes
+}
+
+type domainBytes struct {
+	Domain   string `json:"domain"`
+	Sent     int64  `json:"bytes_sent"`
+	Received int64  `json:"bytes_received"`
+}
+
+func newDomainBandwidth(top int) *domainBandwidth {
+	return &domainBandwidth{top: top, domains: make(map[string]*domainBytes)}
+}
+
+// add counts sent and received bytes of domain.
+func (b *domainBandwidth) add(domain string, sent, received int64) {
+	if b == nil || sent <= 0 && received <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d, ok := b.domains[domain]
+	if !ok {
+		if len(b.domains) >= bandwidthMaxDomains {
+			domain = bandwidthOther
+			d = b.domains[domain]
+		}
+		if d == nil {
+			d = &domainBytes{Domain: domain}
+			b.domains[domain] = d
+		}
+	}
+	d.Sent += max(sent, 0)
+	d.Received += max(received, 0)
+}
+
+// topDomains returns the n destinations with the most bytes, all with n
+// zero.
+func (b *domainBandwidth) topDomains(n int) []domainBytes {
+	b.mu.Lock()
+	res := make([]domainBytes, 0, len(b.domains))
+	for _, d := range b.domains {
+		res = append(res, *d)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		ti, tj := res[i].Sent+res[i].Received, res[j].Sent+res[j].Received
+		if ti != tj {
+			return ti > tj
+		}
+		return res[i].Domain < res[j].Domain
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+func (b *domainBandwidth) writeMetrics(pw metricsWriter) {
+	if b == nil {
+		return
+	}
+
+	pw.header("http2socks_domain_bytes_total", "counter", "Bytes to and from the destinations with the most traffic.")
+	for _, d := range b.topDomains(b.top) {
+		pw.sample("http2socks_domain_bytes_total", map[string]string{"domain": d.Domain, "direction": "sent"}, float64(d.Sent))
+		pw.sample("http2socks_domain_bytes_total", map[string]string{"domain": d.Domain, "direction": "received"}, float64(d.Received))
+	}
+}
+
+// handleDomainStats lists the destinations by bytes, the n=... ones with
+// the most, all without n.
+func (p *forwardProxy) handleDomainStats(w http.ResponseWriter, req *http.Request) {
+	if p.bandwidth == nil {
+		http.Error(w, "bandwidth per domain isn't tracked", http.StatusNotFound)
+		return
+	}
+	var n int
+	if s := req.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			http.Error(w, "n must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, p.bandwidth.topDomains(n))
+}
+
+// sniReader passes reads of a tunnel client through and takes the server
+// name of a TLS ClientHello from the first one, so it doesn't wait for
+// clients which expect the server to speak first.
+type sniReader struct {
+	io.ReadCloser
+	read       bool
+	serverName string
+}
+
+func (r *sniReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.read && n > 0 {
+		r.read = true
+		r.serverName = clientHelloServerName(p[:n])
+	}
+	return n, err
+}
+
+var errClientHelloRead = errors.New("ClientHello read")
+
+// clientHelloServerName returns the server name of the TLS ClientHello in
+// data, empty when there is none.
+func clientHelloServerName(data []byte) string {
+	// Records other than a handshake aren't worth a parse.
+	if len(data) == 0 || data[0] != 0x16 {
+		return ""
+	}
+	var name string
+	conn := tls.Server(helloConn{Reader: bytes.NewReader(data)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	})
+	_ = conn.Handshake()
+	return name
+}
+
+// helloConn is a connection which reads a ClientHello and can't be written
+// to.
+type helloConn struct {
+	io.Reader
+}
+
+func (helloConn) Write([]byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (helloConn) Close() error                     { return nil }
+func (helloConn) LocalAddr() net.Addr              { return nil }
+func (helloConn) RemoteAddr() net.Addr             { return nil }
+func (helloConn) SetDeadline(time.Time) error      { return nil }
+func (helloConn) SetReadDeadline(time.Time) error  { return nil }
+func (helloConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// startupListener is an address the proxy serves on.
+type startupListener struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	TLS     bool   `json:"tls,omitempty"`
+}
+
+// startupUpstream is a SOCKS5 server of the upstream, without credentials.
+type startupUpstream struct {
+	Name     string `json:"name,omitempty"`
+	Address  string `json:"address"`
+	Reserved bool   `json:"reserved,omitempty"`
+}
+
+// configSource tells where the config came from: the config file, and the
+// names of the flags and environment variables which were set. Values are
+// left out, they may be secrets.
+type configSource struct {
+	File  string   `json:"file,omitempty"`
+	Flags []string `json:"flags,omitempty"`
+	Env   []string `json:"env,omitempty"`
+}
+
+// newConfigSource returns the source of a config loaded with flags parsed
+// into fs.
+func newConfigSource(fs *flag.FlagSet) configSource {
+	var src configSource
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			src.File = f.Value.String()
+			return
+		}
+		if _, ok := os.LookupEnv(strings.ToUpper(f.Name)); ok {
+			src.Env = append(src.Env, strings.ToUpper(f.Name))
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			src.Flags = append(src.Flags, f.Name)
+		}
+	})
+	return src
+}
+
+// startupEvent is logged once the proxy listens, so deployment tooling can
+// confirm what was rolled out.
+type startupEvent struct {
+	Version   string            `json:"version"`
+	Revision  string            `json:"revision,omitempty"`
+	GoVersion string            `json:"go_version"`
+	PID       int               `json:"pid"`
+	Network   string            `json:"network"`
+	Listeners []startupListener `json:"listeners"`
+	Upstreams []startupUpstream `json:"upstreams"`
+	Features  []string          `json:"features"`
+	Config    configSource      `json:"config"`
+}
+
+func newStartupEvent(config *Config, listeners []startupListener, u *upstream) startupEvent {
+	e := startupEvent{
+		Version:   "unknown",
+		GoVersion: runtime.Version(),
+		PID:       os.Getpid(),
+		Network:   config.ListenNetwork,
+		Listeners: listeners,
+		Features:  config.features(),
+		Config:    config.source,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		e.Version = info.Main.Version
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				e.Revision = s.Value
+			}
+		}
+	}
+	for _, s := range u.servers {
+		e.Upstreams = append(e.Upstreams, startupUpstream{Name: s.name, Address: s.server, Reserved: s.reserved})
+	}
+	return e
+}
+
+// features returns the names of the optional features the config turns
+// on, sorted.
+func (cfg *Config) features() []string {
+	routing, _ := cfg.routing()
+	enabled := map[string]bool{
+		"local":               cfg.Local,
+		"tls":                 cfg.TLSCertFile != "",
+		"client_certificates": cfg.TLSClientCAFile != "",
+		"proxy_auth":          cfg.ProxyUsersFile != "",
+		"socks_tls":           cfg.SocksTLS,
+		"credentials_file":    cfg.SocksCredentialsFile != "",
+		"startup_wait":        cfg.SocksStartupWait,
+		"fallback_open":       cfg.SocksFallback == fallbackOpen,
+		"circuit_breaker":     cfg.BreakerFailures > 0,
+		"warm_pool":           cfg.SocksWarmConns > 0,
+		"max_conns":           cfg.SocksMaxConns > 0,
+		"max_conns_per_host":  cfg.MaxConnsPerHost > 0,
+		"routing_rules":       len(cfg.RoutingRules) > 0,
+		"geoip":               cfg.GeoIPDatabase != "",
+		"bypass":              !routing.bypassHosts().empty(),
+		"routing_pac_file":    cfg.RoutingPACFile != "",
+		"block_hosts":         len(cfg.BlockHosts) > 0,
+		"host_aliases":        len(cfg.HostAliases) > 0,
+		"url_rules":           len(cfg.URLRules) > 0,
+		"blocklists":          len(cfg.Blocklists) > 0,
+		"categories":          cfg.CategoriesFile != "",
+		"policy_audit":        cfg.PolicyMode == policyModeAudit,
+		"process_tagging":     cfg.ProcessTagging,
+		"events":              cfg.EventsURL != "",
+		"chaos":               cfg.chaos().enabled(),
+		"pacing":              cfg.PacingRate > 0,
+		"qos":                 len(cfg.QosClassHosts) > 0 || len(cfg.QosClassUsers) > 0,
+		"spool":               cfg.SpoolRequestBodies,
+		"cache":               cfg.CacheSize > 0,
+		"signing":             cfg.SigningRulesFile != "",
+		"integrity":           cfg.IntegrityRulesFile != "",
+		"shared_state":        cfg.RedisAddress != "",
+		"statsd":              cfg.MetricsBackend != metricsPrometheus,
+		"conn_map":            cfg.ConnMapFile != "",
+		"costs":               len(cfg.CostRates) > 0,
+		"server_timing":       cfg.ServerTiming,
+		"pac":                 cfg.PACPath != "",
+		"wpad":                cfg.WPAD,
+		"dns_rebind":          cfg.DNSRebindProtection,
+	}
+	features := []string{}
+	for name, on := range enabled {
+		if on {
+			features = append(features, name)
+		}
+	}
+	slices.Sort(features)
+	return features
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxBlocklistSize limits the size of a single downloaded blocklist.
+const maxBlocklistSize = 64 << 20
+
+// blocklist is a set of destinations loaded from subscription lists (URLs or
+// local files) which are refreshed periodically. A refreshed set replaces
+// the previous one atomically, so matching never waits for a refresh.
+type blocklist struct {
+	sources []string
+	refresh time.Duration
+	client  func() (*http.Client, error)
+
+	current   atomic.Pointer[blocklistSet]
+	failures  atomic.Int64
+	refreshes atomic.Int64
+}
+
+type blocklistSet struct {
+	matcher *hostMatcher
+	entries map[string]struct{}
+	loaded  time.Time
+}
+
+func newBlocklist(sources []string, refresh time.Duration, client func() (*http.Client, error)) *blocklist {
+	return &blocklist{
+		sources: sources,
+		refresh: refresh,
+		client:  client,
+	}
+}
+
+// run loads the lists and keeps refreshing them until ctx is done.
+func (b *blocklist) run(ctx context.Context) {
+	if b == nil || len(b.sources) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(b.refresh)
+	defer ticker.Stop()
+	for {
+		if err := b.load(ctx); err != nil {
+			b.failures.Add(1)
+			log.Printf("blocklist refresh failed, keeping the previous list: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *blocklist) load(ctx context.Context) error {
+	entries := make(map[string]struct{})
+	for _, source := range b.sources {
+		if err := b.read(ctx, source, entries); err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+	}
+
+	// A broken line shouldn't keep the whole list from updating.
+	matcher := &hostMatcher{exact: make(map[string]struct{}, len(entries))}
+	var invalid int
+	for entry := range entries {
+		if strings.HasPrefix(entry, "@") || matcher.add(entry) != nil {
+			delete(entries, entry)
+			invalid++
+		}
+	}
+
+	next := &blocklistSet{matcher: matcher, entries: entries, loaded: time.Now()}
+	prev := b.current.Swap(next)
+	b.refreshes.Add(1)
+
+	var added, removed int
+	if prev != nil {
+		for entry := range next.entries {
+			if _, ok := prev.entries[entry]; !ok {
+				added++
+			}
+		}
+		for entry := range prev.entries {
+			if _, ok := next.entries[entry]; !ok {
+				removed++
+			}
+		}
+	} else {
+		added = len(next.entries)
+	}
+	log.Printf("blocklist refreshed: %d entries, %d added, %d removed, %d invalid skipped", len(next.entries), added, removed, invalid)
+	return nil
+}
+
+func (b *blocklist) read(ctx context.Context, source string, entries map[string]struct{}) error {
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client, err := b.client()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, http.NoBody)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	scanner := bufio.NewScanner(io.LimitReader(r, maxBlocklistSize))
+	for scanner.Scan() {
+		if entry := parseBlocklistLine(scanner.Text()); entry != "" {
+			entries[entry] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseBlocklistLine returns the entry of a blocklist line. Both plain lists
+// (one pattern per line) and hosts files ("0.0.0.0 ads.example.com") are
+// understood, comments start with "#".
+func parseBlocklistLine(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 0:
+		return ""
+	case 1:
+		return fields[0]
+	default:
+		// hosts file format, the first field is the address
+		// the host resolves to.
+		host := fields[1]
+		if host == "localhost" || host == "broadcasthost" {
+			return ""
+		}
+		return host
+	}
+}
+
+func (b *blocklist) match(host string) bool {
+	if b == nil {
+		return false
+	}
+	set := b.current.Load()
+	return set != nil && set.matcher.match(host)
+}
+
+func (b *blocklist) writeMetrics(pw metricsWriter) {
+	if b == nil || len(b.sources) == 0 {
+		return
+	}
+
+	var size int
+	var age float64
+	if set := b.current.Load(); set != nil {
+		size = len(set.entries)
+		age = time.Since(set.loaded).Seconds()
+	}
+	pw.gauge("http2socks_blocklist_entries", "Entries in the subscribed blocklists.", float64(size))
+	pw.gauge("http2socks_blocklist_age_seconds", "Time since the blocklists were last refreshed.", age)
+	pw.counter("http2socks_blocklist_refreshes_total", "Successful blocklist refreshes.", b.refreshes.Load())
+	pw.counter("http2socks_blocklist_refresh_failures_total", "Failed blocklist refreshes.", b.failures.Load())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var errCircuitOpen = errors.New("upstream proxy is failing, circuit breaker is open")
+
+// States of the circuit breaker.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops connecting through the upstream after failures
+// consecutive connections failed to reach it, and fails connections fast
+// instead. Once cooldown passed, one connection is let through as a probe:
+// it closes the breaker when it gets through, or opens it again.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failed   int
+	openedAt time.Time
+
+	opens    atomic.Int64
+	rejected atomic.Int64
+}
+
+func newCircuitBreaker(failures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{failures: failures, cooldown: cooldown}
+}
+
+// allow reports whether a connection may be made, which is then the probe
+// when the breaker was open.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.state == breakerClosed:
+		return true
+	case b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown:
+		b.state = breakerHalfOpen
+		log.Println("circuit breaker: probing the upstream proxy")
+		return true
+	}
+	b.rejected.Add(1)
+	return false
+}
+
+// record takes the result of an allowed connection. Errors other than the
+// upstream being down mean it's up.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || !upstreamDown(err) {
+		if b.state != breakerClosed {
+			log.Println("circuit breaker: the upstream proxy recovered, closing")
+		}
+		b.state, b.failed = breakerClosed, 0
+		return
+	}
+
+	b.failed++
+	if b.state == breakerHalfOpen || b.state == breakerClosed && b.failed >= b.failures {
+		b.state, b.openedAt = breakerOpen, time.Now()
+		b.opens.Add(1)
+		log.Printf("circuit breaker: open after %d consecutive failures, failing connections for %v: %v", b.failed, b.cooldown, err)
+	}
+}
+
+// abandon takes back an allowed connection which the client gave up, so a
+// probe is let through again right away.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) writeMetrics(pw metricsWriter) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+	pw.gauge("http2socks_upstream_breaker_state", "State of the circuit breaker: 0 closed, 1 open, 2 half-open (probing).", float64(state))
+	pw.counter("http2socks_upstream_breaker_opens_total", "Times the circuit breaker opened.", b.opens.Load())
+	pw.counter("http2socks_upstream_breaker_rejected_total", "Connections failed fast while the circuit breaker was open.", b.rejected.Load())
+}
+
+// breakerDialer dials through upstream while breaker allows it.
+type breakerDialer struct {
+	upstream proxy.ContextDialer
+	breaker  *circuitBreaker
+}
+
+func (d breakerDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d breakerDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !d.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	conn, err := d.upstream.DialContext(ctx, network, addr)
+	// The upstream wasn't tried when all servers were at their limit or
+	// the destination resolved to a blocked address.
+	if err != nil && (ctx.Err() != nil || errors.Is(err, errUpstreamBudget) || errors.Is(err, errDNSRebind)) {
+		d.breaker.abandon()
+		return nil, err
+	}
+	d.breaker.record(err)
+	return conn, err
+}
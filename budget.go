@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errUpstreamBudget = errors.New("all SOCKS5 servers are at their connection limit")
+
+// budgetPollInterval is how often a connection waiting for a server below
+// its connection limit looks again.
+const budgetPollInterval = 50 * time.Millisecond
+
+// reserve counts a connection as open on the server unless it has limit
+// open already, zero being no limit.
+func (s *upstreamServer) reserve(limit int) bool {
+	for {
+		n := s.open.Load()
+		if limit > 0 && n >= int64(limit) {
+			return false
+		}
+		if s.open.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// full reports whether the server has as many connections open as the
+// upstream allows per server.
+func (u *upstream) full(s *upstreamServer) bool {
+	return u.maxConns > 0 && s.open.Load() >= int64(u.maxConns)
+}
+
+// waitPick waits up to maxConnsWait for one of the servers not in tried to
+// get below the connection limit and picks it like pick.
+func (u *upstream) waitPick(ctx context.Context, tried []bool, key string) (int, error) {
+	if u.maxConnsWait <= 0 {
+		u.budgetExhausted.Add(1)
+		return -1, errUpstreamBudget
+	}
+
+	u.budgetWaits.Add(1)
+	timer := time.NewTimer(u.maxConnsWait)
+	defer timer.Stop()
+	ticker := time.NewTicker(budgetPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		case <-timer.C:
+			u.budgetExhausted.Add(1)
+			return -1, errUpstreamBudget
+		case <-ticker.C:
+			if i := u.pick(tried, key); i >= 0 {
+				return i, nil
+			}
+		}
+	}
+}
+
+func (u *upstream) writeBudgetMetrics(pw metricsWriter) {
+	if u.maxConns <= 0 {
+		return
+	}
+
+	pw.gauge("http2socks_upstream_server_max_conns", "Connections allowed per SOCKS5 server of the current upstream.", float64(u.maxConns))
+	pw.header("http2socks_upstream_server_budget_ratio", "gauge", "Share of the connections allowed per SOCKS5 server in use.")
+	for _, s := range u.servers {
+		pw.sample("http2socks_upstream_server_budget_ratio", map[string]string{"server": s.server}, float64(s.open.Load())/float64(u.maxConns))
+	}
+	pw.counter("http2socks_upstream_budget_waits_total", "Connections which waited for a SOCKS5 server below its connection limit.", u.budgetWaits.Load())
+	pw.counter("http2socks_upstream_budget_exhausted_total", "Connections failed because all SOCKS5 servers were at their connection limit.", u.budgetExhausted.Load())
+}
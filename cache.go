@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache directives of cache rules.
+const (
+	cacheNever = "never-cache"
+	cacheForce = "force-cache"
+	cacheTTL   = "ttl"
+)
+
+// cacheForceTTL is how long responses stored by force-cache without a TTL
+// stay fresh when they don't say so themselves.
+const cacheForceTTL = 5 * time.Minute
+
+// cacheRule tunes the caching of plain HTTP requests to destinations
+// matching hosts whose URL path matches path, as in URL rules. never
+// bypasses the cache, force stores responses whatever their Cache-Control
+// says, and ttl overrides how long they stay fresh.
+type cacheRule struct {
+	text  string
+	never bool
+	force bool
+	ttl   time.Duration
+	hosts *hostMatcher
+	path  string
+}
+
+// cacheRules are checked in order and the first matching rule applies.
+type cacheRules []cacheRule
+
+// parseCacheRules parses rules of the form "directive destination path",
+// the directive being never-cache, force-cache, force-cache=ttl or
+// ttl=duration, e.g. "ttl=10m api.example.com /v1/catalog/*".
+func parseCacheRules(specs []string, groups map[string]string) (cacheRules, error) {
+	rules := make(cacheRules, 0, len(specs))
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("cache rule %q: must be directive, destination and path", spec)
+		}
+		directive, host, pattern := fields[0], fields[1], fields[2]
+		rule := cacheRule{text: strings.Join(fields, " "), path: pattern}
+		name, value, hasValue := strings.Cut(directive, "=")
+		switch {
+		case name == cacheNever && !hasValue:
+			rule.never = true
+		case name == cacheForce || name == cacheTTL && hasValue:
+			rule.force = name == cacheForce
+			if hasValue {
+				ttl, err := time.ParseDuration(value)
+				if err != nil || ttl <= 0 {
+					return nil, fmt.Errorf("cache rule %q: TTL must be a positive duration", spec)
+				}
+				rule.ttl = ttl
+			}
+		default:
+			return nil, fmt.Errorf("cache rule %q: directive must be %s, %s[=ttl] or %s=duration", spec, cacheNever, cacheForce, cacheTTL)
+		}
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("cache rule %q: path must start with /", spec)
+		}
+		hosts, err := newHostMatcher([]string{host}, groups)
+		if err != nil {
+			return nil, fmt.Errorf("cache rule %q: %w", spec, err)
+		}
+		rule.hosts = hosts
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// match returns the first rule matching a request for u to host.
+func (rs cacheRules) match(host string, u *url.URL) (cacheRule, bool) {
+	for _, r := range rs {
+		if r.hosts.match(host) && matchURLPath(r.path, u) {
+			return r, true
+		}
+	}
+	return cacheRule{}, false
+}
+
+// cacheableStatus are the response statuses the cache stores.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// responseCache keeps responses to plain GET requests in memory and serves
+// them again while they are fresh, evicting the least recently used ones
+// beyond size bytes. Responses are stored as a shared cache would: not
+// when they are private, set cookies or answer requests with credentials.
+// Stale responses aren't revalidated, they are fetched again.
+type responseCache struct {
+	rules     cacheRules
+	size      int64
+	maxObject int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *cacheEntry
+	lru     *list.List               // most recently used first
+	used    int64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	stores    atomic.Int64
+	evictions atomic.Int64
+}
+
+// cacheEntry is a stored response. vary holds the values the request had
+// of the headers named by the Vary header of the response.
+type cacheEntry struct {
+	key     string
+	vary    http.Header
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	// age is the Age of the response when it was stored.
+	age time.Duration
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.body))
+}
+
+func newResponseCache(size, maxObject int64, rules cacheRules) *responseCache {
+	return &responseCache{
+		rules:     rules,
+		size:      size,
+		maxObject: maxObject,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// cacheRequest is a plain request whose response may come from or go to
+// the cache.
+type cacheRequest struct {
+	key    string
+	header http.Header
+	rule   cacheRule
+	// lookup is false when the client asked for a fresh response.
+	lookup bool
+}
+
+// request returns the cache state of a request to host, nil when the cache
+// doesn't apply to it. It's taken before the request is changed for the
+// upstream. Nil-safe.
+func (c *responseCache) request(req *http.Request, host string) *cacheRequest {
+	if c == nil || req.Method != http.MethodGet {
+		return nil
+	}
+	rule, _ := c.rules.match(host, req.URL)
+	if rule.never {
+		return nil
+	}
+	directives := parseCacheControl(req.Header)
+	_, noStore := directives["no-store"]
+	if noStore || req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return nil
+	}
+	_, noCache := directives["no-cache"]
+	noCache = noCache || directives["max-age"] == "0" || strings.EqualFold(req.Header.Get("Pragma"), "no-cache")
+
+	// Responses may differ by egress, such as geo-specific content, so
+	// requests through a selected server or made directly by the PAC file
+	// don't share entries with the others.
+	key := req.URL.String()
+	if server, ok := selectedServer(req.Context()); ok {
+		key = "server " + server + " " + key
+	} else if pacDirect(req.Context()) {
+		key = "direct " + key
+	}
+	return &cacheRequest{
+		key:    key,
+		header: req.Header.Clone(),
+		rule:   rule,
+		lookup: !noCache,
+	}
+}
+
+// lookup returns the fresh stored response of cr, or nil.
+func (c *responseCache) lookup(cr *cacheRequest) *cacheEntry {
+	if cr == nil || !cr.lookup {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[cr.key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if !time.Now().Before(entry.expires) {
+			c.removeLocked(elem)
+		} else if entry.matches(cr.header) {
+			c.lru.MoveToFront(elem)
+			c.hits.Add(1)
+			return entry
+		}
+	}
+	c.misses.Add(1)
+	return nil
+}
+
+func (e *cacheEntry) matches(header http.Header) bool {
+	for name, values := range e.vary {
+		if strings.Join(header.Values(name), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// record stores the response to cr once its body was read completely,
+// when it may be stored. Nil-safe.
+func (c *responseCache) record(cr *cacheRequest, resp *http.Response) {
+	if cr == nil {
+		return
+	}
+	lifetime, ok := cacheLifetime(cr.rule, resp, time.Now())
+	if !ok || resp.ContentLength > c.maxObject {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:    cr.key,
+		status: resp.StatusCode,
+		header: resp.Header.Clone(),
+	}
+	entry.age, _ = parseDeltaSeconds(resp.Header.Get("Age"))
+	for _, name := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(name, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if entry.vary == nil {
+					entry.vary = make(http.Header)
+				}
+				entry.vary[http.CanonicalHeaderKey(name)] = cr.header.Values(name)
+			}
+		}
+	}
+	resp.Body = &cachingBody{ReadCloser: resp.Body, cache: c, entry: entry, lifetime: lifetime}
+}
+
+// cacheLifetime returns how long resp stays fresh from now, and whether
+// it may be stored at all.
+func cacheLifetime(rule cacheRule, resp *http.Response, now time.Time) (time.Duration, bool) {
+	if !cacheableStatus[resp.StatusCode] || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+	for _, vary := range resp.Header.Values("Vary") {
+		if strings.TrimSpace(vary) == "*" {
+			return 0, false
+		}
+	}
+
+	directives := parseCacheControl(resp.Header)
+	var lifetime time.Duration
+	if seconds, ok := parseDeltaSeconds(directives["s-maxage"]); ok {
+		lifetime = seconds
+	} else if seconds, ok := parseDeltaSeconds(directives["max-age"]); ok {
+		lifetime = seconds
+	} else if expires := resp.Header.Get("Expires"); expires != "" {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		// Invalid dates like 0 mean already expired.
+		if t, err := http.ParseTime(expires); err == nil {
+			lifetime = t.Sub(date)
+		}
+	}
+
+	if !rule.force {
+		for _, name := range []string{"no-store", "no-cache", "private"} {
+			if _, ok := directives[name]; ok {
+				return 0, false
+			}
+		}
+	} else if lifetime <= 0 {
+		lifetime = cacheForceTTL
+	}
+	if rule.ttl > 0 {
+		lifetime = rule.ttl
+	}
+	return lifetime, lifetime > 0
+}
+
+// parseCacheControl returns the directives of the Cache-Control headers of
+// h by lowercase name, with their unquoted values.
+func parseCacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// parseDeltaSeconds parses a number of seconds as in max-age or Age.
+func parseDeltaSeconds(s string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cachingBody stores the response body it reads in the cache once it was
+// read to the end without exceeding the largest object size.
+type cachingBody struct {
+	io.ReadCloser
+	cache    *responseCache
+	entry    *cacheEntry
+	lifetime time.Duration
+
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.cache.maxObject {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow {
+		b.entry.body = b.buf.Bytes()
+		now := time.Now()
+		b.entry.stored, b.entry.expires = now, now.Add(b.lifetime-b.entry.age)
+		b.cache.put(b.entry)
+		b.overflow = true
+	}
+	return n, err
+}
+
+func (c *responseCache) put(entry *cacheEntry) {
+	if !time.Now().Before(entry.expires) || entry.size() > c.size {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeLocked(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.used += entry.size()
+	c.stores.Add(1)
+	for c.used > c.size {
+		c.removeLocked(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *responseCache) removeLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size()
+}
+
+// serve writes the stored response to w and returns the bytes of its body
+// written.
+func (e *cacheEntry) serve(w http.ResponseWriter) (int64, error) {
+	copyHeader(w.Header(), e.header)
+	age := e.age + time.Since(e.stored)
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	w.WriteHeader(e.status)
+	n, err := w.Write(e.body)
+	return int64(n), err
+}
+
+func (c *responseCache) writeMetrics(pw metricsWriter) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	entries, used := len(c.entries), c.used
+	c.mu.Unlock()
+	pw.counter("http2socks_cache_hits_total", "Plain HTTP requests answered from the response cache.", c.hits.Load())
+	pw.counter("http2socks_cache_misses_total", "Cacheable plain HTTP requests not found fresh in the response cache.", c.misses.Load())
+	pw.counter("http2socks_cache_stores_total", "Responses stored in the response cache.", c.stores.Load())
+	pw.counter("http2socks_cache_evictions_total", "Responses evicted from the full response cache.", c.evictions.Load())
+	pw.gauge("http2socks_cache_entries", "Responses in the response cache.", float64(entries))
+	pw.gauge("http2socks_cache_bytes", "Bytes of responses in the response cache.", float64(used))
+}
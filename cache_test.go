@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCacheRules(t *testing.T) {
+	rules, err := parseCacheRules([]string{
+		"never-cache api.example.com /v1/session*",
+		"force-cache=1h  api.example.com /v1/catalog/*",
+		"force-cache .cdn.example /*",
+		"ttl=30s example.org /*",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want cacheRule
+	}{
+		{"http://api.example.com/v1/session/42", cacheRule{text: "never-cache api.example.com /v1/session*", never: true}},
+		{"http://api.example.com/v1/catalog/items", cacheRule{text: "force-cache=1h api.example.com /v1/catalog/*", force: true, ttl: time.Hour}},
+		{"http://img.cdn.example/a.png", cacheRule{text: "force-cache .cdn.example /*", force: true}},
+		{"http://example.org/", cacheRule{text: "ttl=30s example.org /*", ttl: 30 * time.Second}},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		got, ok := rules.match(u.Hostname(), u)
+		if !ok || got.text != tt.want.text || got.never != tt.want.never || got.force != tt.want.force || got.ttl != tt.want.ttl {
+			t.Errorf("match(%s) = %+v, %v, want %+v", tt.url, got, ok, tt.want)
+		}
+	}
+
+	for _, spec := range []string{
+		"cache api.example.com /*",
+		"never-cache=1m api.example.com /*",
+		"ttl api.example.com /*",
+		"ttl=0s api.example.com /*",
+		"force-cache=soon api.example.com /*",
+		"force-cache api.example.com",
+		"force-cache api.example.com v1/*",
+		"force-cache @missing /*",
+	} {
+		if _, err := parseCacheRules([]string{spec}, nil); err == nil {
+			t.Errorf("parseCacheRules(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	force := cacheRule{force: true}
+	tests := []struct {
+		name   string
+		rule   cacheRule
+		status int
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"max-age", cacheRule{}, 200, "Cache-Control: max-age=60", time.Minute, true},
+		{"s-maxage first", cacheRule{}, 200, "Cache-Control: max-age=60, s-maxage=120", 2 * time.Minute, true},
+		{"quoted", cacheRule{}, 200, `Cache-Control: public, MAX-AGE="30"`, 30 * time.Second, true},
+		{"expires", cacheRule{}, 200, "Date: Thu, 15 Oct 2026 12:00:00 GMT\r\nExpires: Thu, 15 Oct 2026 12:10:00 GMT", 10 * time.Minute, true},
+		{"expires invalid", cacheRule{}, 200, "Expires: 0", 0, false},
+		{"no freshness", cacheRule{}, 200, "Content-Type: text/plain", 0, false},
+		{"max-age zero", cacheRule{}, 200, "Cache-Control: max-age=0", 0, false},
+		{"private", cacheRule{}, 200, "Cache-Control: private, max-age=60", 0, false},
+		{"no-store", cacheRule{}, 200, "Cache-Control: no-store", 0, false},
+		{"no-cache", cacheRule{}, 200, "Cache-Control: no-cache, max-age=60", 0, false},
+		{"status", cacheRule{}, 500, "Cache-Control: max-age=60", 0, false},
+		{"not found", cacheRule{}, 404, "Cache-Control: max-age=60", time.Minute, true},
+		{"set-cookie", cacheRule{}, 200, "Cache-Control: max-age=60\r\nSet-Cookie: a=b", 0, false},
+		{"vary star", cacheRule{}, 200, "Cache-Control: max-age=60\r\nVary: *", 0, false},
+		{"ttl override", cacheRule{ttl: time.Hour}, 200, "Cache-Control: max-age=60", time.Hour, true},
+		{"ttl without freshness", cacheRule{ttl: time.Hour}, 200, "Content-Type: text/plain", time.Hour, true},
+		{"ttl keeps no-store", cacheRule{ttl: time.Hour}, 200, "Cache-Control: no-store", 0, false},
+		{"force no-store", force, 200, "Cache-Control: no-store, private", cacheForceTTL, true},
+		{"force max-age", force, 200, "Cache-Control: no-cache, max-age=600", 10 * time.Minute, true},
+		{"force ttl", cacheRule{force: true, ttl: time.Hour}, 200, "Cache-Control: no-store", time.Hour, true},
+		{"force keeps set-cookie", force, 200, "Set-Cookie: a=b", 0, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: parseTestHeader(t, tt.header)}
+		got, ok := cacheLifetime(tt.rule, resp, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: cacheLifetime = %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func parseTestHeader(t *testing.T, lines string) http.Header {
+	t.Helper()
+	h := make(http.Header)
+	for _, line := range strings.Split(lines, "\r\n") {
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			t.Fatalf("bad header line %q", line)
+		}
+		h.Add(name, value)
+	}
+	return h
+}
+
+// fetchCached answers req from c, or with resp, storing it when it may be.
+func fetchCached(c *responseCache, req *http.Request, resp *http.Response) (*httptest.ResponseRecorder, bool) {
+	w := httptest.NewRecorder()
+	cr := c.request(req, req.URL.Hostname())
+	if entry := c.lookup(cr); entry != nil {
+		_, _ = entry.serve(w)
+		return w, true
+	}
+	c.record(cr, resp)
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+	return w, false
+}
+
+func testResponse(header, body string) *http.Response {
+	h := make(http.Header)
+	for _, line := range strings.Split(header, "\r\n") {
+		if name, value, ok := strings.Cut(line, ": "); ok {
+			h.Add(name, value)
+		}
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	rules, err := parseCacheRules([]string{"never-cache example.com /private/*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newResponseCache(1<<20, 16, rules)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/a", nil)
+	if _, hit := fetchCached(c, req, testResponse("Cache-Control: max-age=60", "first")); hit {
+		t.Fatal("first request answered from the cache")
+	}
+	w, hit := fetchCached(c, req, testResponse("Cache-Control: max-age=60", "second"))
+	if !hit || w.Body.String() != "first" || w.Header().Get("Age") != "0" {
+		t.Errorf("second request: hit %v, body %q, Age %q, want the first response", hit, w.Body.String(), w.Header().Get("Age"))
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		header string
+		resp   string
+		body   string
+	}{
+		{"never-cache rule", http.MethodGet, "http://example.com/private/a", "", "Cache-Control: max-age=60", "body"},
+		{"not GET", http.MethodPost, "http://example.com/post", "", "Cache-Control: max-age=60", "body"},
+		{"authorization", http.MethodGet, "http://example.com/auth", "Authorization: Bearer x", "Cache-Control: max-age=60", "body"},
+		{"range", http.MethodGet, "http://example.com/range", "Range: bytes=0-1", "Cache-Control: max-age=60", "body"},
+		{"request no-store", http.MethodGet, "http://example.com/nostore", "Cache-Control: no-store", "Cache-Control: max-age=60", "body"},
+		{"too large", http.MethodGet, "http://example.com/large", "", "Cache-Control: max-age=60", strings.Repeat("x", 17)},
+		{"not fresh", http.MethodGet, "http://example.com/stale", "", "Cache-Control: max-age=60\r\nAge: 60", "body"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		if tt.header != "" {
+			req.Header = parseTestHeader(t, tt.header)
+		}
+		fetchCached(c, req, testResponse(tt.resp, tt.body))
+		if _, hit := fetchCached(c, req, testResponse(tt.resp, tt.body)); hit {
+			t.Errorf("%s: second request answered from the cache", tt.name)
+		}
+	}
+
+	// Bodies of unknown length are stored only when they fit.
+	chunked := httptest.NewRequest(http.MethodGet, "http://example.com/chunked", nil)
+	for i := 0; i < 2; i++ {
+		resp := testResponse("Cache-Control: max-age=60", strings.Repeat("x", 17))
+		resp.ContentLength = -1
+		if _, hit := fetchCached(c, chunked, resp); hit {
+			t.Error("too large chunked response answered from the cache")
+		}
+	}
+
+	// Clients asking for a fresh response get one, which is stored.
+	fresh := httptest.NewRequest(http.MethodGet, "http://example.com/a", nil)
+	fresh.Header.Set("Cache-Control", "no-cache")
+	if w, hit := fetchCached(c, fresh, testResponse("Cache-Control: max-age=60", "third")); hit || w.Body.String() != "third" {
+		t.Errorf("no-cache request: hit %v, body %q, want a fresh response", hit, w.Body.String())
+	}
+	if w, hit := fetchCached(c, req, testResponse("Cache-Control: max-age=60", "fourth")); !hit || w.Body.String() != "third" {
+		t.Errorf("request after no-cache: hit %v, body %q, want the stored fresh response", hit, w.Body.String())
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	c := newResponseCache(1<<20, 1<<10, nil)
+	request := func(lang string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Accept-Language", lang)
+		return req
+	}
+	resp := func(body string) *http.Response {
+		return testResponse("Cache-Control: max-age=60\r\nVary: Accept-Encoding, accept-language", body)
+	}
+
+	fetchCached(c, request("en"), resp("en"))
+	if w, hit := fetchCached(c, request("en"), resp("other")); !hit || w.Body.String() != "en" {
+		t.Errorf("same Accept-Language: hit %v, body %q", hit, w.Body.String())
+	}
+	if w, hit := fetchCached(c, request("de"), resp("de")); hit || w.Body.String() != "de" {
+		t.Errorf("other Accept-Language: hit %v, body %q", hit, w.Body.String())
+	}
+}
+
+func TestResponseCacheEgress(t *testing.T) {
+	c := newResponseCache(1<<20, 1<<10, nil)
+	request := func(ctx context.Context) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(ctx)
+	}
+	resp := func(body string) *http.Response {
+		return testResponse("Cache-Control: max-age=60", body)
+	}
+
+	bg := context.Background()
+	fetchCached(c, request(bg), resp("default"))
+	fetchCached(c, request(withSelectedServer(bg, "de")), resp("de"))
+	fetchCached(c, request(withPACDirect(bg)), resp("direct"))
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"default", bg, "default"},
+		{"selected server", withSelectedServer(bg, "de"), "de"},
+		{"other server", withSelectedServer(bg, "us"), ""},
+		{"PAC direct", withPACDirect(bg), "direct"},
+	}
+	for _, tt := range tests {
+		w, hit := fetchCached(c, request(tt.ctx), resp(""))
+		if hit != (tt.want != "") || hit && w.Body.String() != tt.want {
+			t.Errorf("%s: hit %v, body %q, want %q", tt.name, hit, w.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	key := len("http://example.com/a")
+	c := newResponseCache(int64(2*(key+10)), 1<<10, nil)
+	get := func(path string) bool {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		_, hit := fetchCached(c, req, testResponse("Cache-Control: max-age=60", "0123456789"))
+		return hit
+	}
+
+	get("/a")
+	get("/b")
+	get("/a") // /b is now the least recently used
+	get("/c")
+	if !get("/a") || !get("/c") {
+		t.Error("recently used responses evicted")
+	}
+	if get("/b") {
+		t.Error("least recently used response not evicted")
+	}
+	if n := c.evictions.Load(); n != 2 {
+		t.Errorf("%d evictions, want 2", n)
+	}
+}
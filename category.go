@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type categoryKey struct{}
+
+// withCategory returns ctx carrying the category of the request destination.
+func withCategory(ctx context.Context, category string) context.Context {
+	return context.WithValue(ctx, categoryKey{}, category)
+}
+
+// categoryFromContext returns the category of the request destination, if
+// any.
+func categoryFromContext(ctx context.Context) string {
+	category, _ := ctx.Value(categoryKey{}).(string)
+	return category
+}
+
+// categories maps destinations to categories such as ads, social or cdn
+// from a category file. Categories show up in logs, access events and
+// metrics, and can be blocked.
+type categories struct {
+	names    []string
+	matchers []*hostMatcher
+
+	mu       sync.Mutex
+	requests map[string]int64
+}
+
+// loadCategories reads a category file. Each line is a category name
+// followed by destination patterns as in block_hosts. A category may span
+// several lines; the first category in the file matching a host wins.
+func loadCategories(file string, groups map[string]string) (*categories, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	c := &categories{requests: make(map[string]int64)}
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a category and destinations", file, n)
+		}
+
+		name := fields[0]
+		i, ok := index[name]
+		if !ok {
+			i = len(c.names)
+			index[name] = i
+			c.names = append(c.names, name)
+			c.matchers = append(c.matchers, &hostMatcher{exact: make(map[string]struct{})})
+		}
+
+		m, err := newHostMatcher(fields[1:], groups)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		c.matchers[i].merge(m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lookup returns the category of host, empty when it has none.
+func (c *categories) lookup(host string) string {
+	if c == nil {
+		return ""
+	}
+	for i, m := range c.matchers {
+		if m.match(host) {
+			return c.names[i]
+		}
+	}
+	return ""
+}
+
+func (c *categories) count(category string) {
+	if c == nil || category == "" {
+		return
+	}
+	c.mu.Lock()
+	c.requests[category]++
+	c.mu.Unlock()
+}
+
+func (c *categories) writeMetrics(pw metricsWriter) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.requests))
+	for name := range c.requests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pw.header("http2socks_category_requests_total", "counter", "Requests by destination category.")
+	for _, name := range names {
+		pw.sample("http2socks_category_requests_total", map[string]string{"category": name}, float64(c.requests[name]))
+	}
+}
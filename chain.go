@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyHop is a proxy of a chain: a SOCKS5 server, or an HTTP proxy
+// tunneling with CONNECT, reached over TLS with tls.
+type proxyHop struct {
+	addr    string
+	auth    *proxy.Auth
+	connect bool
+	tls     bool
+}
+
+// parseProxyHop parses a hop given as [user:password@]host:port for SOCKS5,
+// or as socks5://, http:// or https:// URL with optional credentials.
+func parseProxyHop(s string) (proxyHop, error) {
+	hop := proxyHop{addr: s}
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return proxyHop{}, fmt.Errorf("bad chain hop URL: %w", err)
+		}
+		switch u.Scheme {
+		case "socks5", "socks5h":
+		case "https":
+			hop.tls = true
+			fallthrough
+		case "http":
+			hop.connect = true
+		default:
+			return proxyHop{}, fmt.Errorf("chain hop URL scheme must be socks5, http or https, not %q", u.Scheme)
+		}
+		if u.Port() == "" {
+			return proxyHop{}, fmt.Errorf("chain hop %s must have a port", u.Redacted())
+		}
+		hop.addr = u.Host
+		if u.User != nil {
+			password, _ := u.User.Password()
+			hop.auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		return hop, nil
+	}
+
+	if creds, addr, ok := strings.Cut(s, "@"); ok {
+		user, password, _ := strings.Cut(creds, ":")
+		hop.addr = addr
+		hop.auth = &proxy.Auth{User: user, Password: password}
+	}
+	if _, _, err := net.SplitHostPort(hop.addr); err != nil {
+		return proxyHop{}, fmt.Errorf("chain hop %q must be [user:password@]host:port or a socks5://, http:// or https:// URL", s)
+	}
+	return hop, nil
+}
+
+func parseProxyChain(specs []string) ([]proxyHop, error) {
+	chain := make([]proxyHop, 0, len(specs))
+	for _, s := range specs {
+		hop, err := parseProxyHop(s)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, hop)
+	}
+	return chain, nil
+}
+
+// chainDialer returns a dialer which reaches addresses through the hops in
+// order, the first hop dialed with forward and each further one through
+// the previous. https:// hops are connected to with tlsConfig.
+func chainDialer(hops []proxyHop, tlsConfig *tls.Config, forward proxy.Dialer) (proxy.ContextDialer, error) {
+	dialer := forward
+	for _, hop := range hops {
+		if hop.connect {
+			if hop.tls {
+				dialer = tlsDialer{config: tlsConfig, forward: dialer}
+			}
+			dialer = &connectDialer{addr: hop.addr, auth: hop.auth, forward: dialer}
+			continue
+		}
+		var err error
+		if dialer, err = proxy.SOCKS5("tcp", hop.addr, hop.auth, dialer); err != nil {
+			return nil, err
+		}
+	}
+	return dialer.(proxy.ContextDialer), nil //nolint:errcheck // all dialers of a chain implement it
+}
+
+// errConnectAuth is the failure of a CONNECT because the HTTP proxy
+// rejected the credentials.
+var errConnectAuth = errors.New("HTTP proxy authentication failed")
+
+// connectDialer opens tunnels through an HTTP proxy with CONNECT.
+type connectDialer struct {
+	addr    string
+	auth    *proxy.Auth
+	forward proxy.Dialer
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialContext(ctx, d.forward, network, d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake is bounded by ctx, the tunnel isn't.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	tunnel, err := d.connect(conn, addr)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, &net.OpError{Op: "connect", Net: network, Addr: hopAddr(d.addr), Err: err}
+	}
+	return tunnel, nil
+}
+
+func (d *connectDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != nil {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.auth.User + ":" + d.auth.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	// The body of a successful response is the tunnel, that of a failed one
+	// goes with the connection, so it isn't read.
+	resp, err := http.ReadResponse(br, req) //nolint:bodyclose // see above
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, fmt.Errorf("%w: %s answered CONNECT with %s", errConnectAuth, d.addr, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP proxy %s answered CONNECT with %s", d.addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// Bytes the destination sent right away were read along.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type hopAddr string
+
+func (a hopAddr) Network() string { return "tcp" }
+func (a hopAddr) String() string  { return string(a) }
+
+// bufferedConn reads what's left in r before reading from Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
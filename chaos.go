@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errChaosAuth = errors.New("chaos: simulated SOCKS authentication failure")
+
+// chaosConfig describes faults injected on the path to the SOCKS server, to
+// rehearse how clients and failover behave when the upstream misbehaves.
+// Rates are probabilities from 0 to 1.
+type chaosConfig struct {
+	AuthFailureRate   float64
+	SlowHandshakeRate float64
+	HandshakeDelay    time.Duration
+	ResetRate         float64
+	ResetAfter        time.Duration
+}
+
+func (c chaosConfig) enabled() bool {
+	return c.AuthFailureRate > 0 || c.SlowHandshakeRate > 0 || c.ResetRate > 0
+}
+
+// chaos injects faults configured by chaosConfig.
+type chaos struct {
+	cfg chaosConfig
+
+	injected atomic.Int64
+}
+
+// dialer wraps the dialer of connections to the SOCKS server.
+func (c *chaos) dialer(forward *net.Dialer) *chaosDialer {
+	return &chaosDialer{chaos: c, forward: forward}
+}
+
+func (c *chaos) writeMetrics(pw metricsWriter) {
+	if c == nil {
+		return
+	}
+	pw.counter("http2socks_chaos_injected_total", "Faults injected on the upstream path.", c.injected.Load())
+}
+
+// chaosDialer injects faults into connections to the SOCKS server. It's
+// used as the forward dialer of the SOCKS client, so the faults affect only
+// the upstream path.
+type chaosDialer struct {
+	*chaos
+	forward *net.Dialer
+}
+
+func (d *chaosDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *chaosDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if chance(d.cfg.AuthFailureRate) {
+		d.injected.Add(1)
+		log.Printf("chaos: failing SOCKS authentication to %s", addr)
+		return nil, errChaosAuth
+	}
+
+	conn, err := d.forward.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &chaosConn{Conn: conn}
+	if chance(d.cfg.SlowHandshakeRate) {
+		d.injected.Add(1)
+		log.Printf("chaos: delaying SOCKS handshake with %s by %v", addr, d.cfg.HandshakeDelay)
+		cc.readDelay = d.cfg.HandshakeDelay
+	}
+	if chance(d.cfg.ResetRate) && d.cfg.ResetAfter > 0 {
+		d.injected.Add(1)
+		after := time.Duration(rand.Int63n(int64(d.cfg.ResetAfter))) //nolint:gosec // no need for crypto randomness
+		log.Printf("chaos: resetting connection to %s after %v", addr, after)
+		cc.resetTimer = time.AfterFunc(after, cc.reset)
+	}
+	return cc, nil
+}
+
+// chaosConn delays the first read (the server's handshake reply) and may be
+// reset by a timer.
+type chaosConn struct {
+	net.Conn
+
+	readDelay  time.Duration
+	delayOnce  sync.Once
+	resetTimer *time.Timer
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	c.delayOnce.Do(func() {
+		if c.readDelay > 0 {
+			time.Sleep(c.readDelay)
+		}
+	})
+	return c.Conn.Read(b)
+}
+
+// reset closes the connection with a TCP RST instead of a clean FIN.
+func (c *chaosConn) reset() {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	_ = c.Conn.Close()
+}
+
+func (c *chaosConn) Close() error {
+	if c.resetTimer != nil {
+		c.resetTimer.Stop()
+	}
+	return c.Conn.Close()
+}
+
+func chance(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate //nolint:gosec // no need for crypto randomness
+}
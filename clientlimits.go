@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errRateLimit   = errors.New("too many requests")
+	errQuota       = errors.New("transfer quota exceeded")
+	errAuthLockout = errors.New("too many failed proxy authentication attempts")
+)
+
+// windowCounters count per key over windows starting with the first count,
+// like rate limits and quotas do. With shared state the counts of all proxy
+// instances are added up; local counts are used while the shared state is
+// unavailable.
+type windowCounters struct {
+	shared *sharedState
+
+	mu     sync.Mutex
+	local  map[string]*windowCount
+	nextGC time.Time
+}
+
+type windowCount struct {
+	n       int64
+	expires time.Time
+}
+
+// windowGCInterval is how often expired local counts are dropped.
+const windowGCInterval = time.Minute
+
+func newWindowCounters(shared *sharedState) *windowCounters {
+	return &windowCounters{shared: shared, local: make(map[string]*windowCount)}
+}
+
+// add adds n to the count of key, whose window lasts window from its first
+// count, and returns the count and the end of the window.
+func (c *windowCounters) add(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Time) {
+	if c.shared != nil {
+		count, end, err := c.shared.incr(ctx, key, n, window)
+		if err == nil {
+			return count, end
+		}
+		log.Printf("shared counter unavailable, counting locally: %v", err)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gcLocked(now)
+	wc, ok := c.local[key]
+	if !ok || !now.Before(wc.expires) {
+		wc = &windowCount{expires: now.Add(window)}
+		c.local[key] = wc
+	}
+	wc.n += n
+	return wc.n, wc.expires
+}
+
+// count returns the count of key and the end of its window, 0 when it has
+// none.
+func (c *windowCounters) count(ctx context.Context, key string) (int64, time.Time) {
+	if c.shared != nil {
+		count, end, err := c.shared.count(ctx, key)
+		if err == nil {
+			return count, end
+		}
+		log.Printf("shared counter unavailable, counting locally: %v", err)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wc, ok := c.local[key]
+	if !ok || !now.Before(wc.expires) {
+		return 0, time.Time{}
+	}
+	return wc.n, wc.expires
+}
+
+func (c *windowCounters) gcLocked(now time.Time) {
+	if now.Before(c.nextGC) {
+		return
+	}
+	c.nextGC = now.Add(windowGCInterval)
+	for key, wc := range c.local {
+		if !now.Before(wc.expires) {
+			delete(c.local, key)
+		}
+	}
+}
+
+// clientLimits limits the requests and the bytes transferred per client,
+// the user name or the address of anonymous clients, and locks out client
+// addresses after failed proxy authentication attempts. Each limit is
+// disabled when zero.
+type clientLimits struct {
+	counters *windowCounters
+
+	rate       int64
+	rateWindow time.Duration
+
+	quota       int64
+	quotaPeriod time.Duration
+
+	lockoutFailures int64
+	lockoutWindow   time.Duration
+
+	rateLimited   atomic.Int64
+	quotaExceeded atomic.Int64
+	lockedOut     atomic.Int64
+}
+
+// newClientLimits returns the client limits of cfg, nil when they are all
+// disabled.
+func newClientLimits(cfg *Config, shared *sharedState) *clientLimits {
+	if cfg.RateLimit <= 0 && cfg.QuotaBytes <= 0 && cfg.AuthLockoutFailures <= 0 {
+		return nil
+	}
+	return &clientLimits{
+		counters:        newWindowCounters(shared),
+		rate:            int64(cfg.RateLimit),
+		rateWindow:      cfg.RateLimitWindow,
+		quota:           cfg.QuotaBytes,
+		quotaPeriod:     cfg.QuotaPeriod,
+		lockoutFailures: int64(cfg.AuthLockoutFailures),
+		lockoutWindow:   cfg.AuthLockoutWindow,
+	}
+}
+
+// locked returns when the lockout of the client address addr ends, and
+// errAuthLockout while it's locked out. Nil-safe.
+func (l *clientLimits) locked(ctx context.Context, addr string) (time.Time, error) {
+	if l == nil || l.lockoutFailures <= 0 {
+		return time.Time{}, nil
+	}
+	failures, end := l.counters.count(ctx, "authfail:"+addr)
+	if failures < l.lockoutFailures {
+		return time.Time{}, nil
+	}
+	l.lockedOut.Add(1)
+	return end, errAuthLockout
+}
+
+// authFailed counts a failed proxy authentication attempt from addr.
+// Nil-safe.
+func (l *clientLimits) authFailed(ctx context.Context, addr string) {
+	if l == nil || l.lockoutFailures <= 0 {
+		return
+	}
+	if failures, _ := l.counters.add(ctx, "authfail:"+addr, 1, l.lockoutWindow); failures == l.lockoutFailures {
+		sessionLogger(ctx).Printf("locking out %s after %d failed proxy authentication attempts", addr, failures)
+	}
+}
+
+// allow counts a request of client and returns when it may make requests
+// again, with errQuota or errRateLimit, when it's over a limit. Nil-safe.
+func (l *clientLimits) allow(ctx context.Context, client string) (time.Time, error) {
+	if l == nil {
+		return time.Time{}, nil
+	}
+	if l.quota > 0 {
+		if bytes, end := l.counters.count(ctx, "quota:"+client); bytes >= l.quota {
+			l.quotaExceeded.Add(1)
+			return end, errQuota
+		}
+	}
+	if l.rate > 0 {
+		if requests, end := l.counters.add(ctx, "rate:"+client, 1, l.rateWindow); requests > l.rate {
+			l.rateLimited.Add(1)
+			return end, errRateLimit
+		}
+	}
+	return time.Time{}, nil
+}
+
+// transferred counts n bytes transferred by client against its quota.
+// Nil-safe.
+func (l *clientLimits) transferred(client string, n int64) {
+	if l == nil || l.quota <= 0 || n <= 0 {
+		return
+	}
+	// Tunnels are counted when they end, after the request.
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	l.counters.add(ctx, "quota:"+client, n, l.quotaPeriod)
+}
+
+func (l *clientLimits) writeMetrics(pw metricsWriter) {
+	if l == nil {
+		return
+	}
+
+	pw.counter("http2socks_rate_limited_total", "Requests refused because the client exceeded the rate limit.", l.rateLimited.Load())
+	pw.counter("http2socks_quota_exceeded_total", "Requests refused because the client exceeded its transfer quota.", l.quotaExceeded.Load())
+	pw.counter("http2socks_auth_locked_out_total", "Requests refused because the client address is locked out after failed authentication attempts.", l.lockedOut.Load())
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		run     func(ctx context.Context, l *clientLimits) error
+		wantErr error
+	}{
+		{
+			name: "rate within the limit",
+			cfg:  Config{RateLimit: 3, RateLimitWindow: time.Minute},
+			run: func(ctx context.Context, l *clientLimits) error {
+				for i := 0; i < 3; i++ {
+					if _, err := l.allow(ctx, "alice"); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "rate over the limit",
+			cfg:  Config{RateLimit: 3, RateLimitWindow: time.Minute},
+			run: func(ctx context.Context, l *clientLimits) error {
+				for i := 0; i < 4; i++ {
+					if _, err := l.allow(ctx, "alice"); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			wantErr: errRateLimit,
+		},
+		{
+			name: "rate per client",
+			cfg:  Config{RateLimit: 1, RateLimitWindow: time.Minute},
+			run: func(ctx context.Context, l *clientLimits) error {
+				if _, err := l.allow(ctx, "alice"); err != nil {
+					return err
+				}
+				_, err := l.allow(ctx, "bob")
+				return err
+			},
+		},
+		{
+			name: "rate window over",
+			cfg:  Config{RateLimit: 1, RateLimitWindow: time.Millisecond},
+			run: func(ctx context.Context, l *clientLimits) error {
+				if _, err := l.allow(ctx, "alice"); err != nil {
+					return err
+				}
+				time.Sleep(5 * time.Millisecond)
+				_, err := l.allow(ctx, "alice")
+				return err
+			},
+		},
+		{
+			name: "quota exceeded",
+			cfg:  Config{QuotaBytes: 100, QuotaPeriod: time.Hour},
+			run: func(ctx context.Context, l *clientLimits) error {
+				l.transferred("alice", 60)
+				l.transferred("alice", 40)
+				_, err := l.allow(ctx, "alice")
+				return err
+			},
+			wantErr: errQuota,
+		},
+		{
+			name: "quota left",
+			cfg:  Config{QuotaBytes: 100, QuotaPeriod: time.Hour},
+			run: func(ctx context.Context, l *clientLimits) error {
+				l.transferred("alice", 99)
+				l.transferred("bob", 1000)
+				_, err := l.allow(ctx, "alice")
+				return err
+			},
+		},
+		{
+			name: "lockout",
+			cfg:  Config{AuthLockoutFailures: 2, AuthLockoutWindow: time.Minute},
+			run: func(ctx context.Context, l *clientLimits) error {
+				l.authFailed(ctx, "10.0.0.1")
+				l.authFailed(ctx, "10.0.0.1")
+				_, err := l.locked(ctx, "10.0.0.1")
+				return err
+			},
+			wantErr: errAuthLockout,
+		},
+		{
+			name: "lockout per address",
+			cfg:  Config{AuthLockoutFailures: 2, AuthLockoutWindow: time.Minute},
+			run: func(ctx context.Context, l *clientLimits) error {
+				l.authFailed(ctx, "10.0.0.1")
+				l.authFailed(ctx, "10.0.0.2")
+				_, err := l.locked(ctx, "10.0.0.1")
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		l := newClientLimits(&tt.cfg, nil)
+		if err := tt.run(context.Background(), l); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClientLimitsDisabled(t *testing.T) {
+	l := newClientLimits(&Config{}, nil)
+	if l != nil {
+		t.Fatalf("newClientLimits without limits = %+v, want nil", l)
+	}
+	ctx := context.Background()
+	l.authFailed(ctx, "10.0.0.1")
+	l.transferred("alice", 1)
+	if _, err := l.locked(ctx, "10.0.0.1"); err != nil {
+		t.Errorf("locked: %v", err)
+	}
+	if _, err := l.allow(ctx, "alice"); err != nil {
+		t.Errorf("allow: %v", err)
+	}
+}
+
+// fakeRedisCounters answers the counter scripts of sharedState like Redis
+// would run them, ignoring expiry.
+func fakeRedisCounters(t *testing.T) *fakeRedis {
+	var mu sync.Mutex
+	counters := make(map[string]int64)
+	return newFakeRedis(t, func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(args) < 4 || args[0] != "EVAL" {
+			return "-ERR unexpected command\r\n"
+		}
+		key := args[3]
+		switch args[1] {
+		case sharedIncrScript:
+			n, _ := strconv.ParseInt(args[4], 10, 64)
+			counters[key] += n
+			return "*2\r\n:" + strconv.FormatInt(counters[key], 10) + "\r\n:" + args[5] + "\r\n"
+		case sharedCountScript:
+			n, ok := counters[key]
+			if !ok {
+				return "*2\r\n:0\r\n:0\r\n"
+			}
+			return "*2\r\n:" + strconv.FormatInt(n, 10) + "\r\n:60000\r\n"
+		}
+		return "-ERR unknown script\r\n"
+	})
+}
+
+func TestClientLimitsShared(t *testing.T) {
+	server := fakeRedisCounters(t)
+	cfg := Config{
+		RedisAddress:        server.ln.Addr().String(),
+		RedisKeyPrefix:      "h2s:",
+		RateLimit:           2,
+		RateLimitWindow:     time.Minute,
+		AuthLockoutFailures: 1,
+		AuthLockoutWindow:   time.Minute,
+	}
+	// Two instances share the counts.
+	a := newClientLimits(&cfg, newSharedState(&cfg))
+	b := newClientLimits(&cfg, newSharedState(&cfg))
+	ctx := context.Background()
+
+	if _, err := a.allow(ctx, "alice"); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := b.allow(ctx, "alice"); err != nil {
+		t.Fatalf("second request: %v", err)
+	}
+	end, err := a.allow(ctx, "alice")
+	if !errors.Is(err, errRateLimit) {
+		t.Fatalf("third request: %v, want %v", err, errRateLimit)
+	}
+	if until := time.Until(end); until <= 0 || until > time.Minute {
+		t.Errorf("rate limited for %v, want up to a minute", until)
+	}
+
+	a.authFailed(ctx, "10.0.0.1")
+	if _, err := b.locked(ctx, "10.0.0.1"); !errors.Is(err, errAuthLockout) {
+		t.Errorf("locked on the other instance: %v, want %v", err, errAuthLockout)
+	}
+
+	commands, _ := server.received()
+	for _, command := range commands {
+		if !strings.HasPrefix(command[3], "h2s:") {
+			t.Errorf("key %q without the prefix", command[3])
+		}
+	}
+}
+
+func TestClientLimitsSharedUnavailable(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		return "-LOADING Redis is loading the dataset in memory\r\n"
+	})
+	cfg := Config{
+		RedisAddress:    server.ln.Addr().String(),
+		RateLimit:       1,
+		RateLimitWindow: time.Minute,
+	}
+	shared := newSharedState(&cfg)
+	l := newClientLimits(&cfg, shared)
+	ctx := context.Background()
+
+	// The local count is used instead.
+	if _, err := l.allow(ctx, "alice"); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := l.allow(ctx, "alice"); !errors.Is(err, errRateLimit) {
+		t.Fatalf("second request: %v, want %v", err, errRateLimit)
+	}
+	if n := shared.errors.Load(); n != 2 {
+		t.Errorf("%d shared state errors, want 2", n)
+	}
+}
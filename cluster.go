@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// clusterPublishInterval is how often an instance publishes its stats to
+// the shared state. Instances which haven't published for clusterStaleAfter
+// are considered gone.
+const (
+	clusterPublishInterval = 10 * time.Second
+	clusterStaleAfter      = 3 * clusterPublishInterval
+)
+
+// clusterInstance is the last published report of an instance.
+type clusterInstance struct {
+	Instance string `json:"instance"`
+	runReport
+}
+
+type clusterTotals struct {
+	Instances     int              `json:"instances"`
+	Requests      int64            `json:"requests"`
+	Tunnels       int64            `json:"tunnels"`
+	TunnelsOpen   int64            `json:"tunnels_open"`
+	BytesSent     int64            `json:"bytes_sent"`
+	BytesReceived int64            `json:"bytes_received"`
+	Errors        map[string]int64 `json:"errors"`
+}
+
+type clusterStats struct {
+	Totals    clusterTotals     `json:"totals"`
+	Instances []clusterInstance `json:"instances"`
+}
+
+func (s *sharedState) instancesKey() string {
+	return s.prefix + "instances"
+}
+
+// publish stores the report of this instance in the shared state.
+func (s *sharedState) publish(ctx context.Context, r runReport) error {
+	data, err := json.Marshal(clusterInstance{Instance: s.instance, runReport: r})
+	if err != nil {
+		return err
+	}
+	if _, err := s.redis.do(ctx, "HSET", s.instancesKey(), s.instance, string(data)); err != nil {
+		s.errors.Add(1)
+		return err
+	}
+	return nil
+}
+
+// instances returns the reports of all live instances. Reports of gone
+// instances are removed.
+func (s *sharedState) instances(ctx context.Context) ([]clusterInstance, error) {
+	reply, err := s.redis.do(ctx, "HGETALL", s.instancesKey())
+	if err != nil {
+		s.errors.Add(1)
+		return nil, err
+	}
+
+	fields, _ := reply.([]any)
+	var res []clusterInstance
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		data, _ := fields[i+1].(string)
+
+		var inst clusterInstance
+		if err := json.Unmarshal([]byte(data), &inst); err != nil || time.Since(inst.Time) > clusterStaleAfter {
+			_, _ = s.redis.do(ctx, "HDEL", s.instancesKey(), name)
+			continue
+		}
+		res = append(res, inst)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Instance < res[j].Instance })
+	return res, nil
+}
+
+func (s *sharedState) clusterStats(ctx context.Context) (clusterStats, error) {
+	instances, err := s.instances(ctx)
+	if err != nil {
+		return clusterStats{}, err
+	}
+
+	res := clusterStats{
+		Totals:    clusterTotals{Instances: len(instances), Errors: map[string]int64{}},
+		Instances: instances,
+	}
+	for _, inst := range instances {
+		res.Totals.Requests += inst.Requests
+		res.Totals.Tunnels += inst.Tunnels
+		res.Totals.TunnelsOpen += inst.TunnelsOpen
+		res.Totals.BytesSent += inst.BytesSent
+		res.Totals.BytesReceived += inst.BytesReceived
+		for kind, n := range inst.Errors {
+			res.Totals.Errors[kind] += n
+		}
+	}
+	return res, nil
+}
+
+// handleClusterStats reports the stats of all instances sharing state with
+// this one and their totals.
+func (p *forwardProxy) handleClusterStats(w http.ResponseWriter, req *http.Request) {
+	if p.shared == nil {
+		http.Error(w, "no shared state configured", http.StatusNotFound)
+		return
+	}
+
+	stats, err := p.shared.clusterStats(req.Context())
+	if err != nil {
+		http.Error(w, "shared state unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
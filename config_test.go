@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestParseConfigJSON(t *testing.T) {
+	cfg, err := parseConfigJSON([]byte(`{"socks_proxy": "127.0.0.1:1080", "max_conns_per_host": 5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SocksProxy != "127.0.0.1:1080" || cfg.MaxConnsPerHost != 5 {
+		t.Errorf("parseConfigJSON: socks_proxy %q, max_conns_per_host %d", cfg.SocksProxy, cfg.MaxConnsPerHost)
+	}
+	if cfg.HTTPAddress != ":8080" {
+		t.Errorf("parseConfigJSON: http_address %q, want the default :8080", cfg.HTTPAddress)
+	}
+
+	// Files the config refers to aren't read.
+	cfg, err = parseConfigJSON([]byte(`{"socks_proxy": "127.0.0.1:1080", "socks_credentials_file": "/etc/shadow"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SocksProxyUser != "" || cfg.SocksProxyPassword != "" {
+		t.Errorf("parseConfigJSON: read the credentials %q, %q", cfg.SocksProxyUser, cfg.SocksProxyPassword)
+	}
+
+	for _, doc := range []string{
+		``,
+		`{"socks_proxy": `,
+		`{}`,
+		`{"socks_proxy": "127.0.0.1:1080", "max_conns_per_host": "many"}`,
+		`{"socks_proxy": "127.0.0.1:1080", "socks_credentials_file": "creds", "socks_proxy_user": "alice"}`,
+	} {
+		if _, err := parseConfigJSON([]byte(doc)); err == nil {
+			t.Errorf("parseConfigJSON(%q): want an error", doc)
+		}
+	}
+}
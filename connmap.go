@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connMapping maps a connection to the SOCKS5 proxy, as seen by firewalls
+// and netflow collectors, to the client it was opened for.
+type connMapping struct {
+	Time        time.Time `json:"time"`
+	Session     string    `json:"session"`
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	Process     string    `json:"process,omitempty"`
+	Local       string    `json:"local"`
+	Upstream    string    `json:"upstream"`
+	Destination string    `json:"destination"`
+}
+
+// connMapLog appends a JSON line per connection to the SOCKS5 proxy to a
+// file, so firewall and netflow records of the connection's local port can
+// be correlated back to proxy clients during investigations.
+type connMapLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+
+	written atomic.Int64
+	errors  atomic.Int64
+}
+
+func openConnMapLog(path string) (*connMapLog, error) {
+	l := &connMapLog{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen opens the file again, so it can be rotated by renaming it and
+// sending SIGHUP.
+func (l *connMapLog) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+	l.file = file
+	return nil
+}
+
+// record logs conn, dialed through upstream to destination for the client
+// connection of ctx.
+func (l *connMapLog) record(ctx context.Context, conn net.Conn, upstream, destination string) {
+	if l == nil {
+		return
+	}
+
+	m := connMapping{
+		Time:        time.Now(),
+		Session:     sessionID(ctx),
+		User:        userFromContext(ctx),
+		Local:       conn.LocalAddr().String(),
+		Upstream:    upstream,
+		Destination: destination,
+	}
+	if s := sessionFromContext(ctx); s != nil {
+		m.Client = s.client
+		m.Process = s.process.name
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		l.errors.Add(1)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		l.errors.Add(1)
+		log.Printf("connection map: write failed: %v", err)
+		return
+	}
+	l.written.Add(1)
+}
+
+func (l *connMapLog) writeMetrics(pw metricsWriter) {
+	if l == nil {
+		return
+	}
+	pw.counter("http2socks_conn_map_records_total", "Connections to the SOCKS5 proxy written to the connection map.", l.written.Load())
+	pw.counter("http2socks_conn_map_errors_total", "Connections which couldn't be written to the connection map.", l.errors.Load())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// costDefaultRate is the key of cost_rates applying to traffic whose
+	// category has no rate of its own.
+	costDefaultRate = "*"
+	// costUncategorized is how traffic without a category is reported.
+	costUncategorized = "uncategorized"
+)
+
+// costEstimator tags the bytes of requests and tunnels by destination
+// category and estimates their egress cost from rates per GB. It's a dry
+// run: nothing is limited, the estimate is only reported.
+type costEstimator struct {
+	rates    map[string]float64
+	interval time.Duration
+
+	mu     sync.Mutex
+	total  map[string]int64 // bytes by category
+	period map[string]int64 // bytes since the last report
+	since  time.Time        // of the last report
+}
+
+func newCostEstimator(rates map[string]float64, interval time.Duration) *costEstimator {
+	return &costEstimator{
+		rates:    rates,
+		interval: interval,
+		total:    make(map[string]int64),
+		period:   make(map[string]int64),
+		since:    time.Now(),
+	}
+}
+
+// add accounts n bytes to and from a destination of category.
+func (c *costEstimator) add(category string, n int64) {
+	if c == nil || n <= 0 {
+		return
+	}
+	if category == "" {
+		category = costUncategorized
+	}
+	c.mu.Lock()
+	c.total[category] += n
+	c.period[category] += n
+	c.mu.Unlock()
+}
+
+// rate returns the cost per GB of category.
+func (c *costEstimator) rate(category string) float64 {
+	if rate, ok := c.rates[category]; ok {
+		return rate
+	}
+	return c.rates[costDefaultRate]
+}
+
+// cost returns the estimated cost of n bytes of category.
+func (c *costEstimator) cost(category string, n int64) float64 {
+	return float64(n) / 1e9 * c.rate(category)
+}
+
+// run logs a report every interval until ctx is done.
+func (c *costEstimator) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.report()
+		}
+	}
+}
+
+// report logs the estimate of the bytes since the last report and of all
+// bytes so far.
+func (c *costEstimator) report() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	period, elapsed := c.period, time.Since(c.since).Round(time.Second)
+	c.period, c.since = make(map[string]int64), time.Now()
+	var total float64
+	for category, n := range c.total {
+		total += c.cost(category, n)
+	}
+	c.mu.Unlock()
+
+	categories := make([]string, 0, len(period))
+	for category := range period {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	if len(categories) == 0 {
+		log.Printf("cost estimate for the last %v: no traffic, $%.2f since start", elapsed, total)
+		return
+	}
+
+	var (
+		parts []string
+		bytes int64
+		cost  float64
+	)
+	for _, category := range categories {
+		n := period[category]
+		bytes += n
+		cost += c.cost(category, n)
+		parts = append(parts, fmt.Sprintf("%s %s $%.2f", category, formatGB(n), c.cost(category, n)))
+	}
+	log.Printf("cost estimate for the last %v: %s $%.2f (%s), $%.2f since start",
+		elapsed, formatGB(bytes), cost, strings.Join(parts, ", "), total)
+}
+
+func formatGB(n int64) string {
+	return fmt.Sprintf("%.3f GB", float64(n)/1e9)
+}
+
+func (c *costEstimator) writeMetrics(pw metricsWriter) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	categories := make([]string, 0, len(c.total))
+	for category := range c.total {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	pw.header("http2socks_category_bytes_total", "counter", "Payload bytes to and from destinations by destination category.")
+	for _, category := range categories {
+		pw.sample("http2socks_category_bytes_total", map[string]string{"category": category}, float64(c.total[category]))
+	}
+	pw.header("http2socks_egress_cost_estimate_dollars", "counter", "Estimated egress cost of the traffic by destination category.")
+	for _, category := range categories {
+		pw.sample("http2socks_egress_cost_estimate_dollars", map[string]string{"category": category}, c.cost(category, c.total[category]))
+	}
+}
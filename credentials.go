@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// credentialsCheckInterval is how often the SOCKS5 credentials file is
+// checked for changes.
+const credentialsCheckInterval = 10 * time.Second
+
+// readCredentialsFile reads the SOCKS5 user and password from the first
+// line of path which isn't empty or a # comment, given as user:password.
+func readCredentialsFile(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" || password == "" {
+			return "", "", fmt.Errorf("%s: credentials must be given as user:password", path)
+		}
+		return user, password, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "", fmt.Errorf("%s: no credentials", path)
+}
+
+// credentialsWatcher reloads the upstream when the SOCKS5 credentials file
+// changed, e.g. after the provider rotated the password, so new
+// connections use the new credentials without a SIGHUP.
+type credentialsWatcher struct {
+	path    string
+	modTime time.Time
+
+	reloads      atomic.Int64
+	reloadErrors atomic.Int64
+}
+
+func newCredentialsWatcher(path string) *credentialsWatcher {
+	cw := &credentialsWatcher{path: path}
+	if fi, err := os.Stat(path); err == nil {
+		cw.modTime = fi.ModTime()
+	}
+	return cw
+}
+
+// run checks the file until ctx is done. A file which fails to load, e.g.
+// while it's being written, keeps the previous credentials in use until
+// the next check.
+func (cw *credentialsWatcher) run(ctx context.Context, reload func() error) {
+	ticker := time.NewTicker(credentialsCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(cw.path)
+		if err != nil || fi.ModTime().Equal(cw.modTime) {
+			continue
+		}
+		if err := reload(); err != nil {
+			cw.reloadErrors.Add(1)
+			log.Printf("reloading SOCKS5 credentials from %s failed, keeping the previous ones: %v", cw.path, err)
+			continue
+		}
+		cw.modTime = fi.ModTime()
+		cw.reloads.Add(1)
+		log.Printf("reloaded SOCKS5 credentials from %s", cw.path)
+	}
+}
+
+func (cw *credentialsWatcher) writeMetrics(pw metricsWriter) {
+	if cw == nil {
+		return
+	}
+
+	pw.counter("http2socks_socks_credentials_reloads_total", "SOCKS5 credentials loaded again after their file changed.", cw.reloads.Load())
+	pw.counter("http2socks_socks_credentials_reload_errors_total", "SOCKS5 credentials files which failed to load again.", cw.reloadErrors.Load())
+}
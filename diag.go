@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	diagDefaultSamples = 5
+	diagMaxSamples     = 50
+	diagSampleTimeout  = 5 * time.Second
+	diagSampleInterval = 200 * time.Millisecond
+)
+
+type diagSample struct {
+	ConnectMs   float64 `json:"connect_ms,omitempty"`
+	HandshakeMs float64 `json:"handshake_ms,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+type diagSummary struct {
+	MinMs float64 `json:"min_ms"`
+	AvgMs float64 `json:"avg_ms"`
+	MaxMs float64 `json:"max_ms"`
+}
+
+type diagReport struct {
+	Upstream  string       `json:"upstream"`
+	Samples   int          `json:"samples"`
+	Failed    int          `json:"failed"`
+	Loss      float64      `json:"loss"`
+	Connect   diagSummary  `json:"connect"`
+	Handshake diagSummary  `json:"handshake"`
+	Results   []diagSample `json:"results"`
+}
+
+// handleUpstreamDiag measures TCP connect time and SOCKS handshake time to
+// a server of the upstream, the first one unless the server parameter
+// names another, over several samples. The share of failed samples gives a
+// rough idea of packet loss on the way. It dials the upstream, so it's a
+// POST needing the write role.
+func (p *forwardProxy) handleUpstreamDiag(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	samples := diagDefaultSamples
+	if v := req.URL.Query().Get("samples"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > diagMaxSamples {
+			http.Error(w, "samples must be between 1 and "+strconv.Itoa(diagMaxSamples), http.StatusBadRequest)
+			return
+		}
+		samples = n
+	}
+
+	u := p.upstreams.current.Load()
+	server := u.servers[0]
+	if addr := req.URL.Query().Get("server"); addr != "" {
+		i := slices.IndexFunc(u.servers, func(s *upstreamServer) bool { return s.server == addr })
+		if i < 0 {
+			http.Error(w, "server must be one of "+u.addresses(), http.StatusBadRequest)
+			return
+		}
+		server = u.servers[i]
+	}
+	tlsConfig, err := u.tlsConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report := diagReport{
+		Upstream: server.server,
+		Samples:  samples,
+		Results:  make([]diagSample, 0, samples),
+	}
+
+	var connects, handshakes []float64
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(diagSampleInterval):
+			}
+		}
+
+		s := diagSampleUpstream(req.Context(), server, tlsConfig)
+		if s.Error != "" {
+			report.Failed++
+		} else {
+			connects = append(connects, s.ConnectMs)
+			handshakes = append(handshakes, s.HandshakeMs)
+		}
+		report.Results = append(report.Results, s)
+	}
+	report.Loss = float64(report.Failed) / float64(samples)
+	report.Connect = summarize(connects)
+	report.Handshake = summarize(handshakes)
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func diagSampleUpstream(ctx context.Context, s *upstreamServer, tlsConfig *tls.Config) diagSample {
+	ctx, cancel := context.WithTimeout(ctx, diagSampleTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network(), s.server)
+	if err != nil {
+		return diagSample{Error: err.Error()}
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	connected := time.Now()
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if _, err := proxyHandshake(ctx, conn, s.socksEndpoint, tlsConfig); err != nil {
+		return diagSample{ConnectMs: ms(connected.Sub(start)), Error: err.Error()}
+	}
+
+	return diagSample{
+		ConnectMs:   ms(connected.Sub(start)),
+		HandshakeMs: ms(time.Since(connected)),
+	}
+}
+
+func summarize(values []float64) diagSummary {
+	if len(values) == 0 {
+		return diagSummary{}
+	}
+
+	s := diagSummary{MinMs: values[0], MaxMs: values[0]}
+	var sum float64
+	for _, v := range values {
+		s.MinMs = min(s.MinMs, v)
+		s.MaxMs = max(s.MaxMs, v)
+		sum += v
+	}
+	s.AvgMs = math.Round(sum/float64(len(values))*1000) / 1000
+	return s
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+)
+
+type qosClassKey struct{}
+
+// withQoSClass returns ctx carrying the QoS class of the request.
+func withQoSClass(ctx context.Context, class qosClass) context.Context {
+	return context.WithValue(ctx, qosClassKey{}, class)
+}
+
+// qosClassFromContext returns the QoS class of the request, the default
+// class when it has none.
+func qosClassFromContext(ctx context.Context) qosClass {
+	class, ok := ctx.Value(qosClassKey{}).(qosClass)
+	if !ok {
+		return qosDefault
+	}
+	return class
+}
+
+// dscpMarks are the DSCP values set on connections to the SOCKS server per
+// QoS class, so network equipment can prioritize proxy traffic. Classes
+// without a value keep the system default.
+type dscpMarks map[qosClass]int
+
+func newDSCPMarks(classes map[string]int) (dscpMarks, error) {
+	marks := make(dscpMarks, len(classes))
+	for name, dscp := range classes {
+		class, err := parseQoSClass(name)
+		if err != nil {
+			return nil, err
+		}
+		if dscp < 0 || dscp > 63 {
+			return nil, fmt.Errorf("DSCP value of QoS class %s must be between 0 and 63", name)
+		}
+		marks[class] = dscp
+	}
+	return marks, nil
+}
+
+// control is a net.Dialer ControlContext marking the connection with the
+// DSCP value of the QoS class of ctx.
+func (m dscpMarks) control(ctx context.Context, network, _ string, c syscall.RawConn) error {
+	dscp, ok := m[qosClassFromContext(ctx)]
+	if !ok {
+		return nil
+	}
+
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = setTOS(fd, network, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
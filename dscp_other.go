@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package main
+
+import "errors"
+
+func setTOS(uintptr, string, int) error {
+	return errors.New("DSCP marking is not supported on this platform")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+	decisionAudit = "audit"
+)
+
+// accessEvent is a policy decision about one request.
+type accessEvent struct {
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	Category string    `json:"category,omitempty"`
+	Decision string    `json:"decision"`
+	Rule     string    `json:"rule,omitempty"`
+}
+
+func newAccessEvent(req *http.Request, host, decision, rule string) accessEvent {
+	return accessEvent{
+		Time:     time.Now(),
+		Session:  sessionID(req.Context()),
+		Client:   req.RemoteAddr,
+		User:     userFromContext(req.Context()),
+		Method:   req.Method,
+		Host:     host,
+		Category: categoryFromContext(req.Context()),
+		Decision: decision,
+		Rule:     rule,
+	}
+}
+
+// eventSink posts events in JSON array batches to a webhook, so SIEM
+// systems can consume policy decisions in near real time. Publishing never
+// blocks the request: events are dropped when the queue is full. The sink
+// is named by its metrics and log messages, e.g. "events".
+type eventSink[T any] struct {
+	name     string
+	help     string
+	url      string
+	batch    int
+	interval time.Duration
+	client   *http.Client
+
+	queue   chan T
+	sent    atomic.Int64
+	dropped atomic.Int64
+}
+
+// newEventSink returns a sink of events described as help in metrics,
+// e.g. "Access events".
+func newEventSink[T any](name, help, url string, batch int, interval time.Duration) *eventSink[T] {
+	return &eventSink[T]{
+		name:     name,
+		help:     help,
+		url:      url,
+		batch:    batch,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan T, batch*10),
+	}
+}
+
+func (s *eventSink[T]) publish(e T) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.queue <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// run sends queued events until ctx is done.
+func (s *eventSink[T]) run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	batch := make([]T, 0, s.batch)
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush(batch)
+			return
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) < s.batch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (s *eventSink[T]) flush(batch []T) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := s.post(batch); err != nil {
+		s.dropped.Add(int64(len(batch)))
+		log.Printf("%s: dropped %d %s: %v", s.name, len(batch), strings.ToLower(s.help), err)
+		return
+	}
+	s.sent.Add(int64(len(batch)))
+}
+
+func (s *eventSink[T]) post(batch []T) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *eventSink[T]) writeMetrics(pw metricsWriter) {
+	if s == nil {
+		return
+	}
+	pw.counter("http2socks_"+s.name+"_sent_total", s.help+" delivered to the event sink.", s.sent.Load())
+	pw.counter("http2socks_"+s.name+"_dropped_total", s.help+" dropped because the queue was full or delivery failed.", s.dropped.Load())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/net/proxy"
+)
+
+// Values of socks_fallback.
+const (
+	fallbackClosed = "closed"
+	fallbackOpen   = "open"
+)
+
+// directFallback connects to destinations directly when the upstream is
+// down, for socks_fallback=open.
+type directFallback struct {
+	forward proxy.Dialer
+	used    atomic.Int64
+}
+
+// fallbackDialer dials through upstream and falls back to a direct
+// connection when upstream is down. Destinations with one of routes don't.
+type fallbackDialer struct {
+	upstream proxy.ContextDialer
+	fallback *directFallback
+	routes   upstreamRoutes
+}
+
+func (d fallbackDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d fallbackDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.upstream.DialContext(ctx, network, addr)
+	if err == nil || !upstreamDown(err) || ctx.Err() != nil {
+		return conn, err
+	}
+	// The client asked for the server, not for any way out.
+	if _, ok := selectedServer(ctx); ok {
+		return conn, err
+	}
+	if host, _, splitErr := net.SplitHostPort(addr); splitErr == nil {
+		if _, ok := d.routes.match(strings.ToLower(host)); ok {
+			return conn, err
+		}
+	}
+	d.fallback.used.Add(1)
+	sessionLogger(ctx).Printf("upstream is down, connecting to %s directly: %v", addr, err)
+	return dialContext(ctx, d.fallback.forward, network, addr)
+}
+
+// upstreamDown reports whether err means the upstream proxy couldn't be
+// reached, broke off the handshake or is failing as the circuit breaker
+// found, rather than that it refused the destination.
+func upstreamDown(err error) bool {
+	return unreachable(err) ||
+		errors.Is(err, errCircuitOpen) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+func (f *directFallback) writeMetrics(pw metricsWriter) {
+	if f == nil {
+		return
+	}
+
+	pw.counter("http2socks_direct_fallbacks_total", "Connections made directly because the upstream proxy was down.", f.used.Load())
+}
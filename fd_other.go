@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package main
+
+import "errors"
+
+// fdLimit is only known on Unix.
+func fdLimit() (uint64, bool) {
+	return 0, false
+}
+
+// raiseFDLimit is only supported on Unix.
+func raiseFDLimit(target uint64) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// openFDs is only known on Unix.
+func openFDs() (int, bool) {
+	return 0, false
+}
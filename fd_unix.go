@@ -0,0 +1,76 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// fdLimit returns the soft limit of open file descriptors of the process.
+func fdLimit() (uint64, bool) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, false
+	}
+	return uint64(rlimit.Cur), true
+}
+
+// raiseFDLimit raises the soft limit of open file descriptors to target,
+// along with the hard limit if needed, which takes privileges. Without
+// them the soft limit is raised as far as the hard limit allows, and the
+// error is returned with the limit now in place.
+func raiseFDLimit(target uint64) (uint64, error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, err
+	}
+	if uint64(rlimit.Cur) >= target {
+		return uint64(rlimit.Cur), nil
+	}
+
+	want := rlimit
+	setRlim(&want.Cur, target)
+	if uint64(want.Max) < target {
+		setRlim(&want.Max, target)
+	}
+	err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want)
+	if err == nil {
+		return target, nil
+	}
+	if uint64(rlimit.Max) > uint64(rlimit.Cur) {
+		want = rlimit
+		want.Cur = rlimit.Max
+		if syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want) == nil {
+			return uint64(want.Cur), err
+		}
+	}
+	return uint64(rlimit.Cur), err
+}
+
+// setRlim sets a field of syscall.Rlimit, which is signed on some systems.
+func setRlim[T int64 | uint64](field *T, v uint64) {
+	*field = T(v)
+}
+
+// openFDs returns the number of open file descriptors of the process.
+func openFDs() (int, bool) {
+	dir := "/dev/fd"
+	if runtime.GOOS == "linux" {
+		dir = "/proc/self/fd"
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, false
+	}
+	// The directory itself was open while it was read.
+	return len(names) - 1, true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fdSampleInterval is how long a count of open file descriptors is used
+// before they are counted again.
+const fdSampleInterval = 250 * time.Millisecond
+
+// fdShedResponse is what refused clients get, the connection is closed
+// after it.
+const fdShedResponse = "HTTP/1.1 503 Service Unavailable\r\nRetry-After: 1\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+
+// fdBudget keeps reserve file descriptors under the process limit free by
+// refusing new client connections while fewer are left, so established
+// tunnels don't break because their next connection finds none.
+type fdBudget struct {
+	limit   uint64
+	reserve int
+
+	mu        sync.Mutex
+	open      int
+	sampledAt time.Time
+
+	shed    atomic.Int64
+	lastLog atomic.Int64 // unix nanoseconds
+}
+
+// newFDBudget returns nil when the limit of the process isn't known.
+func newFDBudget(reserve int) *fdBudget {
+	limit, ok := fdLimit()
+	if !ok {
+		return nil
+	}
+	return &fdBudget{limit: limit, reserve: reserve}
+}
+
+// openFDs returns the number of open file descriptors, counted at most
+// every fdSampleInterval.
+func (b *fdBudget) openFDs() (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.sampledAt) >= fdSampleInterval {
+		open, ok := openFDs()
+		if !ok {
+			return 0, false
+		}
+		b.open, b.sampledAt = open, time.Now()
+	}
+	return b.open, true
+}
+
+// exhausted reports whether new client connections are to be refused.
+func (b *fdBudget) exhausted() bool {
+	if b == nil || b.reserve <= 0 {
+		return false
+	}
+	open, ok := b.openFDs()
+	return ok && uint64(open+b.reserve) >= b.limit
+}
+
+// refuse closes conn, answering it with 503 first when respond is set.
+func (b *fdBudget) refuse(conn net.Conn, respond bool) {
+	b.shed.Add(1)
+	if now := time.Now().UnixNano(); now-b.lastLog.Load() >= int64(acceptLogInterval) {
+		b.lastLog.Store(now)
+		log.Printf("fewer than %d of %d file descriptors left, refusing new client connections (%d so far)", b.reserve, b.limit, b.shed.Load())
+	}
+	if respond {
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Write([]byte(fdShedResponse))
+	}
+	_ = conn.Close()
+}
+
+func (b *fdBudget) writeMetrics(pw metricsWriter) {
+	if b == nil {
+		return
+	}
+
+	pw.gauge("http2socks_fds_limit", "Limit of open file descriptors of the process.", float64(b.limit))
+	if open, ok := b.openFDs(); ok {
+		pw.gauge("http2socks_fds_open", "Open file descriptors of the process.", float64(open))
+		pw.gauge("http2socks_fds_headroom", "File descriptors left under the limit.", float64(b.limit)-float64(open))
+	}
+	pw.counter("http2socks_fd_shed_total", "Client connections refused to keep file descriptors in reserve.", b.shed.Load())
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// geoIP looks up the country and continent of addresses in a MaxMind DB
+// (GeoLite2 or GeoIP2 Country or City), reloaded when the file changes.
+type geoIP struct {
+	path     string
+	interval time.Duration
+
+	db      atomic.Pointer[mmdb]
+	modTime time.Time
+
+	lookups      atomic.Int64
+	misses       atomic.Int64
+	reloads      atomic.Int64
+	reloadErrors atomic.Int64
+}
+
+func newGeoIP(path string, interval time.Duration) (*geoIP, error) {
+	g := &geoIP{path: path, interval: interval}
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *geoIP) load() error {
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(g.path)
+	if err != nil {
+		return err
+	}
+	db, err := openMMDB(data)
+	if err != nil {
+		return fmt.Errorf("GeoIP database %s: %w", g.path, err)
+	}
+	g.db.Store(db)
+	g.modTime = info.ModTime()
+	return nil
+}
+
+// lookup returns the ISO country code and the continent code of addr,
+// empty when the database doesn't know it. Nil-safe.
+func (g *geoIP) lookup(addr netip.Addr) (country, continent string) {
+	if g == nil {
+		return "", ""
+	}
+	g.lookups.Add(1)
+	loc, err := g.db.Load().lookup(addr)
+	if err != nil || loc.country == "" && loc.continent == "" {
+		g.misses.Add(1)
+		return "", ""
+	}
+	return loc.country, loc.continent
+}
+
+// run reloads the database every interval when the file changed, until ctx
+// is done. The previous database stays in use when reloading fails.
+func (g *geoIP) run(ctx context.Context) {
+	if g == nil || g.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(g.path)
+		if err == nil && info.ModTime().Equal(g.modTime) {
+			continue
+		}
+		if err == nil {
+			err = g.load()
+		}
+		if err != nil {
+			g.reloadErrors.Add(1)
+			log.Printf("reloading the GeoIP database failed, keeping the previous one: %v", err)
+			continue
+		}
+		g.reloads.Add(1)
+		log.Printf("GeoIP database %s reloaded", g.path)
+	}
+}
+
+func (g *geoIP) writeMetrics(pw metricsWriter) {
+	if g == nil {
+		return
+	}
+
+	pw.counter("http2socks_geoip_lookups_total", "Addresses looked up in the GeoIP database.", g.lookups.Load())
+	pw.counter("http2socks_geoip_misses_total", "Addresses not found in the GeoIP database.", g.misses.Load())
+	pw.counter("http2socks_geoip_reloads_total", "Reloads of the changed GeoIP database.", g.reloads.Load())
+	pw.counter("http2socks_geoip_reload_errors_total", "Failed reloads of the GeoIP database.", g.reloadErrors.Load())
+}
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind
+// DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB")
+
+// mmdb is a MaxMind DB file: a binary search tree over the address bits
+// whose leaves point into a data section of typed values.
+type mmdb struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// dataStart is the offset of the data section in data.
+	dataStart uint
+	// ipv4Start is the node IPv4 addresses start at in an IPv6 tree.
+	ipv4Start uint
+
+	// Records are shared by many networks, their locations are decoded
+	// once.
+	mu        sync.Mutex
+	locations map[uint]geoLocation
+}
+
+type geoLocation struct {
+	country   string
+	continent string
+}
+
+func openMMDB(data []byte) (*mmdb, error) {
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("no MaxMind DB metadata")
+	}
+	meta := data[i+len(mmdbMetadataMarker):]
+	v, _, err := decodeMMDB(meta, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := v.(map[string]any)
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+	num := func(name string) uint {
+		n, _ := fields[name].(uint64)
+		return uint(n)
+	}
+
+	db := &mmdb{
+		data:       data[:i],
+		nodeCount:  num("node_count"),
+		recordSize: num("record_size"),
+		ipVersion:  num("ip_version"),
+		locations:  make(map[uint]geoLocation),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	// The tree is followed by 16 zero bytes.
+	db.dataStart = treeSize + 16
+	if db.dataStart > uint(len(db.data)) {
+		return nil, errMMDBCorrupt
+	}
+	if db.ipVersion == 6 {
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (0) or right (1) record of node.
+func (db *mmdb) record(node, bit uint) uint {
+	size := db.recordSize * 2 / 8
+	b := db.data[node*size : node*size+size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+func (db *mmdb) lookup(addr netip.Addr) (geoLocation, error) {
+	addr = addr.Unmap()
+	node, bits := uint(0), addr.AsSlice()
+	switch {
+	case addr.Is4() && db.ipVersion == 6:
+		node = db.ipv4Start
+	case addr.Is6() && db.ipVersion == 4:
+		return geoLocation{}, nil
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return geoLocation{}, nil
+	}
+	offset := node - db.nodeCount - 16
+
+	db.mu.Lock()
+	loc, ok := db.locations[offset]
+	db.mu.Unlock()
+	if ok {
+		return loc, nil
+	}
+	v, _, err := decodeMMDB(db.data[db.dataStart:], offset, 0)
+	if err != nil {
+		return geoLocation{}, err
+	}
+	fields, _ := v.(map[string]any)
+	loc.country = mmdbField(fields, "country", "iso_code")
+	if loc.country == "" {
+		loc.country = mmdbField(fields, "registered_country", "iso_code")
+	}
+	loc.continent = mmdbField(fields, "continent", "code")
+	db.mu.Lock()
+	db.locations[offset] = loc
+	db.mu.Unlock()
+	return loc, nil
+}
+
+// mmdbField returns the string at the path of map keys in v.
+func mmdbField(v map[string]any, path ...string) string {
+	for _, key := range path[:len(path)-1] {
+		v, _ = v[key].(map[string]any)
+	}
+	s, _ := v[path[len(path)-1]].(string)
+	return s
+}
+
+// Data types of MaxMind DB values.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decodeMMDB decodes the value at off in the section buf, in which
+// pointers are offsets. It returns the value and the offset after it.
+// Integers are returned as uint64 (int32 as int64, uint128 as bytes).
+func decodeMMDB(buf []byte, off uint, depth int) (any, uint, error) {
+	if depth > 32 || off >= uint(len(buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := buf[off]
+	off++
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		ss := uint(ctrl>>3) & 3
+		if off+ss+1 > uint(len(buf)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		p := uint(ctrl & 7)
+		switch ss {
+		case 0:
+			p = p<<8 | uint(buf[off])
+		case 1:
+			p = (p<<16 | uint(buf[off])<<8 | uint(buf[off+1])) + 2048
+		case 2:
+			p = (p<<24 | uint(buf[off])<<16 | uint(buf[off+1])<<8 | uint(buf[off+2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(buf[off:]))
+		}
+		v, _, err := decodeMMDB(buf, p, depth+1)
+		return v, off + ss + 1, err
+	}
+
+	if typ == mmdbExtended {
+		if off >= uint(len(buf)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(buf[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(buf)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		var ext uint
+		for _, b := range buf[off : off+n] {
+			ext = ext<<8 | uint(b)
+		}
+		size = []uint{29, 285, 65821}[n-1] + ext
+		off += n
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := decodeMMDB(buf, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if m[key], off, err = decodeMMDB(buf, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]any, size)
+		for i := range a {
+			var err error
+			if a[i], off, err = decodeMMDB(buf, off, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case mmdbBool:
+		return size != 0, off, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, off, nil
+	}
+
+	if off+size > uint(len(buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	payload := buf[off : off+size]
+	off += size
+	switch typ {
+	case mmdbString:
+		return string(payload), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var n uint64
+		for _, b := range payload {
+			n = n<<8 | uint64(b)
+		}
+		return n, off, nil
+	case mmdbInt32:
+		var n uint32
+		for _, b := range payload {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), off, nil
+	case mmdbBytes, mmdbUint128:
+		return payload, off, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unknown type %d", errMMDBCorrupt, typ)
+}
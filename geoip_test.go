@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDecodeMMDB(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want any
+		end  uint
+	}{
+		{"string", []byte{0x42, 'd', 'e'}, "de", 3},
+		{"empty string", []byte{0x40}, "", 1},
+		{"long string", append([]byte{0x5d, 1}, make([]byte, 30)...), string(make([]byte, 30)), 32},
+		{"uint16", []byte{0xa2, 0x01, 0x00}, uint64(256), 3},
+		{"uint32 zero", []byte{0xc0}, uint64(0), 1},
+		{"uint32", []byte{0xc4, 0xde, 0xad, 0xbe, 0xef}, uint64(0xdeadbeef), 5},
+		{"uint64", []byte{0x08, 0x02, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, uint64(0x0102030405060708), 10},
+		{"int32", []byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe}, int64(-2), 6},
+		{"uint128", []byte{0x02, 0x03, 0x01, 0x02}, []byte{0x01, 0x02}, 4},
+		{"bytes", []byte{0x82, 0xca, 0xfe}, []byte{0xca, 0xfe}, 3},
+		{"double", append([]byte{0x68}, float64Bytes(1.5)...), 1.5, 9},
+		{"float", []byte{0x04, 0x08, 0x3f, 0xc0, 0x00, 0x00}, 1.5, 6},
+		{"bool", []byte{0x01, 0x07}, true, 2},
+		{"false", []byte{0x00, 0x07}, false, 2},
+		{"map", []byte{0xe1, 0x42, 'i', 's', 0x42, 'D', 'E'}, map[string]any{"is": "DE"}, 7},
+		{"array", []byte{0x02, 0x04, 0x41, 'a', 0xa1, 0x07}, []any{"a", uint64(7)}, 6},
+		// The map's value points back at the key.
+		{"pointer", []byte{0xe1, 0x41, 'k', 0x20, 0x01}, map[string]any{"k": "k"}, 5},
+		{"nested", []byte{0xe1, 0x41, 'c', 0xe1, 0x41, 'd', 0x41, 'e'}, map[string]any{"c": map[string]any{"d": "e"}}, 8},
+	}
+	for _, tt := range tests {
+		got, end, err := decodeMMDB(tt.in, 0, 0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) || end != tt.end {
+			t.Errorf("%s: decodeMMDB = %#v, %d, want %#v, %d", tt.name, got, end, tt.want, tt.end)
+		}
+	}
+}
+
+func float64Bytes(f float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(f))
+}
+
+func TestDecodeMMDBErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"short string", []byte{0x43, 'a'}},
+		{"short size", []byte{0x5e, 0x01}},
+		{"short pointer", []byte{0x28, 0x00}},
+		{"pointer out of range", []byte{0x20, 0x10}},
+		{"pointer loop", []byte{0x20, 0x00}},
+		{"short map", []byte{0xe1, 0x41, 'k'}},
+		{"map key not a string", []byte{0xe1, 0xa1, 0x01, 0x41, 'v'}},
+		{"short array", []byte{0x02, 0x04, 0x41, 'a'}},
+		{"missing extended type", []byte{0x01}},
+		{"bad double", []byte{0x64, 0, 0, 0, 0}},
+		{"bad float", []byte{0x02, 0x08, 0, 0}},
+		{"unknown type", []byte{0x00, 0x20}},
+	}
+	for _, tt := range tests {
+		if got, _, err := decodeMMDB(tt.in, 0, 0); !errors.Is(err, errMMDBCorrupt) {
+			t.Errorf("%s: decodeMMDB = %#v, %v, want %v", tt.name, got, err, errMMDBCorrupt)
+		}
+	}
+}
+
+// mmdbTestValue encodes v, a string, uint32, map or slice, in the MaxMind
+// DB data format.
+func mmdbTestValue(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append([]byte{byte(mmdbString<<5 | len(v))}, v...)
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		for len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+		}
+		return append([]byte{byte(mmdbUint32<<5 | len(b))}, b...)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		out := []byte{byte(mmdbMap<<5 | len(v))}
+		for _, key := range keys {
+			out = append(out, mmdbTestValue(key)...)
+			out = append(out, mmdbTestValue(v[key])...)
+		}
+		return out
+	case []any:
+		out := []byte{byte(len(v)), mmdbArray - 7}
+		for _, item := range v {
+			out = append(out, mmdbTestValue(item)...)
+		}
+		return out
+	}
+	panic("unsupported value")
+}
+
+// mmdbTestDatabase builds an IPv6 database with 24 bit records mapping
+// networks to country and continent codes, IPv4 networks in ::/96.
+func mmdbTestDatabase(networks map[string][2]string) []byte {
+	var data []byte
+	type leaf struct {
+		prefix netip.Prefix
+		offset int
+	}
+	var leaves []leaf
+	for network, loc := range networks {
+		prefix := netip.MustParsePrefix(network)
+		leaves = append(leaves, leaf{prefix, len(data)})
+		data = append(data, mmdbTestValue(map[string]any{
+			"continent": map[string]any{"code": loc[1]},
+			"country":   map[string]any{"iso_code": loc[0], "names": map[string]any{"en": "x"}},
+		})...)
+	}
+
+	// Records are node indexes, -1 for none, or data offsets - 2.
+	nodes := [][2]int{{-1, -1}}
+	for _, l := range leaves {
+		bits, addr := l.prefix.Bits(), l.prefix.Addr().As16()
+		if l.prefix.Addr().Is4() {
+			bits += 96
+			a4 := l.prefix.Addr().As4()
+			addr = [16]byte{12: a4[0], 13: a4[1], 14: a4[2], 15: a4[3]}
+		}
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				nodes[node][bit] = -2 - l.offset
+				break
+			}
+			if nodes[node][bit] == -1 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	n := len(nodes)
+	var tree []byte
+	for _, node := range nodes {
+		for _, r := range node {
+			v := n
+			switch {
+			case r >= 0:
+				v = r
+			case r <= -2:
+				v = n + 16 + (-2 - r)
+			}
+			tree = append(tree, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	meta := mmdbTestValue(map[string]any{
+		"node_count":  uint32(n),
+		"record_size": uint32(24),
+		"ip_version":  uint32(6),
+	})
+	out := append(tree, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, mmdbMetadataMarker...)
+	return append(out, meta...)
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	db := mmdbTestDatabase(map[string][2]string{
+		"10.0.0.0/8":    {"FR", "EU"},
+		"192.0.2.0/24":  {"US", "NA"},
+		"2001:db8::/32": {"JP", "AS"},
+	})
+	if err := os.WriteFile(path, db, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	g, err := newGeoIP(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr      string
+		country   string
+		continent string
+	}{
+		{"10.1.2.3", "FR", "EU"},
+		{"::ffff:10.1.2.3", "FR", "EU"},
+		{"192.0.2.200", "US", "NA"},
+		{"192.0.3.1", "", ""},
+		{"2001:db8::1", "JP", "AS"},
+		{"2001:db9::1", "", ""},
+		{"8.8.8.8", "", ""},
+	}
+	for _, tt := range tests {
+		country, continent := g.lookup(netip.MustParseAddr(tt.addr))
+		if country != tt.country || continent != tt.continent {
+			t.Errorf("lookup(%s) = %q, %q, want %q, %q", tt.addr, country, continent, tt.country, tt.continent)
+		}
+	}
+	if lookups, misses := g.lookups.Load(), g.misses.Load(); lookups != 7 || misses != 3 {
+		t.Errorf("%d lookups, %d misses, want 7 and 3", lookups, misses)
+	}
+
+	metadata := func(recordSize, nodes uint32) []byte {
+		return append(append([]byte(nil), mmdbMetadataMarker...), mmdbTestValue(map[string]any{
+			"node_count":  nodes,
+			"record_size": recordSize,
+			"ip_version":  uint32(6),
+		})...)
+	}
+	bad := []struct {
+		name string
+		data []byte
+	}{
+		{"no metadata", db[:len(db)/2]},
+		{"truncated metadata", db[:len(db)-3]},
+		{"record size", metadata(16, 1)},
+		{"tree larger than the file", metadata(24, 1000)},
+	}
+	for _, tt := range bad {
+		if _, err := openMMDB(tt.data); err == nil {
+			t.Errorf("%s: openMMDB succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -4,5 +4,6 @@ go 1.21
 
 require (
 	github.com/cristalhq/aconfig v0.18.5
+	golang.org/x/crypto v0.14.0
 	golang.org/x/net v0.17.0
 )
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// headerProfile normalizes the headers of plain requests sent to origins,
+// so they look like those of a given client regardless of the client of
+// the proxy. Headers of the client not in keep are removed, set replaces
+// headers and defaults fills in those the client didn't send. Go writes
+// headers in its own order, so only their content is normalized.
+type headerProfile struct {
+	keep     []string
+	set      map[string]string
+	defaults map[string]string
+}
+
+// profileKeptHeaders are the headers all profiles keep, which carry the
+// meaning of a request rather than describing the client.
+var profileKeptHeaders = []string{
+	"Accept-Encoding", "Authorization", "Content-Encoding", "Content-Type", "Cookie",
+	"If-Match", "If-Modified-Since", "If-None-Match", "If-Range", "If-Unmodified-Since", "Range",
+}
+
+// headerProfiles are the profiles by name.
+var headerProfiles = map[string]headerProfile{
+	"minimal": {
+		keep: profileKeptHeaders,
+		// An empty User-Agent keeps Go from sending its own.
+		set: map[string]string{"User-Agent": ""},
+	},
+	"curl": {
+		keep:     append([]string{"Accept"}, profileKeptHeaders...),
+		set:      map[string]string{"User-Agent": "curl/8.5.0"},
+		defaults: map[string]string{"Accept": "*/*"},
+	},
+	"chrome": {
+		keep: append([]string{"Accept", "Accept-Language", "Origin", "Referer"}, profileKeptHeaders...),
+		set: map[string]string{
+			"User-Agent":                "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			"Sec-Ch-Ua":                 `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`,
+			"Sec-Ch-Ua-Mobile":          "?0",
+			"Sec-Ch-Ua-Platform":        `"Windows"`,
+			"Upgrade-Insecure-Requests": "1",
+		},
+		defaults: map[string]string{
+			"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8",
+			"Accept-Language": "en-US,en;q=0.9",
+		},
+	},
+}
+
+// headerProfileNames returns the names of the profiles in order, for
+// messages.
+func headerProfileNames() string {
+	names := make([]string, 0, len(headerProfiles))
+	for name := range headerProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// apply normalizes header.
+func (hp headerProfile) apply(header http.Header) {
+	kept := make(http.Header, len(hp.keep))
+	for _, name := range hp.keep {
+		if values := header.Values(name); len(values) > 0 {
+			kept[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for name := range header {
+		delete(header, name)
+	}
+	for name, values := range kept {
+		header[name] = values
+	}
+	for name, value := range hp.set {
+		header.Set(name, value)
+	}
+	for name, value := range hp.defaults {
+		if header.Get(name) == "" {
+			header.Set(name, value)
+		}
+	}
+}
+
+// routeProfiles selects the header profile of plain requests by
+// destination.
+type routeProfiles []routeProfileRule
+
+type routeProfileRule struct {
+	pattern string
+	hosts   *hostMatcher // nil for *, all destinations
+	name    string
+	profile headerProfile
+}
+
+// newRouteProfiles builds the profiles of destinations from destination
+// pattern to profile name. The most specific (longest) pattern matching a
+// host wins, * matches all others.
+func newRouteProfiles(rules map[string]string) (routeProfiles, error) {
+	routes := make(routeProfiles, 0, len(rules))
+	for pattern, name := range rules {
+		profile, ok := headerProfiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown header profile %q of %s, must be one of %s", name, pattern, headerProfileNames())
+		}
+		rule := routeProfileRule{pattern: pattern, name: name, profile: profile}
+		if pattern != "*" {
+			if strings.HasPrefix(pattern, "@") {
+				return nil, fmt.Errorf("group %s can't be used for a header profile", pattern)
+			}
+			var err error
+			if rule.hosts, err = newHostMatcher([]string{pattern}, nil); err != nil {
+				return nil, err
+			}
+		}
+		routes = append(routes, rule)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if (routes[i].hosts == nil) != (routes[j].hosts == nil) {
+			return routes[j].hosts == nil
+		}
+		if len(routes[i].pattern) != len(routes[j].pattern) {
+			return len(routes[i].pattern) > len(routes[j].pattern)
+		}
+		return routes[i].pattern < routes[j].pattern
+	})
+	return routes, nil
+}
+
+// apply normalizes the headers of req to host with its profile, if any,
+// and returns the name of the profile.
+func (rp routeProfiles) apply(req *http.Request, host string) string {
+	for _, rule := range rp {
+		if rule.hosts == nil || rule.hosts.match(host) {
+			rule.profile.apply(req.Header)
+			return rule.name
+		}
+	}
+	return ""
+}
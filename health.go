@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// healthProbeTimeout bounds a health probe of a SOCKS5 server.
+	healthProbeTimeout = 5 * time.Second
+	// healthMaxBackoff is the longest wait before a server which is down
+	// is probed again.
+	healthMaxBackoff = 5 * time.Minute
+
+	// latencyWeight is the weight of a new probe in the moving average of
+	// the latency of a server.
+	latencyWeight = 0.3
+	// fastestMargin is how much faster than the preferred server another
+	// one has to be to take over, so that routing doesn't flap between
+	// servers of about the same latency.
+	fastestMargin = 0.2
+)
+
+// markDown takes s out of rotation until a health probe succeeds again.
+func (s *upstreamServer) markDown(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.down.Load() {
+		return
+	}
+	s.down.Store(true)
+	s.downs.Add(1)
+	log.Printf("SOCKS5 server %s is down, failing over to the others: %v", s.server, err)
+}
+
+// probed records the result of a health probe, which took latency.
+// Servers failing probes are probed again with exponential backoff
+// starting at interval.
+func (s *upstreamServer) probed(err error, latency, interval time.Duration) {
+	if err != nil {
+		s.markDown(err)
+	} else if prev := s.latency.Load(); prev == 0 {
+		s.latency.Store(int64(latency))
+	} else {
+		s.latency.Store(int64(latencyWeight*float64(latency) + (1-latencyWeight)*float64(prev)))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.failures++
+		s.retryAt = time.Now().Add(min(interval<<min(s.failures-1, 16), healthMaxBackoff))
+		return
+	}
+	s.failures, s.retryAt = 0, time.Time{}
+	if s.down.Swap(false) {
+		log.Printf("SOCKS5 server %s is up again", s.server)
+	}
+}
+
+// due reports whether s is to be probed now.
+func (s *upstreamServer) due(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.After(s.retryAt)
+}
+
+// checkHealth probes the servers of the current upstream every interval
+// with a SOCKS5 handshake until ctx is done. There is nothing to fail over
+// to with a single server, so it's left alone.
+func (us *upstreams) checkHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		u := us.current.Load()
+		if len(u.servers) < 2 {
+			continue
+		}
+		tlsConfig, err := u.tlsConfig()
+		if err != nil {
+			log.Printf("health probes: %v", err)
+			continue
+		}
+		now := time.Now()
+		for _, s := range u.servers {
+			if !s.due(now) {
+				continue
+			}
+			probeCtx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+			start := time.Now()
+			err := probeSocks(probeCtx, u.via, s.socksEndpoint, tlsConfig)
+			cancel()
+			s.probed(err, time.Since(start), interval)
+		}
+		if u.balance == balanceFastest {
+			u.chooseFastest()
+		}
+	}
+}
+
+// chooseFastest prefers the server with the lowest latency which is up.
+// The preferred one keeps its place unless it went down or another is
+// faster by fastestMargin.
+func (u *upstream) chooseFastest() {
+	cur := int(u.fastest.Load())
+	best := -1
+	for i, s := range u.servers {
+		if s.reserved || s.down.Load() || s.latency.Load() == 0 {
+			continue
+		}
+		if best < 0 || s.latency.Load() < u.servers[best].latency.Load() {
+			best = i
+		}
+	}
+	if best < 0 || best == cur {
+		return
+	}
+	current := u.servers[cur]
+	if !current.down.Load() && current.latency.Load() > 0 &&
+		float64(u.servers[best].latency.Load()) > (1-fastestMargin)*float64(current.latency.Load()) {
+		return
+	}
+	u.fastest.Store(int32(best))
+	log.Printf("SOCKS5 server %s is now the fastest, handshakes taking %v", u.servers[best].server,
+		time.Duration(u.servers[best].latency.Load()).Round(time.Microsecond))
+}
+
+// unreachable reports whether err of a SOCKS5 dial means the SOCKS5 server
+// itself couldn't be reached, as opposed to the server failing to connect
+// to the destination.
+func unreachable(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	// The SOCKS5 dialer wraps errors of dialing the server, which are
+	// dial errors themselves.
+	var dialErr *net.OpError
+	return errors.As(opErr.Err, &dialErr) && dialErr.Op == "dial"
+}
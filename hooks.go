@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Hooks are called on connection events of the proxy, so applications
+// embedding it can account for traffic without parsing its logs. Hooks left
+// nil aren't called. They run on the goroutines serving the clients and
+// must not block.
+type Hooks struct {
+	// RequestStart is called when a proxy request arrives, before it is
+	// authenticated or checked against any rule.
+	RequestStart func(req *http.Request)
+
+	// RequestEnd is called when the proxy request was handled, for CONNECT
+	// requests once the tunnel was set up or refused.
+	RequestEnd func(req *http.Request, duration time.Duration)
+
+	// TunnelOpen is called when a CONNECT tunnel to target was established.
+	TunnelOpen func(req *http.Request, target string)
+
+	// TunnelClose is called when the tunnel to target was closed, with the
+	// bytes sent to and received from the destination.
+	TunnelClose func(req *http.Request, target string, sent, received int64, duration time.Duration)
+}
+
+func (h *Hooks) requestStart(req *http.Request) {
+	if h != nil && h.RequestStart != nil {
+		h.RequestStart(req)
+	}
+}
+
+func (h *Hooks) requestEnd(req *http.Request, start time.Time) {
+	if h != nil && h.RequestEnd != nil {
+		h.RequestEnd(req, time.Since(start))
+	}
+}
+
+func (h *Hooks) tunnelOpen(req *http.Request, target string) {
+	if h != nil && h.TunnelOpen != nil {
+		h.TunnelOpen(req, target)
+	}
+}
+
+func (h *Hooks) tunnelClose(req *http.Request, target string, sent, received int64, start time.Time) {
+	if h != nil && h.TunnelClose != nil {
+		h.TunnelClose(req, target, sent, received, time.Since(start))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errHostLimit = errors.New("too many simultaneous connections to host")
+
+// hostLimiter caps the number of simultaneous connections to a single
+// destination host. Excess requests wait up to the configured duration for a
+// free slot and are rejected after that.
+//
+// With shared state the limit applies to all proxy instances together. The
+// local limit is used while the shared state is unavailable.
+type hostLimiter struct {
+	limit  int
+	wait   time.Duration
+	shared *sharedState
+
+	mu    sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+type hostSlots struct {
+	sem  chan struct{}
+	refs int
+}
+
+// sharedPollInterval is how often a request waiting for a shared slot
+// retries.
+const sharedPollInterval = 100 * time.Millisecond
+
+func newHostLimiter(limit int, wait time.Duration, shared *sharedState) *hostLimiter {
+	return &hostLimiter{
+		limit:  limit,
+		wait:   wait,
+		shared: shared,
+		hosts:  make(map[string]*hostSlots),
+	}
+}
+
+// acquire reserves a connection slot for host. On success it returns a function
+// which must be called to release the slot when the connection is closed.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if l == nil || l.limit <= 0 {
+		return func() {}, nil
+	}
+
+	host = strings.ToLower(host)
+	if l.shared != nil {
+		release, err := l.acquireShared(ctx, host)
+		if err == nil || errors.Is(err, errHostLimit) || ctx.Err() != nil {
+			return release, err
+		}
+		log.Printf("shared host limit unavailable, using the local one: %v", err)
+	}
+
+	slots := l.ref(host)
+
+	select {
+	case slots.sem <- struct{}{}:
+		return l.releaseFunc(host, slots), nil
+	default:
+	}
+
+	if l.wait <= 0 {
+		l.unref(host, slots)
+		return nil, errHostLimit
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	select {
+	case slots.sem <- struct{}{}:
+		return l.releaseFunc(host, slots), nil
+	case <-timer.C:
+		l.unref(host, slots)
+		return nil, errHostLimit
+	case <-ctx.Done():
+		l.unref(host, slots)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *hostLimiter) acquireShared(ctx context.Context, host string) (func(), error) {
+	deadline := time.Now().Add(l.wait)
+	for {
+		release, ok, err := l.shared.tryAcquire(ctx, "conns:"+host, l.limit)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return release, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, errHostLimit
+		}
+
+		timer := time.NewTimer(sharedPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *hostLimiter) releaseFunc(host string, slots *hostSlots) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-slots.sem
+			l.unref(host, slots)
+		})
+	}
+}
+
+func (l *hostLimiter) ref(host string) *hostSlots {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots, ok := l.hosts[host]
+	if !ok {
+		slots = &hostSlots{sem: make(chan struct{}, l.limit)}
+		l.hosts[host] = slots
+	}
+	slots.refs++
+	return slots
+}
+
+// unref drops the host entry once nobody holds or waits for its slots, so
+// the map doesn't grow with every host ever visited.
+func (l *hostLimiter) unref(host string, slots *hostSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots.refs--
+	if slots.refs == 0 {
+		delete(l.hosts, host)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// wantsHTTP10KeepAlive reports whether req is from an HTTP/1.0 client
+// asking to keep the connection open. It must be called before the
+// Connection header is removed.
+func wantsHTTP10KeepAlive(req *http.Request) bool {
+	if req.ProtoMajor != 1 || req.ProtoMinor != 0 {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "keep-alive") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bufferHTTP10Response reads a response of unknown length up to limit
+// bytes, so it can be sent to an HTTP/1.0 client with a Content-Length.
+// HTTP/1.0 has no chunked encoding, so the end of such a response is
+// otherwise marked by closing the connection, which the client wanted to
+// keep. Longer responses are sent as they are after the buffered part.
+func bufferHTTP10Response(req *http.Request, resp *http.Response, limit int64) error {
+	if resp.ContentLength >= 0 || req.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		resp.Body = readCloser{Reader: io.MultiReader(&buf, resp.Body), Closer: resp.Body}
+		return nil
+	}
+
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(&buf)
+	resp.ContentLength = n
+	resp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
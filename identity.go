@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Ways a client identity is established.
+const (
+	identityBasic = "basic"
+	identityCert  = "cert"
+)
+
+// clientIdentity is who a client is, whichever way it authenticated: name
+// is the proxy user of Basic authentication or the common name of a
+// verified TLS client certificate, as method says, and empty for
+// anonymous clients. addr is the IP address the client connects from.
+// Rules, logs, events and QoS classes all go by it.
+type clientIdentity struct {
+	name   string
+	method string
+	addr   netip.Addr
+}
+
+func (id clientIdentity) String() string {
+	if id.name == "" {
+		return "anonymous from " + id.addr.String()
+	}
+	return id.name + " (" + id.method + ") from " + id.addr.String()
+}
+
+type identityKey struct{}
+
+// withIdentity returns ctx carrying the identity of the client.
+func withIdentity(ctx context.Context, id clientIdentity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFromContext returns the identity of the client of the request.
+func identityFromContext(ctx context.Context) (clientIdentity, bool) {
+	id, ok := ctx.Value(identityKey{}).(clientIdentity)
+	return id, ok
+}
+
+// userFromContext returns the name of the authenticated client of the
+// request, if any.
+func userFromContext(ctx context.Context) string {
+	id, _ := identityFromContext(ctx)
+	return id.name
+}
+
+// affinityKey returns what ties the client of the request to an upstream
+// server: its name when authenticated, its address otherwise.
+func affinityKey(ctx context.Context) string {
+	id, ok := identityFromContext(ctx)
+	switch {
+	case !ok:
+		return ""
+	case id.name != "":
+		return "user:" + id.name
+	default:
+		return "addr:" + id.addr.String()
+	}
+}
+
+// anonymousIdentity returns the identity of the client of req before it
+// authenticated.
+func anonymousIdentity(req *http.Request) clientIdentity {
+	addrPort, _ := netip.ParseAddrPort(req.RemoteAddr)
+	return clientIdentity{addr: addrPort.Addr().Unmap()}
+}
+
+// certIdentity returns the common name of the verified TLS client
+// certificate of req, if any.
+func certIdentity(req *http.Request) (string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// clientRule allows or denies destinations matching hosts, all of them
+// when nil, to clients whose name matches name, a pattern where * matches
+// any characters, or whose address matches addrs.
+type clientRule struct {
+	text  string
+	allow bool
+	name  string
+	addrs *hostMatcher
+	hosts *hostMatcher
+}
+
+// clientRules are checked in order and the first matching rule applies.
+// Clients matching no rule are allowed.
+type clientRules []clientRule
+
+// parseClientRules parses rules of the form "allow|deny client
+// destination", e.g. "deny 10.1.0.0/16 *.example.com" or "allow ops-* *".
+// The client is a network, an IP address or an @group reference, matched
+// against the client address, or else a pattern of client names, where *
+// alone matches all clients, anonymous ones too. The destination *
+// matches all.
+func parseClientRules(specs []string, groups map[string]string) (clientRules, error) {
+	rules := make(clientRules, 0, len(specs))
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("client rule %q: must be action, client and destination", spec)
+		}
+		action, client, host := fields[0], fields[1], fields[2]
+		if action != urlRuleAllow && action != urlRuleDeny {
+			return nil, fmt.Errorf("client rule %q: action must be %s or %s", spec, urlRuleAllow, urlRuleDeny)
+		}
+		rule := clientRule{
+			text:  strings.Join(fields, " "),
+			allow: action == urlRuleAllow,
+		}
+		if isClientNetwork(client) {
+			var err error
+			if rule.addrs, err = newHostMatcher([]string{client}, groups); err != nil {
+				return nil, fmt.Errorf("client rule %q: %w", spec, err)
+			}
+		} else {
+			rule.name = client
+		}
+		if host != "*" {
+			var err error
+			if rule.hosts, err = newHostMatcher([]string{host}, groups); err != nil {
+				return nil, fmt.Errorf("client rule %q: %w", spec, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// isClientNetwork reports whether the client of a rule is given by address
+// rather than by name.
+func isClientNetwork(client string) bool {
+	if strings.HasPrefix(client, "@") {
+		return true
+	}
+	if _, err := netip.ParsePrefix(client); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddr(client)
+	return err == nil
+}
+
+// match returns the first rule matching a request of id to host.
+func (rs clientRules) match(id clientIdentity, host string) (clientRule, bool) {
+	for _, r := range rs {
+		var client bool
+		switch {
+		case r.addrs != nil:
+			client = id.addr.IsValid() && r.addrs.match(id.addr.String())
+		case r.name == "*":
+			client = true
+		default:
+			client = id.name != "" && globMatch(r.name, id.name)
+		}
+		if client && (r.hosts == nil || r.hosts.match(host)) {
+			return r, true
+		}
+	}
+	return clientRule{}, false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientConns tracks inbound client connections and closes keep-alive
+// connections idle for longer than timeout, so file descriptor usage stays
+// predictable on busy gateways.
+type clientConns struct {
+	timeout time.Duration
+
+	mu   sync.Mutex
+	open map[net.Conn]time.Time // idle since, zero while active
+
+	reaped atomic.Int64
+}
+
+func newClientConns(timeout time.Duration) *clientConns {
+	return &clientConns{
+		timeout: timeout,
+		open:    make(map[net.Conn]time.Time),
+	}
+}
+
+// connState is used as http.Server.ConnState. Hijacked connections are
+// tunnels and no longer tracked.
+func (c *clientConns) connState(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch state {
+	case http.StateNew, http.StateActive:
+		c.open[conn] = time.Time{}
+	case http.StateIdle:
+		c.open[conn] = time.Now()
+	case http.StateHijacked, http.StateClosed:
+		delete(c.open, conn)
+	}
+}
+
+// run closes idle connections until ctx is done. It returns right away
+// when reaping is disabled.
+func (c *clientConns) run(ctx context.Context) {
+	if c.timeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(max(c.timeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.reap()
+		}
+	}
+}
+
+func (c *clientConns) reap() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for conn, idleSince := range c.open {
+		if !idleSince.IsZero() && now.Sub(idleSince) > c.timeout {
+			_ = conn.Close()
+			delete(c.open, conn)
+			c.reaped.Add(1)
+		}
+	}
+}
+
+func (c *clientConns) counts() (open, idle int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, idleSince := range c.open {
+		if !idleSince.IsZero() {
+			idle++
+		}
+	}
+	return len(c.open), idle
+}
+
+func (c *clientConns) writeMetrics(pw metricsWriter) {
+	if c == nil {
+		return
+	}
+	open, idle := c.counts()
+	pw.gauge("http2socks_client_conns_open", "Open client connections, excluding CONNECT tunnels.", float64(open))
+	pw.gauge("http2socks_client_conns_idle", "Idle keep-alive client connections.", float64(idle))
+	pw.counter("http2socks_client_conns_reaped_total", "Idle client connections closed by the proxy.", c.reaped.Load())
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// integrityRuleSpec is a rule of the integrity rules file.
+type integrityRuleSpec struct {
+	Destination string   `json:"destination"`
+	Path        string   `json:"path"`
+	SHA256      string   `json:"sha256"`
+	SPKIPins    []string `json:"spki_pins"`
+}
+
+// integrityRule verifies responses of plain HTTP requests to destinations
+// matching hosts whose path matches path: their body against a SHA-256
+// checksum and the certificate chain of https origins against SPKI pins.
+type integrityRule struct {
+	hosts  *hostMatcher
+	path   string
+	sum    []byte
+	pins   [][]byte
+	source string
+}
+
+// integrityRules fail responses closed which don't pass the first rule
+// matching their request. Bodies with a checksum are buffered with spool
+// until they are verified.
+type integrityRules struct {
+	rules []integrityRule
+	spool *spooler
+
+	verified atomic.Int64
+	failed   atomic.Int64
+}
+
+var errIntegrity = errors.New("response integrity check failed")
+
+// loadIntegrityRules reads a JSON array of rules.
+func loadIntegrityRules(file string, groups map[string]string, spool *spooler) (*integrityRules, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var specs []integrityRuleSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	ir := &integrityRules{spool: spool}
+	for i, spec := range specs {
+		rule, err := newIntegrityRule(spec, groups)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", file, i+1, err)
+		}
+		ir.rules = append(ir.rules, rule)
+	}
+	return ir, nil
+}
+
+func newIntegrityRule(spec integrityRuleSpec, groups map[string]string) (integrityRule, error) {
+	rule := integrityRule{path: spec.Path, source: spec.Destination + spec.Path}
+	if rule.path == "" {
+		rule.path = "/*"
+	}
+	if !strings.HasPrefix(rule.path, "/") {
+		return integrityRule{}, fmt.Errorf("path must start with /")
+	}
+	hosts, err := newHostMatcher([]string{spec.Destination}, groups)
+	if err != nil {
+		return integrityRule{}, err
+	}
+	if hosts.empty() {
+		return integrityRule{}, fmt.Errorf("destination must be set")
+	}
+	rule.hosts = hosts
+
+	if spec.SHA256 != "" {
+		rule.sum, err = hex.DecodeString(spec.SHA256)
+		if err != nil || len(rule.sum) != sha256.Size {
+			return integrityRule{}, fmt.Errorf("sha256 must be 64 hex digits")
+		}
+	}
+	for _, pin := range spec.SPKIPins {
+		raw, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(raw) != sha256.Size {
+			return integrityRule{}, fmt.Errorf("SPKI pin %q must be a base64 SHA-256 digest", pin)
+		}
+		rule.pins = append(rule.pins, raw)
+	}
+	if rule.sum == nil && len(rule.pins) == 0 {
+		return integrityRule{}, fmt.Errorf("sha256 or spki_pins must be set")
+	}
+	return rule, nil
+}
+
+func (ir *integrityRules) match(host string, u *url.URL) *integrityRule {
+	if ir == nil {
+		return nil
+	}
+	for i := range ir.rules {
+		if ir.rules[i].hosts.match(host) && matchURLPath(ir.rules[i].path, u) {
+			return &ir.rules[i]
+		}
+	}
+	return nil
+}
+
+// verify checks resp against rule. With a checksum the body is read to
+// its end, and the returned body replaces resp.Body, which is closed.
+// Responses to HEAD requests and 304 responses carry no body to check;
+// any other status than 200 fails a checksum.
+func (ir *integrityRules) verify(rule *integrityRule, req *http.Request, resp *http.Response) (io.ReadCloser, error) {
+	body, err := ir.check(rule, req, resp)
+	if err != nil {
+		ir.failed.Add(1)
+		return nil, err
+	}
+	ir.verified.Add(1)
+	return body, nil
+}
+
+func (ir *integrityRules) check(rule *integrityRule, req *http.Request, resp *http.Response) (io.ReadCloser, error) {
+	if len(rule.pins) > 0 {
+		if resp.TLS == nil {
+			return nil, fmt.Errorf("%w: %s pins certificates, but the origin wasn't reached over TLS", errIntegrity, rule.source)
+		}
+		if !pinned(resp.TLS.PeerCertificates, rule.pins) {
+			return nil, fmt.Errorf("%w: no certificate of the origin matches the SPKI pins of %s", errIntegrity, rule.source)
+		}
+	}
+
+	if rule.sum == nil || req.Method == http.MethodHead || resp.StatusCode == http.StatusNotModified {
+		return resp.Body, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s requires a checksum, but the origin answered %s", errIntegrity, rule.source, resp.Status)
+	}
+
+	h := sha256.New()
+	spooled, err := ir.spool.spool(io.TeeReader(resp.Body, h))
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading the body: %v", errIntegrity, err)
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, rule.sum) {
+		spooled.close()
+		return nil, fmt.Errorf("%w: SHA-256 %x of the body doesn't match %s", errIntegrity, sum, rule.source)
+	}
+	return spooledReadCloser{ReadCloser: spooled.reader(), body: spooled}, nil
+}
+
+// pinned reports whether the public key of any certificate in chain has
+// one of the SHA-256 digests in pins.
+func pinned(chain []*x509.Certificate, pins [][]byte) bool {
+	for _, cert := range chain {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spooledReadCloser removes the spooled body once it has been read.
+type spooledReadCloser struct {
+	io.ReadCloser
+	body *spooledBody
+}
+
+func (r spooledReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.body.close()
+	return err
+}
+
+func (ir *integrityRules) writeMetrics(pw metricsWriter) {
+	if ir == nil {
+		return
+	}
+	pw.counter("http2socks_integrity_verified_total", "Responses which passed integrity rules.", ir.verified.Load())
+	pw.counter("http2socks_integrity_failed_total", "Responses failed closed by integrity rules.", ir.failed.Load())
+}
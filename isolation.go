@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// Values of socks_isolation.
+const (
+	isolateNone        = "none"
+	isolateDestination = "destination"
+	isolateClient      = "client"
+)
+
+// isolatingDialer connects through a SOCKS5 server without credentials
+// with ones derived per destination host or per client instead, so Tor,
+// which isolates streams by them, uses separate circuits for each.
+type isolatingDialer struct {
+	network string
+	addr    string
+	by      string
+	forward proxy.Dialer
+}
+
+func (d isolatingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d isolatingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	key := isolationKey(ctx, d.by, addr)
+	dialer, err := proxy.SOCKS5(d.network, d.addr, &proxy.Auth{User: key, Password: key}, d.forward)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr) //nolint:errcheck // SOCKS5 dialers implement it
+}
+
+// isolationKey returns the credentials of connections to addr with ctx:
+// a hash of the destination host or of the client address, so neither is
+// sent in them.
+func isolationKey(ctx context.Context, by, addr string) string {
+	var s string
+	switch by {
+	case isolateDestination:
+		s, _, _ = net.SplitHostPort(addr)
+	case isolateClient:
+		if session := sessionFromContext(ctx); session != nil {
+			s, _, _ = net.SplitHostPort(session.client)
+		}
+	}
+	sum := sha256.Sum256([]byte(by + " " + s))
+	return hex.EncodeToString(sum[:16])
+}
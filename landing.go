@@ -0,0 +1,118 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>http2socks</title>
+</head>
+<body>
+<h1>http2socks</h1>
+<p>This is an HTTP proxy server, it isn't meant to be opened in a browser.
+Configure your browser or system to use it as a proxy{{if .PACURL}}, or point
+automatic proxy configuration at <a href="{{.PACURL}}">{{.PACURL}}</a>{{end}}.</p>
+<h2>Status</h2>
+<ul>
+{{if .Details}}<li>Uptime: {{.Uptime}}</li>
+<li>Upstream: {{.Upstream}} &mdash; {{.Health}}</li>
+{{else}}<li>Upstream: {{.Health}}</li>
+{{end}}</ul>
+{{if and (not .Details) .SignIn}}<p><a href="/?details">Sign in</a> for details.</p>
+{{end}}</body>
+</html>
+`))
+
+type landingData struct {
+	PACURL string
+	Health string
+	// Details are shown to authenticated clients only, SignIn tells
+	// others they can authenticate.
+	Details  bool
+	SignIn   bool
+	Uptime   time.Duration
+	Upstream string
+}
+
+// handleLanding explains what this is to someone who opens the proxy
+// address in a browser. The upstream servers and errors are only shown to
+// authenticated clients.
+func (p *forwardProxy) handleLanding(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		http.Error(w, "this is a proxy server, requests must use an absolute URL", http.StatusBadRequest)
+		return
+	}
+
+	data := landingData{
+		Health:  "no connections made yet",
+		Details: p.landingDetails(req),
+		SignIn:  p.users != nil,
+	}
+	if !data.Details && data.SignIn && req.URL.Query().Has("details") {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`"`)
+		http.Error(w, errAuthRequired.Error(), http.StatusUnauthorized)
+		return
+	}
+	if p.pacPath != "" {
+		data.PACURL = "http://" + req.Host + p.pacPath
+	}
+	u := p.upstreams.current.Load()
+	if last := u.lastDial.Load(); last != nil {
+		ago := time.Since(last.time).Round(time.Second)
+		switch {
+		case !data.Details && last.err != nil:
+			data.Health = "unavailable"
+		case !data.Details:
+			data.Health = "OK"
+		case last.err != nil:
+			data.Health = "last connection failed " + ago.String() + " ago: " + last.err.Error()
+		default:
+			data.Health = "OK, last connection " + ago.String() + " ago"
+		}
+	}
+	if data.Details {
+		data.Uptime = time.Since(p.stats.started).Round(time.Second)
+		data.Upstream = u.addresses()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(w, data); err != nil {
+		log.Printf("landing page error: %+v", err)
+	}
+}
+
+// landingDetails reports whether the client of req is authenticated for
+// the details of the landing page: by a verified client certificate, as
+// proxy user (with Proxy-Authorization or, from browsers, Authorization)
+// or with an admin token.
+func (p *forwardProxy) landingDetails(req *http.Request) bool {
+	if _, ok := certIdentity(req); ok {
+		return true
+	}
+	if p.adminAuth != nil {
+		if _, ok := p.adminAuth.role(req); ok {
+			return true
+		}
+	}
+	if p.users == nil {
+		return false
+	}
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" {
+		header = req.Header.Get("Authorization")
+	}
+	if !strings.HasPrefix(header, "Basic ") {
+		return false
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set("Proxy-Authorization", header)
+	_, err := p.users.authenticate(r)
+	return err == nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// acceptMinBackoff is the first pause of accepting after the process
+	// ran out of file descriptors, doubled while it stays out of them.
+	acceptMinBackoff = 5 * time.Millisecond
+	// acceptQueued is how short an accept is taken to have found a
+	// connection already waiting in the backlog.
+	acceptQueued = time.Millisecond
+	// acceptLogInterval is how often running out of file descriptors is
+	// logged.
+	acceptLogInterval = 10 * time.Second
+)
+
+// acceptListener instruments the accept loop of the proxy listener. When
+// the process runs out of file descriptors, accepting is paused with
+// backoff up to maxBackoff until some are closed again, instead of the
+// error ending the server; connections meanwhile wait in the backlog.
+// Before it gets there, budget refuses new connections, with a 503
+// response when respond is set (it isn't for TLS).
+type acceptListener struct {
+	net.Listener
+	maxBackoff time.Duration
+	budget     *fdBudget
+	respond    bool
+
+	accepted  atomic.Int64
+	queued    atomic.Int64
+	wait      atomic.Int64 // nanoseconds
+	errors    atomic.Int64
+	exhausted atomic.Int64
+	throttled atomic.Int64 // nanoseconds
+	lastLog   atomic.Int64 // unix nanoseconds
+}
+
+func newAcceptListener(ln net.Listener, maxBackoff time.Duration, budget *fdBudget, respond bool) *acceptListener {
+	return &acceptListener{Listener: ln, maxBackoff: maxBackoff, budget: budget, respond: respond}
+}
+
+func (l *acceptListener) Accept() (net.Conn, error) {
+	var backoff time.Duration
+	for {
+		start := time.Now()
+		conn, err := l.Listener.Accept()
+		if err == nil {
+			wait := time.Since(start)
+			l.accepted.Add(1)
+			l.wait.Add(int64(wait))
+			if wait < acceptQueued {
+				l.queued.Add(1)
+			}
+			if l.budget.exhausted() {
+				l.budget.refuse(conn, l.respond)
+				backoff = 0
+				continue
+			}
+			return conn, nil
+		}
+
+		l.errors.Add(1)
+		if !errors.Is(err, syscall.EMFILE) && !errors.Is(err, syscall.ENFILE) {
+			return nil, err
+		}
+		l.exhausted.Add(1)
+		backoff = min(max(2*backoff, acceptMinBackoff), l.maxBackoff)
+		if now := time.Now().UnixNano(); now-l.lastLog.Load() >= int64(acceptLogInterval) {
+			l.lastLog.Store(now)
+			log.Printf("accept: out of file descriptors, pausing accepts for %v (%d times so far): %v", backoff, l.exhausted.Load(), err)
+		}
+		time.Sleep(backoff)
+		l.throttled.Add(int64(backoff))
+	}
+}
+
+func (l *acceptListener) writeMetrics(pw metricsWriter) {
+	if l == nil {
+		return
+	}
+
+	pw.counter("http2socks_accepts_total", "Client connections accepted.", l.accepted.Load())
+	pw.counter("http2socks_accepts_queued_total", "Client connections which were already waiting in the listen backlog when accepted.", l.queued.Load())
+	pw.header("http2socks_accept_wait_seconds_total", "counter", "Time the accept loop waited for client connections.")
+	pw.sample("http2socks_accept_wait_seconds_total", nil, time.Duration(l.wait.Load()).Seconds())
+	pw.counter("http2socks_accept_errors_total", "Failed accepts of client connections.", l.errors.Load())
+	pw.counter("http2socks_accept_fd_exhausted_total", "Accepts which failed because the process ran out of file descriptors.", l.exhausted.Load())
+	pw.header("http2socks_accept_throttled_seconds_total", "counter", "Time accepting was paused after running out of file descriptors.")
+	pw.sample("http2socks_accept_throttled_seconds_total", nil, time.Duration(l.throttled.Load()).Seconds())
+	if queued, ok := listenBacklog(l.Addr()); ok {
+		pw.gauge("http2socks_accept_backlog", "Connections waiting in the listen backlog.", float64(queued))
+	}
+}
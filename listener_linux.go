@@ -0,0 +1,47 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tcpListen is the state of listening sockets in /proc/net/tcp.
+const tcpListen = "0A"
+
+// listenBacklog returns how many connections wait in the backlog of the
+// listening socket on addr, which /proc/net/tcp lists as the receive queue
+// of listening sockets.
+func listenBacklog(addr net.Addr) (int, bool) {
+	tcpAddr, isTCP := addr.(*net.TCPAddr)
+	if !isTCP {
+		return 0, false
+	}
+	want := netip.AddrPortFrom(tcpAddr.AddrPort().Addr().Unmap(), tcpAddr.AddrPort().Port())
+
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 5 || fields[3] != tcpListen || procNetAddr(fields[1]) != want {
+				continue
+			}
+			_, rx, _ := strings.Cut(fields[4], ":")
+			queued, err := strconv.ParseInt(rx, 16, 64)
+			_ = f.Close()
+			return int(queued), err == nil
+		}
+		_ = f.Close()
+	}
+	return 0, false
+}
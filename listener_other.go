@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// listenBacklog is only known on Linux.
+func listenBacklog(net.Addr) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// certReloadInterval is how often the files of the listener certificates
+// are checked for changes.
+const certReloadInterval = 30 * time.Second
+
+// listenerCerts are the certificates of the proxy listener. Handshakes get
+// the first one valid for the server name (SNI) the client asks for, or
+// the default certificate of tls_cert_file. Certificates are loaded again
+// when their files change, so renewed ones are served without a restart.
+// Files are checked every certReloadInterval and when check is signaled.
+type listenerCerts struct {
+	certs    []*listenerCert
+	stapling bool
+	client   func() (*http.Client, error)
+	check    chan struct{}
+
+	reloads      atomic.Int64
+	reloadErrors atomic.Int64
+}
+
+// listenerCert is a certificate of the listener and its files.
+type listenerCert struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+
+	loaded atomic.Pointer[loadedCert]
+}
+
+// loadedCert is a certificate as loaded from its files, with the stapler
+// of its OCSP responses, if any, which runs until cancel is called.
+type loadedCert struct {
+	cert   tls.Certificate
+	ocsp   *ocspStapler
+	cancel context.CancelFunc
+}
+
+// current returns the certificate with its latest OCSP staple.
+func (lc *loadedCert) current() *tls.Certificate {
+	if lc.ocsp != nil {
+		return lc.ocsp.current.Load()
+	}
+	return &lc.cert
+}
+
+// newListenerCerts loads tls_cert_file and the certificates of
+// tls_certificates. OCSP responses are fetched with client once run.
+func newListenerCerts(cfg *Config, client func() (*http.Client, error)) (*listenerCerts, error) {
+	lcs := &listenerCerts{
+		certs:    []*listenerCert{{certFile: cfg.TLSCertFile, keyFile: cfg.TLSKeyFile}},
+		stapling: cfg.TLSOcspStapling,
+		client:   client,
+		check:    make(chan struct{}, 1),
+	}
+	// The map has no order, the files are sorted to keep the choice
+	// between certificates for the same name stable.
+	files := make([]string, 0, len(cfg.TLSCertificates))
+	for certFile := range cfg.TLSCertificates {
+		files = append(files, certFile)
+	}
+	slices.Sort(files)
+	for _, certFile := range files {
+		lcs.certs = append(lcs.certs, &listenerCert{certFile: certFile, keyFile: cfg.TLSCertificates[certFile]})
+	}
+
+	for _, lc := range lcs.certs {
+		loaded, modTime, err := lcs.load(lc)
+		if err != nil {
+			return nil, err
+		}
+		lc.loaded.Store(loaded)
+		lc.modTime = modTime
+	}
+	return lcs, nil
+}
+
+// load reads the files of lc.
+func (lcs *listenerCerts) load(lc *listenerCert) (*loadedCert, time.Time, error) {
+	modTime, err := certModTime(lc.certFile, lc.keyFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cert, err := tls.LoadX509KeyPair(lc.certFile, lc.keyFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// Matching server names needs the parsed certificate.
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	loaded := &loadedCert{cert: cert}
+	if lcs.stapling {
+		if loaded.ocsp, err = newOCSPStapler(lc.certFile, cert, lcs.client); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return loaded, modTime, nil
+}
+
+// certModTime returns the latest modification time of the files.
+func certModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate.
+func (lcs *listenerCerts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, lc := range lcs.certs {
+		if cert := lc.loaded.Load().current(); hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return lcs.certs[0].loaded.Load().current(), nil
+}
+
+// run keeps the OCSP staples fresh and reloads changed certificates until
+// ctx is done.
+func (lcs *listenerCerts) run(ctx context.Context) {
+	for _, lc := range lcs.certs {
+		lcs.start(ctx, lc.loaded.Load())
+	}
+
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-lcs.check:
+		}
+		for _, lc := range lcs.certs {
+			lcs.reload(ctx, lc)
+		}
+	}
+}
+
+// checkNow has the files checked for changes right away, e.g. after a
+// renewal, instead of with the next interval.
+func (lcs *listenerCerts) checkNow() {
+	select {
+	case lcs.check <- struct{}{}:
+	default:
+	}
+}
+
+// start runs the OCSP stapler of loaded.
+func (lcs *listenerCerts) start(ctx context.Context, loaded *loadedCert) {
+	if loaded.ocsp == nil {
+		return
+	}
+	ctx, loaded.cancel = context.WithCancel(ctx)
+	go loaded.ocsp.run(ctx)
+}
+
+// reload loads lc again when its files changed. A certificate which fails
+// to load, e.g. while only one of the files was replaced yet, is kept and
+// tried again next time.
+func (lcs *listenerCerts) reload(ctx context.Context, lc *listenerCert) {
+	modTime, err := certModTime(lc.certFile, lc.keyFile)
+	if err == nil && modTime.Equal(lc.modTime) {
+		return
+	}
+	loaded, modTime, err := lcs.load(lc)
+	if err != nil {
+		lcs.reloadErrors.Add(1)
+		log.Printf("reloading TLS certificate %s failed, keeping the previous one: %v", lc.certFile, err)
+		return
+	}
+
+	lcs.start(ctx, loaded)
+	if old := lc.loaded.Swap(loaded); old.cancel != nil {
+		old.cancel()
+	}
+	lc.modTime = modTime
+	lcs.reloads.Add(1)
+	log.Printf("reloaded TLS certificate %s, valid until %v", lc.certFile, loaded.cert.Leaf.NotAfter)
+}
+
+func (lcs *listenerCerts) writeMetrics(pw metricsWriter) {
+	pw.counter("http2socks_tls_cert_reloads_total", "Listener certificates loaded again after their files changed.", lcs.reloads.Load())
+	pw.counter("http2socks_tls_cert_reload_errors_total", "Listener certificates which failed to load again.", lcs.reloadErrors.Load())
+
+	var staplers []*ocspStapler
+	for _, lc := range lcs.certs {
+		if s := lc.loaded.Load().ocsp; s != nil {
+			staplers = append(staplers, s)
+		}
+	}
+	writeOCSPMetrics(pw, staplers)
+}
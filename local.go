@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+)
+
+// newLocalHandler returns the handler of requests addressed to the proxy
+// itself (origin-form requests like "GET /proxy.pac") rather than proxied
+// to a destination.
+func newLocalHandler(p *forwardProxy, pacPath string, wpad bool) http.Handler {
+	mux := http.NewServeMux()
+	if pacPath != "" {
+		mux.HandleFunc(pacPath, p.handlePAC)
+	}
+	if wpad && pacPath != wpadPath {
+		mux.HandleFunc(wpadPath, p.handlePAC)
+	}
+	mux.HandleFunc("/", p.handleLanding)
+	return mux
+}
+
+// wpadPath is where WPAD clients look for the PAC file.
+const wpadPath = "/wpad.dat"
+
+// newWPADHandler returns the handler of the dedicated WPAD listener. It
+// serves nothing but the PAC file.
+func newWPADHandler(p *forwardProxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(wpadPath, p.handlePAC)
+	return mux
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of log lines.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// jsonLogLine is a log message in JSON logs. The session ID of session
+// loggers is split from the message.
+type jsonLogLine struct {
+	Time    string `json:"time"`
+	Session string `json:"session,omitempty"`
+	Message string `json:"message"`
+}
+
+// jsonLogWriter turns the messages of the standard logger, which must not
+// add date or time itself, into JSON objects, one per line.
+type jsonLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line := jsonLogLine{Message: strings.TrimSuffix(string(p), "\n")}
+	if rest, ok := strings.CutPrefix(line.Message, "["); ok {
+		if id, msg, ok := strings.Cut(rest, "] "); ok {
+			line.Session, line.Message = id, msg
+		}
+	}
+	data, err := json.Marshal(w.stamp(line))
+	if err != nil {
+		return 0, err
+	}
+	if err := w.writeLine(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeObject writes message with the fields of the JSON object data.
+func (w *jsonLogWriter) writeObject(message string, data []byte) error {
+	head, err := json.Marshal(w.stamp(jsonLogLine{Message: message}))
+	if err != nil {
+		return err
+	}
+	if len(data) > 2 {
+		head = append(append(head[:len(head)-1], ','), data[1:]...)
+	}
+	return w.writeLine(head)
+}
+
+func (w *jsonLogWriter) stamp(line jsonLogLine) jsonLogLine {
+	line.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	return line
+}
+
+func (w *jsonLogWriter) writeLine(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.w.Write(append(data, '\n'))
+	return err
+}
+
+// setLogFormat switches the standard logger to format.
+func setLogFormat(format string) {
+	if format != logFormatJSON {
+		return
+	}
+	log.SetFlags(0)
+	log.SetOutput(&jsonLogWriter{w: log.Writer()})
+}
+
+// logEvent logs v, which marshals to a JSON object, as message: in JSON
+// logs with its fields next to the message, in text logs after it.
+func logEvent(message string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("%s: %v", message, err)
+		return
+	}
+	if w, ok := log.Writer().(*jsonLogWriter); ok {
+		if err := w.writeObject(message, data); err == nil {
+			return
+		}
+	}
+	log.Printf("%s %s", message, data)
+}
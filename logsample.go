@@ -0,0 +1,15 @@
+package main
+
+// logSampler decides which requests are logged in detail, with request and
+// response headers, so debugging data can be collected in production
+// without logging every request in full.
+type logSampler struct {
+	rate  float64
+	hosts *hostMatcher
+}
+
+// detailed reports whether a request to host is logged in detail. Requests
+// to the configured hosts always are, others with the configured rate.
+func (s logSampler) detailed(host string) bool {
+	return s.hosts.match(host) || chance(s.rate)
+}
@@ -6,12 +6,24 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -69,16 +81,306 @@ func appendHostToXForwardHeader(header http.Header, host string) {
 }
 
 type forwardProxy struct {
-	SocksServer   string
-	SocksUser     string
-	SocksPassword string
+	upstreams *upstreams
+
+	// chaos injects faults into connections to the SOCKS server when set.
+	chaos *chaos
+
+	// rebind checks the addresses of destinations resolved on this host
+	// when set.
+	rebind *rebindGuard
+
+	// fallback connects directly while the upstream is down when set.
+	fallback *directFallback
+
+	// router connects to destinations routed direct and blocks those
+	// routed to be blocked, nil without routing rules.
+	router *router
+
+	// pac routes requests to destinations no routing rule matches by a
+	// PAC file when one is set.
+	pac *pacRouter
+
+	// aliases canonicalizes destination names for rules.
+	aliases *hostAliases
+
+	// startup holds requests back until the upstream was first reachable,
+	// nil when they aren't.
+	startup *startupGate
+
+	// breaker fails connections fast while the upstream is failing, nil
+	// when disabled.
+	breaker *circuitBreaker
+
+	users        *proxyUsers
+	hostLimit    *hostLimiter
+	blocked      *hostMatcher
+	blocklist    *blocklist
+	urlRules     urlRules
+	connectPorts *connectPorts
+	policy       *policy
+
+	// adminAuth lets admin API clients see details of the landing page.
+	adminAuth *adminAuth
+
+	// processTagging looks up the local process of clients, which
+	// processRules apply to.
+	processTagging bool
+	processRules   processRules
+
+	// clientRules apply to clients by their identity.
+	clientRules clientRules
+
+	categories        *categories
+	blockedCategories map[string]struct{}
+	costs             *costEstimator
+	bandwidth         *domainBandwidth
+
+	events *eventSink[accessEvent]
+	stats  *proxyStats
+
+	// tunnelRecords publishes start and end records of CONNECT tunnels
+	// when set.
+	tunnelRecords *eventSink[tunnelRecord]
+
+	// hooks are called on requests and tunnels when set.
+	hooks *Hooks
+
+	// tls is the TLS config of the proxy listener, nil for plain HTTP.
+	tls *listenerTLS
+
+	// pacing smooths bulk transfers, nil when disabled. Its rate is shared
+	// by the QoS classes of qos.
+	pacing *pacing
+	qos    *qosClassifier
+
+	// dscp marks connections to the SOCKS server per QoS class.
+	dscp dscpMarks
+
+	// logSampler selects requests logged with headers.
+	logSampler logSampler
+
+	// serverTiming adds a Server-Timing header to proxied responses.
+	serverTiming bool
+
+	// http10BufferSize is how much of a response of unknown length is
+	// buffered for HTTP/1.0 keep-alive clients.
+	http10BufferSize int64
+
+	// limits are the rate limits, quotas and authentication lockouts of
+	// clients, nil when disabled.
+	limits *clientLimits
+
+	// shared is the state shared with other instances, nil when the
+	// instance is standalone.
+	shared *sharedState
+
+	// spool buffers request bodies of the plain path, nil when disabled.
+	spool *spooler
+
+	// cache answers requests of the plain path with stored responses, nil
+	// when disabled.
+	cache *responseCache
+
+	// signer signs requests of the plain path, nil without rules.
+	signer *requestSigner
+
+	// integrity verifies responses of the plain path, nil without rules.
+	integrity *integrityRules
+
+	// retries limits retries of failed uploads, of which each gets up to
+	// uploadRetries, and of throttled requests waiting up to retryAfterMax.
+	retries       *retryBudget
+	uploadRetries int
+	retryAfterMax time.Duration
+
+	// dialRetries is how often upstream dials are retried within
+	// dialRetryWindow, taking from the retry budget too.
+	dialRetries     int
+	dialRetryWindow time.Duration
+
+	// connMap logs connections to the SOCKS server with their client, nil
+	// when disabled.
+	connMap *connMapLog
+
+	// upstreamClient is built on first use and again after the upstream
+	// changed. Its connection pools keep up to maxIdleConns idle
+	// connections, maxIdleConnsPerHost per destination, for
+	// idleConnTimeout.
+	upstreamClient      atomic.Pointer[upstreamClient]
+	upstreamClientMu    sync.Mutex
+	recycler            *poolRecycler
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+
+	// requestTimeout bounds plain requests through the upstream and
+	// responseHeaderTimeout their wait for the response headers.
+	// tunnelDialTimeout bounds establishing CONNECT tunnels, which are
+	// closed after tunnelMaxLifetime. Zero means no limit.
+	requestTimeout        time.Duration
+	responseHeaderTimeout time.Duration
+	tunnelDialTimeout     time.Duration
+	tunnelMaxLifetime     time.Duration
+
+	// warmConns SOCKS5 connections per server are negotiated ahead of
+	// time and kept for up to warmMaxAge.
+	warmConns  int
+	warmMaxAge time.Duration
+
+	// socksAuth tracks rejections of the SOCKS5 credentials.
+	socksAuth *socksAuthGuard
+
+	// credentials reloads the upstream when the SOCKS5 credentials file
+	// changed, nil without one.
+	credentials *credentialsWatcher
+
+	// healthInterval is how often SOCKS5 servers are probed, zero when
+	// they aren't and unreachable ones stay in rotation.
+	healthInterval time.Duration
+
+	// clients tracks inbound connections and reaps idle ones.
+	clients *clientConns
+
+	// listener instruments accepting client connections, fds keeps file
+	// descriptors in reserve for established connections. fds is nil when
+	// the limit isn't known.
+	listener *acceptListener
+	fds      *fdBudget
+
+	// serverNames overrides the SNI of https origins, nil when none are
+	// configured.
+	serverNames serverNames
+
+	// headerProfiles normalizes the headers of plain requests by
+	// destination.
+	headerProfiles routeProfiles
+
+	// local serves requests addressed to the proxy itself.
+	local           http.Handler
+	pacPath         string
+	pacProxyAddress string
+}
+
+// deny applies the policy to a request denied by rule and publishes the
+// decision. It reports whether the request has to be blocked.
+func (p *forwardProxy) deny(logger *log.Logger, req *http.Request, rule, host string) bool {
+	block := p.policy.block(logger, rule, host)
+	decision := decisionDeny
+	if !block {
+		decision = decisionAudit
+	}
+	p.events.publish(newAccessEvent(req, host, decision, rule))
+	return block
+}
+
+// authenticate checks the proxy credentials of req unless its client
+// address is locked out after failed attempts, which are counted. It
+// returns the user, or when the lockout ends with errAuthLockout. host is
+// the destination of the request, if known.
+func (p *forwardProxy) authenticate(logger *log.Logger, req *http.Request, host string) (string, time.Time, error) {
+	addr := anonymousIdentity(req).addr.String()
+	if until, lockErr := p.limits.locked(req.Context(), addr); lockErr != nil && p.deny(logger, req, "auth lockout", host) {
+		return "", until, lockErr
+	}
+	user, err := p.users.authenticate(req)
+	if err != nil {
+		if !errors.Is(err, errAuthRequired) {
+			p.limits.authFailed(req.Context(), addr)
+		}
+		p.events.publish(newAccessEvent(req, host, decisionDeny, "proxy authentication"))
+		return "", time.Time{}, err
+	}
+	return user, time.Time{}, nil
 }
 
 func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logger := sessionLogger(req.Context())
+
 	// The "Host:" header is promoted to Request.Host and is removed from
 	// request.Header by net/http, so we print it out explicitly.
-	log.Printf("%s\t%s\t%s\tHost: %s\n", req.RemoteAddr, req.Method, req.URL, req.Host)
-	log.Println("\t", req.Header)
+	logger.Printf("%s\t%s\t%s\tHost: %s\n", req.RemoteAddr, req.Method, req.URL, req.Host)
+	host, _, _ := normalizeHost(req.URL.Hostname())
+	detailed := p.logSampler.detailed(host)
+	if detailed {
+		logger.Println("\t", req.Header)
+	}
+
+	var process clientProcess
+	if p.processTagging {
+		if process = processOf(req.Context()); process.name != "" {
+			logger.Printf("process: %v", process)
+		}
+	}
+
+	if req.Method != http.MethodConnect && !req.URL.IsAbs() {
+		p.local.ServeHTTP(w, req)
+		return
+	}
+	p.stats.requestsTotal.Add(1)
+	if sessionRequest(req.Context()) {
+		p.stats.requestsReused.Add(1)
+	}
+	start := time.Now()
+	p.hooks.requestStart(req)
+	// The hook sees the request as it was last handled, with its identity.
+	defer func() { p.hooks.requestEnd(req, start) }()
+
+	// A verified client certificate authenticates the client as well as
+	// proxy credentials do.
+	identity := anonymousIdentity(req)
+	if name, ok := certIdentity(req); ok {
+		identity.name, identity.method = name, identityCert
+	} else if id, ok := identityFromContext(req.Context()); ok {
+		// The SOCKS5 listener authenticated the client in its negotiation.
+		identity = id
+	} else if p.users != nil {
+		user, until, authErr := p.authenticate(logger, req, host)
+		if authErr != nil {
+			logger.Println(authErr)
+			p.stats.countError(errorAuth)
+			if errors.Is(authErr, errAuthLockout) {
+				p.tooManyRequests(w, authErr, until)
+			} else {
+				requireAuth(w)
+			}
+			return
+		}
+		identity.name, identity.method = user, identityBasic
+	}
+	req = req.WithContext(withIdentity(req.Context(), identity))
+	if identity.name != "" {
+		logger.Printf("client: %v", identity)
+	}
+	if until, limitErr := p.limits.allow(req.Context(), affinityKey(req.Context())); limitErr != nil {
+		rule := "rate limit"
+		if errors.Is(limitErr, errQuota) {
+			rule = "transfer quota"
+		}
+		if p.deny(logger, req, rule, host) {
+			logger.Println(limitErr)
+			p.stats.countError(errorLimit)
+			p.tooManyRequests(w, limitErr, until)
+			return
+		}
+	}
+
+	if server, selectErr := p.selectUpstream(req, identity); errors.Is(selectErr, errSelectNeedsAuth) && p.users != nil {
+		p.stats.countError(errorAuth)
+		requireAuth(w)
+		return
+	} else if selectErr != nil {
+		p.stats.countError(errorBadRequest)
+		http.Error(w, selectErr.Error(), http.StatusBadRequest)
+		logger.Println(selectErr)
+		return
+	} else if server != "" {
+		req = req.WithContext(withSelectedServer(req.Context(), server))
+		logger.Printf("upstream server %s selected by the client", server)
+	} else if server := p.upstreams.current.Load().userServer(identity.name); server != "" {
+		req = req.WithContext(withSelectedServer(req.Context(), server))
+		logger.Printf("upstream server %s of user %s", server, identity.name)
+	}
 
 	if req.URL.Scheme == "" {
 		if req.URL.Port() == "443" {
@@ -90,21 +392,152 @@ func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
 		msg := "unsupported protocol scheme " + req.URL.Scheme
+		p.stats.countError(errorBadRequest)
 		http.Error(w, msg, http.StatusBadRequest)
-		log.Println(msg)
+		logger.Println(msg)
+		return
+	}
+
+	var target connectTarget
+	if req.Method == http.MethodConnect {
+		var targetErr error
+		target, targetErr = parseConnectTarget(req.Host)
+		if targetErr != nil {
+			p.stats.countError(errorBadRequest)
+			http.Error(w, targetErr.Error(), http.StatusBadRequest)
+			logger.Println(targetErr)
+			return
+		}
+		if !p.connectPorts.allowed(target.Port) && p.deny(logger, req, "CONNECT port "+target.Port, target.Host) {
+			p.stats.countError(errorDenied)
+			http.Error(w, "destination port is blocked", http.StatusForbidden)
+			return
+		}
+	} else {
+		target.Host, target.Zone, _ = normalizeHost(req.URL.Hostname())
+	}
+
+	// Rules see the canonical name of aliases, the connection goes to the
+	// requested one.
+	policyHost := p.aliases.canonical(target.Host)
+	if policyHost != target.Host {
+		logger.Printf("canonical host: %s", policyHost)
+	}
+
+	if category := p.categories.lookup(policyHost); category != "" {
+		logger.Printf("category: %s", category)
+		p.categories.count(category)
+		req = req.WithContext(withCategory(req.Context(), category))
+		if _, ok := p.blockedCategories[category]; ok && p.deny(logger, req, "category "+category, target.Host) {
+			p.stats.countError(errorDenied)
+			http.Error(w, "destination is blocked", http.StatusForbidden)
+			return
+		}
+	}
+
+	route, routed := p.router.match(req.Context(), policyHost)
+	if routed && route.action == routeBlock && p.deny(logger, req, "routing rule "+route.text, target.Host) {
+		p.router.blocked.Add(1)
+		p.stats.countError(errorDenied)
+		http.Error(w, "destination is blocked", http.StatusForbidden)
+		return
+	}
+	if p.blocked.match(policyHost) && p.deny(logger, req, "block list", target.Host) {
+		p.stats.countError(errorDenied)
+		http.Error(w, "destination is blocked", http.StatusForbidden)
+		return
+	}
+	if p.blocklist.match(policyHost) && p.deny(logger, req, "blocklist subscription", target.Host) {
+		p.stats.countError(errorDenied)
+		http.Error(w, "destination is blocked", http.StatusForbidden)
+		return
+	}
+	if rule, ok := p.processRules.match(process.name, policyHost); ok && !rule.allow && p.deny(logger, req, "process rule "+rule.text, target.Host) {
+		p.stats.countError(errorDenied)
+		http.Error(w, "destination is blocked", http.StatusForbidden)
+		return
+	}
+	if rule, ok := p.clientRules.match(identity, policyHost); ok && !rule.allow && p.deny(logger, req, "client rule "+rule.text, target.Host) {
+		p.stats.countError(errorDenied)
+		http.Error(w, "destination is blocked", http.StatusForbidden)
+		return
+	}
+	// CONNECT tunnels carry no URL path, rules only apply to plain HTTP.
+	if req.Method != http.MethodConnect {
+		rule, ok := p.urlRules.match(policyHost, req.URL)
+		if ok && !rule.allow && p.deny(logger, req, "URL rule "+rule.text, target.Host) {
+			p.stats.countError(errorDenied)
+			http.Error(w, "URL is blocked", http.StatusForbidden)
+			return
+		}
+	}
+
+	if _, selected := selectedServer(req.Context()); !selected && !routed {
+		// Fallbacks to the upstream are logged by decide.
+		if decision, ok := p.pac.decide(req.Context(), pacURL(req, target), policyHost, p.upstreams.current.Load()); ok && decision.direct {
+			logger.Printf("PAC file: %s, connecting directly", decision.result)
+			req = req.WithContext(withPACDirect(req.Context()))
+		} else if ok && decision.server != "" {
+			logger.Printf("PAC file: %s, upstream server %s", decision.result, decision.server)
+			req = req.WithContext(withSelectedServer(req.Context(), decision.server))
+		}
+	}
+
+	release, limitErr := p.hostLimit.acquire(req.Context(), policyHost)
+	if errors.Is(limitErr, errHostLimit) && !p.deny(logger, req, "max connections per host", target.Host) {
+		release, limitErr = func() {}, nil
+	}
+	if limitErr != nil {
+		msg := fmt.Sprintf("%s: %v", target.Host, limitErr)
+		p.stats.countError(errorLimit)
+		if errors.Is(limitErr, errHostLimit) {
+			w.Header().Set("Retry-After", "1")
+		}
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		logger.Println(msg)
+		return
+	}
+	// Direct connections don't wait for the upstream.
+	direct := routed && route.action == routeDirect || pacDirect(req.Context())
+	if !direct && p.startup.hold(w) {
+		release()
+		p.stats.countError(errorUpstream)
+		logger.Println("waiting for the upstream proxy")
 		return
 	}
+	p.events.publish(newAccessEvent(req, target.Host, decisionAllow, ""))
+	req = req.WithContext(withQoSClass(req.Context(), p.qos.class(policyHost, userFromContext(req.Context()))))
 
 	if req.Method == http.MethodConnect {
-		p.proxyConnect(w, req)
+		p.proxyConnect(w, req, target, release)
 		return
 	}
+	defer release()
 
-	client, clientErr := p.getHTTPClient()
+	cacheReq := p.cache.request(req, policyHost)
+	if entry := p.cache.lookup(cacheReq); entry != nil {
+		n, err := entry.serve(w)
+		p.limits.transferred(affinityKey(req.Context()), n)
+		logger.Println(req.RemoteAddr, " ", entry.status, http.StatusText(entry.status), "(cached)")
+		if err != nil {
+			logger.Printf("ServeHTTP write cached body error: %+v", err)
+		}
+		return
+	}
+
+	var client *http.Client
+	var clientErr error
+	if _, ok := selectedServer(req.Context()); ok || pacDirect(req.Context()) {
+		// Pooled connections may go through any server.
+		client, clientErr = p.getSelectedHTTPClient()
+	} else {
+		client, clientErr = p.getClassHTTPClient(qosClassFromContext(req.Context()))
+	}
 	if clientErr != nil {
 		msg := fmt.Sprintf("failed create http client: %v", clientErr)
+		p.stats.countError(errorUpstream)
 		http.Error(w, msg, http.StatusInternalServerError)
-		log.Println(msg)
+		logger.Println(msg)
 		return
 	}
 
@@ -112,17 +545,84 @@ func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// be set (see documentation of this field).
 	req.RequestURI = ""
 
+	http10KeepAlive := wantsHTTP10KeepAlive(req)
 	removeHopHeaders(req.Header)
 	removeConnectionHeaders(req.Header)
 
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
 		appendHostToXForwardHeader(req.Header, clientIP)
 	}
+	if profile := p.headerProfiles.apply(req, target.Host); profile != "" {
+		logger.Printf("headers normalized with profile %s", profile)
+	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Server Error", http.StatusInternalServerError)
-		log.Printf("ServeHTTP request error: %+v", err)
+	if p.spool != nil && req.Body != nil && req.Body != http.NoBody {
+		body, spoolErr := p.spool.spool(req.Body)
+		if spoolErr != nil {
+			status := http.StatusBadRequest
+			if errors.Is(spoolErr, errBodyTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			p.stats.countError(errorBadRequest)
+			http.Error(w, spoolErr.Error(), status)
+			logger.Println("failed to spool request body:", spoolErr)
+			return
+		}
+		defer body.close()
+
+		req.Body = body.reader()
+		req.GetBody = func() (io.ReadCloser, error) { return body.reader(), nil }
+		req.ContentLength = body.size
+		req.TransferEncoding = nil
+	}
+
+	if signature, signErr := p.signer.sign(req, target.Host); signErr != nil {
+		msg := fmt.Sprintf("failed to sign request: %v", signErr)
+		p.stats.countError(errorUpstream)
+		http.Error(w, msg, http.StatusInternalServerError)
+		logger.Println(msg)
+		return
+	} else if signature != "" {
+		logger.Printf("signed request with %s", signature)
+	}
+
+	ctx := p.stats.withConnTrace(req.Context())
+	var timing *proxyTiming
+	if p.serverTiming {
+		ctx, timing = withTiming(ctx)
+		ctx = timing.trace(ctx)
+	}
+
+	req = req.WithContext(ctx)
+	resp, err := p.do(client, req, logger)
+	p.observeUpstream(err)
+	if wait, paused := p.socksAuth.retryAfter(err); paused {
+		p.stats.countError(errorUpstreamAuth)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, errCircuitOpen) {
+		p.stats.countError(errorUpstream)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	} else if errors.Is(err, errUpstreamBudget) {
+		p.stats.countError(errorLimit)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, errUpstreamBudget.Error(), http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, errDNSRebind) {
+		p.stats.countError(errorDenied)
+		http.Error(w, "destination is blocked", http.StatusForbidden)
+		return
+	} else if err != nil {
+		p.stats.countError(upstreamErrorKind(err))
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, "Server Error", http.StatusInternalServerError)
+		}
+		logger.Printf("ServeHTTP request error: %+v", err)
 	}
 
 	if resp == nil || resp.Body == nil {
@@ -131,100 +631,991 @@ func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer func() {
 		closeErr := resp.Body.Close()
 		if closeErr != nil {
-			log.Printf("ServeHTTP close body error: %+v", closeErr)
+			logger.Printf("ServeHTTP close body error: %+v", closeErr)
 		}
 	}()
 
-	log.Println(req.RemoteAddr, " ", resp.Status)
+	if rule := p.integrity.match(target.Host, req.URL); rule != nil {
+		body, verifyErr := p.integrity.verify(rule, req, resp)
+		if verifyErr != nil {
+			p.stats.countError(errorIntegrity)
+			http.Error(w, "response integrity check failed", http.StatusBadGateway)
+			logger.Println(verifyErr)
+			return
+		}
+		resp.Body = body
+	}
+
+	logger.Println(req.RemoteAddr, " ", resp.Status)
+	if detailed {
+		logger.Println("\t", resp.Header)
+	}
 
 	removeHopHeaders(resp.Header)
 	removeConnectionHeaders(resp.Header)
 
+	if http10KeepAlive && p.http10BufferSize > 0 {
+		if err := bufferHTTP10Response(req, resp, p.http10BufferSize); err != nil {
+			p.stats.countError(errorUpstream)
+			http.Error(w, "Server Error", http.StatusBadGateway)
+			logger.Printf("reading response for HTTP/1.0 client: %v", err)
+			return
+		}
+	}
+
+	p.cache.record(cacheReq, resp)
 	copyHeader(w.Header(), resp.Header)
+	if timing != nil {
+		if metrics := timing.header(); metrics != "" {
+			w.Header().Add("Server-Timing", metrics)
+		}
+	}
 	w.WriteHeader(resp.StatusCode)
-	_, copyErr := io.Copy(w, resp.Body)
+	transferStart := time.Now()
+	class := qosClassFromContext(req.Context())
+	n, copyErr := io.Copy(p.pacing.download(w, class), resp.Body)
+	p.stats.bytesReceived.Add(n)
+	p.limits.transferred(affinityKey(req.Context()), n)
+	p.costs.add(categoryFromContext(req.Context()), n)
+	p.bandwidth.add(target.Host, 0, n)
 	if copyErr != nil {
-		log.Printf("ServeHTTP copy body error: %+v", copyErr)
+		logger.Printf("ServeHTTP copy body error: %+v", copyErr)
+	}
+
+	if timing != nil {
+		// The transfer time can only be sent as a trailer, which reaches
+		// the client with chunked responses.
+		transfer := serverTimingMetric("transfer", time.Since(transferStart))
+		w.Header().Set(http.TrailerPrefix+"Server-Timing", transfer)
+		logger.Printf("timing: %s, %s", timing.header(), transfer)
+	}
+}
+
+// upstreamClient is the SOCKS dialer and the HTTP clients of an upstream
+// generation, shared by all requests so connections are pooled.
+type upstreamClient struct {
+	upstream *upstream
+	dialer   proxy.ContextDialer
+
+	// clients are per QoS class when connections are marked with DSCP,
+	// so pooled connections keep the marking of their class. Otherwise
+	// all classes share one client.
+	clients [qosClassCount]*http.Client
+
+	// warm are the pools of SOCKS5 connections negotiated ahead of time.
+	warm []*warmPool
+}
+
+// close closes the idle pooled connections and warm SOCKS5 connections.
+// Connections in use carry on.
+func (uc *upstreamClient) close() {
+	for _, client := range uc.clients {
+		client.CloseIdleConnections()
+	}
+	for _, wp := range uc.warm {
+		wp.close()
+	}
+}
+
+// warmPools returns the pools of warm SOCKS5 connections of the current
+// upstream.
+func (p *forwardProxy) warmPools() []*warmPool {
+	if uc := p.upstreamClient.Load(); uc != nil {
+		return uc.warm
 	}
+	return nil
 }
 
+// getUpstreamClient returns the dialer and clients of the current upstream.
+// When the upstream changed, they are built anew and idle connections to
+// the previous upstream are closed.
+func (p *forwardProxy) getUpstreamClient() (*upstreamClient, error) {
+	u := p.upstreams.current.Load()
+	if uc := p.upstreamClient.Load(); uc != nil && uc.upstream == u {
+		return uc, nil
+	}
+
+	p.upstreamClientMu.Lock()
+	defer p.upstreamClientMu.Unlock()
+	if uc := p.upstreamClient.Load(); uc != nil && uc.upstream == u {
+		return uc, nil
+	}
+
+	dialer, warm, err := p.newSocksDialer(u)
+	if err != nil {
+		return nil, err
+	}
+	uc := &upstreamClient{upstream: u, dialer: dialer, warm: warm}
+	for class := range uc.clients {
+		if class > 0 && len(p.dscp) == 0 {
+			uc.clients[class] = uc.clients[0]
+			continue
+		}
+		uc.clients[class] = p.newHTTPClient(dialer)
+		// Pooled connections are shared by all clients.
+		if u.isolation == isolateClient || u.balance == balanceAffinity {
+			uc.clients[class].Transport.(*http.Transport).DisableKeepAlives = true //nolint:errcheck // made by newHTTPClient
+		}
+	}
+
+	for _, wp := range warm {
+		wp.start()
+	}
+	if old := p.upstreamClient.Swap(uc); old != nil {
+		old.close()
+	}
+	return uc, nil
+}
+
+// getSocksDialer returns a dialer through the current upstream.
+func (p *forwardProxy) getSocksDialer() (proxy.ContextDialer, error) {
+	uc, err := p.getUpstreamClient()
+	if err != nil {
+		return nil, err
+	}
+	return uc.dialer, nil
+}
+
+// getHTTPClient returns the client through the current upstream for
+// requests of the default QoS class.
 func (p *forwardProxy) getHTTPClient() (*http.Client, error) {
-	auth := proxy.Auth{
-		User:     p.SocksUser,
-		Password: p.SocksPassword,
+	return p.getClassHTTPClient(qosDefault)
+}
+
+// getClassHTTPClient returns the client through the current upstream for
+// requests of class.
+func (p *forwardProxy) getClassHTTPClient(class qosClass) (*http.Client, error) {
+	uc, err := p.getUpstreamClient()
+	if err != nil {
+		return nil, err
 	}
+	return uc.clients[class], nil
+}
 
-	dialer, err := proxy.SOCKS5("tcp", p.SocksServer, &auth, nil)
+// getSelectedHTTPClient returns a client through the current upstream for
+// a request with a selected server, which doesn't reuse connections.
+func (p *forwardProxy) getSelectedHTTPClient() (*http.Client, error) {
+	uc, err := p.getUpstreamClient()
 	if err != nil {
 		return nil, err
 	}
+	client := p.newHTTPClient(uc.dialer)
+	client.Transport.(*http.Transport).DisableKeepAlives = true //nolint:errcheck // made by newHTTPClient
+	return client, nil
+}
 
-	contextDialer := dialer.(proxy.ContextDialer) //nolint:errcheck // definition of function before it called
+// newSocksDialer returns the dialer through u along with the pools of
+// warm SOCKS5 connections it takes connections from, which are yet to be
+// started.
+func (p *forwardProxy) newSocksDialer(u *upstream) (proxy.ContextDialer, []*warmPool, error) {
+	// The keep-alive keeps NAT and firewall state between the proxy and the
+	// SOCKS server alive on idle pooled connections and tunnels.
+	netDialer := &net.Dialer{
+		KeepAlive: u.keepAlive,
+	}
+	if len(p.dscp) > 0 {
+		netDialer.ControlContext = p.dscp.control
+	}
+	var forward proxy.Dialer = netDialer
+	if p.chaos != nil {
+		forward = p.chaos.dialer(netDialer)
+	}
+	if p.serverTiming {
+		forward = timedDialer{forward: forward}
+	}
+	tlsConfig, err := u.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(u.via) > 0 {
+		via, err := chainDialer(u.via, tlsConfig, forward)
+		if err != nil {
+			return nil, nil, err
+		}
+		forward = via.(proxy.Dialer) //nolint:errcheck // chain dialers implement both
+	}
+
+	var warm []*warmPool
+	ud := upstreamDialer{
+		upstream: u,
+		connMap:  p.connMap,
+		markDown: p.healthInterval > 0,
+		auth:     p.socksAuth,
+		rebind:   p.rebind,
+	}
+	for _, server := range u.servers {
+		// Only offer username/password authentication with credentials.
+		var auth *proxy.Auth
+		if server.user != "" {
+			auth = &proxy.Auth{
+				User:     server.user,
+				Password: server.password,
+			}
+		}
 
+		// Through via proxies the name of the server is theirs to resolve.
+		serverForward := forward
+		if server.resolver != nil && len(u.via) == 0 {
+			serverForward = server.resolver.dialer(forward)
+		}
+		if server.tls {
+			serverForward = tlsDialer{config: tlsConfig, forward: serverForward}
+		}
+
+		var dialer proxy.Dialer
+		switch {
+		case server.connect:
+			dialer = &connectDialer{addr: server.server, auth: auth, forward: serverForward}
+		case server.ssh:
+			sshConfig, err := newSSHClientConfig(server.user, server.password, u.sshKeyFile, u.sshKnownHostsFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			dialer = &sshDialer{addr: server.server, config: sshConfig, forward: serverForward}
+		case auth == nil && u.isolation != isolateNone:
+			dialer = isolatingDialer{network: server.network(), addr: server.server, by: u.isolation, forward: serverForward}
+		default:
+			if dialer, err = proxy.SOCKS5(server.network(), server.server, auth, serverForward); err != nil {
+				return nil, nil, err
+			}
+			if p.warmConns > 0 {
+				wp := newWarmPool(server.server, p.warmConns, p.warmMaxAge, warmDial(serverForward, server.socksEndpoint))
+				warm = append(warm, wp)
+				dialer = warmDialer{pool: wp, forward: dialer.(proxy.ContextDialer)} //nolint:errcheck // SOCKS5 dialers implement it
+			}
+		}
+		sd := serverDialer{
+			dialer: dialer.(proxy.ContextDialer), //nolint:errcheck // definition of function before it called
+		}
+
+		// Each hop of the chain is reached through the previous one.
+		if len(u.chain) > 0 {
+			if sd.chained, err = chainDialer(u.chain, tlsConfig, dialer); err != nil {
+				return nil, nil, err
+			}
+		}
+		ud.servers = append(ud.servers, sd)
+	}
+
+	var dialer proxy.ContextDialer = ud
+	if p.dialRetries > 0 {
+		dialer = retryingDialer{upstream: dialer, retries: p.dialRetries, window: p.dialRetryWindow, budget: p.retries}
+	}
+	if p.breaker != nil {
+		dialer = breakerDialer{upstream: dialer, breaker: p.breaker}
+	}
+	if p.fallback != nil {
+		dialer = fallbackDialer{upstream: dialer, fallback: p.fallback, routes: u.routes}
+	}
+	if p.router != nil {
+		dialer = routingDialer{upstream: dialer, router: p.router}
+	}
+	return dialer, warm, nil
+}
+
+func (p *forwardProxy) newHTTPClient(dialer proxy.ContextDialer) *http.Client {
 	// Client request timeouts from cloudflare blog recommendations
 	// https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
+	transport := &http.Transport{
+		DialContext:           p.stats.trackDial(dialer.DialContext),
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: p.responseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          p.maxIdleConns,
+		MaxIdleConnsPerHost:   p.maxIdleConnsPerHost,
+		IdleConnTimeout:       p.idleConnTimeout,
+	}
+	if len(p.serverNames) > 0 {
+		transport.DialTLSContext = p.serverNames.dialTLS(transport.DialContext)
+	}
+
 	return &http.Client{
-		Timeout: 15 * time.Second,
-		Transport: &http.Transport{
-			DialContext:           contextDialer.DialContext,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
-	}, nil
-}
-
-func (p *forwardProxy) proxyConnect(w http.ResponseWriter, req *http.Request) {
-	log.Printf("CONNECT requested to %v (from %v)", req.Host, req.RemoteAddr)
-	targetConn, err := net.Dial("tcp", req.Host)
+		Timeout:   p.requestTimeout,
+		Transport: transport,
+	}
+}
+
+// proxyConnect tunnels the CONNECT request to its target through the SOCKS
+// server. release is called once the tunnel is closed.
+func (p *forwardProxy) proxyConnect(w http.ResponseWriter, req *http.Request, target connectTarget, release func()) {
+	logger := sessionLogger(req.Context())
+	logger.Printf("CONNECT requested to %v (from %v)", target, req.RemoteAddr)
+
+	addr, err := target.socksAddr()
 	if err != nil {
-		log.Println("failed to dial to target", req.Host)
+		release()
+		logger.Println(err)
+		p.stats.countError(errorBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dialer, err := p.getSocksDialer()
+	if err != nil {
+		release()
+		logger.Println("failed to create SOCKS dialer:", err)
+		p.stats.countError(errorUpstream)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := req.Context()
+	var timing *proxyTiming
+	if p.serverTiming {
+		ctx, timing = withTiming(ctx)
+	}
+
+	dialCtx, cancel := ctx, context.CancelFunc(func() {})
+	if p.tunnelDialTimeout > 0 {
+		dialCtx, cancel = context.WithTimeout(ctx, p.tunnelDialTimeout)
+	}
+	targetConn, err := dialer.DialContext(dialCtx, "tcp", addr)
+	cancel()
+	p.observeUpstream(err)
+	if wait, paused := p.socksAuth.retryAfter(err); paused {
+		release()
+		p.stats.countError(errorUpstreamAuth)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
+	} else if errors.Is(err, errCircuitOpen) {
+		release()
+		p.stats.countError(errorUpstream)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	} else if errors.Is(err, errUpstreamBudget) {
+		release()
+		p.stats.countError(errorLimit)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, errDNSRebind) {
+		release()
+		p.stats.countError(errorDenied)
+		http.Error(w, "destination is blocked", http.StatusForbidden)
+		return
+	} else if err != nil {
+		release()
+		logger.Println("failed to dial to target", addr, err)
+		p.stats.countError(upstreamErrorKind(err))
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if timing != nil {
+		if metrics := timing.header(); metrics != "" {
+			w.Header().Set("Server-Timing", metrics)
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		log.Println("http server doesn't support hijacking connection")
+		release()
+		_ = targetConn.Close()
+		logger.Println("http server doesn't support hijacking connection")
 		return
 	}
 
 	clientConn, _, err := hj.Hijack()
 	if err != nil {
-		log.Println("http hijacking failed")
+		release()
+		_ = targetConn.Close()
+		logger.Println("http hijacking failed")
 		return
 	}
 
-	log.Println("tunnel established")
-	go p.tunnelConn(targetConn, clientConn)
-	go p.tunnelConn(clientConn, targetConn)
+	logger.Println("tunnel established")
+	class := qosClassFromContext(req.Context())
+	category := categoryFromContext(req.Context())
+	closed := p.stats.tunnelOpened()
+	var client io.ReadCloser = clientConn
+	var sni *sniReader
+	_, addrErr := netip.ParseAddr(target.Host)
+	if addrErr == nil && p.bandwidth != nil || p.tunnelRecords != nil {
+		// Tunnels to addresses are told apart by their server name.
+		sni = &sniReader{ReadCloser: clientConn}
+		client = sni
+	}
+	var record tunnelRecord
+	if p.tunnelRecords != nil {
+		record = newTunnelRecord(req, addr)
+		p.tunnelRecords.publish(record)
+	}
+	opened := time.Now()
+	p.hooks.tunnelOpen(req, addr)
+	go func() {
+		defer release()
+		defer closed()
+		if p.tunnelMaxLifetime > 0 {
+			timer := time.AfterFunc(p.tunnelMaxLifetime, func() {
+				logger.Printf("closing tunnel open for %v", p.tunnelMaxLifetime)
+				_ = clientConn.Close()
+				_ = targetConn.Close()
+			})
+			defer timer.Stop()
+		}
+		var wg sync.WaitGroup
+		var sent, received int64
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sent = p.tunnelConn(p.pacing.upload(targetConn, class), client)
+			p.stats.bytesSent.Add(sent)
+			p.costs.add(category, sent)
+		}()
+		go func() {
+			defer wg.Done()
+			received = p.tunnelConn(p.pacing.downloadCloser(clientConn, class), targetConn)
+			p.stats.bytesReceived.Add(received)
+			p.costs.add(category, received)
+		}()
+		wg.Wait()
+
+		domain := target.Host
+		if addrErr == nil && sni != nil && sni.serverName != "" {
+			domain = sni.serverName
+		}
+		p.bandwidth.add(domain, sent, received)
+		p.limits.transferred(affinityKey(req.Context()), sent+received)
+		if p.tunnelRecords != nil {
+			p.tunnelRecords.publish(record.ended(sni.serverName, sent, received))
+		}
+		p.hooks.tunnelClose(req, addr, sent, received, opened)
+	}()
 }
 
-func (p *forwardProxy) tunnelConn(dst io.WriteCloser, src io.ReadCloser) {
+// tunnelConn copies src to dst until either fails and returns the number
+// of bytes copied.
+func (p *forwardProxy) tunnelConn(dst io.WriteCloser, src io.ReadCloser) int64 {
 	defer func() {
 		_ = dst.Close()
 	}()
 	defer func() {
 		_ = src.Close()
 	}()
-	_, _ = io.Copy(dst, src)
+	n, _ := io.Copy(dst, src)
+	return n
+}
+
+// tooManyRequests refuses a request over a client limit with 429 and
+// Retry-After until.
+func (p *forwardProxy) tooManyRequests(w http.ResponseWriter, err error, until time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(time.Until(until).Seconds())), 1)))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// reloadOnSignal reloads the proxy users file, changed listener
+// certificates and the upstream config on SIGHUP.
+func (p *forwardProxy) reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		p.reload()
+	}
 }
 
+func (p *forwardProxy) reload() {
+	if p.users != nil {
+		if err := p.users.reload(); err != nil {
+			log.Printf("reload of proxy users failed, keeping the previous ones: %v", err)
+		} else {
+			log.Println("proxy users reloaded")
+		}
+	}
+
+	if p.tls != nil {
+		p.tls.certs.checkNow()
+	}
+
+	if p.connMap != nil {
+		if err := p.connMap.reopen(); err != nil {
+			log.Printf("reopening the connection map failed, keeping the previous file: %v", err)
+		}
+	}
+
+	if err := p.reloadUpstream(); err != nil {
+		log.Printf("reload of config failed, keeping the previous one: %v", err)
+	}
+}
+
+// reloadUpstream loads the config again and switches to its upstream when
+// that changed.
+func (p *forwardProxy) reloadUpstream() error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := p.reloadRouting(config); err != nil {
+		log.Printf("reload of routing rules failed, keeping the previous ones: %v", err)
+	}
+	if err := p.pac.load(context.Background(), config.RoutingPACFile); err != nil {
+		log.Printf("reload of the PAC file failed, keeping the previous one: %v", err)
+	}
+	if p.upstreams.update(config) {
+		u := p.upstreams.current.Load()
+		log.Printf("switched to upstream %s (generation %d), established connections stay on the previous one", u.addresses(), u.generation)
+		// Idle pooled connections to the previous upstream are closed.
+		if _, err := p.getUpstreamClient(); err != nil {
+			log.Printf("failed to create SOCKS dialer for the new upstream: %v", err)
+		}
+	}
+	return nil
+}
+
+// reloadRouting switches to the routing rules and bypassed hosts of config
+// when they changed.
+func (p *forwardProxy) reloadRouting(config *Config) error {
+	routing, err := config.routing()
+	if err != nil {
+		return err
+	}
+	if slices.EqualFunc(routing, p.router.rules(), func(a, b routingRule) bool { return a.text == b.text }) {
+		return nil
+	}
+	if err := p.router.update(routing); err != nil {
+		return err
+	}
+	log.Printf("routing rules reloaded, %d rules", len(routing))
+	return nil
+}
+
+// shutdownTimeout is how long requests in flight may take to finish on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		if err := writeConfigSchema(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+
 	config, configErr := loadConfig()
 	if configErr != nil {
 		log.Fatal(configErr)
 	}
+	setLogFormat(config.LogFormat)
+	if config.StateDir != "" {
+		if err := os.MkdirAll(config.SpoolDir, 0o700); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.FDLimit > 0 {
+		limit, err := raiseFDLimit(uint64(config.FDLimit))
+		switch {
+		case err != nil && limit > 0:
+			log.Printf("file descriptor limit is %d, could not raise it to %d: %v", limit, config.FDLimit, err)
+		case err != nil:
+			log.Printf("file descriptor limit: %v", err)
+		default:
+			log.Printf("file descriptor limit is %d", limit)
+		}
+	}
+	// The upstream TLS and SSH files are loaded along with the upstream,
+	// which is only on first use.
+	if _, err := newUpstreamTLSConfig(config.SocksCAFile, config.SocksTLSCertFile, config.SocksTLSKeyFile); err != nil {
+		log.Fatal(err)
+	}
+	if config.SocksSSHKnownHostsFile != "" {
+		if _, err := newSSHClientConfig("", "", config.SocksSSHKeyFile, config.SocksSSHKnownHostsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	blocked, blockedErr := newHostMatcher(config.BlockHosts, config.HostGroups)
+	if blockedErr != nil {
+		log.Fatal(blockedErr)
+	}
+
+	ports, portsErr := newConnectPorts(config.ConnectPorts, config.ConnectDenyPorts)
+	if portsErr != nil {
+		log.Fatal(portsErr)
+	}
+
+	rules, rulesErr := parseURLRules(config.URLRules, config.HostGroups)
+	if rulesErr != nil {
+		log.Fatal(rulesErr)
+	}
+
+	cacheRules, cacheRulesErr := parseCacheRules(config.CacheRules, config.HostGroups)
+	if cacheRulesErr != nil {
+		log.Fatal(cacheRulesErr)
+	}
+
+	procRules, procRulesErr := parseProcessRules(config.ProcessRules, config.HostGroups)
+	if procRulesErr != nil {
+		log.Fatal(procRulesErr)
+	}
+
+	clientRules, clientRulesErr := parseClientRules(config.ClientRules, config.HostGroups)
+	if clientRulesErr != nil {
+		log.Fatal(clientRulesErr)
+	}
+
+	routing, routingErr := config.routing()
+	if routingErr != nil {
+		log.Fatal(routingErr)
+	}
+
+	aliases, aliasesErr := newHostAliases(config.HostAliases)
+	if aliasesErr != nil {
+		log.Fatal(aliasesErr)
+	}
+
+	logHosts, logHostsErr := newHostMatcher(config.LogDetailHosts, config.HostGroups)
+	if logHostsErr != nil {
+		log.Fatal(logHostsErr)
+	}
+
+	qos, qosErr := newQoSClassifier(config.QosClassHosts, config.QosClassUsers, config.HostGroups)
+	if qosErr != nil {
+		log.Fatal(qosErr)
+	}
+
+	dscp, dscpErr := newDSCPMarks(config.DscpClasses)
+	if dscpErr != nil {
+		log.Fatal(dscpErr)
+	}
+
+	serverNames, serverNamesErr := newServerNames(config.OriginServerNames)
+	if serverNamesErr != nil {
+		log.Fatal(serverNamesErr)
+	}
+
+	headerProfiles, headerProfilesErr := newRouteProfiles(config.HeaderProfiles)
+	if headerProfilesErr != nil {
+		log.Fatal(headerProfilesErr)
+	}
+
+	var users *proxyUsers
+	if config.ProxyUsersFile != "" {
+		var usersErr error
+		users, usersErr = newProxyUsers(config.ProxyUsersFile, config.AuthCacheTTL)
+		if usersErr != nil {
+			log.Fatal(usersErr)
+		}
+	}
+
+	var shared *sharedState
+	if config.RedisAddress != "" {
+		shared = newSharedState(config)
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		if err := shared.ping(ctx); err != nil {
+			log.Printf("shared state at %s unavailable, using local limits until it's reachable: %v", config.RedisAddress, err)
+		}
+		cancel()
+	}
+
+	pol := newPolicy(config.PolicyMode)
+	limitWait := config.MaxConnsPerHostWait
+	if pol.audit {
+		// Waiting for a free slot would already enforce the limit.
+		limitWait = 0
+	}
 
 	fp := &forwardProxy{
-		SocksServer:   config.SocksProxy,
-		SocksUser:     config.SocksProxyUser,
-		SocksPassword: config.SocksProxyPassword,
+		upstreams:    newUpstreams(config),
+		users:        users,
+		hostLimit:    newHostLimiter(config.MaxConnsPerHost, limitWait, shared),
+		limits:       newClientLimits(config, shared),
+		blocked:      blocked,
+		urlRules:     rules,
+		connectPorts: ports,
+		policy:       pol,
+		stats:        newProxyStats(),
+
+		processTagging: config.ProcessTagging,
+		processRules:   procRules,
+		clientRules:    clientRules,
+
+		serverNames:      serverNames,
+		headerProfiles:   headerProfiles,
+		serverTiming:     config.ServerTiming,
+		http10BufferSize: config.KeepAliveBufferSize,
+		logSampler:       logSampler{rate: config.LogDetailRate, hosts: logHosts},
+		pacing:           newPacing(config.PacingRate, config.PacingBurst),
+		qos:              qos,
+		dscp:             dscp,
+		clients:          newClientConns(config.ClientIdleTimeout),
+		shared:           shared,
+
+		maxIdleConns:        config.UpstreamMaxIdleConns,
+		maxIdleConnsPerHost: config.UpstreamMaxIdleConnsPerHost,
+		idleConnTimeout:     config.UpstreamIdleConnTimeout,
+		recycler:            &poolRecycler{errors: config.UpstreamRecycleErrors},
+		warmConns:           config.SocksWarmConns,
+
+		requestTimeout:        config.RequestTimeout,
+		responseHeaderTimeout: config.ResponseHeaderTimeout,
+		tunnelDialTimeout:     config.TunnelDialTimeout,
+		tunnelMaxLifetime:     config.TunnelMaxLifetime,
+
+		warmMaxAge:     config.SocksWarmMaxAge,
+		healthInterval: config.SocksHealthInterval,
+	}
+	fp.socksAuth = &socksAuthGuard{pause: config.SocksAuthPause, upstreams: fp.upstreams}
+
+	// The upstream dialer is built on first use, which needs the chaos
+	// dialer and the connection map in place.
+	if chaosCfg := config.chaos(); chaosCfg.enabled() {
+		log.Println("chaos: injecting faults on the upstream path")
+		fp.chaos = &chaos{cfg: chaosCfg}
+	}
+
+	if config.BreakerFailures > 0 {
+		fp.breaker = newCircuitBreaker(config.BreakerFailures, config.BreakerCooldown)
+	}
+	if config.SocksStartupWait {
+		fp.startup = &startupGate{}
+	}
+	fp.aliases = aliases
+	var direct proxy.Dialer = &net.Dialer{KeepAlive: config.SocksKeepAlive}
+	if config.DNSRebindProtection {
+		fp.rebind = &rebindGuard{proxy: fp}
+		direct = rebindDialer{forward: direct, guard: fp.rebind}
+	}
+	var geo *geoIP
+	if config.GeoIPDatabase != "" {
+		var geoErr error
+		if geo, geoErr = newGeoIP(config.GeoIPDatabase, config.GeoIPReloadInterval); geoErr != nil {
+			log.Fatal(geoErr)
+		}
+		go geo.run(context.Background())
+	}
+	// The router is there without rules too, reloads may add them.
+	fp.router = newRouter(routing, direct, config.SocksDNS != dnsRemote, geo)
+	fp.router.aliases = aliases
+	if config.SocksFallback == fallbackOpen {
+		fp.fallback = &directFallback{forward: direct}
+	}
+
+	if config.ConnMapFile != "" {
+		var connMapErr error
+		fp.connMap, connMapErr = openConnMapLog(config.ConnMapFile)
+		if connMapErr != nil {
+			log.Fatal(connMapErr)
+		}
+	}
+
+	if config.TLSCertFile != "" {
+		var tlsErr error
+		fp.tls, tlsErr = newListenerTLS(config, fp.getHTTPClient)
+		if tlsErr != nil {
+			log.Fatal(tlsErr)
+		}
+		if fp.tls.tickets != nil {
+			go fp.tls.tickets.run(context.Background())
+		}
+		go fp.tls.certs.run(context.Background())
+	}
+
+	if config.SigningRulesFile != "" {
+		var signerErr error
+		fp.signer, signerErr = loadSigningRules(config.SigningRulesFile, config.HostGroups)
+		if signerErr != nil {
+			log.Fatal(signerErr)
+		}
+	}
+
+	if config.IntegrityRulesFile != "" {
+		responseSpool := &spooler{
+			memory:  config.SpoolMemoryLimit,
+			maxSize: config.SpoolMaxSize,
+			dir:     config.SpoolDir,
+		}
+		var integrityErr error
+		fp.integrity, integrityErr = loadIntegrityRules(config.IntegrityRulesFile, config.HostGroups, responseSpool)
+		if integrityErr != nil {
+			log.Fatal(integrityErr)
+		}
+	}
+
+	if config.CategoriesFile != "" {
+		var categoriesErr error
+		fp.categories, categoriesErr = loadCategories(config.CategoriesFile, config.HostGroups)
+		if categoriesErr != nil {
+			log.Fatal(categoriesErr)
+		}
+	}
+	fp.blockedCategories = make(map[string]struct{}, len(config.BlockCategories))
+	for _, category := range config.BlockCategories {
+		fp.blockedCategories[category] = struct{}{}
+	}
+
+	if len(config.CostRates) > 0 {
+		fp.costs = newCostEstimator(config.CostRates, config.CostReportInterval)
+		for category := range config.CostRates {
+			if category != costDefaultRate && category != costUncategorized && !slices.Contains(fp.categories.names, category) {
+				log.Printf("cost rates: category %s is not in the categories file", category)
+			}
+		}
+		go fp.costs.run(context.Background())
+	}
+	if config.DomainBandwidthTop > 0 {
+		fp.bandwidth = newDomainBandwidth(config.DomainBandwidthTop)
+	}
+
+	fp.local = newLocalHandler(fp, config.PACPath, config.WPAD)
+	fp.adminAuth = newAdminAuth(config)
+	fp.pacPath = config.PACPath
+	fp.pacProxyAddress = config.PACProxyAddress
+
+	fp.blocklist = newBlocklist(config.Blocklists, config.BlocklistRefresh, fp.getHTTPClient)
+	go fp.blocklist.run(context.Background())
+
+	fp.pac = newPACRouter(config.RoutingPACFile, fp.getHTTPClient)
+	if isURLSource(config.RoutingPACFile) {
+		go fp.pac.run(context.Background())
+	} else if err := fp.pac.load(context.Background(), config.RoutingPACFile); err != nil {
+		log.Fatal(err)
+	}
+
+	if config.SocksHealthInterval > 0 {
+		go fp.upstreams.checkHealth(context.Background(), config.SocksHealthInterval)
+	}
+	if fp.startup != nil {
+		go fp.startup.wait(context.Background(), fp.upstreams)
+	}
+	if fp.warmConns > 0 {
+		// The pools start filling with the client instead of on the
+		// first request.
+		if _, err := fp.getUpstreamClient(); err != nil {
+			log.Fatalf("failed to create SOCKS dialer: %v", err)
+		}
+	}
+
+	if config.EventsURL != "" {
+		fp.events = newEventSink[accessEvent]("events", "Access events", config.EventsURL, config.EventsBatchSize, config.EventsFlushInterval)
+		go fp.events.run(context.Background())
+	}
+	if config.TunnelRecordsURL != "" {
+		fp.tunnelRecords = newEventSink[tunnelRecord]("tunnel_records", "Tunnel records", config.TunnelRecordsURL, config.TunnelRecordsBatchSize, config.TunnelRecordsFlushInterval)
+		go fp.tunnelRecords.run(context.Background())
+	}
+
+	if config.CacheSize > 0 {
+		fp.cache = newResponseCache(config.CacheSize, config.CacheMaxObject, cacheRules)
+	}
+
+	if config.SpoolRequestBodies {
+		fp.spool = &spooler{
+			memory:  config.SpoolMemoryLimit,
+			maxSize: config.SpoolMaxSize,
+			dir:     config.SpoolDir,
+		}
+	}
+	fp.retries = newRetryBudget(config.RetryBudget)
+	fp.uploadRetries = config.UploadRetries
+	fp.retryAfterMax = config.RetryAfterMax
+	fp.dialRetries = config.DialRetries
+	fp.dialRetryWindow = config.DialRetryWindow
+
+	if fp.shared != nil {
+		go fp.shared.run(context.Background(), fp.stats.report)
+	}
+
+	if config.MetricsBackend != metricsPrometheus {
+		go newStatsdPusher(fp, config).run(context.Background())
 	}
 
-	log.Println("Starting proxy server on", config.HTTPAddress)
-	if err := http.ListenAndServe(config.HTTPAddress, fp); err != nil {
-		log.Fatal("ListenAndServe:", err)
+	go fp.reloadOnSignal()
+	if config.SocksCredentialsFile != "" {
+		fp.credentials = newCredentialsWatcher(config.SocksCredentialsFile)
+		go fp.credentials.run(context.Background(), fp.reloadUpstream)
+	}
+
+	var listeners []startupListener
+	if config.WPADAddress != "" {
+		listeners = append(listeners, startupListener{Name: "wpad", Address: config.WPADAddress})
+		go func() {
+			ln, err := net.Listen(config.network(), config.WPADAddress)
+			if err != nil {
+				log.Fatal("WPAD Listen:", err)
+			}
+			if err := http.Serve(ln, newWPADHandler(fp)); err != nil {
+				log.Fatal("WPAD Serve:", err)
+			}
+		}()
+	}
+
+	if config.AdminAddress != "" {
+		listeners = append(listeners, startupListener{Name: "admin", Address: config.adminListenAddress(), TLS: config.AdminTLSCertFile != ""})
+		go serveAdmin(fp, config)
+	}
+
+	fp.fds = newFDBudget(config.FDReserve)
+	if config.SocksListenAddress != "" {
+		ln, err := net.Listen(config.network(), config.SocksListenAddress)
+		if err != nil {
+			log.Fatal("SOCKS5 Listen:", err)
+		}
+		listeners = append(listeners, startupListener{Name: "socks", Address: ln.Addr().String()})
+		ln = newAcceptListener(ln, config.AcceptBackoffMax, fp.fds, false)
+		go func() {
+			if err := (&socksServer{proxy: fp}).serve(ln); err != nil {
+				log.Fatal("SOCKS5 Serve:", err)
+			}
+		}()
+	}
+	if config.ProxyEnvFile != "" {
+		if err := writeProxyEnv(config.ProxyEnvFile, config); err != nil {
+			log.Fatal("failed to write proxy env file: ", err)
+		}
+	}
+
+	ln, err := net.Listen(config.network(), config.HTTPAddress)
+	if err != nil {
+		log.Fatal("Listen:", err)
+	}
+	listeners = append([]startupListener{{Name: "proxy", Address: ln.Addr().String(), TLS: fp.tls != nil}}, listeners...)
+	logEvent("startup", newStartupEvent(config, listeners, fp.upstreams.current.Load()))
+	fp.listener = newAcceptListener(ln, config.AcceptBackoffMax, fp.fds, fp.tls == nil)
+	ln = fp.listener
+	server := &http.Server{
+		Handler:     fp,
+		ConnContext: withSession,
+		ConnState:   fp.clients.connState,
+	}
+	go fp.clients.run(context.Background())
+	if fp.tls != nil {
+		// CONNECT tunnels hijack the connection, which HTTP/2 doesn't
+		// support, so only HTTP/1.1 is offered.
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		ln = tls.NewListener(ln, fp.tls.config)
+	}
+	go func() {
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Serve:", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	log.Printf("received %v, shutting down", <-stop)
+
+	// Hijacked CONNECT tunnels aren't waited for, they are counted as
+	// still open in the report.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+	}
+	cancel()
+
+	report := fp.stats.report()
+	report.log()
+	fp.costs.report()
+	if config.ShutdownReportFile != "" {
+		if err := report.writeFile(config.ShutdownReportFile); err != nil {
+			log.Println("failed to write shutdown report:", err)
+		}
 	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// hostMatcher matches normalized destination hosts against a list of
+// patterns:
+//
+//	example.com     the host itself
+//	*.example.com   any subdomain of example.com
+//	.example.com    example.com and any of its subdomains
+//	10.1.2.3        an IP address
+//	10.0.0.0/8      any IP address in the network
+//	@name           every pattern of the named group
+//
+// Members of a group are separated by whitespace.
+type hostMatcher struct {
+	exact    map[string]struct{}
+	suffixes []string
+	prefixes []netip.Prefix
+}
+
+func newHostMatcher(patterns []string, groups map[string]string) (*hostMatcher, error) {
+	m := &hostMatcher{exact: make(map[string]struct{})}
+	for _, pattern := range patterns {
+		if name, ok := strings.CutPrefix(pattern, "@"); ok {
+			group, ok := groups[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown group %q", name)
+			}
+			for _, gp := range strings.Fields(group) {
+				if strings.HasPrefix(gp, "@") {
+					return nil, fmt.Errorf("group %q: groups can't refer to other groups", name)
+				}
+				if err := m.add(gp); err != nil {
+					return nil, fmt.Errorf("group %q: %w", name, err)
+				}
+			}
+			continue
+		}
+		if err := m.add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *hostMatcher) add(pattern string) error {
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case pattern == "":
+		return nil
+	case strings.Contains(pattern, "/"):
+		prefix, err := netip.ParsePrefix(pattern)
+		if err != nil {
+			return fmt.Errorf("bad network %q: %w", pattern, err)
+		}
+		m.prefixes = append(m.prefixes, prefix.Masked())
+	case strings.HasPrefix(pattern, "*."):
+		m.suffixes = append(m.suffixes, strings.ToLower(pattern[1:]))
+	case strings.HasPrefix(pattern, "."):
+		m.suffixes = append(m.suffixes, strings.ToLower(pattern))
+		m.exact[strings.ToLower(pattern[1:])] = struct{}{}
+	default:
+		host, _, err := normalizeHost(pattern)
+		if err != nil {
+			return fmt.Errorf("bad host %q: %w", pattern, err)
+		}
+		m.exact[host] = struct{}{}
+	}
+	return nil
+}
+
+// merge adds the patterns of o to m.
+func (m *hostMatcher) merge(o *hostMatcher) {
+	for host := range o.exact {
+		m.exact[host] = struct{}{}
+	}
+	m.suffixes = append(m.suffixes, o.suffixes...)
+	m.prefixes = append(m.prefixes, o.prefixes...)
+}
+
+// empty reports whether the matcher has no patterns at all.
+func (m *hostMatcher) empty() bool {
+	return m == nil || len(m.exact) == 0 && len(m.suffixes) == 0 && len(m.prefixes) == 0
+}
+
+// match reports whether host (as returned by normalizeHost) matches any of
+// the patterns.
+func (m *hostMatcher) match(host string) bool {
+	if m.empty() {
+		return false
+	}
+
+	if _, ok := m.exact[host]; ok {
+		return true
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		for _, prefix := range m.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, suffix := range m.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
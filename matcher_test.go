@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestHostMatcher(t *testing.T) {
+	groups := map[string]string{
+		"ads":    "ads.example  *.tracker.example\n10.9.0.0/16",
+		"nested": "@ads",
+		"broken": "10.0.0.0/33",
+	}
+	tests := []struct {
+		patterns []string
+		host     string
+		want     bool
+	}{
+		{[]string{"example.com"}, "example.com", true},
+		{[]string{"Example.COM"}, "example.com", true},
+		{[]string{"example.com"}, "www.example.com", false},
+		{[]string{"*.example.com"}, "www.example.com", true},
+		{[]string{"*.example.com"}, "a.b.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*.example.com"}, "badexample.com", false},
+		{[]string{".example.com"}, "example.com", true},
+		{[]string{".example.com"}, "www.example.com", true},
+		{[]string{".example.com"}, "notexample.com", false},
+		{[]string{"10.1.2.3"}, "10.1.2.3", true},
+		{[]string{"10.1.2.3"}, "10.1.2.4", false},
+		{[]string{"10.0.0.0/8"}, "10.200.1.1", true},
+		{[]string{"10.1.2.3/8"}, "10.200.1.1", true},
+		{[]string{"10.0.0.0/8"}, "11.0.0.1", false},
+		{[]string{"fd00::/8"}, "fd12::1", true},
+		{[]string{"::1"}, "::1", true},
+		{[]string{"::ffff:10.1.2.3"}, "10.1.2.3", true},
+		{[]string{"example.com."}, "example.com", true},
+		// Networks match addresses only, suffixes names only.
+		{[]string{"10.0.0.0/8"}, "10.example", false},
+		{[]string{"*.0.0.1"}, "127.0.0.1", false},
+		{[]string{"@ads"}, "ads.example", true},
+		{[]string{"@ads"}, "x.tracker.example", true},
+		{[]string{"@ads"}, "10.9.1.1", true},
+		{[]string{"@ads"}, "example.com", false},
+		{[]string{"", " example.com "}, "example.com", true},
+		{nil, "example.com", false},
+	}
+	for _, tt := range tests {
+		m, err := newHostMatcher(tt.patterns, groups)
+		if err != nil {
+			t.Errorf("newHostMatcher(%q): %v", tt.patterns, err)
+			continue
+		}
+		if got := m.match(tt.host); got != tt.want {
+			t.Errorf("newHostMatcher(%q).match(%q) = %v, want %v", tt.patterns, tt.host, got, tt.want)
+		}
+	}
+
+	for _, patterns := range [][]string{
+		{"@missing"},
+		{"@nested"},
+		{"@broken"},
+		{"10.0.0.0/33"},
+		{"[::1]"},
+		{"fe80::1%"},
+	} {
+		if _, err := newHostMatcher(patterns, groups); err == nil {
+			t.Errorf("newHostMatcher(%q) succeeded, want an error", patterns)
+		}
+	}
+}
+
+func TestHostMatcherMerge(t *testing.T) {
+	a, _ := newHostMatcher([]string{"a.example"}, nil)
+	b, _ := newHostMatcher([]string{"*.b.example", "10.0.0.0/8"}, nil)
+	var none *hostMatcher
+	if !none.empty() || none.match("a.example") {
+		t.Error("nil matcher isn't empty")
+	}
+	a.merge(b)
+	for _, host := range []string{"a.example", "x.b.example", "10.1.1.1"} {
+		if !a.match(host) {
+			t.Errorf("merged matcher doesn't match %s", host)
+		}
+	}
+	if a.empty() {
+		t.Error("merged matcher is empty")
+	}
+}
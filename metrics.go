@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metricsWriter receives the metrics of the proxy components. Metric names
+// and types follow Prometheus conventions, other backends translate them.
+type metricsWriter interface {
+	// header starts a metric of type typ ("counter" or "gauge") whose
+	// samples follow.
+	header(name, typ, help string)
+	counter(name, help string, v int64)
+	gauge(name, help string, v float64)
+	sample(name string, labels map[string]string, v float64)
+}
+
+// promWriter writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	w io.Writer
+}
+
+func (pw promWriter) header(name, typ, help string) {
+	_, _ = fmt.Fprintf(pw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (pw promWriter) counter(name, help string, v int64) {
+	pw.header(name, "counter", help)
+	pw.sample(name, nil, float64(v))
+}
+
+func (pw promWriter) gauge(name, help string, v float64) {
+	pw.header(name, "gauge", help)
+	pw.sample(name, nil, v)
+}
+
+// sample writes a single value. Label names are sorted to keep the output
+// stable between scrapes.
+func (pw promWriter) sample(name string, labels map[string]string, v float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(k)
+			b.WriteString("=")
+			b.WriteString(strconv.Quote(labels[k]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	b.WriteByte('\n')
+	_, _ = io.WriteString(pw.w, b.String())
+}
+
+func formatUint(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
+
+func (p *forwardProxy) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.writeMetrics(promWriter{w: w})
+}
+
+// writeMetrics writes the metrics of all components to mw.
+func (p *forwardProxy) writeMetrics(mw metricsWriter) {
+	p.stats.writeMetrics(mw)
+	p.upstreams.writeMetrics(mw)
+	p.socksAuth.writeMetrics(mw)
+	p.credentials.writeMetrics(mw)
+	p.policy.writeMetrics(mw)
+	p.blocklist.writeMetrics(mw)
+	p.users.writeMetrics(mw)
+	p.limits.writeMetrics(mw)
+	p.cache.writeMetrics(mw)
+	p.chaos.writeMetrics(mw)
+	p.fallback.writeMetrics(mw)
+	p.router.writeMetrics(mw)
+	p.pac.writeMetrics(mw)
+	p.startup.writeMetrics(mw)
+	p.breaker.writeMetrics(mw)
+	p.events.writeMetrics(mw)
+	p.tunnelRecords.writeMetrics(mw)
+	p.tls.writeMetrics(mw)
+	p.categories.writeMetrics(mw)
+	p.costs.writeMetrics(mw)
+	p.bandwidth.writeMetrics(mw)
+	p.pacing.writeMetrics(mw)
+	p.clients.writeMetrics(mw)
+	p.listener.writeMetrics(mw)
+	p.fds.writeMetrics(mw)
+	p.shared.writeMetrics(mw)
+	p.spool.writeMetrics(mw)
+	p.retries.writeMetrics(mw)
+	p.recycler.writeMetrics(mw)
+	writeWarmMetrics(mw, p.warmPools())
+	p.connMap.writeMetrics(mw)
+	p.signer.writeMetrics(mw)
+	p.integrity.writeMetrics(mw)
+	p.rebind.writeMetrics(mw)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetry is the wait before another try after a failed refresh.
+	ocspRetry = 5 * time.Minute
+	// ocspDefaultRefresh is the refresh interval of responses without a
+	// next update time.
+	ocspDefaultRefresh = time.Hour
+	// ocspMaxResponse bounds the size of responder replies.
+	ocspMaxResponse = 1 << 20
+)
+
+// ocspStapler keeps an OCSP response for the listener certificate and
+// staples it to handshakes, so clients in strict environments don't have
+// to query the responder themselves. Responses are refreshed in the
+// background halfway through their validity.
+type ocspStapler struct {
+	file   string
+	cert   tls.Certificate
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+	client func() (*http.Client, error)
+
+	// current is cert with the latest valid staple, or without one.
+	current    atomic.Pointer[tls.Certificate]
+	nextUpdate time.Time
+
+	refreshes atomic.Int64
+	errors    atomic.Int64
+}
+
+// newOCSPStapler returns nil when cert, loaded from file, has no issuer
+// certificate in its chain or names no OCSP responder, since there is
+// nothing to staple then.
+func newOCSPStapler(file string, cert tls.Certificate, client func() (*http.Client, error)) (*ocspStapler, error) {
+	if len(cert.Certificate) < 2 {
+		log.Printf("OCSP stapling: %s has no issuer certificate, stapling disabled", file)
+		return nil, nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		log.Printf("OCSP stapling: the certificate of %s names no OCSP responder, stapling disabled", file)
+		return nil, nil
+	}
+
+	s := &ocspStapler{file: file, cert: cert, leaf: leaf, issuer: issuer, client: client}
+	s.current.Store(&cert)
+	return s, nil
+}
+
+// run keeps the staple fresh until ctx is done.
+func (s *ocspStapler) run(ctx context.Context) {
+	for {
+		wait, err := s.refresh(ctx)
+		if err != nil {
+			s.errors.Add(1)
+			log.Printf("OCSP stapling: refresh for %s failed, retrying in %v: %v", s.file, wait, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refresh fetches a new response and returns the time until the next
+// refresh. A staple past its next update time is dropped when no new
+// response can be fetched, since clients would reject it.
+func (s *ocspStapler) refresh(ctx context.Context) (time.Duration, error) {
+	resp, raw, err := s.fetch(ctx)
+	if err != nil {
+		if !s.nextUpdate.IsZero() && time.Now().After(s.nextUpdate) {
+			cert := s.cert
+			s.current.Store(&cert)
+			s.nextUpdate = time.Time{}
+		}
+		return ocspRetry, err
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		log.Printf("OCSP stapling: the certificate of %s was revoked at %v", s.file, resp.RevokedAt)
+	default:
+		log.Printf("OCSP stapling: the responder doesn't know the certificate of %s", s.file)
+	}
+
+	cert := s.cert
+	cert.OCSPStaple = raw
+	s.current.Store(&cert)
+	s.nextUpdate = resp.NextUpdate
+	s.refreshes.Add(1)
+
+	if resp.NextUpdate.IsZero() {
+		return ocspDefaultRefresh, nil
+	}
+	return max(resp.NextUpdate.Sub(resp.ThisUpdate)/2-time.Since(resp.ThisUpdate), ocspRetry), nil
+}
+
+func (s *ocspStapler) fetch(ctx context.Context) (*ocsp.Response, []byte, error) {
+	reqBody, err := ocsp.CreateRequest(s.leaf, s.issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := s.client()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.leaf.OCSPServer[0], bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = httpResp.Body.Close()
+	}()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: %s", s.leaf.OCSPServer[0], httpResp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, ocspMaxResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, s.leaf, s.issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		return nil, nil, errors.New("responder sent an expired response")
+	}
+	return resp, raw, nil
+}
+
+// writeOCSPMetrics writes the metrics of staplers labeled with their
+// certificate file.
+func writeOCSPMetrics(pw metricsWriter, staplers []*ocspStapler) {
+	if len(staplers) == 0 {
+		return
+	}
+
+	pw.header("http2socks_tls_ocsp_stapled", "gauge", "Whether handshakes carry a stapled OCSP response.")
+	for _, s := range staplers {
+		stapled := 0.0
+		if len(s.current.Load().OCSPStaple) > 0 {
+			stapled = 1
+		}
+		pw.sample("http2socks_tls_ocsp_stapled", map[string]string{"cert": s.file}, stapled)
+	}
+	pw.header("http2socks_tls_ocsp_refreshes_total", "counter", "OCSP responses fetched for stapling.")
+	for _, s := range staplers {
+		pw.sample("http2socks_tls_ocsp_refreshes_total", map[string]string{"cert": s.file}, float64(s.refreshes.Load()))
+	}
+	pw.header("http2socks_tls_ocsp_errors_total", "counter", "Failed refreshes of the stapled OCSP response.")
+	for _, s := range staplers {
+		pw.sample("http2socks_tls_ocsp_errors_total", map[string]string{"cert": s.file}, float64(s.errors.Load()))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+// generatePAC returns a proxy auto-config script which sends plain host
+// names and loopback addresses DIRECT, and other destinations DIRECT or
+// through proxyAddr as the first routing rule they match says. Locations
+// can't be looked up by PAC and rules by location are left out.
+func generatePAC(proxyAddr string, rules routingRules) string {
+	proxyResult := strconv.Quote("PROXY " + proxyAddr)
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host) || host === \"localhost\" || shExpMatch(host, \"127.*\") || host === \"::1\") {\n")
+	b.WriteString("\t\treturn \"DIRECT\";\n")
+	b.WriteString("\t}\n")
+
+	// Destinations matching no rule go through the proxy, so do those
+	// matching rules after the last direct one.
+	last := -1
+	for i, rule := range rules {
+		if rule.action == routeDirect {
+			last = i
+		}
+	}
+	for _, rule := range rules[:last+1] {
+		conds := pacConditions(rule.hosts)
+		if len(conds) == 0 {
+			continue
+		}
+		result := proxyResult
+		if rule.action == routeDirect {
+			result = `"DIRECT"`
+		}
+		b.WriteString("\tif (")
+		b.WriteString(strings.Join(conds, " ||\n\t\t"))
+		fmt.Fprintf(&b, ") {\n\t\treturn %s;\n\t}\n", result)
+	}
+
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", proxyResult)
+	return b.String()
+}
+
+// pacConditions returns PAC conditions matching the patterns of m.
+func pacConditions(m *hostMatcher) []string {
+	if m.empty() {
+		return nil
+	}
+
+	var conds []string
+	exact := make([]string, 0, len(m.exact))
+	for host := range m.exact {
+		exact = append(exact, host)
+	}
+	sort.Strings(exact)
+	for _, host := range exact {
+		conds = append(conds, "host === "+strconv.Quote(host))
+	}
+	for _, suffix := range m.suffixes {
+		conds = append(conds, "dnsDomainIs(host, "+strconv.Quote(suffix)+")")
+	}
+	for _, prefix := range m.prefixes {
+		if cond, ok := pacNetCondition(prefix); ok {
+			conds = append(conds, cond)
+		}
+	}
+	return conds
+}
+
+// pacNetCondition returns a condition matching IPv4 literals in prefix.
+// isInNet would resolve host names, so it's applied to literals only. IPv6
+// networks have no portable PAC function and are skipped.
+func pacNetCondition(prefix netip.Prefix) (string, bool) {
+	if !prefix.Addr().Is4() {
+		return "", false
+	}
+	var mask [4]byte
+	for i := range mask {
+		n := min(max(prefix.Bits()-8*i, 0), 8)
+		mask[i] = byte(0xff << (8 - n))
+	}
+	return fmt.Sprintf(`(/^\d+\.\d+\.\d+\.\d+$/.test(host) && isInNet(host, %q, %q))`,
+		prefix.Addr(), netip.AddrFrom4(mask)), true
+}
+
+// handlePAC serves the PAC file. The proxy is announced with the configured
+// address, or with the host the PAC file was requested from.
+func (p *forwardProxy) handlePAC(w http.ResponseWriter, req *http.Request) {
+	addr := p.pacProxyAddress
+	if addr == "" {
+		addr = req.Host
+	}
+	p.writePAC(w, addr)
+}
+
+// adminPACHandler serves the PAC file on the admin API. Unless configured,
+// the proxy is announced with the host the PAC file was requested from and
+// proxyPort, the port of the proxy listener.
+func (p *forwardProxy) adminPACHandler(proxyPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		addr := p.pacProxyAddress
+		if addr == "" {
+			host := req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			addr = net.JoinHostPort(strings.Trim(host, "[]"), proxyPort)
+		}
+		p.writePAC(w, addr)
+	}
+}
+
+func (p *forwardProxy) writePAC(w http.ResponseWriter, proxyAddr string) {
+	w.Header().Set("Content-Type", pacContentType)
+	_, _ = w.Write([]byte(generatePAC(proxyAddr, p.router.rules())))
+}
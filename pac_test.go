@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	rules, err := parseRoutingRules([]string{
+		"proxy api.corp.example",
+		"direct .corp.example",
+		"direct country:DE",
+		"direct 10.0.0.0/8",
+		"block ads.example",
+		"proxy .example",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bypass, err := bypassRules([]string{"intranet"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac := generatePAC("proxy.example:8080", append(rules, bypass...))
+
+	// Conditions in the order of the rules, each with its result.
+	want := []string{
+		`isPlainHostName(host)`,
+		`host === "api.corp.example") {
+		return "PROXY proxy.example:8080";`,
+		`host === "corp.example" ||
+		dnsDomainIs(host, ".corp.example")) {
+		return "DIRECT";`,
+		`isInNet(host, "10.0.0.0", "255.0.0.0"))) {
+		return "DIRECT";`,
+		`host === "ads.example") {
+		return "PROXY proxy.example:8080";`,
+		`dnsDomainIs(host, ".example")) {
+		return "PROXY proxy.example:8080";`,
+		`host === "intranet" ||
+		dnsDomainIs(host, ".intranet")) {
+		return "DIRECT";`,
+		`return "PROXY proxy.example:8080";
+}`,
+	}
+	rest := pac
+	for _, w := range want {
+		i := strings.Index(rest, w)
+		if i < 0 {
+			t.Fatalf("generated PAC lacks %q after the previous conditions:\n%s", w, pac)
+		}
+		rest = rest[i+len(w):]
+	}
+	if strings.Contains(pac, "DE") {
+		t.Errorf("generated PAC has the country rule:\n%s", pac)
+	}
+}
+
+func TestGeneratePACTrailingProxyRules(t *testing.T) {
+	rules, err := parseRoutingRules([]string{"direct .corp.example", "proxy .example", "block ads.example"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac := generatePAC("proxy.example:8080", rules)
+	if strings.Contains(pac, `".example"`) || strings.Contains(pac, "ads.example") {
+		t.Errorf("generated PAC has rules after the last direct one:\n%s", pac)
+	}
+	if pac := generatePAC("proxy.example:8080", nil); strings.Count(pac, "if (") != 1 {
+		t.Errorf("generated PAC without rules has conditions other than the local ones:\n%s", pac)
+	}
+}
@@ -0,0 +1,764 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxPACFileSize limits the size of a PAC file.
+const maxPACFileSize = 4 << 20
+
+// pacEvalTimeout bounds the evaluation of FindProxyForURL for a request,
+// including the names it resolves.
+const pacEvalTimeout = 3 * time.Second
+
+// pacRetryInterval is how often a PAC file URL which couldn't be fetched
+// at startup is tried again.
+const pacRetryInterval = time.Minute
+
+// pacRouter routes requests by the FindProxyForURL function of a PAC file,
+// a local file or a URL, for destinations no routing rule matches. DIRECT
+// connects directly, proxies naming an upstream server by name or address
+// go through that server, and requests go through the upstream as usual
+// when no proxy the script returns is usable. The file is loaded again on
+// reload.
+type pacRouter struct {
+	client func() (*http.Client, error)
+	env    *pacEnv
+
+	// mu serializes loads, which set source.
+	mu      sync.Mutex
+	source  string
+	enabled atomic.Bool
+	script  atomic.Pointer[pacScript]
+
+	direct    atomic.Int64
+	servers   atomic.Int64
+	fallbacks atomic.Int64
+	failures  atomic.Int64
+	loads     atomic.Int64
+}
+
+// pacScript is a parsed PAC file.
+type pacScript struct {
+	source string
+	text   string
+	prog   *jsFuncLit
+	// fn is FindProxyForURLEx when the file defines it, which returns
+	// IPv6 addresses too, or FindProxyForURL.
+	fn string
+}
+
+// newPACRouter returns the router by the PAC file source, which is yet to
+// be loaded, fetching URLs with client.
+func newPACRouter(source string, client func() (*http.Client, error)) *pacRouter {
+	r := &pacRouter{client: client, env: newPACEnv(), source: source}
+	r.enabled.Store(source != "")
+	return r
+}
+
+// load loads the PAC file source, dropping the script when it's empty,
+// and keeps the previous script when it fails. Nil-safe.
+func (r *pacRouter) load(ctx context.Context, source string) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.source = source
+	r.enabled.Store(source != "")
+	if source == "" {
+		if r.script.Swap(nil) != nil {
+			log.Print("PAC file routing disabled")
+		}
+		return nil
+	}
+
+	text, err := r.read(ctx, source)
+	if err == nil {
+		if prev := r.script.Load(); prev != nil && prev.source == source && prev.text == text {
+			return nil
+		}
+		var script *pacScript
+		if script, err = parsePACScript(source, text); err == nil {
+			r.script.Store(script)
+			r.loads.Add(1)
+			log.Printf("PAC file %s loaded, routing by %s", source, script.fn)
+			return nil
+		}
+	}
+	r.failures.Add(1)
+	return fmt.Errorf("PAC file %s: %w", source, err)
+}
+
+// run loads the PAC file URL until it was loaded, from here or by a
+// reload, so a server which is unreachable at startup doesn't hold it up.
+// Requests go through the upstream until then.
+func (r *pacRouter) run(ctx context.Context) {
+	ticker := time.NewTicker(pacRetryInterval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		source := r.source
+		r.mu.Unlock()
+		if source == "" || r.script.Load() != nil {
+			return
+		}
+		if err := r.load(ctx, source); err != nil {
+			log.Printf("loading the PAC file failed, trying again in %v: %v", pacRetryInterval, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *pacRouter) read(ctx context.Context, source string) (string, error) {
+	var rd io.ReadCloser
+	if isURLSource(source) {
+		client, err := r.client()
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, http.NoBody)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return "", fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		rd = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return "", err
+		}
+		rd = f
+	}
+	defer func() {
+		_ = rd.Close()
+	}()
+
+	b, err := io.ReadAll(io.LimitReader(rd, maxPACFileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxPACFileSize {
+		return "", fmt.Errorf("larger than %d bytes", maxPACFileSize)
+	}
+	return string(b), nil
+}
+
+// isURLSource reports whether source is fetched over HTTP rather than a
+// local file.
+func isURLSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// parsePACScript parses the PAC file text, which has to define
+// FindProxyForURL or FindProxyForURLEx.
+func parsePACScript(source, text string) (*pacScript, error) {
+	prog, err := parseJS(text)
+	if err != nil {
+		return nil, err
+	}
+	script := &pacScript{source: source, text: text, prog: prog}
+	for _, f := range prog.funcs {
+		switch f.name {
+		case "FindProxyForURLEx":
+			script.fn = f.name
+		case "FindProxyForURL":
+			if script.fn == "" {
+				script.fn = f.name
+			}
+		}
+	}
+	if script.fn == "" {
+		return nil, fmt.Errorf("FindProxyForURL isn't defined")
+	}
+	return script, nil
+}
+
+// pacURL returns the URL FindProxyForURL sees for req: CONNECT tunnels
+// only show the scheme and host, like browsers do for https URLs.
+func pacURL(req *http.Request, target connectTarget) string {
+	if req.Method != http.MethodConnect {
+		return req.URL.String()
+	}
+	host := target.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if target.Port != "443" {
+		host += ":" + target.Port
+	}
+	return "https://" + host + "/"
+}
+
+// pacDecision is where the PAC file sends a request.
+type pacDecision struct {
+	// result is what FindProxyForURL returned.
+	result string
+	direct bool
+	// server is the upstream server requests go through, empty for the
+	// upstream as usual.
+	server string
+}
+
+// evaluate returns what FindProxyForURL of the script in use returns for
+// rawURL and host.
+func (r *pacRouter) evaluate(ctx context.Context, rawURL, host string) (string, error) {
+	script := r.script.Load()
+	if script == nil {
+		return "", fmt.Errorf("no PAC file loaded")
+	}
+	ctx, cancel := context.WithTimeout(ctx, pacEvalTimeout)
+	defer cancel()
+	in := &jsInterp{ctx: ctx, global: newJSScope(r.env.builtins), host: r.env}
+	result, err := in.run(script.prog, script.fn, rawURL, host)
+	if err != nil {
+		return "", err
+	}
+	s, ok := result.(string)
+	if !ok {
+		return "", fmt.Errorf("%s returned %s, not a string", script.fn, jsToString(result))
+	}
+	return s, nil
+}
+
+// decide returns where the PAC file sends a request for rawURL to host,
+// with the servers of u. It's false without a PAC file. Nil-safe.
+func (r *pacRouter) decide(ctx context.Context, rawURL, host string, u *upstream) (pacDecision, bool) {
+	if r == nil || !r.enabled.Load() {
+		return pacDecision{}, false
+	}
+
+	result, err := r.evaluate(ctx, rawURL, host)
+	if err != nil {
+		r.failures.Add(1)
+		r.fallbacks.Add(1)
+		sessionLogger(ctx).Printf("PAC file evaluation failed, using the upstream: %v", err)
+		return pacDecision{}, true
+	}
+	d := pacDecision{result: result}
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" && len(fields) == 1 {
+			d.direct = true
+			r.direct.Add(1)
+			return d, true
+		}
+		if len(fields) != 2 || !pacProxyKinds[kind] {
+			continue
+		}
+		if i := u.serverIndex(fields[1]); i >= 0 {
+			d.server = fields[1]
+			r.servers.Add(1)
+			return d, true
+		}
+	}
+	r.fallbacks.Add(1)
+	sessionLogger(ctx).Printf("PAC file returned no usable proxy, using the upstream: %q", result)
+	return d, true
+}
+
+// pacProxyKinds are the kinds of proxies PAC files return, which are used
+// when they name an upstream server.
+var pacProxyKinds = map[string]bool{
+	"PROXY": true, "HTTP": true, "HTTPS": true, "SOCKS": true, "SOCKS4": true, "SOCKS5": true,
+}
+
+type pacDirectKey struct{}
+
+// withPACDirect returns ctx of a request the PAC file sends directly.
+func withPACDirect(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pacDirectKey{}, true)
+}
+
+// pacDirect reports whether the PAC file sends the request of ctx
+// directly.
+func pacDirect(ctx context.Context) bool {
+	direct, _ := ctx.Value(pacDirectKey{}).(bool)
+	return direct
+}
+
+func (r *pacRouter) writeMetrics(pw metricsWriter) {
+	if r == nil || !r.enabled.Load() && r.loads.Load() == 0 {
+		return
+	}
+
+	pw.counter("http2socks_pac_direct_total", "Requests the PAC file sent directly.", r.direct.Load())
+	pw.counter("http2socks_pac_server_total", "Requests the PAC file sent through a named upstream server.", r.servers.Load())
+	pw.counter("http2socks_pac_fallback_total", "Requests going through the upstream because the PAC file returned no usable proxy or failed.", r.fallbacks.Load())
+	pw.counter("http2socks_pac_failures_total", "PAC file evaluations and loads that failed.", r.failures.Load())
+	pw.counter("http2socks_pac_loads_total", "Times the PAC file was loaded.", r.loads.Load())
+}
+
+// pacEnv holds the functions PAC files call, which look names up with
+// lookup.
+type pacEnv struct {
+	lookup   func(ctx context.Context, host string) ([]netip.Addr, error)
+	myIP     func() []netip.Addr
+	builtins *jsScope
+}
+
+func newPACEnv() *pacEnv {
+	env := &pacEnv{
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		myIP: localAddrs,
+	}
+	env.builtins = pacBuiltins()
+	return env
+}
+
+// localAddrs returns the addresses of this host, the one of the interface
+// of the default route first.
+func localAddrs() []netip.Addr {
+	var addrs []netip.Addr
+	// Dialing UDP sends nothing, it only picks the local address.
+	if conn, err := net.Dial("udp", "192.0.2.1:80"); err == nil {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			addrs = append(addrs, addr.AddrPort().Addr().Unmap())
+		}
+		_ = conn.Close()
+	}
+	ifAddrs, _ := net.InterfaceAddrs()
+	for _, a := range ifAddrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil && !prefix.Addr().IsLoopback() && !prefix.Addr().IsLinkLocalUnicast() {
+			addrs = append(addrs, prefix.Addr())
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, netip.MustParseAddr("127.0.0.1"))
+	}
+	return addrs
+}
+
+// resolve returns the addresses of host, which may be an address.
+func (e *pacEnv) resolve(in *jsInterp, host string) []netip.Addr {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return []netip.Addr{addr.Unmap()}
+	}
+	addrs, err := e.lookup(in.ctx, host)
+	if err != nil {
+		return nil
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs
+}
+
+func firstIPv4(addrs []netip.Addr) (netip.Addr, bool) {
+	for _, addr := range addrs {
+		if addr.Is4() {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func joinAddrs(addrs []netip.Addr) string {
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ";")
+}
+
+var pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+var pacMonths = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// pacNow returns the current time, in UTC when the last argument is "GMT",
+// and the arguments without it.
+func pacNow(args []jsValue) (time.Time, []jsValue) {
+	now := jsNow()
+	if len(args) > 0 && jsToString(args[len(args)-1]) == "GMT" {
+		return now.UTC(), args[:len(args)-1]
+	}
+	return now, args
+}
+
+// inRange reports whether now is between start and end, compared field by
+// field and inclusive; ranges with a start after the end wrap around.
+func inRange(start, now, end []int) bool {
+	cmp := func(a, b []int) int {
+		for i := range a {
+			if a[i] != b[i] {
+				if a[i] < b[i] {
+					return -1
+				}
+				return 1
+			}
+		}
+		return 0
+	}
+	if cmp(start, end) <= 0 {
+		return cmp(start, now) <= 0 && cmp(now, end) <= 0
+	}
+	return cmp(start, now) <= 0 || cmp(now, end) <= 0
+}
+
+// shExpMatch matches s against a shell expression with * and ?.
+func shExpMatch(s, pattern string) bool {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	return err == nil && re.MatchString(s)
+}
+
+// pacDateField is a field of a dateRange argument.
+type pacDateField int
+
+const (
+	pacDay pacDateField = iota
+	pacMonth
+	pacYear
+)
+
+// dateRange implements dateRange of PAC files: a day, month or year, or
+// ranges of days, months, years or combinations of them.
+func dateRange(args []jsValue) bool {
+	now, args := pacNow(args)
+	type value struct {
+		field pacDateField
+		n     int
+	}
+	values := make([]value, len(args))
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			month := indexOf(pacMonths, strings.ToUpper(s))
+			if month < 0 {
+				return false
+			}
+			values[i] = value{pacMonth, month}
+			continue
+		}
+		n := int(jsToNumber(arg))
+		if n > 31 {
+			values[i] = value{pacYear, n}
+		} else {
+			values[i] = value{pacDay, n}
+		}
+	}
+	current := func(field pacDateField) int {
+		switch field {
+		case pacDay:
+			return now.Day()
+		case pacMonth:
+			return int(now.Month()) - 1
+		}
+		return now.Year()
+	}
+
+	switch len(values) {
+	case 1:
+		return current(values[0].field) == values[0].n
+	case 2, 4, 6:
+	default:
+		return false
+	}
+	half := len(values) / 2
+	start, end := values[:half], values[half:]
+	// Fields are compared from the most significant, the year.
+	var startNs, nowNs, endNs []int
+	for field := pacYear; field >= pacDay; field-- {
+		i := -1
+		for j, v := range start {
+			if v.field == field {
+				i = j
+			}
+		}
+		if i < 0 {
+			continue
+		}
+		if end[i].field != field {
+			return false
+		}
+		startNs = append(startNs, start[i].n)
+		nowNs = append(nowNs, current(field))
+		endNs = append(endNs, end[i].n)
+	}
+	if len(startNs) != half {
+		return false
+	}
+	return inRange(startNs, nowNs, endNs)
+}
+
+// timeRange implements timeRange of PAC files: an hour, or ranges of
+// hours, hours and minutes, or hours, minutes and seconds.
+func timeRange(args []jsValue) bool {
+	now, args := pacNow(args)
+	n := make([]int, len(args))
+	for i, arg := range args {
+		n[i] = int(jsToNumber(arg))
+	}
+	current := []int{now.Hour(), now.Minute(), now.Second()}
+	switch len(n) {
+	case 1:
+		return current[0] == n[0]
+	case 2, 4, 6:
+		half := len(n) / 2
+		return inRange(n[:half], current[:half], n[half:])
+	}
+	return false
+}
+
+// weekdayRange implements weekdayRange of PAC files: a weekday or a range
+// of them.
+func weekdayRange(args []jsValue) bool {
+	now, args := pacNow(args)
+	if len(args) == 0 || len(args) > 2 {
+		return false
+	}
+	days := make([]int, len(args))
+	for i, arg := range args {
+		if days[i] = indexOf(pacWeekdays, strings.ToUpper(jsToString(arg))); days[i] < 0 {
+			return false
+		}
+	}
+	today := int(now.Weekday())
+	if len(days) == 1 {
+		return today == days[0]
+	}
+	return inRange(days[:1], []int{today}, days[1:])
+}
+
+// jsFloatPrefix matches the number parseFloat parses at the start of a
+// string.
+var jsFloatPrefix = regexp.MustCompile(`^[+-]?(Infinity|(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?)`)
+
+// pacBuiltins returns the scope of the functions PAC files call along with
+// the parts of the JavaScript library they use.
+func pacBuiltins() *jsScope {
+	scope := &jsScope{vars: make(map[string]jsValue), readOnly: true}
+	define := func(name string, f jsNative) {
+		scope.vars[name] = &jsFunction{name: name, native: f}
+	}
+	str := func(args []jsValue, i int) string {
+		return jsToString(jsArg(args, i))
+	}
+	env := func(in *jsInterp) *pacEnv {
+		return in.host.(*pacEnv)
+	}
+
+	define("isPlainHostName", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		return !strings.Contains(str(args, 0), ".")
+	})
+	define("dnsDomainIs", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		return strings.HasSuffix(strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1)))
+	})
+	define("localHostOrDomainIs", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		host, hostDom := strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1))
+		if host == hostDom {
+			return true
+		}
+		return !strings.Contains(host, ".") && strings.HasPrefix(hostDom, host+".")
+	})
+	define("dnsDomainLevels", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		return float64(strings.Count(str(args, 0), "."))
+	})
+	define("shExpMatch", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		return shExpMatch(str(args, 0), str(args, 1))
+	})
+	define("isResolvable", func(in *jsInterp, _ jsValue, args []jsValue) jsValue {
+		_, ok := firstIPv4(env(in).resolve(in, str(args, 0)))
+		return ok
+	})
+	define("isResolvableEx", func(in *jsInterp, _ jsValue, args []jsValue) jsValue {
+		return len(env(in).resolve(in, str(args, 0))) > 0
+	})
+	define("dnsResolve", func(in *jsInterp, _ jsValue, args []jsValue) jsValue {
+		if addr, ok := firstIPv4(env(in).resolve(in, str(args, 0))); ok {
+			return addr.String()
+		}
+		return jsNull
+	})
+	define("dnsResolveEx", func(in *jsInterp, _ jsValue, args []jsValue) jsValue {
+		return joinAddrs(env(in).resolve(in, str(args, 0)))
+	})
+	define("myIpAddress", func(in *jsInterp, _ jsValue, _ []jsValue) jsValue {
+		if addr, ok := firstIPv4(env(in).myIP()); ok {
+			return addr.String()
+		}
+		return "127.0.0.1"
+	})
+	define("myIpAddressEx", func(in *jsInterp, _ jsValue, _ []jsValue) jsValue {
+		return joinAddrs(env(in).myIP())
+	})
+	define("isInNet", func(in *jsInterp, _ jsValue, args []jsValue) jsValue {
+		addr, ok := firstIPv4(env(in).resolve(in, str(args, 0)))
+		pattern, err1 := netip.ParseAddr(str(args, 1))
+		mask, err2 := netip.ParseAddr(str(args, 2))
+		if !ok || err1 != nil || err2 != nil || !pattern.Is4() || !mask.Is4() {
+			return false
+		}
+		a, p, m := addr.As4(), pattern.As4(), mask.As4()
+		return binary.BigEndian.Uint32(a[:])&binary.BigEndian.Uint32(m[:]) == binary.BigEndian.Uint32(p[:])&binary.BigEndian.Uint32(m[:])
+	})
+	define("isInNetEx", func(in *jsInterp, _ jsValue, args []jsValue) jsValue {
+		prefix, err := netip.ParsePrefix(str(args, 1))
+		if err != nil {
+			return false
+		}
+		for _, addr := range env(in).resolve(in, str(args, 0)) {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	})
+	define("convert_addr", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		addr, err := netip.ParseAddr(str(args, 0))
+		if err != nil || !addr.Is4() {
+			return float64(0)
+		}
+		a := addr.As4()
+		return float64(binary.BigEndian.Uint32(a[:]))
+	})
+	define("weekdayRange", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue { return weekdayRange(args) })
+	define("dateRange", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue { return dateRange(args) })
+	define("timeRange", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue { return timeRange(args) })
+	define("alert", func(in *jsInterp, _ jsValue, args []jsValue) jsValue {
+		sessionLogger(in.ctx).Printf("PAC file: %s", str(args, 0))
+		return nil
+	})
+
+	define("parseInt", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		s := strings.TrimSpace(str(args, 0))
+		radix := jsIndexArg(args, 1, 10)
+		sign := 1.0
+		if rest, ok := strings.CutPrefix(s, "-"); ok {
+			s, sign = rest, -1
+		} else {
+			s = strings.TrimPrefix(s, "+")
+		}
+		if (radix == 16 || jsArg(args, 1) == nil) && (strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X")) {
+			s, radix = s[2:], 16
+		}
+		if radix == 0 {
+			radix = 10
+		}
+		if radix < 2 || radix > 36 {
+			return math.NaN()
+		}
+		n, digits := 0.0, 0
+		for _, c := range strings.ToLower(s) {
+			d := strings.IndexRune("0123456789abcdefghijklmnopqrstuvwxyz", c)
+			if d < 0 || d >= radix {
+				break
+			}
+			n = n*float64(radix) + float64(d)
+			digits++
+		}
+		if digits == 0 {
+			return math.NaN()
+		}
+		return sign * n
+	})
+	define("parseFloat", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		prefix := jsFloatPrefix.FindString(strings.TrimSpace(str(args, 0)))
+		if prefix == "" {
+			return math.NaN()
+		}
+		return jsToNumber(prefix)
+	})
+	define("isNaN", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		return math.IsNaN(jsToNumber(jsArg(args, 0)))
+	})
+	define("String", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		if len(args) == 0 {
+			return ""
+		}
+		return jsToString(args[0])
+	})
+	define("Number", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		if len(args) == 0 {
+			return float64(0)
+		}
+		return jsToNumber(args[0])
+	})
+	define("Boolean", func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		return jsTruthy(jsArg(args, 0))
+	})
+
+	mathObj := newJSObject()
+	mathFunc := func(name string, f func(x float64) float64) {
+		mathObj.set(name, &jsFunction{name: name, native: func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+			return f(jsToNumber(jsArg(args, 0)))
+		}})
+	}
+	mathFunc("floor", math.Floor)
+	mathFunc("ceil", math.Ceil)
+	mathFunc("round", func(x float64) float64 { return math.Floor(x + 0.5) })
+	mathFunc("abs", math.Abs)
+	mathObj.set("max", &jsFunction{name: "max", native: func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		m := math.Inf(-1)
+		for _, arg := range args {
+			if n := jsToNumber(arg); math.IsNaN(n) || n > m {
+				m = n
+			}
+		}
+		return m
+	}})
+	mathObj.set("min", &jsFunction{name: "min", native: func(_ *jsInterp, _ jsValue, args []jsValue) jsValue {
+		m := math.Inf(1)
+		for _, arg := range args {
+			if n := jsToNumber(arg); math.IsNaN(n) || n < m {
+				m = n
+			}
+		}
+		return m
+	}})
+	scope.vars["Math"] = mathObj
+	scope.vars["NaN"] = math.NaN()
+	scope.vars["Infinity"] = math.Inf(1)
+	return scope
+}
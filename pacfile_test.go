@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPACEnv resolves names from hosts and has the address 10.1.2.3.
+func testPACEnv(hosts map[string]string) *pacEnv {
+	env := newPACEnv()
+	env.lookup = func(_ context.Context, host string) ([]netip.Addr, error) {
+		addrs, ok := hosts[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		var res []netip.Addr
+		for _, addr := range strings.Split(addrs, ",") {
+			res = append(res, netip.MustParseAddr(addr))
+		}
+		return res, nil
+	}
+	env.myIP = func() []netip.Addr {
+		return []netip.Addr{netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("fd00::3")}
+	}
+	return env
+}
+
+func TestPACBuiltins(t *testing.T) {
+	// Thursday, 15 October 2026.
+	now := time.Date(2026, 10, 15, 14, 30, 15, 0, time.UTC)
+	defer func(prev func() time.Time) { jsNow = prev }(jsNow)
+	jsNow = func() time.Time { return now }
+
+	env := testPACEnv(map[string]string{
+		"intranet.corp": "10.20.0.5",
+		"dual.example":  "2001:db8::1,192.0.2.7",
+		"v6.example":    "2001:db8::2",
+	})
+	tests := []struct {
+		call string
+		want jsValue
+	}{
+		{"isPlainHostName('intranet')", true},
+		{"isPlainHostName('intranet.corp')", false},
+		{"dnsDomainIs('www.Example.com', '.example.com')", true},
+		{"dnsDomainIs('example.com', '.example.com')", false},
+		{"localHostOrDomainIs('www', 'www.example.com')", true},
+		{"localHostOrDomainIs('www.example.com', 'www.example.com')", true},
+		{"localHostOrDomainIs('www.other.com', 'www.example.com')", false},
+		{"dnsDomainLevels('www.example.com')", 2.0},
+		{"shExpMatch('http://www.example.com/a/b', '*/a/*')", true},
+		{"shExpMatch('www.example.com', '*.example.?om')", true},
+		{"shExpMatch('www.example.com', '*.example.org')", false},
+		{"shExpMatch('a.b', 'a?b')", true},
+		{"shExpMatch('a(b', 'a(b')", true},
+		{"isResolvable('intranet.corp')", true},
+		{"isResolvable('missing.corp')", false},
+		{"isResolvable('v6.example')", false},
+		{"isResolvableEx('v6.example')", true},
+		{"dnsResolve('dual.example')", "192.0.2.7"},
+		{"dnsResolve('missing.corp')", jsNull},
+		{"dnsResolveEx('dual.example')", "2001:db8::1;192.0.2.7"},
+		{"isInNet('intranet.corp', '10.20.0.0', '255.255.0.0')", true},
+		{"isInNet('10.21.0.1', '10.20.0.0', '255.255.0.0')", false},
+		{"isInNet('missing.corp', '0.0.0.0', '0.0.0.0')", false},
+		{"isInNetEx('v6.example', '2001:db8::/32')", true},
+		{"isInNetEx('intranet.corp', '10.0.0.0/8')", true},
+		{"convert_addr('10.0.0.1')", float64(10<<24 + 1)},
+		{"myIpAddress()", "10.1.2.3"},
+		{"myIpAddressEx()", "10.1.2.3;fd00::3"},
+		{"weekdayRange('THU')", true},
+		{"weekdayRange('MON', 'FRI')", true},
+		{"weekdayRange('FRI', 'MON')", false},
+		{"weekdayRange('SAT', 'THU')", true},
+		{"weekdayRange('THU', 'GMT')", true},
+		{"weekdayRange('XYZ')", false},
+		{"dateRange(15)", true},
+		{"dateRange('OCT')", true},
+		{"dateRange(2026)", true},
+		{"dateRange(1, 14)", false},
+		{"dateRange('SEP', 'NOV')", true},
+		{"dateRange('NOV', 'FEB')", false},
+		{"dateRange('DEC', 'OCT')", true},
+		{"dateRange(1, 'OCT', 31, 'DEC')", true},
+		{"dateRange(16, 'OCT', 31, 'DEC')", false},
+		{"dateRange('OCT', 2025, 'JAN', 2027)", true},
+		{"dateRange(1, 'JAN', 2027, 31, 'DEC', 2027)", false},
+		{"dateRange(1, 'OCT', 2026, 15, 'OCT', 2026, 'GMT')", true},
+		{"timeRange(14)", true},
+		{"timeRange(9, 17)", true},
+		{"timeRange(22, 6)", false},
+		{"timeRange(14, 30, 14, 31)", true},
+		{"timeRange(14, 31, 15, 0)", false},
+		{"timeRange(14, 30, 0, 14, 30, 15)", true},
+		{"timeRange(14, 30, 16, 14, 30, 59, 'GMT')", false},
+	}
+	for _, tt := range tests {
+		prog, err := parseJS("function f() { return " + tt.call + " }")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.call, err)
+		}
+		in := &jsInterp{ctx: context.Background(), global: newJSScope(env.builtins), host: env}
+		got, err := in.run(prog, "f")
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %#v, %v, want %#v", tt.call, got, err, tt.want)
+		}
+	}
+}
+
+const testPACFile = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".corp"))
+		return "DIRECT";
+	if (shExpMatch(url, "*/via-named/*"))
+		return "PROXY unknown.example:3128; SOCKS5 second; DIRECT";
+	if (host == "by-address.example")
+		return "SOCKS 127.0.0.1:1081";
+	if (host == "unknown.example")
+		return "PROXY unknown.example:3128";
+	if (host == "broken.example")
+		return broken();
+	if (host == "number.example")
+		return 1;
+	return "PROXY first";
+}
+`
+
+func TestPACRouterDecide(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.pac")
+	if err := os.WriteFile(path, []byte(testPACFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := newPACRouter(path, nil)
+	if err := r.load(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	u := &upstream{servers: []*upstreamServer{
+		{socksEndpoint: socksEndpoint{server: "127.0.0.1:1080"}, name: "first"},
+		{socksEndpoint: socksEndpoint{server: "127.0.0.1:1081"}, name: "second", reserved: true},
+	}}
+
+	tests := []struct {
+		url  string
+		want pacDecision
+	}{
+		{"http://intranet/", pacDecision{result: "DIRECT", direct: true}},
+		{"https://git.corp/", pacDecision{result: "DIRECT", direct: true}},
+		{"http://www.example.com/via-named/x", pacDecision{result: "PROXY unknown.example:3128; SOCKS5 second; DIRECT", server: "second"}},
+		{"https://by-address.example/", pacDecision{result: "SOCKS 127.0.0.1:1081", server: "127.0.0.1:1081"}},
+		{"http://www.example.com/", pacDecision{result: "PROXY first", server: "first"}},
+		{"http://unknown.example/", pacDecision{result: "PROXY unknown.example:3128"}},
+		{"http://broken.example/", pacDecision{}},
+		{"http://number.example/", pacDecision{}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		got, ok := r.decide(context.Background(), req.URL.String(), req.URL.Hostname(), u)
+		if !ok || got != tt.want {
+			t.Errorf("decide(%s) = %+v, %v, want %+v", tt.url, got, ok, tt.want)
+		}
+	}
+	if r.direct.Load() != 2 || r.servers.Load() != 3 || r.fallbacks.Load() != 3 || r.failures.Load() != 2 {
+		t.Errorf("counted %d direct, %d servers, %d fallbacks, %d failures, want 2, 3, 3, 2",
+			r.direct.Load(), r.servers.Load(), r.fallbacks.Load(), r.failures.Load())
+	}
+
+	// A broken file keeps the previous script.
+	if err := os.WriteFile(path, []byte("function FindProxyForURL(url, host) {"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.load(context.Background(), path); err == nil {
+		t.Error("loading a broken PAC file succeeded")
+	}
+	if got, _ := r.decide(context.Background(), "http://intranet/", "intranet", u); !got.direct {
+		t.Errorf("decision after a failed reload = %+v, want the previous script's", got)
+	}
+
+	// Without a file, nothing is decided.
+	if err := r.load(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := r.decide(context.Background(), "http://intranet/", "intranet", u); ok {
+		t.Errorf("decision without a PAC file = %+v", got)
+	}
+	var disabled *pacRouter
+	if _, ok := disabled.decide(context.Background(), "http://intranet/", "intranet", u); ok {
+		t.Error("decision of a nil router")
+	}
+}
+
+func TestPACRouterLoadURL(t *testing.T) {
+	body := `function FindProxyForURL(url, host) { return "PROXY first" }
+		function FindProxyForURLEx(url, host) { return "DIRECT" }`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/proxy.pac" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", pacContentType)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+	client := func() (*http.Client, error) { return server.Client(), nil }
+
+	r := newPACRouter(server.URL+"/proxy.pac", client)
+	if err := r.load(context.Background(), server.URL+"/proxy.pac"); err != nil {
+		t.Fatal(err)
+	}
+	if fn := r.script.Load().fn; fn != "FindProxyForURLEx" {
+		t.Errorf("routing by %s, want FindProxyForURLEx", fn)
+	}
+	// Unchanged files aren't loaded again.
+	if err := r.load(context.Background(), server.URL+"/proxy.pac"); err != nil || r.loads.Load() != 1 {
+		t.Errorf("reloading an unchanged file: %v, %d loads, want 1", err, r.loads.Load())
+	}
+
+	for _, source := range []string{server.URL + "/missing.pac", filepath.Join(t.TempDir(), "missing.pac")} {
+		if err := newPACRouter(source, client).load(context.Background(), source); err == nil {
+			t.Errorf("loading %s succeeded", source)
+		}
+	}
+	if _, err := parsePACScript("test", "function other() {}"); err == nil {
+		t.Error("parsing a PAC file without FindProxyForURL succeeded")
+	}
+}
+
+func TestPACURL(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		want   string
+	}{
+		{http.MethodGet, "http://example.com/a?b=c", "http://example.com/a?b=c"},
+		{http.MethodConnect, "example.com:443", "https://example.com/"},
+		{http.MethodConnect, "example.com:8443", "https://example.com:8443/"},
+		{http.MethodConnect, "[2001:db8::1]:443", "https://[2001:db8::1]/"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		var target connectTarget
+		if tt.method == http.MethodConnect {
+			var err error
+			if target, err = parseConnectTarget(tt.target); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := pacURL(req, target); got != tt.want {
+			t.Errorf("pacURL(%s %s) = %q, want %q", tt.method, tt.target, got, tt.want)
+		}
+	}
+}
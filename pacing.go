@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pacingChunk is the largest write paced at once, so a single large write
+// doesn't go out as one burst after a long wait.
+const pacingChunk = 16 << 10
+
+// tokenBucket smooths a byte stream. Up to burst bytes pass without delay,
+// so short interactive transfers keep their low latency while bulk
+// transfers are paced once the bucket is drained.
+type tokenBucket struct {
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(burst int64) *tokenBucket {
+	return &tokenBucket{
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take removes n tokens refilled at rate bytes per second and returns how
+// long to wait before sending them. The bucket may go into debt, which
+// later writers wait off.
+func (b *tokenBucket) take(n int, rate float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// pacedDirection paces one direction of all transfers. The rate is shared
+// by the QoS classes currently transferring in proportion to their weight,
+// so interactive traffic gets preference over bulk traffic.
+type pacedDirection struct {
+	rate float64
+
+	mu      sync.Mutex
+	buckets [qosClassCount]*tokenBucket
+	active  [qosClassCount]time.Time
+
+	delayed atomic.Int64 // nanoseconds writers waited
+}
+
+func newPacedDirection(rate, burst int64) *pacedDirection {
+	d := &pacedDirection{rate: float64(rate)}
+	for i := range d.buckets {
+		d.buckets[i] = newTokenBucket(burst)
+	}
+	return d
+}
+
+func (d *pacedDirection) take(n int, class qosClass) time.Duration {
+	d.mu.Lock()
+	now := time.Now()
+	d.active[class] = now
+	var weights int
+	for c, last := range d.active {
+		if now.Sub(last) < qosActiveWindow {
+			weights += qosWeights[c]
+		}
+	}
+	d.mu.Unlock()
+
+	return d.buckets[class].take(n, d.rate*float64(qosWeights[class])/float64(weights))
+}
+
+// pacedWriter writes to w at the pace of its direction.
+type pacedWriter struct {
+	w         io.Writer
+	direction *pacedDirection
+	class     qosClass
+}
+
+func (pw pacedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), pacingChunk)]
+		if d := pw.direction.take(len(chunk), pw.class); d > 0 {
+			pw.direction.delayed.Add(int64(d))
+			time.Sleep(d)
+		}
+
+		n, err := pw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// pacedWriteCloser is a pacedWriter of a connection of a tunnel.
+type pacedWriteCloser struct {
+	pacedWriter
+	io.Closer
+}
+
+// pacing paces all transfers of the proxy, separately for data sent to
+// and received from destinations.
+type pacing struct {
+	up   *pacedDirection
+	down *pacedDirection
+}
+
+func newPacing(rate, burst int64) *pacing {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacing{
+		up:   newPacedDirection(rate, burst),
+		down: newPacedDirection(rate, burst),
+	}
+}
+
+// upload returns dst paced as data of class sent to a destination.
+func (p *pacing) upload(dst io.WriteCloser, class qosClass) io.WriteCloser {
+	if p == nil {
+		return dst
+	}
+	return pacedWriteCloser{pacedWriter{dst, p.up, class}, dst}
+}
+
+// download returns dst paced as data of class received from a destination.
+func (p *pacing) download(dst io.Writer, class qosClass) io.Writer {
+	if p == nil {
+		return dst
+	}
+	return pacedWriter{dst, p.down, class}
+}
+
+func (p *pacing) downloadCloser(dst io.WriteCloser, class qosClass) io.WriteCloser {
+	if p == nil {
+		return dst
+	}
+	return pacedWriteCloser{pacedWriter{dst, p.down, class}, dst}
+}
+
+func (p *pacing) writeMetrics(pw metricsWriter) {
+	if p == nil {
+		return
+	}
+	pw.header("http2socks_pacing_delay_seconds_total", "counter", "Time transfers were delayed by pacing.")
+	pw.sample("http2socks_pacing_delay_seconds_total", map[string]string{"direction": "up"}, time.Duration(p.up.delayed.Load()).Seconds())
+	pw.sample("http2socks_pacing_delay_seconds_total", map[string]string{"direction": "down"}, time.Duration(p.down.delayed.Load()).Seconds())
+}
@@ -0,0 +1,2249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is an interpreter of the part of JavaScript PAC files are written
+// in: functions, var declarations, if, switch and loops, the usual
+// operators, strings, arrays, regular expressions and simple objects. It
+// isn't a general JavaScript engine; scripts using anything else fail to
+// load or, for things only known at run time, fail to evaluate.
+
+// jsValue is a value of a script: nil for undefined, jsNull, bool,
+// float64, string, *jsArray, *jsObject, *jsFunction, *jsRegexp or *jsDate.
+type jsValue any
+
+type jsNullValue struct{}
+
+var jsNull jsNullValue
+
+type jsArray struct {
+	elems []jsValue
+	// joining is set while the array is converted to a string, which
+	// leaves out the arrays containing themselves, as JavaScript does.
+	joining bool
+}
+
+type jsObject struct {
+	props map[string]jsValue
+	keys  []string
+}
+
+func newJSObject() *jsObject {
+	return &jsObject{props: make(map[string]jsValue)}
+}
+
+func (o *jsObject) set(key string, v jsValue) {
+	if _, ok := o.props[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.props[key] = v
+}
+
+// jsFunction is a function of the script, a closure over scope, or a
+// native one. Native methods are bound to their receiver this.
+type jsFunction struct {
+	name   string
+	lit    *jsFuncLit
+	scope  *jsScope
+	native func(in *jsInterp, this jsValue, args []jsValue) jsValue
+	this   jsValue
+}
+
+type jsRegexp struct {
+	re     *regexp.Regexp
+	source string
+	global bool
+}
+
+// jsError is a script error, thrown by panicking and recovered where the
+// script is entered.
+type jsError struct {
+	msg string
+}
+
+func (e *jsError) Error() string {
+	return e.msg
+}
+
+func jsThrow(format string, args ...any) {
+	panic(&jsError{msg: fmt.Sprintf(format, args...)})
+}
+
+// Tokens.
+
+type jsTokenKind int
+
+const (
+	jsTokenEOF jsTokenKind = iota
+	jsTokenName
+	jsTokenNumber
+	jsTokenString
+	jsTokenRegexp
+	jsTokenPunct
+)
+
+type jsToken struct {
+	kind jsTokenKind
+	text string // name, punctuator, string value or regexp source
+	num  float64
+	// flags are the flags of a regexp.
+	flags string
+	// newline is set when a line break precedes the token, which ends
+	// statements without a semicolon.
+	newline bool
+	line    int
+}
+
+func (t jsToken) is(punct string) bool {
+	return t.kind == jsTokenPunct && t.text == punct
+}
+
+func (t jsToken) isName(name string) bool {
+	return t.kind == jsTokenName && t.text == name
+}
+
+// jsPuncts are the punctuators, longest first.
+var jsPuncts = []string{
+	">>>=", "===", "!==", ">>>", "<<=", ">>=",
+	"==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "<<", ">>",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "?", ":", "=", "<", ">", "+", "-", "*", "/", "%", "!", "~", "&", "|", "^",
+}
+
+type jsLexer struct {
+	src  string
+	pos  int
+	line int
+	// prev is the last token, which tells whether a / starts a regexp.
+	prev jsToken
+}
+
+func (l *jsLexer) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips white space and comments and reports whether they
+// contained a line break.
+func (l *jsLexer) skipSpace() (bool, error) {
+	newline := false
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			newline = true
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "//"):
+			end := strings.IndexByte(l.src[l.pos:], '\n')
+			if end < 0 {
+				l.pos = len(l.src)
+			} else {
+				l.pos += end
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return false, l.errorf("unterminated comment")
+			}
+			comment := l.src[l.pos : l.pos+2+end+2]
+			if n := strings.Count(comment, "\n"); n > 0 {
+				newline = true
+				l.line += n
+			}
+			l.pos += len(comment)
+		case strings.HasPrefix(l.src[l.pos:], "\u00a0"):
+			l.pos += len("\u00a0")
+		case strings.HasPrefix(l.src[l.pos:], "\ufeff"):
+			l.pos += len("\ufeff")
+		default:
+			return newline, nil
+		}
+	}
+	return newline, nil
+}
+
+// regexpAllowed reports whether a / after the previous token starts a
+// regexp rather than being a division.
+func (l *jsLexer) regexpAllowed() bool {
+	switch l.prev.kind {
+	case jsTokenNumber, jsTokenString, jsTokenRegexp:
+		return false
+	case jsTokenName:
+		switch l.prev.text {
+		case "return", "typeof", "case", "in", "new", "else", "void", "delete":
+			return true
+		}
+		return false
+	case jsTokenPunct:
+		return l.prev.text != ")" && l.prev.text != "]" && l.prev.text != "}"
+	}
+	return true
+}
+
+func (l *jsLexer) next() (jsToken, error) {
+	newline, err := l.skipSpace()
+	if err != nil {
+		return jsToken{}, err
+	}
+	tok, err := l.scan()
+	if err != nil {
+		return jsToken{}, err
+	}
+	tok.newline, tok.line = newline, l.line
+	l.prev = tok
+	return tok, nil
+}
+
+func (l *jsLexer) scan() (jsToken, error) {
+	if l.pos >= len(l.src) {
+		return jsToken{kind: jsTokenEOF}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case isJSNameStart(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isJSNameStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		return jsToken{kind: jsTokenName, text: l.src[start:l.pos]}, nil
+	case isDigit(c) || c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+		return l.scanNumber()
+	case c == '"' || c == '\'':
+		return l.scanString(c)
+	case c == '/' && l.regexpAllowed():
+		return l.scanRegexp()
+	}
+	for _, p := range jsPuncts {
+		if strings.HasPrefix(l.src[l.pos:], p) {
+			l.pos += len(p)
+			return jsToken{kind: jsTokenPunct, text: p}, nil
+		}
+	}
+	return jsToken{}, l.errorf("unexpected character %q", c)
+}
+
+func isJSNameStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (l *jsLexer) scanNumber() (jsToken, error) {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.src) && strings.IndexByte("0123456789abcdefABCDEF", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		n, err := strconv.ParseUint(l.src[start+2:l.pos], 16, 64)
+		if err != nil {
+			return jsToken{}, l.errorf("bad number %q", l.src[start:l.pos])
+		}
+		return jsToken{kind: jsTokenNumber, num: float64(n)}, nil
+	}
+	for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	}
+	n, err := strconv.ParseFloat(l.src[start:l.pos], 64)
+	if err != nil {
+		return jsToken{}, l.errorf("bad number %q", l.src[start:l.pos])
+	}
+	return jsToken{kind: jsTokenNumber, num: n}, nil
+}
+
+func (l *jsLexer) scanString(quote byte) (jsToken, error) {
+	var b strings.Builder
+	l.pos++
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return jsToken{}, l.errorf("unterminated string")
+		}
+		c := l.src[l.pos]
+		l.pos++
+		if c == quote {
+			return jsToken{kind: jsTokenString, text: b.String()}, nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if l.pos >= len(l.src) {
+			return jsToken{}, l.errorf("unterminated string")
+		}
+		c = l.src[l.pos]
+		l.pos++
+		switch c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '0':
+			b.WriteByte(0)
+		case '\n':
+			// A line continuation.
+			l.line++
+		case 'x', 'u':
+			size := 2
+			if c == 'u' {
+				size = 4
+			}
+			if l.pos+size > len(l.src) {
+				return jsToken{}, l.errorf("bad escape in string")
+			}
+			n, err := strconv.ParseUint(l.src[l.pos:l.pos+size], 16, 32)
+			if err != nil {
+				return jsToken{}, l.errorf("bad escape in string")
+			}
+			l.pos += size
+			b.WriteRune(rune(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (l *jsLexer) scanRegexp() (jsToken, error) {
+	start := l.pos + 1
+	inClass := false
+	for l.pos++; ; l.pos++ {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return jsToken{}, l.errorf("unterminated regular expression")
+		}
+		switch l.src[l.pos] {
+		case '\\':
+			l.pos++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if inClass {
+				continue
+			}
+			source := l.src[start:l.pos]
+			l.pos++
+			flagsStart := l.pos
+			for l.pos < len(l.src) && isJSNameStart(l.src[l.pos]) {
+				l.pos++
+			}
+			return jsToken{kind: jsTokenRegexp, text: source, flags: l.src[flagsStart:l.pos]}, nil
+		}
+	}
+}
+
+// Syntax tree.
+
+type jsStmt interface{}
+
+type jsExpr interface{}
+
+type (
+	jsVarStmt struct {
+		names []string
+		inits []jsExpr // nil without an initializer
+	}
+	jsExprStmt struct {
+		x jsExpr
+	}
+	jsIfStmt struct {
+		cond      jsExpr
+		then, els jsStmt
+	}
+	jsReturnStmt struct {
+		x jsExpr
+	}
+	jsBlockStmt struct {
+		list []jsStmt
+	}
+	jsForStmt struct {
+		init       jsStmt
+		cond, post jsExpr
+		body       jsStmt
+	}
+	jsForInStmt struct {
+		name string
+		obj  jsExpr
+		body jsStmt
+	}
+	jsWhileStmt struct {
+		cond jsExpr
+		body jsStmt
+		// do runs the body before checking cond.
+		do bool
+	}
+	jsSwitchStmt struct {
+		tag   jsExpr
+		cases []jsCase
+	}
+	jsCase struct {
+		test jsExpr // nil for default
+		body []jsStmt
+	}
+	jsBreakStmt    struct{}
+	jsContinueStmt struct{}
+	jsEmptyStmt    struct{}
+)
+
+type (
+	jsLiteral struct {
+		v jsValue
+	}
+	jsName struct {
+		name string
+	}
+	jsArrayLit struct {
+		elems []jsExpr
+	}
+	jsObjectLit struct {
+		keys []string
+		vals []jsExpr
+	}
+	// jsFuncLit is a function with the names of its var declarations and
+	// its function declarations, which are hoisted.
+	jsFuncLit struct {
+		name   string
+		params []string
+		body   []jsStmt
+		vars   []string
+		funcs  []*jsFuncLit
+	}
+	jsRegexpLit struct {
+		re *jsRegexp
+	}
+	jsUnary struct {
+		op string
+		x  jsExpr
+	}
+	jsUpdate struct {
+		op     string
+		prefix bool
+		x      jsExpr
+	}
+	jsBinary struct {
+		op   string
+		x, y jsExpr
+	}
+	jsCond struct {
+		cond, x, y jsExpr
+	}
+	jsAssign struct {
+		op     string
+		target jsExpr
+		value  jsExpr
+	}
+	jsCall struct {
+		fn   jsExpr
+		args []jsExpr
+	}
+	jsNew struct {
+		ctor jsExpr
+		args []jsExpr
+	}
+	jsMember struct {
+		obj  jsExpr
+		prop jsExpr // a jsLiteral string for obj.name
+	}
+)
+
+// Parser.
+
+type jsParser struct {
+	lex   *jsLexer
+	tok   jsToken
+	fn    *jsFuncLit
+	err   error
+	loop  int
+	depth int
+}
+
+// jsMaxNesting is how deeply statements and expressions may nest, so
+// scripts can't exhaust the stack of the parser or the interpreter.
+const jsMaxNesting = 2000
+
+// parseJS parses a script into the function literal of its top level.
+func parseJS(src string) (prog *jsFuncLit, err error) {
+	p := &jsParser{lex: &jsLexer{src: src, line: 1}}
+	prog = &jsFuncLit{name: "(script)"}
+	p.fn = prog
+	defer func() {
+		if r := recover(); r != nil {
+			jsErr, ok := r.(*jsError)
+			if !ok {
+				panic(r)
+			}
+			prog, err = nil, errors.New(jsErr.msg)
+		}
+	}()
+	p.advance()
+	for p.tok.kind != jsTokenEOF {
+		prog.body = append(prog.body, p.statement())
+	}
+	return prog, nil
+}
+
+func (p *jsParser) fail(format string, args ...any) {
+	jsThrow("line %d: %s", p.tok.line, fmt.Sprintf(format, args...))
+}
+
+// nest enters a level of nesting. Callers leave it by decrementing depth.
+func (p *jsParser) nest() {
+	p.depth++
+	if p.depth > jsMaxNesting {
+		p.fail("statements or expressions nested too deeply")
+	}
+}
+
+func (p *jsParser) advance() {
+	tok, err := p.lex.next()
+	if err != nil {
+		jsThrow("%v", err)
+	}
+	p.tok = tok
+}
+
+func (p *jsParser) expect(punct string) {
+	if !p.tok.is(punct) {
+		p.fail("expected %s, found %s", punct, p.describe())
+	}
+	p.advance()
+}
+
+func (p *jsParser) describe() string {
+	switch p.tok.kind {
+	case jsTokenEOF:
+		return "end of script"
+	case jsTokenString:
+		return strconv.Quote(p.tok.text)
+	case jsTokenNumber:
+		return jsToString(p.tok.num)
+	}
+	return p.tok.text
+}
+
+func (p *jsParser) name() string {
+	if p.tok.kind != jsTokenName || jsReserved[p.tok.text] {
+		p.fail("expected a name, found %s", p.describe())
+	}
+	name := p.tok.text
+	p.advance()
+	return name
+}
+
+var jsReserved = map[string]bool{
+	"var": true, "let": true, "const": true, "function": true, "return": true, "if": true, "else": true,
+	"for": true, "while": true, "do": true, "break": true, "continue": true, "switch": true, "case": true,
+	"default": true, "new": true, "typeof": true, "true": true, "false": true, "null": true, "in": true,
+	"this": true, "try": true, "catch": true, "finally": true, "throw": true, "with": true, "delete": true,
+	"void": true, "instanceof": true, "class": true,
+}
+
+// semicolon ends a statement, which doesn't need a semicolon before a
+// line break, a } or the end of the script.
+func (p *jsParser) semicolon() {
+	switch {
+	case p.tok.is(";"):
+		p.advance()
+	case p.tok.is("}") || p.tok.kind == jsTokenEOF || p.tok.newline:
+	default:
+		p.fail("expected ;, found %s", p.describe())
+	}
+}
+
+func (p *jsParser) statement() jsStmt {
+	p.nest()
+	defer func() { p.depth-- }()
+	switch {
+	case p.tok.is("{"):
+		return p.block()
+	case p.tok.is(";"):
+		p.advance()
+		return jsEmptyStmt{}
+	case p.tok.kind != jsTokenName:
+		return p.expressionStatement()
+	}
+
+	switch p.tok.text {
+	case "var", "let", "const":
+		p.advance()
+		s := p.varDecl()
+		p.semicolon()
+		return s
+	case "function":
+		p.advance()
+		fn := p.function(true)
+		p.fn.funcs = append(p.fn.funcs, fn)
+		return jsEmptyStmt{}
+	case "if":
+		p.advance()
+		p.expect("(")
+		s := &jsIfStmt{cond: p.expression()}
+		p.expect(")")
+		s.then = p.statement()
+		if p.tok.isName("else") {
+			p.advance()
+			s.els = p.statement()
+		}
+		return s
+	case "return":
+		p.advance()
+		s := &jsReturnStmt{}
+		if !p.tok.is(";") && !p.tok.is("}") && p.tok.kind != jsTokenEOF && !p.tok.newline {
+			s.x = p.expression()
+		}
+		p.semicolon()
+		return s
+	case "for":
+		return p.forStatement()
+	case "while":
+		p.advance()
+		p.expect("(")
+		s := &jsWhileStmt{cond: p.expression()}
+		p.expect(")")
+		s.body = p.loopBody()
+		return s
+	case "do":
+		p.advance()
+		s := &jsWhileStmt{do: true, body: p.loopBody()}
+		if !p.tok.isName("while") {
+			p.fail("expected while, found %s", p.describe())
+		}
+		p.advance()
+		p.expect("(")
+		s.cond = p.expression()
+		p.expect(")")
+		if p.tok.is(";") {
+			p.advance()
+		}
+		return s
+	case "break", "continue":
+		if p.loop == 0 {
+			p.fail("%s outside of a loop or switch", p.tok.text)
+		}
+		var s jsStmt = jsBreakStmt{}
+		if p.tok.text == "continue" {
+			s = jsContinueStmt{}
+		}
+		p.advance()
+		p.semicolon()
+		return s
+	case "switch":
+		return p.switchStatement()
+	case "try", "throw", "with", "class":
+		p.fail("%s statements are not supported", p.tok.text)
+	}
+	return p.expressionStatement()
+}
+
+func (p *jsParser) expressionStatement() jsStmt {
+	s := &jsExprStmt{x: p.expression()}
+	p.semicolon()
+	return s
+}
+
+func (p *jsParser) block() *jsBlockStmt {
+	p.expect("{")
+	s := &jsBlockStmt{}
+	for !p.tok.is("}") {
+		if p.tok.kind == jsTokenEOF {
+			p.fail("expected }, found end of script")
+		}
+		s.list = append(s.list, p.statement())
+	}
+	p.advance()
+	return s
+}
+
+func (p *jsParser) loopBody() jsStmt {
+	p.loop++
+	defer func() { p.loop-- }()
+	return p.statement()
+}
+
+// varDecl parses the declarations following var, without the semicolon.
+func (p *jsParser) varDecl() *jsVarStmt {
+	s := &jsVarStmt{}
+	for {
+		name := p.name()
+		p.fn.vars = append(p.fn.vars, name)
+		var init jsExpr
+		if p.tok.is("=") {
+			p.advance()
+			init = p.assignment()
+		}
+		s.names = append(s.names, name)
+		s.inits = append(s.inits, init)
+		if !p.tok.is(",") {
+			return s
+		}
+		p.advance()
+	}
+}
+
+func (p *jsParser) forStatement() jsStmt {
+	p.advance()
+	p.expect("(")
+	s := &jsForStmt{}
+	switch {
+	case p.tok.is(";"):
+	case p.tok.isName("var") || p.tok.isName("let") || p.tok.isName("const"):
+		p.advance()
+		decl := p.varDecl()
+		if len(decl.names) == 1 && decl.inits[0] == nil && p.tok.isName("in") {
+			return p.forIn(decl.names[0])
+		}
+		s.init = decl
+	default:
+		x := p.expression()
+		if name, ok := x.(*jsName); ok && p.tok.isName("in") {
+			return p.forIn(name.name)
+		}
+		s.init = &jsExprStmt{x: x}
+	}
+	p.expect(";")
+	if !p.tok.is(";") {
+		s.cond = p.expression()
+	}
+	p.expect(";")
+	if !p.tok.is(")") {
+		s.post = p.expression()
+	}
+	p.expect(")")
+	s.body = p.loopBody()
+	return s
+}
+
+func (p *jsParser) forIn(name string) jsStmt {
+	p.advance()
+	s := &jsForInStmt{name: name, obj: p.expression()}
+	p.expect(")")
+	s.body = p.loopBody()
+	return s
+}
+
+func (p *jsParser) switchStatement() jsStmt {
+	p.advance()
+	p.expect("(")
+	s := &jsSwitchStmt{tag: p.expression()}
+	p.expect(")")
+	p.expect("{")
+	p.loop++
+	defer func() { p.loop-- }()
+	for !p.tok.is("}") {
+		var c jsCase
+		switch {
+		case p.tok.isName("case"):
+			p.advance()
+			c.test = p.expression()
+		case p.tok.isName("default"):
+			p.advance()
+		default:
+			p.fail("expected case or default, found %s", p.describe())
+		}
+		p.expect(":")
+		for !p.tok.is("}") && !p.tok.isName("case") && !p.tok.isName("default") {
+			if p.tok.kind == jsTokenEOF {
+				p.fail("expected }, found end of script")
+			}
+			c.body = append(c.body, p.statement())
+		}
+		s.cases = append(s.cases, c)
+	}
+	p.advance()
+	return s
+}
+
+// function parses a function after the function keyword.
+func (p *jsParser) function(named bool) *jsFuncLit {
+	fn := &jsFuncLit{}
+	if named || p.tok.kind == jsTokenName {
+		fn.name = p.name()
+	}
+	p.expect("(")
+	for !p.tok.is(")") {
+		fn.params = append(fn.params, p.name())
+		if !p.tok.is(")") {
+			p.expect(",")
+		}
+	}
+	p.advance()
+
+	outer, loop := p.fn, p.loop
+	p.fn, p.loop = fn, 0
+	fn.body = p.block().list
+	p.fn, p.loop = outer, loop
+	return fn
+}
+
+func (p *jsParser) expression() jsExpr {
+	return p.assignment()
+}
+
+func (p *jsParser) assignment() jsExpr {
+	p.nest()
+	defer func() { p.depth-- }()
+	x := p.conditional()
+	if p.tok.kind == jsTokenPunct && strings.HasSuffix(p.tok.text, "=") && !jsComparisons[p.tok.text] {
+		op := p.tok.text
+		switch x.(type) {
+		case *jsName, *jsMember:
+		default:
+			p.fail("invalid assignment target")
+		}
+		p.advance()
+		return &jsAssign{op: op, target: x, value: p.assignment()}
+	}
+	return x
+}
+
+var jsComparisons = map[string]bool{"==": true, "!=": true, "===": true, "!==": true, "<=": true, ">=": true}
+
+func (p *jsParser) conditional() jsExpr {
+	cond := p.binary(0)
+	if !p.tok.is("?") {
+		return cond
+	}
+	p.advance()
+	x := p.assignment()
+	p.expect(":")
+	return &jsCond{cond: cond, x: x, y: p.assignment()}
+}
+
+// jsBinaryPrec are the precedences of binary operators, higher binding
+// tighter.
+var jsBinaryPrec = map[string]int{
+	"||": 1, "&&": 2, "|": 3, "^": 4, "&": 5,
+	"==": 6, "!=": 6, "===": 6, "!==": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7, "in": 7,
+	"<<": 8, ">>": 8, ">>>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+func (p *jsParser) binary(minPrec int) jsExpr {
+	x := p.unary()
+	// Each operator nests the operands before it one level deeper.
+	defer func(depth int) { p.depth = depth }(p.depth)
+	for {
+		op := ""
+		if p.tok.kind == jsTokenPunct || p.tok.isName("in") {
+			op = p.tok.text
+		}
+		prec, ok := jsBinaryPrec[op]
+		if !ok || prec <= minPrec {
+			return x
+		}
+		p.advance()
+		p.nest()
+		x = &jsBinary{op: op, x: x, y: p.binary(prec)}
+	}
+}
+
+func (p *jsParser) unary() jsExpr {
+	p.nest()
+	defer func() { p.depth-- }()
+	switch {
+	case p.tok.is("!") || p.tok.is("-") || p.tok.is("+") || p.tok.is("~") || p.tok.isName("typeof") || p.tok.isName("void"):
+		op := p.tok.text
+		p.advance()
+		return &jsUnary{op: op, x: p.unary()}
+	case p.tok.is("++") || p.tok.is("--"):
+		op := p.tok.text
+		p.advance()
+		return &jsUpdate{op: op, prefix: true, x: p.target(p.unary())}
+	}
+	x := p.postfix()
+	if (p.tok.is("++") || p.tok.is("--")) && !p.tok.newline {
+		op := p.tok.text
+		p.advance()
+		return &jsUpdate{op: op, x: p.target(x)}
+	}
+	return x
+}
+
+func (p *jsParser) target(x jsExpr) jsExpr {
+	switch x.(type) {
+	case *jsName, *jsMember:
+		return x
+	}
+	p.fail("invalid increment or decrement target")
+	return nil
+}
+
+func (p *jsParser) postfix() jsExpr {
+	var x jsExpr
+	if p.tok.isName("new") {
+		p.advance()
+		n := &jsNew{ctor: p.member(p.primary())}
+		if p.tok.is("(") {
+			n.args = p.arguments()
+		}
+		x = n
+	} else {
+		x = p.primary()
+	}
+	for {
+		switch {
+		case p.tok.is("("):
+			x = &jsCall{fn: x, args: p.arguments()}
+		case p.tok.is(".") || p.tok.is("["):
+			x = p.member(x)
+		default:
+			return x
+		}
+	}
+}
+
+// member parses the property accesses following x.
+func (p *jsParser) member(x jsExpr) jsExpr {
+	for {
+		switch {
+		case p.tok.is("."):
+			p.advance()
+			if p.tok.kind != jsTokenName {
+				p.fail("expected a property name, found %s", p.describe())
+			}
+			x = &jsMember{obj: x, prop: &jsLiteral{v: p.tok.text}}
+			p.advance()
+		case p.tok.is("["):
+			p.advance()
+			x = &jsMember{obj: x, prop: p.expression()}
+			p.expect("]")
+		default:
+			return x
+		}
+	}
+}
+
+func (p *jsParser) arguments() []jsExpr {
+	p.expect("(")
+	var args []jsExpr
+	for !p.tok.is(")") {
+		args = append(args, p.assignment())
+		if !p.tok.is(")") {
+			p.expect(",")
+		}
+	}
+	p.advance()
+	return args
+}
+
+func (p *jsParser) primary() jsExpr {
+	tok := p.tok
+	switch tok.kind {
+	case jsTokenNumber:
+		p.advance()
+		return &jsLiteral{v: tok.num}
+	case jsTokenString:
+		p.advance()
+		return &jsLiteral{v: tok.text}
+	case jsTokenRegexp:
+		p.advance()
+		re, err := compileJSRegexp(tok.text, tok.flags)
+		if err != nil {
+			p.fail("%v", err)
+		}
+		return &jsRegexpLit{re: re}
+	case jsTokenName:
+		switch tok.text {
+		case "true", "false":
+			p.advance()
+			return &jsLiteral{v: tok.text == "true"}
+		case "null":
+			p.advance()
+			return &jsLiteral{v: jsNull}
+		case "function":
+			p.advance()
+			return p.function(false)
+		}
+		return &jsName{name: p.name()}
+	case jsTokenPunct:
+		switch tok.text {
+		case "(":
+			p.advance()
+			x := p.expression()
+			p.expect(")")
+			return x
+		case "[":
+			p.advance()
+			a := &jsArrayLit{}
+			for !p.tok.is("]") {
+				a.elems = append(a.elems, p.assignment())
+				if !p.tok.is("]") {
+					p.expect(",")
+				}
+			}
+			p.advance()
+			return a
+		case "{":
+			p.advance()
+			o := &jsObjectLit{}
+			for !p.tok.is("}") {
+				var key string
+				switch p.tok.kind {
+				case jsTokenName, jsTokenString:
+					key = p.tok.text
+				case jsTokenNumber:
+					key = jsToString(p.tok.num)
+				default:
+					p.fail("expected a property name, found %s", p.describe())
+				}
+				p.advance()
+				p.expect(":")
+				o.keys = append(o.keys, key)
+				o.vals = append(o.vals, p.assignment())
+				if !p.tok.is("}") {
+					p.expect(",")
+				}
+			}
+			p.advance()
+			return o
+		}
+	}
+	p.fail("unexpected %s", p.describe())
+	return nil
+}
+
+// compileJSRegexp translates a JavaScript regular expression to RE2, which
+// lacks backreferences and lookaround but covers what PAC files use.
+func compileJSRegexp(source, flags string) (*jsRegexp, error) {
+	prefix := ""
+	r := &jsRegexp{source: source}
+	for _, f := range flags {
+		switch f {
+		case 'i':
+			prefix += "i"
+		case 'm':
+			prefix += "m"
+		case 's':
+			prefix += "s"
+		case 'g':
+			r.global = true
+		default:
+			return nil, fmt.Errorf("unsupported regular expression flag %q", f)
+		}
+	}
+	pattern := source
+	if prefix != "" {
+		pattern = "(?" + prefix + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("regular expression /%s/: %w", source, err)
+	}
+	r.re = re
+	return r, nil
+}
+
+// Interpreter.
+
+// jsScope holds the variables of a function call, or the global ones.
+type jsScope struct {
+	vars   map[string]jsValue
+	parent *jsScope
+	// readOnly scopes, the built-in functions shared by all evaluations,
+	// are shadowed in the global scope rather than changed.
+	readOnly bool
+}
+
+func newJSScope(parent *jsScope) *jsScope {
+	return &jsScope{vars: make(map[string]jsValue), parent: parent}
+}
+
+func (s *jsScope) lookup(name string) (*jsScope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Limits of a script evaluation, so broken scripts can't hang requests or
+// exhaust the memory. jsMaxAlloc is roughly how many bytes of strings,
+// arrays and objects an evaluation may allocate.
+const (
+	jsMaxSteps = 1000000
+	jsMaxDepth = 200
+	jsMaxAlloc = 16 << 20
+)
+
+// jsValueSize is what a value in an array or object is counted as.
+const jsValueSize = 16
+
+// jsInterp evaluates a script. It's used by one goroutine at a time.
+type jsInterp struct {
+	ctx    context.Context
+	global *jsScope
+	steps  int
+	depth  int
+	// allocated is about how many bytes the evaluation allocated.
+	allocated int
+	// host is the state of the embedding application, the PAC functions.
+	host any
+}
+
+// completion is how a statement completed.
+type jsCompletion int
+
+const (
+	jsNormal jsCompletion = iota
+	jsReturn
+	jsBreak
+	jsContinue
+)
+
+func (in *jsInterp) step() {
+	in.steps++
+	if in.steps > jsMaxSteps {
+		jsThrow("script took too many steps")
+	}
+	if in.steps%1024 == 0 && in.ctx.Err() != nil {
+		jsThrow("script evaluation: %v", in.ctx.Err())
+	}
+}
+
+// alloc counts n bytes allocated by the script.
+func (in *jsInterp) alloc(n int) {
+	in.allocated += n
+	if in.allocated > jsMaxAlloc {
+		jsThrow("script allocated too much memory")
+	}
+}
+
+// allocValue counts the memory of v, a value the script created, and
+// returns it.
+func (in *jsInterp) allocValue(v jsValue) jsValue {
+	switch v := v.(type) {
+	case string:
+		in.alloc(len(v))
+	case *jsArray:
+		in.alloc(jsValueSize * (1 + len(v.elems)))
+	}
+	return v
+}
+
+// run runs the top level of prog and then calls the function named fn
+// with args, returning its result.
+func (in *jsInterp) run(prog *jsFuncLit, fn string, args ...jsValue) (result jsValue, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			jsErr, ok := r.(*jsError)
+			if !ok {
+				panic(r)
+			}
+			result, err = nil, errors.New(jsErr.msg)
+		}
+	}()
+	in.enter(prog, in.global, nil)
+	if _, c := in.execList(prog.body, in.global); c == jsReturn {
+		jsThrow("return outside of a function")
+	}
+	f, ok := in.global.vars[fn].(*jsFunction)
+	if !ok {
+		if scope, found := in.global.lookup(fn); found {
+			f, ok = scope.vars[fn].(*jsFunction)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("script doesn't define %s", fn)
+	}
+	return in.call(f, nil, args), nil
+}
+
+// enter declares the variables and functions of fn in scope and binds its
+// parameters to args.
+func (in *jsInterp) enter(fn *jsFuncLit, scope *jsScope, args []jsValue) {
+	for _, name := range fn.vars {
+		if _, ok := scope.vars[name]; !ok {
+			scope.vars[name] = nil
+		}
+	}
+	for i, name := range fn.params {
+		if i < len(args) {
+			scope.vars[name] = args[i]
+		} else {
+			scope.vars[name] = nil
+		}
+	}
+	for _, f := range fn.funcs {
+		scope.vars[f.name] = &jsFunction{name: f.name, lit: f, scope: scope}
+	}
+}
+
+func (in *jsInterp) call(f *jsFunction, this jsValue, args []jsValue) jsValue {
+	if f.native != nil {
+		if f.this != nil {
+			this = f.this
+		}
+		// Natives grow arrays they are called on, like push.
+		if a, ok := this.(*jsArray); ok {
+			n := len(a.elems)
+			defer func() { in.alloc(jsValueSize * (len(a.elems) - n)) }()
+		}
+		return in.allocValue(f.native(in, this, args))
+	}
+	in.depth++
+	defer func() { in.depth-- }()
+	if in.depth > jsMaxDepth {
+		jsThrow("too much recursion")
+	}
+	scope := newJSScope(f.scope)
+	in.enter(f.lit, scope, args)
+	v, _ := in.execList(f.lit.body, scope)
+	return v
+}
+
+func (in *jsInterp) execList(list []jsStmt, scope *jsScope) (jsValue, jsCompletion) {
+	for _, s := range list {
+		if v, c := in.exec(s, scope); c != jsNormal {
+			return v, c
+		}
+	}
+	return nil, jsNormal
+}
+
+func (in *jsInterp) exec(s jsStmt, scope *jsScope) (jsValue, jsCompletion) {
+	in.step()
+	switch s := s.(type) {
+	case jsEmptyStmt:
+	case *jsExprStmt:
+		in.eval(s.x, scope)
+	case *jsVarStmt:
+		for i, name := range s.names {
+			if s.inits[i] != nil {
+				in.assign(name, in.eval(s.inits[i], scope), scope)
+			}
+		}
+	case *jsIfStmt:
+		if jsTruthy(in.eval(s.cond, scope)) {
+			return in.exec(s.then, scope)
+		} else if s.els != nil {
+			return in.exec(s.els, scope)
+		}
+	case *jsReturnStmt:
+		if s.x == nil {
+			return nil, jsReturn
+		}
+		return in.eval(s.x, scope), jsReturn
+	case *jsBlockStmt:
+		return in.execList(s.list, scope)
+	case *jsForStmt:
+		if s.init != nil {
+			in.exec(s.init, scope)
+		}
+		for s.cond == nil || jsTruthy(in.eval(s.cond, scope)) {
+			v, c := in.exec(s.body, scope)
+			if c == jsBreak {
+				break
+			}
+			if c == jsReturn {
+				return v, c
+			}
+			if s.post != nil {
+				in.eval(s.post, scope)
+			}
+			in.step()
+		}
+	case *jsForInStmt:
+		var keys []string
+		switch obj := in.eval(s.obj, scope).(type) {
+		case *jsObject:
+			keys = append(keys, obj.keys...)
+		case *jsArray:
+			for i := range obj.elems {
+				keys = append(keys, strconv.Itoa(i))
+			}
+		case string:
+			for i := range obj {
+				keys = append(keys, strconv.Itoa(i))
+			}
+		}
+		for _, key := range keys {
+			in.assign(s.name, key, scope)
+			v, c := in.exec(s.body, scope)
+			if c == jsBreak {
+				break
+			}
+			if c == jsReturn {
+				return v, c
+			}
+		}
+	case *jsWhileStmt:
+		for s.do || jsTruthy(in.eval(s.cond, scope)) {
+			v, c := in.exec(s.body, scope)
+			if c == jsBreak {
+				break
+			}
+			if c == jsReturn {
+				return v, c
+			}
+			if s.do && !jsTruthy(in.eval(s.cond, scope)) {
+				break
+			}
+			in.step()
+		}
+	case *jsSwitchStmt:
+		tag := in.eval(s.tag, scope)
+		start := -1
+		for i, c := range s.cases {
+			if c.test != nil && jsStrictEquals(tag, in.eval(c.test, scope)) {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			for i, c := range s.cases {
+				if c.test == nil {
+					start = i
+				}
+			}
+		}
+		if start < 0 {
+			break
+		}
+		for _, c := range s.cases[start:] {
+			v, comp := in.execList(c.body, scope)
+			if comp == jsBreak {
+				break
+			}
+			if comp != jsNormal {
+				return v, comp
+			}
+		}
+	case jsBreakStmt:
+		return nil, jsBreak
+	case jsContinueStmt:
+		return nil, jsContinue
+	default:
+		jsThrow("unsupported statement %T", s)
+	}
+	return nil, jsNormal
+}
+
+// assign sets the variable name, a global one when it isn't declared.
+func (in *jsInterp) assign(name string, v jsValue, scope *jsScope) {
+	if s, ok := scope.lookup(name); ok && !s.readOnly {
+		s.vars[name] = v
+		return
+	}
+	in.global.vars[name] = v
+}
+
+func (in *jsInterp) eval(x jsExpr, scope *jsScope) jsValue {
+	in.step()
+	switch x := x.(type) {
+	case *jsLiteral:
+		return x.v
+	case *jsName:
+		if x.name == "undefined" {
+			return nil
+		}
+		s, ok := scope.lookup(x.name)
+		if !ok {
+			jsThrow("%s is not defined", x.name)
+		}
+		return s.vars[x.name]
+	case *jsArrayLit:
+		in.alloc(jsValueSize * (1 + len(x.elems)))
+		a := &jsArray{elems: make([]jsValue, len(x.elems))}
+		for i, e := range x.elems {
+			a.elems[i] = in.eval(e, scope)
+		}
+		return a
+	case *jsObjectLit:
+		in.alloc(jsValueSize * (1 + len(x.keys)))
+		o := newJSObject()
+		for i, key := range x.keys {
+			o.set(key, in.eval(x.vals[i], scope))
+		}
+		return o
+	case *jsFuncLit:
+		return &jsFunction{name: x.name, lit: x, scope: scope}
+	case *jsRegexpLit:
+		return x.re
+	case *jsUnary:
+		return in.evalUnary(x, scope)
+	case *jsUpdate:
+		old := jsToNumber(in.eval(x.x, scope))
+		v := old + 1
+		if x.op == "--" {
+			v = old - 1
+		}
+		in.store(x.x, v, scope)
+		if x.prefix {
+			return v
+		}
+		return old
+	case *jsBinary:
+		switch x.op {
+		case "&&":
+			if v := in.eval(x.x, scope); !jsTruthy(v) {
+				return v
+			}
+			return in.eval(x.y, scope)
+		case "||":
+			if v := in.eval(x.x, scope); jsTruthy(v) {
+				return v
+			}
+			return in.eval(x.y, scope)
+		}
+		return in.allocValue(jsBinaryOp(x.op, in.eval(x.x, scope), in.eval(x.y, scope)))
+	case *jsCond:
+		if jsTruthy(in.eval(x.cond, scope)) {
+			return in.eval(x.x, scope)
+		}
+		return in.eval(x.y, scope)
+	case *jsAssign:
+		v := in.eval(x.value, scope)
+		if x.op != "=" {
+			v = in.allocValue(jsBinaryOp(strings.TrimSuffix(x.op, "="), in.eval(x.target, scope), v))
+		}
+		in.store(x.target, v, scope)
+		return v
+	case *jsCall:
+		var this, fv jsValue
+		if m, ok := x.fn.(*jsMember); ok {
+			this = in.eval(m.obj, scope)
+			fv = jsGet(this, jsToString(in.eval(m.prop, scope)))
+		} else {
+			fv = in.eval(x.fn, scope)
+		}
+		f, ok := fv.(*jsFunction)
+		if !ok {
+			jsThrow("%s is not a function", jsDescribe(x.fn))
+		}
+		args := make([]jsValue, len(x.args))
+		for i, a := range x.args {
+			args[i] = in.eval(a, scope)
+		}
+		return in.call(f, this, args)
+	case *jsNew:
+		name, _ := x.ctor.(*jsName)
+		if name == nil || name.name != "Date" {
+			jsThrow("new %s is not supported", jsDescribe(x.ctor))
+		}
+		args := make([]jsValue, len(x.args))
+		for i, a := range x.args {
+			args[i] = in.eval(a, scope)
+		}
+		return newJSDate(args)
+	case *jsMember:
+		obj := in.eval(x.obj, scope)
+		return jsGet(obj, jsToString(in.eval(x.prop, scope)))
+	}
+	jsThrow("unsupported expression %T", x)
+	return nil
+}
+
+func (in *jsInterp) evalUnary(x *jsUnary, scope *jsScope) jsValue {
+	if x.op == "typeof" {
+		// typeof of undeclared names is allowed.
+		if name, ok := x.x.(*jsName); ok {
+			if _, found := scope.lookup(name.name); !found {
+				return "undefined"
+			}
+		}
+		return jsTypeOf(in.eval(x.x, scope))
+	}
+	v := in.eval(x.x, scope)
+	switch x.op {
+	case "!":
+		return !jsTruthy(v)
+	case "-":
+		return -jsToNumber(v)
+	case "+":
+		return jsToNumber(v)
+	case "~":
+		return float64(^jsToInt32(v))
+	case "void":
+		return nil
+	}
+	jsThrow("unsupported operator %s", x.op)
+	return nil
+}
+
+// store assigns v to target, a name or a property.
+func (in *jsInterp) store(target jsExpr, v jsValue, scope *jsScope) {
+	switch t := target.(type) {
+	case *jsName:
+		in.assign(t.name, v, scope)
+	case *jsMember:
+		key := jsToString(in.eval(t.prop, scope))
+		switch obj := in.eval(t.obj, scope).(type) {
+		case *jsObject:
+			if _, ok := obj.props[key]; !ok {
+				in.alloc(len(key) + jsValueSize)
+			}
+			obj.set(key, v)
+		case *jsArray:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i > 1<<20 {
+				jsThrow("bad array index %s", key)
+			}
+			if i >= len(obj.elems) {
+				in.alloc(jsValueSize * (i + 1 - len(obj.elems)))
+			}
+			for len(obj.elems) <= i {
+				obj.elems = append(obj.elems, nil)
+			}
+			obj.elems[i] = v
+		default:
+			jsThrow("can't set property %s of %s", key, jsToString(obj))
+		}
+	}
+}
+
+func jsDescribe(x jsExpr) string {
+	switch x := x.(type) {
+	case *jsName:
+		return x.name
+	case *jsMember:
+		if lit, ok := x.prop.(*jsLiteral); ok {
+			return jsDescribe(x.obj) + "." + jsToString(lit.v)
+		}
+		return jsDescribe(x.obj) + "[...]"
+	}
+	return "expression"
+}
+
+// Operators and conversions.
+
+func jsBinaryOp(op string, x, y jsValue) jsValue {
+	switch op {
+	case "+":
+		xs, xIsString := jsToPrimitive(x).(string)
+		ys, yIsString := jsToPrimitive(y).(string)
+		if xIsString || yIsString {
+			if !xIsString {
+				xs = jsToString(x)
+			}
+			if !yIsString {
+				ys = jsToString(y)
+			}
+			return xs + ys
+		}
+		return jsToNumber(x) + jsToNumber(y)
+	case "-":
+		return jsToNumber(x) - jsToNumber(y)
+	case "*":
+		return jsToNumber(x) * jsToNumber(y)
+	case "/":
+		return jsToNumber(x) / jsToNumber(y)
+	case "%":
+		return math.Mod(jsToNumber(x), jsToNumber(y))
+	case "==":
+		return jsLooseEquals(x, y)
+	case "!=":
+		return !jsLooseEquals(x, y)
+	case "===":
+		return jsStrictEquals(x, y)
+	case "!==":
+		return !jsStrictEquals(x, y)
+	case "<", ">", "<=", ">=":
+		return jsCompare(op, x, y)
+	case "&":
+		return float64(jsToInt32(x) & jsToInt32(y))
+	case "|":
+		return float64(jsToInt32(x) | jsToInt32(y))
+	case "^":
+		return float64(jsToInt32(x) ^ jsToInt32(y))
+	case "<<":
+		return float64(jsToInt32(x) << (uint32(jsToInt32(y)) & 31))
+	case ">>":
+		return float64(jsToInt32(x) >> (uint32(jsToInt32(y)) & 31))
+	case ">>>":
+		return float64(uint32(jsToInt32(x)) >> (uint32(jsToInt32(y)) & 31))
+	case "in":
+		key := jsToString(x)
+		switch obj := y.(type) {
+		case *jsObject:
+			_, ok := obj.props[key]
+			return ok
+		case *jsArray:
+			i, err := strconv.Atoi(key)
+			return err == nil && i >= 0 && i < len(obj.elems)
+		}
+		jsThrow("in needs an object")
+	}
+	jsThrow("unsupported operator %s", op)
+	return nil
+}
+
+func jsCompare(op string, x, y jsValue) bool {
+	x, y = jsToPrimitive(x), jsToPrimitive(y)
+	xs, xIsString := x.(string)
+	ys, yIsString := y.(string)
+	if xIsString && yIsString {
+		switch op {
+		case "<":
+			return xs < ys
+		case ">":
+			return xs > ys
+		case "<=":
+			return xs <= ys
+		}
+		return xs >= ys
+	}
+	xn, yn := jsToNumber(x), jsToNumber(y)
+	switch op {
+	case "<":
+		return xn < yn
+	case ">":
+		return xn > yn
+	case "<=":
+		return xn <= yn
+	}
+	return xn >= yn
+}
+
+func jsStrictEquals(x, y jsValue) bool {
+	switch x := x.(type) {
+	case nil, jsNullValue, bool, string:
+		return x == y
+	case float64:
+		yn, ok := y.(float64)
+		return ok && x == yn
+	}
+	return x == y
+}
+
+func jsLooseEquals(x, y jsValue) bool {
+	isNullish := func(v jsValue) bool { return v == nil || v == jsNull }
+	switch {
+	case isNullish(x) || isNullish(y):
+		return isNullish(x) && isNullish(y)
+	case jsTypeOf(x) == jsTypeOf(y):
+		return jsStrictEquals(x, y)
+	}
+	if b, ok := x.(bool); ok {
+		return jsLooseEquals(jsToNumber(b), y)
+	}
+	if b, ok := y.(bool); ok {
+		return jsLooseEquals(x, jsToNumber(b))
+	}
+	x, y = jsToPrimitive(x), jsToPrimitive(y)
+	if xs, ok := x.(string); ok {
+		if ys, ok := y.(string); ok {
+			return xs == ys
+		}
+	}
+	return jsToNumber(x) == jsToNumber(y)
+}
+
+func jsTypeOf(v jsValue) string {
+	switch v.(type) {
+	case nil:
+		return "undefined"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *jsFunction:
+		return "function"
+	}
+	return "object"
+}
+
+func jsTruthy(v jsValue) bool {
+	switch v := v.(type) {
+	case nil, jsNullValue:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+// jsToPrimitive converts objects to their string values.
+func jsToPrimitive(v jsValue) jsValue {
+	switch v.(type) {
+	case *jsArray, *jsObject, *jsFunction, *jsRegexp, *jsDate:
+		return jsToString(v)
+	}
+	return v
+}
+
+func jsToNumber(v jsValue) float64 {
+	switch v := v.(type) {
+	case nil:
+		return math.NaN()
+	case jsNullValue:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		s := strings.TrimSpace(v)
+		switch s {
+		case "":
+			return 0
+		case "Infinity", "+Infinity":
+			return math.Inf(1)
+		case "-Infinity":
+			return math.Inf(-1)
+		}
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			if n, err := strconv.ParseUint(s[2:], 16, 64); err == nil {
+				return float64(n)
+			}
+			return math.NaN()
+		}
+		if strings.ContainsAny(s, "_xXpPnNiI") {
+			return math.NaN()
+		}
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+		return math.NaN()
+	case *jsDate:
+		return float64(v.t.UnixMilli())
+	}
+	return jsToNumber(jsToPrimitive(v))
+}
+
+func jsToInt32(v jsValue) int32 {
+	n := jsToNumber(v)
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	return int32(uint32(int64(math.Trunc(math.Mod(n, 1<<32)))))
+}
+
+func jsToString(v jsValue) string {
+	switch v := v.(type) {
+	case nil:
+		return "undefined"
+	case jsNullValue:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return jsNumberString(v)
+	case string:
+		return v
+	case *jsArray:
+		return jsJoin(v, ",")
+	case *jsObject:
+		return "[object Object]"
+	case *jsFunction:
+		return "function " + v.name + "() { [code] }"
+	case *jsRegexp:
+		return "/" + v.source + "/"
+	case *jsDate:
+		return v.t.Format("Mon Jan 02 2006 15:04:05 GMT-0700")
+	}
+	return fmt.Sprint(v)
+}
+
+func jsNumberString(n float64) string {
+	switch {
+	case math.IsNaN(n):
+		return "NaN"
+	case math.IsInf(n, 1):
+		return "Infinity"
+	case math.IsInf(n, -1):
+		return "-Infinity"
+	case n == 0:
+		return "0"
+	}
+	if abs := math.Abs(n); abs >= 1e21 || abs < 1e-6 {
+		// Like 1e+21 and 1e-7.
+		s := strconv.FormatFloat(n, 'e', -1, 64)
+		mantissa, exp, _ := strings.Cut(s, "e")
+		sign, digits := exp[:1], strings.TrimLeft(exp[1:], "0")
+		return mantissa + "e" + sign + digits
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// jsJoin joins the elements of a as strings. Joined strings longer than
+// jsMaxAlloc are an error, as elements may be the same long string.
+func jsJoin(a *jsArray, sep string) string {
+	if a.joining {
+		return ""
+	}
+	a.joining = true
+	defer func() { a.joining = false }()
+	parts := make([]string, len(a.elems))
+	n := len(sep) * (len(parts) - 1)
+	for i, e := range a.elems {
+		if e != nil && e != jsNull {
+			parts[i] = jsToString(e)
+		}
+		if n += len(parts[i]); n > jsMaxAlloc {
+			jsThrow("joined string too long")
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+// Properties and methods.
+
+func jsGet(obj jsValue, key string) jsValue {
+	switch o := obj.(type) {
+	case nil, jsNullValue:
+		jsThrow("can't read property %s of %s", key, jsToString(obj))
+	case string:
+		if key == "length" {
+			return float64(len(o))
+		}
+		if i, err := strconv.Atoi(key); err == nil {
+			if i >= 0 && i < len(o) {
+				return o[i : i+1]
+			}
+			return nil
+		}
+		return jsMethod(o, key, jsStringMethods)
+	case *jsArray:
+		if key == "length" {
+			return float64(len(o.elems))
+		}
+		if i, err := strconv.Atoi(key); err == nil {
+			if i >= 0 && i < len(o.elems) {
+				return o.elems[i]
+			}
+			return nil
+		}
+		return jsMethod(o, key, jsArrayMethods)
+	case *jsObject:
+		return o.props[key]
+	case *jsRegexp:
+		switch key {
+		case "source":
+			return o.source
+		case "global":
+			return o.global
+		}
+		return jsMethod(o, key, jsRegexpMethods)
+	case *jsDate:
+		return jsMethod(o, key, jsDateMethods)
+	case float64:
+		return jsMethod(o, key, jsNumberMethods)
+	}
+	return nil
+}
+
+type jsNative = func(in *jsInterp, this jsValue, args []jsValue) jsValue
+
+func jsMethod(this jsValue, key string, methods map[string]jsNative) jsValue {
+	if m, ok := methods[key]; ok {
+		return &jsFunction{name: key, native: m, this: this}
+	}
+	return nil
+}
+
+// jsArg returns args[i], undefined when there are fewer arguments.
+func jsArg(args []jsValue, i int) jsValue {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// jsIndexArg returns args[i] as an index, def when it's undefined.
+func jsIndexArg(args []jsValue, i, def int) int {
+	v := jsArg(args, i)
+	if v == nil {
+		return def
+	}
+	n := jsToNumber(v)
+	switch {
+	case math.IsNaN(n):
+		return 0
+	case n > math.MaxInt32:
+		return math.MaxInt32
+	case n < math.MinInt32:
+		return math.MinInt32
+	}
+	return int(n)
+}
+
+func clampIndex(i, n int) int {
+	return max(0, min(i, n))
+}
+
+// relativeIndex resolves negative indexes from the end, as slice does.
+func relativeIndex(i, n int) int {
+	if i < 0 {
+		i += n
+	}
+	return clampIndex(i, n)
+}
+
+var jsStringMethods map[string]jsNative
+
+var jsArrayMethods map[string]jsNative
+
+var jsRegexpMethods map[string]jsNative
+
+var jsNumberMethods map[string]jsNative
+
+func init() {
+	str := func(this jsValue) string { return this.(string) }
+	jsStringMethods = map[string]jsNative{
+		"toLowerCase": func(_ *jsInterp, this jsValue, _ []jsValue) jsValue { return strings.ToLower(str(this)) },
+		"toUpperCase": func(_ *jsInterp, this jsValue, _ []jsValue) jsValue { return strings.ToUpper(str(this)) },
+		"trim":        func(_ *jsInterp, this jsValue, _ []jsValue) jsValue { return strings.TrimSpace(str(this)) },
+		"toString":    func(_ *jsInterp, this jsValue, _ []jsValue) jsValue { return this },
+		"indexOf": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			s := str(this)
+			from := clampIndex(jsIndexArg(args, 1, 0), len(s))
+			i := strings.Index(s[from:], jsToString(jsArg(args, 0)))
+			if i < 0 {
+				return float64(-1)
+			}
+			return float64(from + i)
+		},
+		"lastIndexOf": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			return float64(strings.LastIndex(str(this), jsToString(jsArg(args, 0))))
+		},
+		"includes": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			return strings.Contains(str(this), jsToString(jsArg(args, 0)))
+		},
+		"startsWith": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			return strings.HasPrefix(str(this), jsToString(jsArg(args, 0)))
+		},
+		"endsWith": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			return strings.HasSuffix(str(this), jsToString(jsArg(args, 0)))
+		},
+		"charAt": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			s, i := str(this), jsIndexArg(args, 0, 0)
+			if i < 0 || i >= len(s) {
+				return ""
+			}
+			return s[i : i+1]
+		},
+		"charCodeAt": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			s, i := str(this), jsIndexArg(args, 0, 0)
+			if i < 0 || i >= len(s) {
+				return math.NaN()
+			}
+			return float64(s[i])
+		},
+		"substring": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			s := str(this)
+			start := clampIndex(jsIndexArg(args, 0, 0), len(s))
+			end := clampIndex(jsIndexArg(args, 1, len(s)), len(s))
+			if start > end {
+				start, end = end, start
+			}
+			return s[start:end]
+		},
+		"substr": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			s := str(this)
+			start := relativeIndex(jsIndexArg(args, 0, 0), len(s))
+			end := clampIndex(start+max(jsIndexArg(args, 1, len(s)), 0), len(s))
+			return s[start:end]
+		},
+		"slice": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			s := str(this)
+			start := relativeIndex(jsIndexArg(args, 0, 0), len(s))
+			end := relativeIndex(jsIndexArg(args, 1, len(s)), len(s))
+			if start > end {
+				return ""
+			}
+			return s[start:end]
+		},
+		"split": func(in *jsInterp, this jsValue, args []jsValue) jsValue {
+			s := str(this)
+			// Only as many parts as the memory left for the script
+			// allows are split off.
+			n := (jsMaxAlloc-in.allocated)/jsValueSize + 1
+			var parts []string
+			switch sep := jsArg(args, 0).(type) {
+			case nil:
+				parts = []string{s}
+			case *jsRegexp:
+				parts = sep.re.Split(s, n)
+			default:
+				parts = strings.SplitN(s, jsToString(sep), n)
+			}
+			if len(parts) == n {
+				jsThrow("script allocated too much memory")
+			}
+			if limit := jsArg(args, 1); limit != nil {
+				parts = parts[:clampIndex(jsIndexArg(args, 1, 0), len(parts))]
+			}
+			a := &jsArray{elems: make([]jsValue, len(parts))}
+			for i, part := range parts {
+				a.elems[i] = part
+			}
+			return a
+		},
+		"replace": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			s := str(this)
+			if _, ok := jsArg(args, 1).(*jsFunction); ok {
+				jsThrow("replace with a function is not supported")
+			}
+			repl := jsToString(jsArg(args, 1))
+			re, ok := jsArg(args, 0).(*jsRegexp)
+			if !ok {
+				return strings.Replace(s, jsToString(jsArg(args, 0)), repl, 1)
+			}
+			template := jsReplacementTemplate(repl)
+			n := 1
+			if re.global {
+				n = -1
+			}
+			// Replacements may repeat the long strings, so the result is
+			// limited as it's built.
+			var b []byte
+			last := 0
+			for _, loc := range re.re.FindAllStringSubmatchIndex(s, n) {
+				b = append(b, s[last:loc[0]]...)
+				b = re.re.ExpandString(b, template, s, loc)
+				last = loc[1]
+				if len(b) > jsMaxAlloc {
+					jsThrow("replaced string too long")
+				}
+			}
+			return string(append(b, s[last:]...))
+		},
+		"match": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			s := str(this)
+			re, ok := jsArg(args, 0).(*jsRegexp)
+			if !ok {
+				var err error
+				if re, err = compileJSRegexp(jsToString(jsArg(args, 0)), ""); err != nil {
+					jsThrow("%v", err)
+				}
+			}
+			if re.global {
+				matches := re.re.FindAllString(s, -1)
+				if matches == nil {
+					return jsNull
+				}
+				a := &jsArray{}
+				for _, m := range matches {
+					a.elems = append(a.elems, m)
+				}
+				return a
+			}
+			return jsSubmatches(re.re, s)
+		},
+		"search": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			re, ok := jsArg(args, 0).(*jsRegexp)
+			if !ok {
+				jsThrow("search needs a regular expression")
+			}
+			loc := re.re.FindStringIndex(str(this))
+			if loc == nil {
+				return float64(-1)
+			}
+			return float64(loc[0])
+		},
+	}
+
+	arr := func(this jsValue) *jsArray { return this.(*jsArray) }
+	jsArrayMethods = map[string]jsNative{
+		"push": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			a := arr(this)
+			a.elems = append(a.elems, args...)
+			return float64(len(a.elems))
+		},
+		"join": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			sep := ","
+			if v := jsArg(args, 0); v != nil {
+				sep = jsToString(v)
+			}
+			return jsJoin(arr(this), sep)
+		},
+		"indexOf": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			for i, e := range arr(this).elems {
+				if jsStrictEquals(e, jsArg(args, 0)) {
+					return float64(i)
+				}
+			}
+			return float64(-1)
+		},
+		"includes": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			for _, e := range arr(this).elems {
+				if jsStrictEquals(e, jsArg(args, 0)) {
+					return true
+				}
+			}
+			return false
+		},
+		"toString": func(_ *jsInterp, this jsValue, _ []jsValue) jsValue { return jsJoin(arr(this), ",") },
+	}
+
+	jsRegexpMethods = map[string]jsNative{
+		"test": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			return this.(*jsRegexp).re.MatchString(jsToString(jsArg(args, 0)))
+		},
+		"exec": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			return jsSubmatches(this.(*jsRegexp).re, jsToString(jsArg(args, 0)))
+		},
+	}
+
+	jsNumberMethods = map[string]jsNative{
+		"toString": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			radix := jsIndexArg(args, 0, 10)
+			if radix == 10 {
+				return jsToString(this)
+			}
+			if radix < 2 || radix > 36 {
+				jsThrow("toString radix must be between 2 and 36")
+			}
+			return strconv.FormatInt(int64(jsToNumber(this)), radix)
+		},
+		"toFixed": func(_ *jsInterp, this jsValue, args []jsValue) jsValue {
+			return strconv.FormatFloat(jsToNumber(this), 'f', clampIndex(jsIndexArg(args, 0, 0), 100), 64)
+		},
+	}
+}
+
+// jsReplacementTemplate translates $& and $1 in replacement strings to
+// the template syntax of regexp.
+func jsReplacementTemplate(repl string) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		if c != '$' || i+1 == len(repl) {
+			b.WriteByte(c)
+			continue
+		}
+		switch next := repl[i+1]; {
+		case next == '$':
+			b.WriteString("$$")
+			i++
+		case next == '&':
+			b.WriteString("${0}")
+			i++
+		case isDigit(next):
+			j := i + 1
+			for j < len(repl) && isDigit(repl[j]) && j < i+3 {
+				j++
+			}
+			b.WriteString("${" + repl[i+1:j] + "}")
+			i = j - 1
+		default:
+			b.WriteString("$$")
+		}
+	}
+	return b.String()
+}
+
+func jsSubmatches(re *regexp.Regexp, s string) jsValue {
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return jsNull
+	}
+	a := &jsArray{}
+	for i := 0; i < len(loc); i += 2 {
+		if loc[i] < 0 {
+			a.elems = append(a.elems, nil)
+		} else {
+			a.elems = append(a.elems, s[loc[i]:loc[i+1]])
+		}
+	}
+	return a
+}
+
+// jsDate is a Date, in local time.
+type jsDate struct {
+	t time.Time
+}
+
+// jsNow is the current time of scripts, replaced in tests.
+var jsNow = time.Now
+
+// newJSDate returns new Date(args...), supporting no arguments, a time in
+// milliseconds and year, month[, day, hours, minutes, seconds].
+func newJSDate(args []jsValue) *jsDate {
+	switch len(args) {
+	case 0:
+		return &jsDate{t: jsNow()}
+	case 1:
+		ms := jsToNumber(args[0])
+		if math.IsNaN(ms) {
+			jsThrow("invalid date")
+		}
+		return &jsDate{t: time.UnixMilli(int64(ms))}
+	}
+	var fields [6]int
+	fields[2] = 1
+	for i := range fields {
+		if i < len(args) {
+			fields[i] = jsIndexArg(args, i, 0)
+		}
+	}
+	t := time.Date(fields[0], time.Month(fields[1]+1), fields[2], fields[3], fields[4], fields[5], 0, jsNow().Location())
+	return &jsDate{t: t}
+}
+
+var jsDateMethods map[string]jsNative
+
+func init() {
+	field := func(get func(t time.Time) int, utc bool) jsNative {
+		return func(_ *jsInterp, this jsValue, _ []jsValue) jsValue {
+			t := this.(*jsDate).t
+			if utc {
+				t = t.UTC()
+			}
+			return float64(get(t))
+		}
+	}
+	getters := map[string]func(t time.Time) int{
+		"FullYear": func(t time.Time) int { return t.Year() },
+		"Month":    func(t time.Time) int { return int(t.Month()) - 1 },
+		"Date":     func(t time.Time) int { return t.Day() },
+		"Day":      func(t time.Time) int { return int(t.Weekday()) },
+		"Hours":    func(t time.Time) int { return t.Hour() },
+		"Minutes":  func(t time.Time) int { return t.Minute() },
+		"Seconds":  func(t time.Time) int { return t.Second() },
+	}
+	jsDateMethods = map[string]jsNative{
+		"getTime": func(_ *jsInterp, this jsValue, _ []jsValue) jsValue {
+			return float64(this.(*jsDate).t.UnixMilli())
+		},
+		"getYear": field(func(t time.Time) int { return t.Year() - 1900 }, false),
+		"getTimezoneOffset": func(_ *jsInterp, this jsValue, _ []jsValue) jsValue {
+			_, offset := this.(*jsDate).t.Zone()
+			return float64(-offset / 60)
+		},
+		"toString": func(_ *jsInterp, this jsValue, _ []jsValue) jsValue { return jsToString(this) },
+	}
+	for name, get := range getters {
+		jsDateMethods["get"+name] = field(get, false)
+		jsDateMethods["getUTC"+name] = field(get, true)
+	}
+}
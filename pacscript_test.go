@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runJS runs src and returns what its function f returns.
+func runJS(t *testing.T, src string) (jsValue, error) {
+	t.Helper()
+	prog, err := parseJS(src)
+	if err != nil {
+		return nil, err
+	}
+	env := newPACEnv()
+	in := &jsInterp{ctx: context.Background(), global: newJSScope(env.builtins), host: env}
+	return in.run(prog, "f")
+}
+
+func TestJSExpressions(t *testing.T) {
+	tests := []struct {
+		expr string
+		want jsValue
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"7 % 4 - 10 / 4", 0.5},
+		{"2 - 3 - 4", -5.0},
+		{"0x1F | 0x20", 63.0},
+		{"1 << 4 >> 2", 4.0},
+		{"-1 >>> 28", 15.0},
+		{"~5 & 0xff", 250.0},
+		{"'a' + 1 + 2", "a12"},
+		{"1 + 2 + 'a'", "3a"},
+		{"'3' * '4'", 12.0},
+		{"1 / 0", math.Inf(1)},
+		{"0.1 * 3", 0.30000000000000004},
+		{"'' + 1e21", "1e+21"},
+		{"'' + 1.5", "1.5"},
+		{"1 == '1'", true},
+		{"1 === '1'", false},
+		{"null == undefined", true},
+		{"null === undefined", false},
+		{"0 == false", true},
+		{"'' != 0", false},
+		{"NaN == NaN", false},
+		{"'b' > 'a'", true},
+		{"'10' < '9'", true},
+		{"'10' < 9", false},
+		{"1 && 'x'", "x"},
+		{"0 || null || 'y'", "y"},
+		{"!''", true},
+		{"true ? 'a' : 'b'", "a"},
+		{"typeof 1", "number"},
+		{"typeof 'x'", "string"},
+		{"typeof undeclared", "undefined"},
+		{"typeof null", "object"},
+		{"typeof f", "function"},
+		{"'Example.COM'.toLowerCase()", "example.com"},
+		{"'a.b.c'.indexOf('.')", 1.0},
+		{"'a.b.c'.indexOf('.', 2)", 3.0},
+		{"'a.b.c'.lastIndexOf('.')", 3.0},
+		{"'a.b.c'.split('.').length", 3.0},
+		{"'a.b.c'.split('.')[2]", "c"},
+		{"'hello'.substring(3, 1)", "el"},
+		{"'hello'.substr(-3, 2)", "ll"},
+		{"'hello'.slice(1, -1)", "ell"},
+		{"'hello'.charAt(1)", "e"},
+		{"'hello'.charCodeAt(0)", 104.0},
+		{"'hello'[4]", "o"},
+		{"'hello'.length", 5.0},
+		{"' x '.trim()", "x"},
+		{"'aaa'.replace('a', 'b')", "baa"},
+		{"'aaa'.replace(/a/g, 'b')", "bbb"},
+		{"'host:8080'.replace(/:(\\d+)$/, '/$1')", "host/8080"},
+		{"'www.example.com'.match(/^(\\w+)\\.(.*)$/)[2]", "example.com"},
+		{"'x'.match(/y/)", jsNull},
+		{"/^INTERNAL/i.test('internal.corp')", true},
+		{"/a\\/b/.source", "a\\/b"},
+		{"'abc'.startsWith('ab') && 'abc'.endsWith('bc')", true},
+		{"[1, 2, 3].join('-')", "1-2-3"},
+		{"[1, 2, 3].indexOf(2)", 1.0},
+		{"'' + [1, [2, 3]]", "1,2,3"},
+		{"({a: 1, 'b': 2}).b", 2.0},
+		{"'a' in {a: 1}", true},
+		{"parseInt('42px')", 42.0},
+		{"parseInt('0x1f')", 31.0},
+		{"parseInt('ff', 16)", 255.0},
+		{"parseFloat('3.5e1x')", 35.0},
+		{"parseFloat('0x1')", 0.0},
+		{"isNaN(parseInt('x'))", true},
+		{"Math.max(1, 5, 3)", 5.0},
+		{"Math.floor(-1.5)", -2.0},
+		{"String(12) + Number('3')", "123"},
+		{"(function (a, b) { return a + b })(1, 2)", 3.0},
+		{"void 0", nil},
+		{"undefined", nil},
+	}
+	for _, tt := range tests {
+		got, err := runJS(t, "function f() { return "+tt.expr+"; }")
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if gotN, ok := got.(float64); ok {
+			if wantN, ok := tt.want.(float64); ok && (gotN == wantN || math.IsNaN(gotN) && math.IsNaN(wantN)) {
+				continue
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s = %#v, want %#v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestJSStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want jsValue
+	}{
+		{"hoisting", `
+			function f() { return g() + x }
+			function g() { return 'g' }
+			var x = 'x'`, "gx"},
+		{"globals", `
+			var n = 0
+			function inc() { n++ }
+			function f() { inc(); inc(); return n }`, 2.0},
+		{"closures", `
+			function counter() { var n = 0; return function () { return ++n } }
+			function f() { var c = counter(); c(); return c() }`, 2.0},
+		{"implicit global", `
+			function set() { leaked = 'yes' }
+			function f() { set(); return leaked }`, "yes"},
+		{"if else", `
+			function f() {
+				var host = 'intranet'
+				if (host == 'x') return 1
+				else if (host == 'intranet') return 2
+				else return 3
+			}`, 2.0},
+		{"for", `
+			function f() {
+				var s = 0
+				for (var i = 0; i < 10; i++) {
+					if (i == 2) continue
+					if (i == 5) break
+					s += i
+				}
+				return s
+			}`, 8.0},
+		{"for in", `
+			function f() {
+				var o = {a: 1, b: 2, c: 3}, keys = ''
+				for (var k in o) keys += k + o[k]
+				return keys
+			}`, "a1b2c3"},
+		{"while", `
+			function f() { var i = 0; while (i < 3) i += 1; return i }`, 3.0},
+		{"do while", `
+			function f() { var i = 10; do { i++ } while (i < 3); return i }`, 11.0},
+		{"switch", `
+			function f() {
+				var r = ''
+				switch ('b') {
+				case 'a': r += 'a'
+				case 'b': r += 'b'
+				case 'c': r += 'c'; break
+				default: r += 'd'
+				}
+				return r
+			}`, "bc"},
+		{"switch default", `
+			function f() { switch (3) { case 1: return 'one'; default: return 'other' } }`, "other"},
+		{"arrays", `
+			function f() {
+				var a = []
+				a.push('x', 'y')
+				a[3] = 'z'
+				return a.length + a.join()
+			}`, "4x,y,,z"},
+		{"objects", `
+			function f() {
+				var o = {}
+				o.name = 'n'
+				o['other'] = 1
+				o.other += 1
+				return o.name + o.other
+			}`, "n2"},
+		{"compound assignment", `
+			function f() { var s = 'a'; s += 'b'; var n = 10; n -= 3; n *= 2; return s + n }`, "ab14"},
+		{"no semicolons", `
+			function f() {
+				var a = 1
+				var b = 2
+				return a + b
+			}`, 3.0},
+		{"return before a line break", `
+			function f() {
+				return
+				'unreachable'
+			}`, nil},
+		{"regexp after keyword", `
+			function f() { return typeof /x/ }`, "object"},
+		{"division", `
+			function f() { var a = 8, b = 2, g = 2; return a / b / g }`, 2.0},
+		{"comments", `
+			// A line comment.
+			/* A block
+			   comment. */
+			function f() { return 'ok' /* inline */ }`, "ok"},
+		{"date", `
+			function f() { var d = new Date(2026, 0, 31); return d.getMonth() + '-' + d.getDate() + '-' + d.getDay() }`, "0-31-6"},
+		{"recursion", `
+			function fib(n) { return n < 2 ? n : fib(n - 1) + fib(n - 2) }
+			function f() { return fib(15) }`, 610.0},
+		{"cyclic array", `
+			function f() { var a = [1]; a.push(a); return '' + a }`, "1,"},
+		{"global replace", `
+			function f() { return 'abc'.replace(/x*/g, '-') + 'a.b'.replace(/(\w)/g, '[$1]') }`, "-a-b-c-[a].[b]"},
+	}
+	for _, tt := range tests {
+		got, err := runJS(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJSErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"syntax", "function f() { return 1 +; }", "line 1: unexpected ;"},
+		{"unterminated string", "function f() {\n return 'x\n}", "line 2: unterminated string"},
+		{"unterminated comment", "/* x", "unterminated comment"},
+		{"missing brace", "function f() { return 1", "expected }"},
+		{"unsupported statement", "function f() { try { } catch (e) { } }", "try statements are not supported"},
+		{"break outside a loop", "function f() { break }", "break outside of a loop"},
+		{"invalid assignment", "function f() { 1 = 2 }", "invalid assignment target"},
+		{"bad regexp", "function f() { return /(?<=a)b/ }", "regular expression"},
+		{"undefined name", "function f() { return missing }", "missing is not defined"},
+		{"not a function", "function f() { var x = 1; return x() }", "x is not a function"},
+		{"undefined property", "function f() { var x; return x.y }", "can't read property y of undefined"},
+		{"no function", "var x = 1", "script doesn't define f"},
+		{"endless loop", "function f() { while (true) {} }", "too many steps"},
+		{"endless recursion", "function f() { return f() }", "too much recursion"},
+		{"deep nesting", "function f() { return " + strings.Repeat("(", 3000) + "1" + strings.Repeat(")", 3000) + " }", "nested too deeply"},
+		{"long chain", "function f() { return 1" + strings.Repeat(" + 1", 3000) + " }", "nested too deeply"},
+		{"growing string", "function f() { var s = 'x'; while (true) s += s }", "too much memory"},
+		{"growing array", "function f() { var a = []; a[1048576] = 1 }", "too much memory"},
+		{"long join", "function f() { var s = 'x', a = []; for (var i = 0; i < 20; i++) s += s; for (i = 0; i < 100; i++) a.push(s); return a.join('') }", "string too long"},
+		{"long replace", "function f() { var s = 'x'; for (var i = 0; i < 13; i++) s += s; return s.replace(/x/g, s) }", "string too long"},
+		{"long split", "function f() { var s = 'x'; for (var i = 0; i < 22; i++) s += s; return s.split('') }", "too much memory"},
+		{"builtins are read-only", "function f() { isPlainHostName = 1; return typeof isPlainHostName }", ""},
+	}
+	for _, tt := range tests {
+		got, err := runJS(t, tt.src)
+		if tt.want == "" {
+			if err != nil || got != "number" {
+				t.Errorf("%s: %#v, %v", tt.name, got, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %#v, %v, want an error with %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// jsFuzzSeeds are scripts to start fuzzing the parser and interpreter from.
+var jsFuzzSeeds = []string{
+	"function f() { return 1 + 2 * 3 }",
+	"function f() { var a = [1, 'x', {b: null}]; for (var k in a) a[k] = typeof a[k]; return a.join() }",
+	"function f() { var s = 'a.b.c'; switch (s.split('.').length) { case 3: return s.replace(/\\./g, '-'); default: return } }",
+	"function f() { var n = 0; do { n++ } while (n < 10); return n > 5 ? 'x'.toUpperCase() : void 0 }",
+	"function f() { return /^(\\w+)\\.(.*)$/i.exec('www.example.com')[2].substr(-3, 2) }",
+	"function f() { var d = new Date(2026, 0, 31); return d.getDay() + parseInt('0x1f') + Math.max(1, 2) }",
+	"function FindProxyForURL(url, host) { if (isPlainHostName(host) || dnsDomainIs(host, '.corp')) return 'DIRECT'; return 'PROXY p:8080' }",
+}
+
+func FuzzParseJS(f *testing.F) {
+	for _, src := range jsFuzzSeeds {
+		f.Add(src)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		prog, err := parseJS(src)
+		if (prog == nil) == (err == nil) {
+			t.Errorf("parseJS(%q) = %v, %v", src, prog, err)
+		}
+	})
+}
+
+func FuzzRunJS(f *testing.F) {
+	for _, src := range jsFuzzSeeds {
+		f.Add(src)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		prog, err := parseJS(src)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		env := newPACEnv()
+		in := &jsInterp{ctx: ctx, global: newJSScope(env.builtins), host: env}
+		// Errors are fine, panics and runaway evaluations aren't.
+		_, _ = in.run(prog, "f")
+		if in.allocated > jsMaxAlloc || in.steps > jsMaxSteps+1 {
+			t.Errorf("%q: allocated %d bytes in %d steps", src, in.allocated, in.steps)
+		}
+	})
+}
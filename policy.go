@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+const (
+	policyModeEnforce = "enforce"
+	policyModeAudit   = "audit"
+)
+
+// policy applies the decisions of access rules. In audit mode denials are
+// only logged and counted, so a new rule set can be checked against live
+// traffic before it's enforced.
+type policy struct {
+	audit bool
+
+	blocked    atomic.Int64
+	wouldBlock atomic.Int64
+}
+
+func newPolicy(mode string) *policy {
+	return &policy{audit: mode == policyModeAudit}
+}
+
+// block reports whether a request denied by rule has to be blocked.
+func (pol *policy) block(logger *log.Logger, rule, host string) bool {
+	if pol.audit {
+		pol.wouldBlock.Add(1)
+		logger.Printf("policy audit: %s would block %s", rule, host)
+		return false
+	}
+
+	pol.blocked.Add(1)
+	logger.Printf("policy: %s blocked %s", rule, host)
+	return true
+}
+
+func (pol *policy) writeMetrics(pw metricsWriter) {
+	pw.counter("http2socks_policy_blocked_total", "Requests blocked by access rules.", pol.blocked.Load())
+	pw.counter("http2socks_policy_would_block_total", "Requests which access rules would block in audit mode.", pol.wouldBlock.Load())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of TCP ports.
+type portRange struct {
+	low, high uint16
+}
+
+// portRanges matches ports against a list of ports and ranges.
+type portRanges []portRange
+
+// parsePortRanges parses ports ("443"), ranges ("8000-8999") and * for any
+// port.
+func parsePortRanges(specs []string) (portRanges, error) {
+	ranges := make(portRanges, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "*" {
+			ranges = append(ranges, portRange{1, 65535})
+			continue
+		}
+		lowSpec, highSpec, isRange := strings.Cut(spec, "-")
+		if !isRange {
+			highSpec = lowSpec
+		}
+		low, lowErr := strconv.ParseUint(lowSpec, 10, 16)
+		high, highErr := strconv.ParseUint(highSpec, 10, 16)
+		if lowErr != nil || highErr != nil || low == 0 || low > high {
+			return nil, fmt.Errorf("bad port or port range %q", spec)
+		}
+		ranges = append(ranges, portRange{uint16(low), uint16(high)})
+	}
+	return ranges, nil
+}
+
+func (rs portRanges) match(port uint16) bool {
+	for _, r := range rs {
+		if port >= r.low && port <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// connectPorts limits the destination ports of CONNECT tunnels, so the
+// proxy isn't an open relay to any TCP service. Denied ports are refused
+// even when allowed.
+type connectPorts struct {
+	allow portRanges
+	deny  portRanges
+}
+
+func newConnectPorts(allow, deny []string) (*connectPorts, error) {
+	allowed, err := parsePortRanges(allow)
+	if err != nil {
+		return nil, fmt.Errorf("CONNECT ports: %w", err)
+	}
+	denied, err := parsePortRanges(deny)
+	if err != nil {
+		return nil, fmt.Errorf("CONNECT deny ports: %w", err)
+	}
+	return &connectPorts{allow: allowed, deny: denied}, nil
+}
+
+// allowed reports whether tunnels may go to port, a port as in
+// connectTarget.
+func (c *connectPorts) allowed(port string) bool {
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return false
+	}
+	return c.allow.match(uint16(n)) && !c.deny.match(uint16(n))
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// warmFillTimeout bounds making one connection of a warm pool.
+const warmFillTimeout = 10 * time.Second
+
+// warmPool keeps size connections to a SOCKS5 server connected and
+// authenticated ahead of time, so a new connection only has to send the
+// CONNECT command. Servers close connections which don't send one for a
+// while, so those older than maxAge are replaced.
+type warmPool struct {
+	server string
+	size   int
+	maxAge time.Duration
+	// dial connects to the server and runs the SOCKS5 negotiation.
+	dial func(ctx context.Context) (net.Conn, error)
+
+	mu     sync.Mutex
+	conns  []warmConn
+	kick   chan struct{}
+	cancel context.CancelFunc
+
+	taken   atomic.Int64
+	missed  atomic.Int64
+	expired atomic.Int64
+	stale   atomic.Int64
+}
+
+type warmConn struct {
+	conn net.Conn
+	at   time.Time
+}
+
+func newWarmPool(server string, size int, maxAge time.Duration, dial func(ctx context.Context) (net.Conn, error)) *warmPool {
+	return &warmPool{server: server, size: size, maxAge: maxAge, dial: dial, kick: make(chan struct{}, 1)}
+}
+
+// start fills the pool in the background until close.
+func (wp *warmPool) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	wp.mu.Lock()
+	wp.cancel = cancel
+	wp.mu.Unlock()
+	go wp.run(ctx)
+}
+
+// run tops the pool up after connections were taken and replaces them
+// before they get too old. After a failed connection it waits for the
+// next take or expiry, so an unreachable server isn't hammered.
+func (wp *warmPool) run(ctx context.Context) {
+	for {
+		wp.fill(ctx)
+
+		wait := wp.maxAge
+		wp.mu.Lock()
+		if len(wp.conns) > 0 {
+			wait = time.Until(wp.conns[0].at.Add(wp.maxAge))
+		}
+		wp.mu.Unlock()
+
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			wp.drain()
+			return
+		case <-wp.kick:
+			timer.Stop()
+		case <-timer.C:
+		}
+		wp.expire()
+	}
+}
+
+// fill makes connections until the pool has size.
+func (wp *warmPool) fill(ctx context.Context) {
+	for {
+		wp.mu.Lock()
+		missing := wp.size - len(wp.conns)
+		wp.mu.Unlock()
+		if missing <= 0 || ctx.Err() != nil {
+			return
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, warmFillTimeout)
+		conn, err := wp.dial(dialCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("warm SOCKS5 connections to %s: %v", wp.server, err)
+			}
+			return
+		}
+		wp.mu.Lock()
+		wp.conns = append(wp.conns, warmConn{conn: conn, at: time.Now()})
+		wp.mu.Unlock()
+	}
+}
+
+// expire closes the connections older than maxAge.
+func (wp *warmPool) expire() {
+	wp.mu.Lock()
+	var old []warmConn
+	for len(wp.conns) > 0 && time.Since(wp.conns[0].at) >= wp.maxAge {
+		old = append(old, wp.conns[0])
+		wp.conns = wp.conns[1:]
+	}
+	wp.mu.Unlock()
+	for _, c := range old {
+		wp.expired.Add(1)
+		_ = c.conn.Close()
+	}
+}
+
+// take returns the newest connection of the pool, nil when it's empty.
+func (wp *warmPool) take() net.Conn {
+	wp.mu.Lock()
+	var conn net.Conn
+	for n := len(wp.conns); n > 0 && conn == nil; n = len(wp.conns) {
+		c := wp.conns[n-1]
+		wp.conns = wp.conns[:n-1]
+		if time.Since(c.at) < wp.maxAge {
+			conn = c.conn
+		} else {
+			wp.expired.Add(1)
+			_ = c.conn.Close()
+		}
+	}
+	wp.mu.Unlock()
+
+	select {
+	case wp.kick <- struct{}{}:
+	default:
+	}
+	if conn == nil {
+		wp.missed.Add(1)
+		return nil
+	}
+	wp.taken.Add(1)
+	return conn
+}
+
+// close stops filling the pool and closes its connections.
+func (wp *warmPool) close() {
+	wp.mu.Lock()
+	cancel := wp.cancel
+	wp.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (wp *warmPool) drain() {
+	wp.mu.Lock()
+	conns := wp.conns
+	wp.conns = nil
+	wp.mu.Unlock()
+	for _, c := range conns {
+		_ = c.conn.Close()
+	}
+}
+
+// warmDial returns the dial function of a warm pool of the SOCKS5 server
+// e, reached with forward.
+func warmDial(forward proxy.Dialer, e socksEndpoint) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialContext(ctx, forward, e.network(), e.server)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		if err := socksHandshake(conn, e.user, e.password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// warmDialer sends the CONNECT command over a connection of pool, and
+// dials with forward when the pool is empty or the connection turned out
+// to be closed by the server.
+type warmDialer struct {
+	pool    *warmPool
+	forward proxy.ContextDialer
+}
+
+func (d warmDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d warmDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn := d.pool.take()
+	if conn == nil {
+		return d.forward.DialContext(ctx, network, addr)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	err := socksConnect(conn, addr)
+	if !stop() {
+		err = ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() == nil && protocolError(err) {
+			d.pool.stale.Add(1)
+			return d.forward.DialContext(ctx, network, addr)
+		}
+		return nil, &net.OpError{Op: "socks connect", Net: network, Addr: hopAddr(d.pool.server), Err: err}
+	}
+	return conn, nil
+}
+
+// socksReplyErrors are the messages of failed SOCKS5 replies.
+var socksReplyErrors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socksConnect sends the SOCKS5 CONNECT command for addr over conn, which
+// went through the negotiation, and reads the reply.
+func socksConnect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port %q", portStr)
+	}
+
+	req := []byte{socksVersion5, socksCmdConnect, 0x00}
+	if ip, err := netip.ParseAddr(host); err == nil && ip.Is4() {
+		req = append(append(req, socksAddrIPv4), ip.AsSlice()...)
+	} else if err == nil {
+		req = append(append(req, socksAddrIPv6), ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(append(req, socksAddrDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion5 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != socksReplySucceeded {
+		if msg, ok := socksReplyErrors[reply[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("unknown SOCKS reply %d", reply[1])
+	}
+
+	// The bound address isn't of use.
+	var skip int
+	switch reply[3] {
+	case socksAddrIPv4:
+		skip = net.IPv4len + 2
+	case socksAddrIPv6:
+		skip = net.IPv6len + 2
+	case socksAddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("unknown SOCKS address type %d", reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip))
+	return err
+}
+
+// writeWarmMetrics writes the metrics of the warm pools.
+func writeWarmMetrics(pw metricsWriter, pools []*warmPool) {
+	if len(pools) == 0 {
+		return
+	}
+
+	pw.header("http2socks_socks_warm_conns", "gauge", "Idle SOCKS5 connections negotiated ahead of time.")
+	for _, wp := range pools {
+		wp.mu.Lock()
+		n := len(wp.conns)
+		wp.mu.Unlock()
+		pw.sample("http2socks_socks_warm_conns", map[string]string{"server": wp.server}, float64(n))
+	}
+	for _, m := range []struct {
+		name, help string
+		value      func(*warmPool) int64
+	}{
+		{"http2socks_socks_warm_taken_total", "Connections made over a SOCKS5 connection negotiated ahead of time.", func(wp *warmPool) int64 { return wp.taken.Load() }},
+		{"http2socks_socks_warm_missed_total", "Connections made without a warm SOCKS5 connection because the pool was empty.", func(wp *warmPool) int64 { return wp.missed.Load() }},
+		{"http2socks_socks_warm_expired_total", "Warm SOCKS5 connections closed unused for their age.", func(wp *warmPool) int64 { return wp.expired.Load() }},
+		{"http2socks_socks_warm_stale_total", "Warm SOCKS5 connections the server had closed when taken.", func(wp *warmPool) int64 { return wp.stale.Load() }},
+	} {
+		pw.header(m.name, "counter", m.help)
+		for _, wp := range pools {
+			pw.sample(m.name, map[string]string{"server": wp.server}, float64(m.value(wp)))
+		}
+	}
+}
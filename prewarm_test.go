@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocksConnect(t *testing.T) {
+	succeeded := func(addr ...byte) []byte {
+		return append([]byte{socksVersion5, socksReplySucceeded, 0x00}, addr...)
+	}
+	bound4 := succeeded(socksAddrIPv4, 10, 0, 0, 1, 0x04, 0x38)
+
+	tests := []struct {
+		name    string
+		addr    string
+		reply   []byte
+		request []byte
+		wantErr bool
+	}{
+		{
+			name:    "domain",
+			addr:    "example.com:443",
+			reply:   bound4,
+			request: append(append([]byte{socksVersion5, socksCmdConnect, 0x00, socksAddrDomain, 11}, "example.com"...), 0x01, 0xbb),
+		},
+		{
+			name:    "IPv4",
+			addr:    "10.0.0.1:80",
+			reply:   bound4,
+			request: []byte{socksVersion5, socksCmdConnect, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+		},
+		{
+			name:    "IPv6",
+			addr:    "[2001:db8::1]:443",
+			reply:   succeeded(append([]byte{socksAddrIPv6}, make([]byte, 18)...)...),
+			request: []byte{socksVersion5, socksCmdConnect, 0x00, socksAddrIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb},
+		},
+		{
+			name:    "bound domain",
+			addr:    "10.0.0.1:80",
+			reply:   succeeded(append([]byte{socksAddrDomain, 4}, "host\x00\x50"...)...),
+			request: []byte{socksVersion5, socksCmdConnect, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+		},
+		{
+			name:    "refused",
+			addr:    "10.0.0.1:80",
+			reply:   []byte{socksVersion5, 0x05, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0},
+			request: []byte{socksVersion5, socksCmdConnect, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+			wantErr: true,
+		},
+		{
+			name:    "unknown reply",
+			addr:    "10.0.0.1:80",
+			reply:   []byte{socksVersion5, 0x7f, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0},
+			request: []byte{socksVersion5, socksCmdConnect, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+			wantErr: true,
+		},
+		{
+			name:    "version",
+			addr:    "10.0.0.1:80",
+			reply:   []byte{0x04, socksReplySucceeded, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0},
+			request: []byte{socksVersion5, socksCmdConnect, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+			wantErr: true,
+		},
+		{
+			name:    "bound address type",
+			addr:    "10.0.0.1:80",
+			reply:   succeeded(0x05),
+			request: []byte{socksVersion5, socksCmdConnect, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+			wantErr: true,
+		},
+		{
+			name:    "truncated reply",
+			addr:    "10.0.0.1:80",
+			reply:   succeeded(socksAddrIPv4, 10, 0),
+			request: []byte{socksVersion5, socksCmdConnect, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+			wantErr: true,
+		},
+		{name: "no port", addr: "example.com", wantErr: true},
+		{name: "bad port", addr: "example.com:https", wantErr: true},
+		{name: "long host", addr: string(bytes.Repeat([]byte("a"), 256)) + ":80", wantErr: true},
+	}
+	for _, tt := range tests {
+		client, server := tcpPair(t)
+		// Data following the reply belongs to the tunnel.
+		if _, err := server.Write(append(tt.reply, 'x')); err != nil {
+			t.Fatal(err)
+		}
+		if tt.wantErr && bytes.HasPrefix(tt.reply, succeeded()) {
+			_ = server.(*net.TCPConn).CloseWrite()
+		}
+
+		err := socksConnect(client, tt.addr)
+		_ = client.(*net.TCPConn).CloseWrite()
+		request, _ := io.ReadAll(server)
+
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("%s: socksConnect succeeded, want an error", tt.name)
+		case !tt.wantErr && err != nil:
+			t.Errorf("%s: socksConnect: %v", tt.name, err)
+		case !tt.wantErr:
+			next := make([]byte, 1)
+			if _, err := io.ReadFull(client, next); err != nil || next[0] != 'x' {
+				t.Errorf("%s: read %q, %v after the reply, want the tunnel's data", tt.name, next, err)
+			}
+		}
+		if !bytes.Equal(request, tt.request) {
+			t.Errorf("%s: sent %v, want %v", tt.name, request, tt.request)
+		}
+	}
+}
+
+func TestWarmPoolTake(t *testing.T) {
+	wp := newWarmPool("127.0.0.1:1080", 3, time.Minute, nil)
+	if conn := wp.take(); conn != nil || wp.missed.Load() != 1 {
+		t.Fatalf("took %v from an empty pool, %d missed", conn, wp.missed.Load())
+	}
+
+	old, _ := net.Pipe()
+	older, _ := net.Pipe()
+	newest, _ := net.Pipe()
+	wp.conns = []warmConn{
+		{conn: older, at: time.Now().Add(-2 * time.Minute)},
+		{conn: old, at: time.Now().Add(-2 * time.Minute)},
+		{conn: newest, at: time.Now()},
+	}
+	if conn := wp.take(); conn != newest {
+		t.Errorf("took %v, want the newest connection", conn)
+	}
+	if conn := wp.take(); conn != nil {
+		t.Errorf("took %v, want the expired connections skipped", conn)
+	}
+	if wp.taken.Load() != 1 || wp.expired.Load() != 2 || wp.missed.Load() != 2 {
+		t.Errorf("%d taken, %d expired, %d missed, want 1, 2, 2", wp.taken.Load(), wp.expired.Load(), wp.missed.Load())
+	}
+	if _, err := older.Write([]byte{0}); err == nil {
+		t.Error("expired connection isn't closed")
+	}
+}
+
+// testDialer returns conn, counting the dials.
+type testDialer struct {
+	conn  net.Conn
+	dials int
+}
+
+func (d *testDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *testDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	d.dials++
+	return d.conn, nil
+}
+
+func TestWarmDialerStale(t *testing.T) {
+	client, server := tcpPair(t)
+	// The server closed the warm connection in the meantime.
+	_ = server.Close()
+
+	wp := newWarmPool("127.0.0.1:1080", 1, time.Minute, nil)
+	wp.conns = []warmConn{{conn: client, at: time.Now()}}
+	fallback, _ := net.Pipe()
+	forward := &testDialer{conn: fallback}
+
+	conn, err := warmDialer{pool: wp, forward: forward}.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil || conn != fallback || forward.dials != 1 {
+		t.Fatalf("DialContext = %v, %v after %d dials, want the forward dialer's connection", conn, err, forward.dials)
+	}
+	if wp.stale.Load() != 1 {
+		t.Errorf("%d stale connections, want 1", wp.stale.Load())
+	}
+
+	// Without warm connections, the forward dialer connects.
+	if conn, err := (warmDialer{pool: wp, forward: forward}).DialContext(context.Background(), "tcp", "example.com:443"); err != nil || conn != fallback || forward.dials != 2 {
+		t.Errorf("DialContext = %v, %v after %d dials, want the forward dialer's connection", conn, err, forward.dials)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// clientProcess is the local process a client connection comes from.
+type clientProcess struct {
+	name string
+	pid  int
+}
+
+func (c clientProcess) String() string {
+	return c.name + " (pid " + strconv.Itoa(c.pid) + ")"
+}
+
+// processOf returns the local process of the client connection of ctx, an
+// empty name when the client isn't on this host or its process couldn't be
+// found. It's looked up once per connection.
+func processOf(ctx context.Context) clientProcess {
+	s := sessionFromContext(ctx)
+	if s == nil {
+		return clientProcess{}
+	}
+	s.processOnce.Do(func() {
+		s.process = lookupProcess(s.client, s.local)
+	})
+	return s.process
+}
+
+// processRule allows or denies destinations matching hosts, all of them
+// when nil, to local clients whose process name matches process, a pattern
+// where * matches any characters.
+type processRule struct {
+	text    string
+	allow   bool
+	process string
+	hosts   *hostMatcher
+}
+
+// processRules are checked in order and the first matching rule applies.
+// Clients matching no rule, and those whose process is unknown, are
+// allowed.
+type processRules []processRule
+
+// parseProcessRules parses rules of the form "allow|deny process
+// destination", e.g. "deny curl *.example.com", where the destination *
+// matches all.
+func parseProcessRules(specs []string, groups map[string]string) (processRules, error) {
+	rules := make(processRules, 0, len(specs))
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("process rule %q: must be action, process and destination", spec)
+		}
+		action, process, host := fields[0], fields[1], fields[2]
+		if action != urlRuleAllow && action != urlRuleDeny {
+			return nil, fmt.Errorf("process rule %q: action must be %s or %s", spec, urlRuleAllow, urlRuleDeny)
+		}
+		var hosts *hostMatcher
+		if host != "*" {
+			var err error
+			if hosts, err = newHostMatcher([]string{host}, groups); err != nil {
+				return nil, fmt.Errorf("process rule %q: %w", spec, err)
+			}
+		}
+		rules = append(rules, processRule{
+			text:    strings.Join(fields, " "),
+			allow:   action == urlRuleAllow,
+			process: process,
+			hosts:   hosts,
+		})
+	}
+	return rules, nil
+}
+
+// match returns the first rule matching a request of process to host.
+func (rs processRules) match(process, host string) (processRule, bool) {
+	if process == "" {
+		return processRule{}, false
+	}
+
+	for _, r := range rs {
+		if globMatch(r.process, process) && (r.hosts == nil || r.hosts.match(host)) {
+			return r, true
+		}
+	}
+	return processRule{}, false
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lookupProcess finds the process owning the client end of a connection
+// from client to local, both on this host: the socket's inode is found in
+// /proc/net/tcp or tcp6, then the process holding it among the file
+// descriptors in /proc. Processes of other users are only found when
+// running as root.
+func lookupProcess(client, local string) clientProcess {
+	clientAddr, err := netip.ParseAddrPort(client)
+	if err != nil || !clientAddr.Addr().Unmap().IsLoopback() {
+		return clientProcess{}
+	}
+	localAddr, err := netip.ParseAddrPort(local)
+	if err != nil {
+		return clientProcess{}
+	}
+
+	inode := ""
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if inode = socketInode(table, clientAddr, localAddr); inode != "" {
+			break
+		}
+	}
+	if inode == "" {
+		return clientProcess{}
+	}
+	return socketOwner("socket:[" + inode + "]")
+}
+
+// socketInode returns the inode of the socket from local to remote listed
+// in table.
+func socketInode(table string, local, remote netip.AddrPort) string {
+	f, err := os.Open(table)
+	if err != nil {
+		return ""
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if procNetAddr(fields[1]) == local && procNetAddr(fields[2]) == remote {
+			return fields[9]
+		}
+	}
+	return ""
+}
+
+// procNetAddr parses an address of /proc/net/tcp, the IP as 32-bit words
+// in host byte order and the port, both in hex. IPv4-mapped addresses are
+// unmapped, so they compare equal to IPv4 ones.
+func procNetAddr(s string) netip.AddrPort {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}
+	}
+	b, err := hex.DecodeString(ipHex)
+	if err != nil || len(b)%4 != 0 {
+		return netip.AddrPort{}
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+	ip, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(ip.Unmap(), uint16(port))
+}
+
+// socketOwner returns the process with a file descriptor linking to
+// socket.
+func socketOwner(socket string) clientProcess {
+	pids, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range pids {
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, _ := os.Readlink(filepath.Join(dir, "fd", fd.Name())); link != socket {
+				continue
+			}
+			pid, _ := strconv.Atoi(filepath.Base(dir))
+			comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+			return clientProcess{name: strings.TrimSpace(string(comm)), pid: pid}
+		}
+	}
+	return clientProcess{}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// lookupProcess only finds processes on Linux.
+func lookupProcess(string, string) clientProcess {
+	return clientProcess{}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// writeProxyEnv writes the proxy variables of containers using the proxy
+// to name, in the KEY=value format of env files: HTTP_PROXY and
+// HTTPS_PROXY point to the HTTP proxy, ALL_PROXY to the SOCKS listener when
+// there is one, each in upper and lower case as tools differ in which they
+// read.
+func writeProxyEnv(name string, cfg *Config) error {
+	host := cfg.ProxyEnvHost
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	scheme := "http"
+	if cfg.TLSCertFile != "" {
+		scheme = "https"
+	}
+	_, port, err := net.SplitHostPort(cfg.HTTPAddress)
+	if err != nil {
+		return err
+	}
+	httpProxy := scheme + "://" + net.JoinHostPort(host, port)
+	allProxy := httpProxy
+	if cfg.SocksListenAddress != "" {
+		if _, port, err = net.SplitHostPort(cfg.SocksListenAddress); err != nil {
+			return err
+		}
+		allProxy = "socks5h://" + net.JoinHostPort(host, port)
+	}
+
+	var b strings.Builder
+	for _, v := range [][2]string{
+		{"HTTP_PROXY", httpProxy},
+		{"HTTPS_PROXY", httpProxy},
+		{"ALL_PROXY", allProxy},
+		{"NO_PROXY", strings.Join(cfg.ProxyEnvNoProxy, ",")},
+	} {
+		fmt.Fprintf(&b, "%s=%s\n%s=%s\n", v[0], v[1], strings.ToLower(v[0]), v[1])
+	}
+	return os.WriteFile(name, []byte(b.String()), 0o644)
+}
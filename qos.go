@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// qosClass is the priority class of a transfer when pacing is enabled.
+type qosClass int
+
+const (
+	qosInteractive qosClass = iota
+	qosDefault
+	qosBulk
+
+	qosClassCount
+)
+
+var qosClassNames = [qosClassCount]string{"interactive", "default", "bulk"}
+
+// qosWeights are the shares of the paced rate classes get while they
+// transfer at the same time.
+var qosWeights = [qosClassCount]int{8, 4, 1}
+
+// qosActiveWindow is how long a class counts as transferring after its
+// last write.
+const qosActiveWindow = 250 * time.Millisecond
+
+func parseQoSClass(name string) (qosClass, error) {
+	for c, n := range qosClassNames {
+		if n == name {
+			return qosClass(c), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown QoS class %q, must be one of %s", name, strings.Join(qosClassNames[:], ", "))
+}
+
+// qosClassifier assigns transfers to QoS classes by destination or by
+// proxy user. A matching destination takes precedence over the user.
+type qosClassifier struct {
+	hosts [qosClassCount]*hostMatcher
+	users map[string]qosClass
+}
+
+// newQoSClassifier builds the classifier from class:destinations and
+// class:users maps with space-separated members.
+func newQoSClassifier(hosts, users, groups map[string]string) (*qosClassifier, error) {
+	q := &qosClassifier{users: make(map[string]qosClass)}
+	for name, patterns := range hosts {
+		class, err := parseQoSClass(name)
+		if err != nil {
+			return nil, err
+		}
+		m, err := newHostMatcher(strings.Fields(patterns), groups)
+		if err != nil {
+			return nil, fmt.Errorf("QoS class %s: %w", name, err)
+		}
+		q.hosts[class] = m
+	}
+	for name, members := range users {
+		class, err := parseQoSClass(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range strings.Fields(members) {
+			q.users[user] = class
+		}
+	}
+	return q, nil
+}
+
+// class returns the class of a transfer to host for user.
+func (q *qosClassifier) class(host, user string) qosClass {
+	if q == nil {
+		return qosDefault
+	}
+	for c, m := range q.hosts {
+		if m.match(host) {
+			return qosClass(c)
+		}
+	}
+	if class, ok := q.users[user]; ok {
+		return class
+	}
+	return qosDefault
+}
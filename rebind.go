@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"golang.org/x/net/proxy"
+)
+
+var errDNSRebind = errors.New("destination resolved to a blocked address")
+
+// rebindGuard checks the addresses destination names are resolved to on
+// this host when connecting, against the rules which block destinations
+// regardless of the client. Names were checked before the request was
+// proxied, so a name resolving to a blocked address by then was likely
+// rebound to it. The connection goes to the checked address.
+type rebindGuard struct {
+	proxy *forwardProxy
+
+	blocked atomic.Int64
+}
+
+// check fails connections to host resolved to ip when a rule blocks ip, or
+// only logs them in audit mode. Nil-safe.
+func (g *rebindGuard) check(ctx context.Context, host string, ip netip.Addr) error {
+	if g == nil {
+		return nil
+	}
+	rule, ok := g.proxy.destinationRule(ctx, ip.String())
+	if !ok {
+		return nil
+	}
+	logger := sessionLogger(ctx)
+	logger.Printf("DNS rebind: %s resolved to %s", host, ip)
+	if !g.proxy.policy.block(logger, rule, ip.String()) {
+		return nil
+	}
+	g.blocked.Add(1)
+	return fmt.Errorf("%w: %s resolved to %s", errDNSRebind, host, ip)
+}
+
+// resolve resolves the host of addr like resolveLocally and checks the
+// address. Addresses aren't checked again.
+func (g *rebindGuard) resolve(ctx context.Context, addr string) (string, error) {
+	target, err := resolveLocally(ctx, addr)
+	if err != nil || target == addr {
+		return target, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	ip, err := netip.ParseAddrPort(target)
+	if err != nil {
+		return "", err
+	}
+	if err := g.check(ctx, host, ip.Addr()); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// rebindDialer makes direct connections to the address the guard checked.
+type rebindDialer struct {
+	forward proxy.Dialer
+	guard   *rebindGuard
+}
+
+func (d rebindDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d rebindDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	target, err := d.guard.resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialContext(ctx, d.forward, network, target)
+}
+
+// destinationRule returns the rule blocking connections to host whoever
+// the client is: block routing rules, the block list and blocklist
+// subscriptions.
+func (p *forwardProxy) destinationRule(ctx context.Context, host string) (string, bool) {
+	if route, ok := p.router.match(ctx, host); ok && route.action == routeBlock {
+		return "routing rule " + route.text, true
+	}
+	if p.blocked.match(host) {
+		return "block list", true
+	}
+	if p.blocklist.match(host) {
+		return "blocklist subscription", true
+	}
+	return "", false
+}
+
+func (g *rebindGuard) writeMetrics(pw metricsWriter) {
+	if g == nil {
+		return
+	}
+
+	pw.counter("http2socks_dns_rebind_blocked_total", "Connections refused because the destination name resolved to a blocked address.", g.blocked.Load())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+)
+
+// poolRecycler flushes the upstream connection pool and dialer state
+// after errors (unless zero) consecutive protocol errors of requests and tunnels, which
+// point at pooled connections broken without notice, e.g. by a NAT
+// between the proxy and the SOCKS5 server forgetting them or the server
+// restarting.
+type poolRecycler struct {
+	errors int
+
+	consecutive atomic.Int64
+	recycled    atomic.Int64
+	flushed     atomic.Int64
+}
+
+// protocolError reports whether err means a connection broke in the
+// middle of the protocol rather than being refused.
+func protocolError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// observe records the outcome of a request or tunnel through the
+// upstream and reports whether the pool is due for recycling.
+func (r *poolRecycler) observe(err error) bool {
+	if r.errors <= 0 {
+		return false
+	}
+	if err == nil || !protocolError(err) {
+		r.consecutive.Store(0)
+		return false
+	}
+	if r.consecutive.Add(1) != int64(r.errors) {
+		return false
+	}
+	r.consecutive.Store(0)
+	r.recycled.Add(1)
+	return true
+}
+
+// observeUpstream recycles the upstream connection pool after repeated
+// protocol errors.
+func (p *forwardProxy) observeUpstream(err error) {
+	if p.recycler.observe(err) {
+		log.Printf("%d protocol errors in a row through the upstream, recycling its connections: %v", p.recycler.errors, err)
+		p.flushUpstream()
+	}
+}
+
+// flushUpstream closes the idle pooled connections to the upstream and
+// drops the dialer state, such as SSH connections and resolved proxy
+// addresses, so new connections start afresh. Open tunnels and requests
+// carry on.
+func (p *forwardProxy) flushUpstream() {
+	p.upstreamClientMu.Lock()
+	old := p.upstreamClient.Swap(nil)
+	p.upstreamClientMu.Unlock()
+
+	if old == nil {
+		return
+	}
+	old.close()
+	for _, s := range old.upstream.servers {
+		s.resolver.expire()
+	}
+}
+
+type flushUpstreamResponse struct {
+	Generation uint64 `json:"generation"`
+}
+
+// handleFlushUpstream recycles the upstream connection pool on demand.
+func (p *forwardProxy) handleFlushUpstream(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.flushUpstream()
+	p.recycler.flushed.Add(1)
+	log.Printf("upstream connections recycled by the admin API")
+	writeJSON(w, http.StatusOK, flushUpstreamResponse{Generation: p.upstreams.current.Load().generation})
+}
+
+func (r *poolRecycler) writeMetrics(pw metricsWriter) {
+	pw.counter("http2socks_upstream_pool_recycled_total", "Times the upstream connection pool was recycled after repeated protocol errors.", r.recycled.Load())
+	pw.counter("http2socks_upstream_pool_flushed_total", "Times the upstream connection pool was flushed through the admin API.", r.flushed.Load())
+}
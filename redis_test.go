@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"+OK\r\n", "OK"},
+		{"+\r\n", ""},
+		{":42\r\n", int64(42)},
+		{":-1\r\n", int64(-1)},
+		{"$5\r\nhello\r\n", "hello"},
+		{"$0\r\n\r\n", ""},
+		{"$4\r\na\r\nb\r\n", "a\r\nb"},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"*0\r\n", []any{}},
+		{"*3\r\n:1\r\n$1\r\na\r\n$-1\r\n", []any{int64(1), "a", nil}},
+		{"*2\r\n*1\r\n:1\r\n+x\r\n", []any{[]any{int64(1)}, "x"}},
+		{"*2\r\n-ERR inner\r\n:1\r\n", []any{redisError("ERR inner"), int64(1)}},
+	}
+	for _, tt := range tests {
+		got, err := readRedisReply(bufio.NewReader(strings.NewReader(tt.in)))
+		if err != nil {
+			t.Errorf("readRedisReply(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readRedisReply(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadRedisReplyErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"+OK",
+		"+OK\n",
+		"\r\n",
+		"?what\r\n",
+		":x\r\n",
+		"$x\r\n",
+		"$5\r\nab\r\n",
+		"*x\r\n",
+		"*2\r\n:1\r\n",
+	}
+	for _, in := range tests {
+		if got, err := readRedisReply(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Errorf("readRedisReply(%q) = %#v, want an error", in, got)
+		}
+	}
+
+	_, err := readRedisReply(bufio.NewReader(strings.NewReader("-WRONGTYPE bad\r\n")))
+	var replyErr redisError
+	if !errors.As(err, &replyErr) || replyErr != "WRONGTYPE bad" {
+		t.Errorf("readRedisReply of an error reply: %v, want redisError", err)
+	}
+}
+
+// fakeRedis is a Redis server for tests which records the commands it
+// receives and answers them with reply.
+type fakeRedis struct {
+	ln    net.Listener
+	reply func(args []string) string
+
+	mu       sync.Mutex
+	commands [][]string
+	conns    int
+}
+
+func newFakeRedis(t *testing.T, reply func(args []string) string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, reply: reply}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		items, _ := args.([]any)
+		command := make([]string, len(items))
+		for i, item := range items {
+			command[i], _ = item.(string)
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+
+		reply := s.reply(command)
+		if reply == "" {
+			// Drops the connection.
+			return
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) received() ([][]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.commands...), s.conns
+}
+
+func TestRedisClient(t *testing.T) {
+	// The handler runs on the goroutine of each connection.
+	var dropped atomic.Bool
+	server := newFakeRedis(t, func(args []string) string {
+		switch args[0] {
+		case "AUTH", "SELECT":
+			return "+OK\r\n"
+		case "GET":
+			if args[1] == "missing" {
+				return "$-1\r\n"
+			}
+			return "$" + strconv.Itoa(len(args[1])) + "\r\n" + args[1] + "\r\n"
+		case "DROP":
+			if dropped.CompareAndSwap(false, true) {
+				return ""
+			}
+			return "+OK\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	c := newRedisClient(server.ln.Addr().String(), "secret", 2)
+	ctx := context.Background()
+
+	if got, err := c.do(ctx, "GET", "a b\r\nc"); err != nil || got != "a b\r\nc" {
+		t.Errorf("GET: %#v, %v", got, err)
+	}
+	if got, err := c.do(ctx, "GET", "missing"); err != nil || got != nil {
+		t.Errorf("GET of a missing key: %#v, %v", got, err)
+	}
+	// Error replies keep the connection.
+	var replyErr redisError
+	if _, err := c.do(ctx, "NOPE"); !errors.As(err, &replyErr) {
+		t.Errorf("unknown command: %v, want redisError", err)
+	}
+	// A dropped connection fails the command, the next one reconnects.
+	if _, err := c.do(ctx, "DROP"); err == nil {
+		t.Error("command on a dropped connection succeeded")
+	}
+	if got, err := c.do(ctx, "DROP"); err != nil || got != "OK" {
+		t.Errorf("command after reconnecting: %#v, %v", got, err)
+	}
+
+	commands, conns := server.received()
+	want := [][]string{
+		{"AUTH", "secret"}, {"SELECT", "2"},
+		{"GET", "a b\r\nc"}, {"GET", "missing"}, {"NOPE"}, {"DROP"},
+		{"AUTH", "secret"}, {"SELECT", "2"},
+		{"DROP"},
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands received:\n%q\nwant\n%q", commands, want)
+	}
+	if conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+}
+
+func TestRedisClientAuthFailure(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		return "-WRONGPASS invalid password\r\n"
+	})
+	c := newRedisClient(server.ln.Addr().String(), "wrong", 0)
+	var replyErr redisError
+	if _, err := c.do(context.Background(), "PING"); !errors.As(err, &replyErr) {
+		t.Errorf("PING with a wrong password: %v, want redisError", err)
+	}
+	if commands, _ := server.received(); len(commands) != 1 {
+		t.Errorf("commands received: %q, want just AUTH", commands)
+	}
+}
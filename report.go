@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// runReport summarizes a run of the proxy up to Time. It's logged on
+// shutdown and optionally written as JSON, which is useful for ephemeral CI
+// or container runs, and published to the other instances of a cluster.
+type runReport struct {
+	Started       time.Time        `json:"started"`
+	Time          time.Time        `json:"time"`
+	Uptime        float64          `json:"uptime_seconds"`
+	Requests      int64            `json:"requests"`
+	Tunnels       int64            `json:"tunnels"`
+	TunnelsPeak   int64            `json:"tunnels_peak"`
+	TunnelsOpen   int64            `json:"tunnels_open"`
+	BytesSent     int64            `json:"bytes_sent"`
+	BytesReceived int64            `json:"bytes_received"`
+	Errors        map[string]int64 `json:"errors"`
+}
+
+func (s *proxyStats) report() runReport {
+	now := time.Now()
+	return runReport{
+		Started:       s.started,
+		Time:          now,
+		Uptime:        now.Sub(s.started).Seconds(),
+		Requests:      s.requestsTotal.Load(),
+		Tunnels:       s.tunnelsTotal.Load(),
+		TunnelsPeak:   s.tunnelsPeak.Load(),
+		TunnelsOpen:   s.tunnelsOpen.Load(),
+		BytesSent:     s.bytesSent.Load(),
+		BytesReceived: s.bytesReceived.Load(),
+		Errors:        s.errorCounts(),
+	}
+}
+
+func (r runReport) log() {
+	log.Printf("shutdown report: uptime %s, %d requests, %d tunnels (peak %d, %d still open), %d bytes sent, %d bytes received, errors %v",
+		time.Duration(r.Uptime*float64(time.Second)).Round(time.Second),
+		r.Requests, r.Tunnels, r.TunnelsPeak, r.TunnelsOpen, r.BytesSent, r.BytesReceived, r.Errors)
+}
+
+func (r runReport) writeFile(name string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Values of socks_resolve.
+const (
+	resolveSystem     = "system"
+	resolvePinFirst   = "pin-first"
+	resolveRoundRobin = "round-robin"
+)
+
+// serverResolver resolves the host name of an upstream proxy itself, so the
+// policy decides which of its addresses connections go to: pin-first sticks
+// to one address as long as the name still resolves to it, round-robin
+// spreads connections over all of them. The name is resolved again every
+// interval.
+type serverResolver struct {
+	host     string
+	policy   string
+	interval time.Duration
+
+	mu         sync.Mutex
+	addrs      []netip.Addr
+	pinned     netip.Addr
+	resolvedAt time.Time
+	stale      bool
+
+	next atomic.Uint64
+}
+
+// newServerResolver returns the resolver of the proxy at server, or nil
+// when the system resolver is to be left alone or server is an address.
+func newServerResolver(server, policy string, interval time.Duration) *serverResolver {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || policy == resolveSystem {
+		return nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	return &serverResolver{host: host, policy: policy, interval: interval}
+}
+
+// addr returns the address the next connection to the proxy goes to.
+func (r *serverResolver) addr(ctx context.Context) (netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.addrs == nil || r.stale || r.interval > 0 && time.Since(r.resolvedAt) >= r.interval {
+		if err := r.resolveLocked(ctx); err != nil && r.addrs == nil {
+			return netip.Addr{}, err
+		}
+	}
+	if r.policy == resolvePinFirst {
+		return r.pinned, nil
+	}
+	return r.addrs[r.next.Add(1)%uint64(len(r.addrs))], nil
+}
+
+// resolveLocked looks the host up again. When that fails the previous
+// addresses are kept until the next interval.
+func (r *serverResolver) resolveLocked(ctx context.Context) error {
+	r.resolvedAt, r.stale = time.Now(), false
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", r.host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no addresses for %s", r.host)
+	}
+	if err != nil {
+		if r.addrs != nil {
+			log.Printf("resolving upstream proxy %s failed, keeping %v: %v", r.host, r.addrs, err)
+		}
+		return err
+	}
+
+	for i := range ips {
+		ips[i] = ips[i].Unmap()
+	}
+	r.addrs = ips
+	if !slices.Contains(ips, r.pinned) {
+		if r.pinned.IsValid() && r.policy == resolvePinFirst {
+			log.Printf("upstream proxy %s no longer resolves to %v, pinning %v", r.host, r.pinned, ips[0])
+		}
+		r.pinned = ips[0]
+	}
+	return nil
+}
+
+// expire has the host looked up again before the next connection.
+func (r *serverResolver) expire() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.stale = true
+	r.mu.Unlock()
+}
+
+// dialer returns a dialer which connects to the proxy at the address the
+// policy picks.
+func (r *serverResolver) dialer(forward proxy.Dialer) proxy.Dialer {
+	return resolvingDialer{resolver: r, forward: forward}
+}
+
+type resolvingDialer struct {
+	resolver *serverResolver
+	forward  proxy.Dialer
+}
+
+func (d resolvingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != d.resolver.host {
+		return dialContext(ctx, d.forward, network, addr)
+	}
+	ip, err := d.resolver.addr(ctx)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return dialContext(ctx, d.forward, network, net.JoinHostPort(ip.String(), port))
+}
+
+// dialContext dials with ctx when forward supports it.
+func dialContext(ctx context.Context, forward proxy.Dialer, network, addr string) (net.Conn, error) {
+	if cd, ok := forward.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return forward.Dial(network, addr)
+}
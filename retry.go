@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// retryBudgetReserve is the number of retries the budget allows before
+// requests have earned any, and the most it saves up during quiet times.
+const retryBudgetReserve = 10
+
+// retryBackoff is the wait before the first retry, doubled for each further
+// one.
+const retryBackoff = 250 * time.Millisecond
+
+// retryBudget limits retries to a share of the requests, so retries don't
+// multiply the load on an upstream which fails for all of them.
+type retryBudget struct {
+	ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+
+	retries   atomic.Int64
+	exhausted atomic.Int64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, tokens: retryBudgetReserve}
+}
+
+// deposit earns the retry share of one request.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetReserve)
+	b.mu.Unlock()
+}
+
+// withdraw reports whether a retry is in the budget and takes it.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		b.exhausted.Add(1)
+		return false
+	}
+	b.tokens--
+	b.retries.Add(1)
+	return true
+}
+
+func (b *retryBudget) writeMetrics(pw metricsWriter) {
+	if b == nil {
+		return
+	}
+	pw.counter("http2socks_retries_total", "Requests and upstream dials retried after transient upstream failures.", b.retries.Load())
+	pw.counter("http2socks_retry_budget_exhausted_total", "Retries skipped because the retry budget was used up.", b.exhausted.Load())
+}
+
+// dialRetryBackoff is the wait before the first retry of an upstream dial,
+// doubled for each further one.
+const dialRetryBackoff = 100 * time.Millisecond
+
+// retryingDialer dials through upstream again after it couldn't be reached
+// or broke off the handshake, up to retries times within window. Nothing
+// was sent to the destination yet, so every connection can be retried.
+type retryingDialer struct {
+	upstream proxy.ContextDialer
+	retries  int
+	window   time.Duration
+	budget   *retryBudget
+}
+
+func (d retryingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d retryingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	giveUp := time.Now().Add(d.window)
+	backoff := dialRetryBackoff
+	for retry := 1; ; retry++ {
+		conn, err := d.upstream.DialContext(ctx, network, addr)
+		if err == nil || !upstreamDown(err) || ctx.Err() != nil || retry > d.retries {
+			return conn, err
+		}
+		// The jitter keeps clients failing at once from retrying at once.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if time.Now().Add(wait).After(giveUp) || !d.budget.withdraw() {
+			return conn, err
+		}
+		sessionLogger(ctx).Printf("dial to %s failed, retry %d of %d in %v: %v", addr, retry, d.retries, wait.Round(time.Millisecond), err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// retryAfterAttempts is how often a throttled request is sent again.
+const retryAfterAttempts = 2
+
+// do sends req. Idempotent PUT uploads with a spooled body are sent again
+// from the beginning after transient upstream failures, up to
+// uploadRetries times. Idempotent requests throttled by the origin with
+// 429 or 503 are sent again after the Retry-After delay when it's at most
+// retryAfterMax, which disables it when zero. All retries are limited by
+// the retry budget.
+func (p *forwardProxy) do(client *http.Client, req *http.Request, logger *log.Logger) (*http.Response, error) {
+	p.retries.deposit()
+	resp, err := client.Do(req)
+
+	backoff := retryBackoff
+	uploadRetries, throttledRetries := 0, 0
+	for {
+		var wait time.Duration
+		switch {
+		case err != nil:
+			// Failures caused by the client going away are not transient.
+			if req.Method != http.MethodPut || req.GetBody == nil || uploadRetries >= p.uploadRetries ||
+				errors.Is(err, context.Canceled) || errors.Is(err, errSocksAuthPaused) || req.Context().Err() != nil {
+				return resp, err
+			}
+			uploadRetries++
+			wait, backoff = backoff, backoff*2
+			logger.Printf("upload failed, retry %d of %d in %v: %v", uploadRetries, p.uploadRetries, wait, err)
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+			delay, ok := retryAfter(resp.Header, time.Now())
+			if !ok || p.retryAfterMax <= 0 || delay > p.retryAfterMax || !replayable(req) || throttledRetries >= retryAfterAttempts {
+				return resp, err
+			}
+			throttledRetries++
+			wait = delay
+			logger.Printf("origin throttled with %s, retry %d of %d in %v", resp.Status, throttledRetries, retryAfterAttempts, wait)
+		default:
+			return resp, err
+		}
+
+		if !p.retries.withdraw() {
+			logger.Println("retry budget exhausted, not retrying")
+			return resp, err
+		}
+		var body io.ReadCloser = http.NoBody
+		if req.GetBody != nil {
+			var bodyErr error
+			if body, bodyErr = req.GetBody(); bodyErr != nil {
+				return resp, err
+			}
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, retryDrainLimit))
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		retry := req.Clone(req.Context())
+		retry.Body = body
+		resp, err = client.Do(retry)
+	}
+}
+
+// retryDrainLimit is how much of a discarded response is read, so its
+// connection can be reused.
+const retryDrainLimit = 64 << 10
+
+// replayable reports whether req is idempotent and its body can be sent
+// again.
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryAfter returns the delay of a Retry-After header, given in seconds or
+// as an HTTP date.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	value := h.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
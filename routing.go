@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Actions of routing rules.
+const (
+	routeProxy  = "proxy"
+	routeDirect = "direct"
+	routeBlock  = "block"
+)
+
+// routingRule sends connections to destinations matching hosts through
+// the SOCKS5 proxy, directly, or blocks them.
+type routingRule struct {
+	text   string
+	action string
+	hosts  *hostMatcher
+	// countries and continents match destination addresses by the GeoIP
+	// database.
+	countries  []string
+	continents []string
+	// bypass marks rules of the bypass list.
+	bypass bool
+}
+
+// Prefixes of routing rule destinations matched by the GeoIP database.
+const (
+	routeCountryPrefix   = "country:"
+	routeContinentPrefix = "continent:"
+)
+
+// byAddress reports whether the rule matches destination addresses by
+// network or location, which names have to be resolved for.
+func (r routingRule) byAddress() bool {
+	return len(r.hosts.prefixes) > 0 || r.geo()
+}
+
+// geo reports whether the rule matches locations.
+func (r routingRule) geo() bool {
+	return len(r.countries) > 0 || len(r.continents) > 0
+}
+
+// matchAddr reports whether addr is in a network or location of the rule.
+func (r routingRule) matchAddr(addr netip.Addr, geo *geoIP) bool {
+	if r.hosts.match(addr.String()) {
+		return true
+	}
+	if !r.geo() {
+		return false
+	}
+	country, continent := geo.lookup(addr)
+	return country != "" && slices.Contains(r.countries, country) ||
+		continent != "" && slices.Contains(r.continents, continent)
+}
+
+// routingRules are checked in order and the first matching rule applies.
+// Destinations matching no rule go through the SOCKS5 proxy.
+type routingRules []routingRule
+
+// parseRoutingRules parses rules of the form "proxy|direct|block
+// destination", e.g. "direct *.internal.corp". Destinations may also be
+// country:CC[|CC...] ISO country codes or continent:CC[|CC...] continent
+// codes of the GeoIP database.
+func parseRoutingRules(specs []string, groups map[string]string) (routingRules, error) {
+	rules := make(routingRules, 0, len(specs))
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("routing rule %q: must be action and destination", spec)
+		}
+		action, host := fields[0], fields[1]
+		if action != routeProxy && action != routeDirect && action != routeBlock {
+			return nil, fmt.Errorf("routing rule %q: action must be %s, %s or %s", spec, routeProxy, routeDirect, routeBlock)
+		}
+		rule := routingRule{text: strings.Join(fields, " "), action: action}
+		var codes *[]string
+		if list, ok := strings.CutPrefix(host, routeCountryPrefix); ok {
+			host, codes = list, &rule.countries
+		} else if list, ok := strings.CutPrefix(host, routeContinentPrefix); ok {
+			host, codes = list, &rule.continents
+		}
+		if codes != nil {
+			for _, code := range strings.Split(host, "|") {
+				if len(code) != 2 {
+					return nil, fmt.Errorf("routing rule %q: %q isn't a two-letter code", spec, code)
+				}
+				*codes = append(*codes, strings.ToUpper(code))
+			}
+			host = ""
+		}
+		var err error
+		if rule.hosts, err = newHostMatcher([]string{host}, groups); err != nil {
+			return nil, fmt.Errorf("routing rule %q: %w", spec, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// bypassRules returns direct rules for the entries of a NO_PROXY style
+// bypass list: names match the domain and its subdomains, ports are
+// ignored, "*" matches every destination and @name the host group.
+func bypassRules(entries []string, groups map[string]string) (routingRules, error) {
+	rules := make(routingRules, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		pattern := entry
+		if host, _, err := net.SplitHostPort(pattern); err == nil {
+			pattern = host
+		}
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]")
+		if pattern == "" {
+			continue
+		}
+
+		var hosts *hostMatcher
+		if strings.HasPrefix(entry, "@") {
+			var err error
+			if hosts, err = newHostMatcher([]string{entry}, groups); err != nil {
+				return nil, fmt.Errorf("bypass entry %q: %w", entry, err)
+			}
+		} else if pattern == "*" {
+			hosts = &hostMatcher{
+				exact:    map[string]struct{}{},
+				suffixes: []string{""},
+				prefixes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+			}
+		} else {
+			if _, err := netip.ParseAddr(pattern); err != nil && !strings.Contains(pattern, "/") && !strings.HasPrefix(pattern, "*.") && !strings.HasPrefix(pattern, ".") {
+				pattern = "." + pattern
+			}
+			var err error
+			if hosts, err = newHostMatcher([]string{pattern}, nil); err != nil {
+				return nil, fmt.Errorf("bypass entry %q: %w", entry, err)
+			}
+		}
+		rules = append(rules, routingRule{text: "bypass " + entry, action: routeDirect, hosts: hosts, bypass: true})
+	}
+	return rules, nil
+}
+
+// bypassHosts merges the hosts of the bypass rules of rs.
+func (rs routingRules) bypassHosts() *hostMatcher {
+	m := &hostMatcher{exact: make(map[string]struct{})}
+	for _, r := range rs {
+		if r.bypass {
+			m.merge(r.hosts)
+		}
+	}
+	return m
+}
+
+// routingResolveTTL is how long addresses of destinations resolved for
+// routing rules with networks are kept.
+const routingResolveTTL = 30 * time.Second
+
+// routingResolveMax bounds the resolved destinations kept.
+const routingResolveMax = 10000
+
+// router applies the routing rules: connections routed direct are made
+// with forward. With resolve, names are resolved on this host and their
+// addresses matched against networks and locations of the rules, which
+// geo looks up. The rules are replaced on reload.
+type router struct {
+	table   atomic.Pointer[routingTable]
+	forward proxy.Dialer
+	resolve bool
+	geo     *geoIP
+	// aliases canonicalizes destinations dialed, like those of requests.
+	aliases *hostAliases
+
+	mu       sync.Mutex
+	resolved map[string]resolvedHost
+
+	direct        atomic.Int64
+	blocked       atomic.Int64
+	lookups       atomic.Int64
+	lookupsFailed atomic.Int64
+}
+
+// routingTable is the routing rules in use, and whether names are resolved
+// for them.
+type routingTable struct {
+	rules   routingRules
+	resolve bool
+}
+
+type resolvedHost struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newRouter(rules routingRules, forward proxy.Dialer, resolve bool, geo *geoIP) *router {
+	r := &router{
+		forward:  forward,
+		resolve:  resolve,
+		geo:      geo,
+		resolved: make(map[string]resolvedHost),
+	}
+	r.table.Store(&routingTable{rules: rules, resolve: resolve && slices.ContainsFunc(rules, routingRule.byAddress)})
+	return r
+}
+
+// rules returns the routing rules in use. Nil-safe.
+func (r *router) rules() routingRules {
+	if r == nil {
+		return nil
+	}
+	return r.table.Load().rules
+}
+
+// update switches to rules for new connections. Rules with locations need
+// the GeoIP database the router was made with.
+func (r *router) update(rules routingRules) error {
+	if r.geo == nil && slices.ContainsFunc(rules, routingRule.geo) {
+		return fmt.Errorf("routing rules with country: or continent: destinations need a restart to load the GeoIP database")
+	}
+	r.table.Store(&routingTable{rules: rules, resolve: r.resolve && slices.ContainsFunc(rules, routingRule.byAddress)})
+	return nil
+}
+
+// match returns the first rule matching host, or one of its addresses for
+// rules with networks or locations. Names are only resolved when the
+// router resolves names. Nil-safe.
+func (r *router) match(ctx context.Context, host string) (routingRule, bool) {
+	if r == nil {
+		return routingRule{}, false
+	}
+
+	table := r.table.Load()
+	var addrs []netip.Addr
+	looked := false
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs, looked = []netip.Addr{addr}, true
+	}
+	for _, rule := range table.rules {
+		if rule.hosts.match(host) {
+			return rule, true
+		}
+		if !rule.byAddress() || !looked && !table.resolve {
+			continue
+		}
+		if !looked {
+			addrs, looked = r.lookup(ctx, host), true
+		}
+		for _, addr := range addrs {
+			if rule.matchAddr(addr, r.geo) {
+				return rule, true
+			}
+		}
+	}
+	return routingRule{}, false
+}
+
+// lookup returns the addresses of host, none when it doesn't resolve.
+func (r *router) lookup(ctx context.Context, host string) []netip.Addr {
+	r.mu.Lock()
+	cached, ok := r.resolved[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs
+	}
+
+	r.lookups.Add(1)
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		r.lookupsFailed.Add(1)
+		sessionLogger(ctx).Printf("routing: resolving %s failed: %v", host, err)
+		return nil
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+
+	r.mu.Lock()
+	if len(r.resolved) >= routingResolveMax {
+		clear(r.resolved)
+	}
+	r.resolved[host] = resolvedHost{addrs: addrs, expires: time.Now().Add(routingResolveTTL)}
+	r.mu.Unlock()
+	return addrs
+}
+
+// routingDialer connects to destinations routed direct by router or the
+// PAC file and to the others through upstream. Connections to a server
+// selected for the request go through upstream regardless.
+type routingDialer struct {
+	upstream proxy.ContextDialer
+	router   *router
+}
+
+func (d routingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d routingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if _, ok := selectedServer(ctx); !ok {
+		if pacDirect(ctx) {
+			return dialContext(ctx, d.router.forward, network, addr)
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if rule, ok := d.router.match(ctx, d.router.aliases.canonical(strings.ToLower(host))); ok && rule.action == routeDirect {
+				d.router.direct.Add(1)
+				return dialContext(ctx, d.router.forward, network, addr)
+			}
+		}
+	}
+	return d.upstream.DialContext(ctx, network, addr)
+}
+
+func (r *router) writeMetrics(pw metricsWriter) {
+	if r == nil {
+		return
+	}
+
+	// Without rules, e.g. until they are added on reload, there's nothing
+	// to count.
+	table := r.table.Load()
+	if len(table.rules) == 0 && r.direct.Load() == 0 && r.blocked.Load() == 0 {
+		r.geo.writeMetrics(pw)
+		return
+	}
+
+	pw.counter("http2socks_routed_direct_total", "Connections made directly by routing rules.", r.direct.Load())
+	pw.counter("http2socks_routed_blocked_total", "Requests blocked by routing rules.", r.blocked.Load())
+	r.geo.writeMetrics(pw)
+	if table.resolve {
+		pw.counter("http2socks_routing_lookups_total", "Destination names resolved for routing rules with networks.", r.lookups.Load())
+		pw.counter("http2socks_routing_lookups_failed_total", "Destination names routing rules with networks couldn't resolve.", r.lookupsFailed.Load())
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBypassRules(t *testing.T) {
+	tests := []struct {
+		entries []string
+		host    string
+		want    bool
+	}{
+		{[]string{"*"}, "example.com", true},
+		{[]string{"*"}, "10.1.2.3", true},
+		{[]string{"*"}, "::1", true},
+		{[]string{"example.com"}, "example.com", true},
+		{[]string{"example.com"}, "www.example.com", true},
+		{[]string{"example.com"}, "notexample.com", false},
+		{[]string{".example.com"}, "example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"*.example.com"}, "www.example.com", true},
+		{[]string{"example.com:8080"}, "www.example.com", true},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3", false},
+		{[]string{"10.1.2.3"}, "10.1.2.3", true},
+		{[]string{"[::1]:80"}, "::1", true},
+		{[]string{" ", "localhost"}, "localhost", true},
+		{[]string{"localhost"}, "10.1.2.3", false},
+		{[]string{"@corp"}, "10.9.1.1", true},
+		{[]string{"@corp"}, "intranet.corp", true},
+		{[]string{"@corp"}, "www.intranet.corp", false},
+		{[]string{"@corp"}, "example.com", false},
+	}
+	groups := map[string]string{"corp": "10.9.0.0/16 intranet.corp"}
+	for _, tt := range tests {
+		rules, err := bypassRules(tt.entries, groups)
+		if err != nil {
+			t.Errorf("bypassRules(%q): %v", tt.entries, err)
+			continue
+		}
+		rule, ok := newRouter(rules, nil, false, nil).match(context.Background(), tt.host)
+		if ok != tt.want {
+			t.Errorf("bypassRules(%q) matches %s: %v, want %v", tt.entries, tt.host, ok, tt.want)
+		}
+		if ok && (rule.action != routeDirect || !rule.bypass) {
+			t.Errorf("bypassRules(%q) matches %s with %+v, want a direct bypass rule", tt.entries, tt.host, rule)
+		}
+		if got := rules.bypassHosts().match(tt.host); got != tt.want {
+			t.Errorf("bypassRules(%q).bypassHosts() matches %s: %v, want %v", tt.entries, tt.host, got, tt.want)
+		}
+	}
+	if _, err := bypassRules([]string{"@missing"}, groups); err == nil {
+		t.Error("bypassRules accepted an unknown group")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cristalhq/aconfig"
+)
+
+// configSchema returns a JSON Schema of the configuration file format, so
+// external tools can validate configs before they are deployed.
+func configSchema() map[string]any {
+	fields := make(map[string]aconfig.Field)
+	aconfig.LoaderFor(&Config{}, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Args:      []string{},
+	}).WalkFields(func(f aconfig.Field) bool {
+		fields[f.Name()] = f
+		return true
+	})
+
+	properties := make(map[string]any)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		f, ok := fields[sf.Name]
+		if !ok {
+			continue
+		}
+
+		prop := schemaType(sf.Type)
+		prop["description"] = f.Tag("usage")
+		if def := f.Tag("default"); def != "" {
+			prop["default"] = schemaDefault(sf.Type, def)
+		}
+		if enum := sf.Tag.Get("enum"); enum != "" {
+			prop["enum"] = strings.Split(enum, ",")
+		}
+		properties[f.Tag("json")] = prop
+	}
+
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "http2socks configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func schemaType(t reflect.Type) map[string]any {
+	if t == durationType {
+		return map[string]any{
+			"type":    "string",
+			"pattern": `^-?([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$|^0$`,
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaType(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaType(t.Elem())}
+	default:
+		return map[string]any{"type": "string"}
+	}
+}
+
+// schemaDefault converts a default tag value to the JSON type of the field.
+func schemaDefault(t reflect.Type, def string) any {
+	if t == durationType {
+		return def
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if v, err := strconv.ParseBool(def); err == nil {
+			return v
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v, err := strconv.ParseInt(def, 0, 64); err == nil {
+			return v
+		}
+	case reflect.Float32, reflect.Float64:
+		if v, err := strconv.ParseFloat(def, 64); err == nil {
+			return v
+		}
+	case reflect.Slice:
+		items := strings.Split(def, ",")
+		res := make([]any, len(items))
+		for i, item := range items {
+			res[i] = schemaDefault(t.Elem(), strings.TrimSpace(item))
+		}
+		return res
+	}
+	return def
+}
+
+func writeConfigSchema(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(configSchema())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// upstreamHeader selects the upstream server of a request by its name, so
+// testing tools can compare exits through one proxy. It's only honored
+// for authenticated clients and never forwarded.
+const upstreamHeader = "X-Http2socks-Upstream"
+
+var errSelectNeedsAuth = errors.New("selecting an upstream server needs an authenticated client")
+
+type selectedServerKey struct{}
+
+// withSelectedServer returns ctx carrying the name of the upstream server
+// connections are to go through.
+func withSelectedServer(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, selectedServerKey{}, name)
+}
+
+// selectedServer returns the name of the upstream server selected for the
+// request, if any.
+func selectedServer(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(selectedServerKey{}).(string)
+	return name, ok
+}
+
+// selectUpstream removes upstreamHeader from req and returns the name of
+// the upstream server it selects, empty when it isn't set.
+func (p *forwardProxy) selectUpstream(req *http.Request, id clientIdentity) (string, error) {
+	name := req.Header.Get(upstreamHeader)
+	req.Header.Del(upstreamHeader)
+	if name == "" {
+		return "", nil
+	}
+	if id.name == "" {
+		return "", errSelectNeedsAuth
+	}
+	if p.upstreams.current.Load().serverIndex(name) < 0 {
+		return "", fmt.Errorf("unknown upstream server %q", name)
+	}
+	return name, nil
+}
+
+// serverIndex returns the index of the server named name, or with the
+// address name, and -1 when there is none.
+func (u *upstream) serverIndex(name string) int {
+	for i, s := range u.servers {
+		if s.name == name || s.server == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// userServer returns the name of the upstream server user is mapped to,
+// empty when there is none.
+func (u *upstream) userServer(user string) string {
+	if user == "" {
+		return ""
+	}
+	return u.users[user]
+}
+
+// upstreamRoutes send connections to destinations through named upstream
+// servers.
+type upstreamRoutes []upstreamRoute
+
+type upstreamRoute struct {
+	pattern string
+	hosts   *hostMatcher // nil for *, all destinations
+	name    string
+}
+
+// newUpstreamRoutes builds the routes from destination pattern to upstream
+// name. The most specific (longest) pattern matching a host wins, * matches
+// all others.
+func newUpstreamRoutes(routes map[string]string) (upstreamRoutes, error) {
+	res := make(upstreamRoutes, 0, len(routes))
+	for pattern, name := range routes {
+		route := upstreamRoute{pattern: pattern, name: name}
+		if pattern != "*" {
+			if strings.HasPrefix(pattern, "@") {
+				return nil, fmt.Errorf("group %s can't be used for an upstream route", pattern)
+			}
+			var err error
+			if route.hosts, err = newHostMatcher([]string{pattern}, nil); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, route)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if (res[i].hosts == nil) != (res[j].hosts == nil) {
+			return res[j].hosts == nil
+		}
+		if len(res[i].pattern) != len(res[j].pattern) {
+			return len(res[i].pattern) > len(res[j].pattern)
+		}
+		return res[i].pattern < res[j].pattern
+	})
+	return res, nil
+}
+
+// match returns the name of the upstream server connections to host go
+// through, if any.
+func (r upstreamRoutes) match(host string) (string, bool) {
+	for _, route := range r {
+		if route.hosts == nil || route.hosts.match(host) {
+			return route.name, true
+		}
+	}
+	return "", false
+}
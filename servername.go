@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// serverNames overrides the TLS server name (SNI) used for https origins
+// dialed by the proxy, for fronted or split-horizon services.
+type serverNames []serverNameRule
+
+type serverNameRule struct {
+	pattern string
+	hosts   *hostMatcher
+	name    string
+}
+
+// newServerNames builds the overrides from destination pattern to server
+// name. The most specific (longest) pattern matching a host wins.
+func newServerNames(rules map[string]string) (serverNames, error) {
+	names := make(serverNames, 0, len(rules))
+	for pattern, name := range rules {
+		if strings.HasPrefix(pattern, "@") {
+			return nil, fmt.Errorf("group %s can't be used for a server name", pattern)
+		}
+		hosts, err := newHostMatcher([]string{pattern}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, fmt.Errorf("server name of %s must not be empty", pattern)
+		}
+		names = append(names, serverNameRule{pattern: pattern, hosts: hosts, name: name})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i].pattern) != len(names[j].pattern) {
+			return len(names[i].pattern) > len(names[j].pattern)
+		}
+		return names[i].pattern < names[j].pattern
+	})
+	return names, nil
+}
+
+// lookup returns the server name to use for host.
+func (s serverNames) lookup(host string) string {
+	for _, rule := range s {
+		if rule.hosts.match(host) {
+			return rule.name
+		}
+	}
+	return host
+}
+
+// dialTLS returns a DialTLSContext of http.Transport which dials with dial
+// and does the TLS handshake with the server name of the destination.
+func (s serverNames) dialTLS(dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		defer cancel()
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: s.lookup(strings.ToLower(host))})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type sessionKey struct{}
+
+var (
+	sessionPrefix  = newSessionPrefix()
+	sessionCounter atomic.Uint64
+)
+
+// newSessionPrefix returns a random per-process prefix, so session IDs from
+// different runs don't collide in aggregated logs.
+func newSessionPrefix() string {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// clientSession is the state of one inbound client connection, shared by all
+// requests received over it.
+type clientSession struct {
+	id string
+
+	// client is the remote address of the connection, local the address
+	// it was accepted on.
+	client string
+	local  string
+
+	// process is the local process of the client, looked up once by
+	// processOf.
+	processOnce sync.Once
+	process     clientProcess
+
+	// auth is the last successful authentication on the connection.
+	auth atomic.Pointer[authEntry]
+
+	// requests counts the proxy requests received over the connection.
+	requests atomic.Int64
+}
+
+// withSession is used as http.Server.ConnContext and assigns a session to
+// every inbound client connection.
+func withSession(ctx context.Context, conn net.Conn) context.Context {
+	s := &clientSession{
+		id:     sessionPrefix + "-" + strconv.FormatUint(sessionCounter.Add(1), 10),
+		client: conn.RemoteAddr().String(),
+		local:  conn.LocalAddr().String(),
+	}
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// sessionFromContext returns the session of the client connection ctx
+// belongs to, or nil.
+func sessionFromContext(ctx context.Context) *clientSession {
+	s, _ := ctx.Value(sessionKey{}).(*clientSession)
+	return s
+}
+
+// sessionID returns the session ID of the client connection ctx belongs to.
+func sessionID(ctx context.Context) string {
+	if s := sessionFromContext(ctx); s != nil {
+		return s.id
+	}
+	return ""
+}
+
+// sessionRequest counts a proxy request of the session of ctx and reports
+// whether an earlier request was received over the same connection.
+func sessionRequest(ctx context.Context) bool {
+	if s := sessionFromContext(ctx); s != nil {
+		return s.requests.Add(1) > 1
+	}
+	return false
+}
+
+// sessionLogger returns a logger which prefixes messages with the session ID
+// of ctx.
+func sessionLogger(ctx context.Context) *log.Logger {
+	return log.New(log.Writer(), "["+sessionID(ctx)+"] ", log.Flags()|log.Lmsgprefix)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSessions(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	first := withSession(context.Background(), a)
+	second := withSession(context.Background(), b)
+	if id := sessionID(first); !strings.HasPrefix(id, sessionPrefix+"-") {
+		t.Errorf("session ID %q without the prefix %q", id, sessionPrefix)
+	}
+	if sessionID(first) == sessionID(second) {
+		t.Errorf("two connections share the session ID %q", sessionID(first))
+	}
+	if id := sessionID(context.Background()); id != "" {
+		t.Errorf("session ID %q without a session", id)
+	}
+
+	for i, want := range []bool{false, true, true} {
+		if got := sessionRequest(first); got != want {
+			t.Errorf("request %d: sessionRequest = %v, want %v", i+1, got, want)
+		}
+	}
+	if sessionRequest(second) {
+		t.Error("first request of the second session reported as reused")
+	}
+	if sessionRequest(context.Background()) {
+		t.Error("request without a session reported as reused")
+	}
+}
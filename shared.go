@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sharedLeaseTTL is how long a slot held by an instance stays taken without
+// renewal, e.g. after the instance crashed.
+const sharedLeaseTTL = 30 * time.Second
+
+// sharedState keeps limits consistent across several proxy instances
+// behind a load balancer by storing them in Redis. Slots are leases in a
+// sorted set per key, scored by their expiry, which the holding instance
+// renews while it holds them.
+type sharedState struct {
+	redis    *redisClient
+	prefix   string
+	instance string
+
+	nextLease atomic.Uint64
+
+	mu     sync.Mutex
+	leases map[string]string // member -> key
+
+	errors atomic.Int64
+}
+
+func newSharedState(cfg *Config) *sharedState {
+	// The session prefix tells apart instances running on the same host.
+	instance := sessionPrefix
+	if host, err := os.Hostname(); err == nil {
+		instance = host + "-" + sessionPrefix
+	}
+
+	return &sharedState{
+		redis:    newRedisClient(cfg.RedisAddress, cfg.RedisPassword, cfg.RedisDB),
+		prefix:   cfg.RedisKeyPrefix,
+		instance: instance,
+		leases:   make(map[string]string),
+	}
+}
+
+// sharedAcquireScript takes a slot of KEYS[1] if fewer than ARGV[1] unexpired
+// leases exist. The server clock is used so instances may disagree on time.
+const sharedAcquireScript = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`
+
+// sharedRenewScript extends the lease ARGV[2] of KEYS[1] if it's still held.
+const sharedRenewScript = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('ZADD', KEYS[1], 'XX', now + tonumber(ARGV[1]), ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return 1
+`
+
+// tryAcquire takes one of limit slots of key. On success it returns the
+// function releasing the slot.
+func (s *sharedState) tryAcquire(ctx context.Context, key string, limit int) (func(), bool, error) {
+	key = s.prefix + key
+	member := s.instance + ":" + strconv.FormatUint(s.nextLease.Add(1), 10)
+	ttl := strconv.FormatInt(sharedLeaseTTL.Milliseconds(), 10)
+
+	reply, err := s.redis.do(ctx, "EVAL", sharedAcquireScript, "1", key, strconv.Itoa(limit), ttl, member)
+	if err != nil {
+		s.errors.Add(1)
+		return nil, false, err
+	}
+	if n, ok := reply.(int64); !ok || n != 1 {
+		return nil, false, nil
+	}
+
+	s.mu.Lock()
+	s.leases[member] = key
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.leases, member)
+			s.mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+			defer cancel()
+			if _, err := s.redis.do(ctx, "ZREM", key, member); err != nil {
+				// The lease expires on its own.
+				s.errors.Add(1)
+				log.Printf("shared state: release of %s failed: %v", key, err)
+			}
+		})
+	}, true, nil
+}
+
+// run renews the leases held by this instance and publishes its report
+// until ctx is done.
+func (s *sharedState) run(ctx context.Context, report func() runReport) {
+	renew := time.NewTicker(sharedLeaseTTL / 3)
+	defer renew.Stop()
+	publish := time.NewTicker(clusterPublishInterval)
+	defer publish.Stop()
+
+	publishReport := func() {
+		if err := s.publish(ctx, report()); err != nil {
+			log.Printf("shared state: publishing stats failed: %v", err)
+		}
+	}
+
+	publishReport()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-renew.C:
+			s.renew(ctx)
+		case <-publish.C:
+			publishReport()
+		}
+	}
+}
+
+func (s *sharedState) renew(ctx context.Context) {
+	s.mu.Lock()
+	leases := make(map[string]string, len(s.leases))
+	for member, key := range s.leases {
+		leases[member] = key
+	}
+	s.mu.Unlock()
+
+	ttl := strconv.FormatInt(sharedLeaseTTL.Milliseconds(), 10)
+	for member, key := range leases {
+		if _, err := s.redis.do(ctx, "EVAL", sharedRenewScript, "1", key, ttl, member); err != nil {
+			s.errors.Add(1)
+			log.Printf("shared state: renewal of leases failed: %v", err)
+			return
+		}
+	}
+}
+
+// sharedIncrScript adds ARGV[1] to the counter KEYS[1], which expires
+// ARGV[2] milliseconds after its first increment, and returns its value and
+// the milliseconds until it expires.
+const sharedIncrScript = `
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	ttl = tonumber(ARGV[2])
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return {n, ttl}
+`
+
+// sharedCountScript returns the value of the counter KEYS[1] and the
+// milliseconds until it expires, zeros when there's none.
+const sharedCountScript = `
+local n = redis.call('GET', KEYS[1])
+if not n then
+	return {0, 0}
+end
+return {tonumber(n), redis.call('PTTL', KEYS[1])}
+`
+
+// incr adds n to the counter key, which expires ttl after it was created,
+// and returns its value and expiry.
+func (s *sharedState) incr(ctx context.Context, key string, n int64, ttl time.Duration) (int64, time.Time, error) {
+	return s.counter(ctx, sharedIncrScript, key, strconv.FormatInt(n, 10), strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+}
+
+// count returns the value of the counter key and its expiry, 0 when
+// there's none.
+func (s *sharedState) count(ctx context.Context, key string) (int64, time.Time, error) {
+	return s.counter(ctx, sharedCountScript, key)
+}
+
+func (s *sharedState) counter(ctx context.Context, script, key string, args ...string) (int64, time.Time, error) {
+	reply, err := s.redis.do(ctx, append([]string{"EVAL", script, "1", s.prefix + key}, args...)...)
+	if err != nil {
+		s.errors.Add(1)
+		return 0, time.Time{}, err
+	}
+	items, _ := reply.([]any)
+	if len(items) != 2 {
+		return 0, time.Time{}, fmt.Errorf("redis: unexpected counter reply %v", reply)
+	}
+	n, ok1 := items[0].(int64)
+	ttl, ok2 := items[1].(int64)
+	if !ok1 || !ok2 {
+		return 0, time.Time{}, fmt.Errorf("redis: unexpected counter reply %v", reply)
+	}
+	return n, time.Now().Add(time.Duration(ttl) * time.Millisecond), nil
+}
+
+func (s *sharedState) ping(ctx context.Context) error {
+	reply, err := s.redis.do(ctx, "PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("redis: unexpected PING reply %v", reply)
+	}
+	return nil
+}
+
+func (s *sharedState) writeMetrics(pw metricsWriter) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	held := len(s.leases)
+	s.mu.Unlock()
+	pw.gauge("http2socks_shared_leases", "Shared limit slots held by this instance.", float64(held))
+	pw.counter("http2socks_shared_errors_total", "Failed requests to the shared state backend.", s.errors.Load())
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	signHMAC    = "hmac"
+	signSigV4   = "aws-sigv4"
+	unsignedSum = "UNSIGNED-PAYLOAD"
+)
+
+// signingRuleSpec is a rule of the signing rules file.
+type signingRuleSpec struct {
+	Destination string `json:"destination"`
+	Path        string `json:"path"`
+	Type        string `json:"type"`
+
+	// hmac
+	Header string `json:"header"`
+	KeyID  string `json:"key_id"`
+	Secret string `json:"secret"`
+
+	// aws-sigv4
+	Region          string `json:"region"`
+	Service         string `json:"service"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+}
+
+// signingRule signs plain HTTP requests to destinations matching hosts
+// whose path matches path, so clients without signing support can reach
+// APIs requiring signed requests through the proxy.
+type signingRule struct {
+	spec  signingRuleSpec
+	hosts *hostMatcher
+}
+
+// requestSigner holds the signing rules, of which the first matching one
+// signs a request.
+type requestSigner struct {
+	rules []signingRule
+
+	mu     sync.Mutex
+	signed map[string]int64 // by type
+}
+
+// loadSigningRules reads a JSON array of rules. Secrets are given as
+// env:NAME, file:PATH or literally.
+func loadSigningRules(file string, groups map[string]string) (*requestSigner, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var specs []signingRuleSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	s := &requestSigner{signed: make(map[string]int64)}
+	for i, spec := range specs {
+		rule, err := newSigningRule(spec, groups)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", file, i+1, err)
+		}
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+func newSigningRule(spec signingRuleSpec, groups map[string]string) (signingRule, error) {
+	if spec.Path == "" {
+		spec.Path = "/*"
+	}
+	if !strings.HasPrefix(spec.Path, "/") {
+		return signingRule{}, fmt.Errorf("path must start with /")
+	}
+	hosts, err := newHostMatcher([]string{spec.Destination}, groups)
+	if err != nil {
+		return signingRule{}, err
+	}
+	if hosts.empty() {
+		return signingRule{}, fmt.Errorf("destination must be set")
+	}
+
+	switch spec.Type {
+	case signHMAC:
+		if spec.Header == "" {
+			spec.Header = "X-Signature"
+		}
+		if spec.Secret, err = resolveSecret(spec.Secret); err != nil {
+			return signingRule{}, err
+		}
+		if spec.Secret == "" {
+			return signingRule{}, fmt.Errorf("secret must be set")
+		}
+	case signSigV4:
+		if spec.Region == "" || spec.Service == "" {
+			return signingRule{}, fmt.Errorf("region and service must be set")
+		}
+		if spec.AccessKeyID, err = resolveSecret(spec.AccessKeyID); err != nil {
+			return signingRule{}, err
+		}
+		if spec.SecretAccessKey, err = resolveSecret(spec.SecretAccessKey); err != nil {
+			return signingRule{}, err
+		}
+		if spec.SessionToken, err = resolveSecret(spec.SessionToken); err != nil {
+			return signingRule{}, err
+		}
+		if spec.AccessKeyID == "" || spec.SecretAccessKey == "" {
+			return signingRule{}, fmt.Errorf("access key ID and secret access key must be set")
+		}
+	default:
+		return signingRule{}, fmt.Errorf("unknown type %q, must be %s or %s", spec.Type, signHMAC, signSigV4)
+	}
+	return signingRule{spec: spec, hosts: hosts}, nil
+}
+
+// resolveSecret returns the value of an env:NAME or file:PATH reference,
+// or value itself.
+func resolveSecret(value string) (string, error) {
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	}
+	if file, ok := strings.CutPrefix(value, "file:"); ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return value, nil
+}
+
+// sign signs req to host with the first matching rule. It reports the
+// type of the signature, empty when no rule matched.
+func (s *requestSigner) sign(req *http.Request, host string) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	for _, rule := range s.rules {
+		if !rule.hosts.match(host) || !matchURLPath(rule.spec.Path, req.URL) {
+			continue
+		}
+
+		bodySum, err := payloadHash(req)
+		if err != nil {
+			return "", err
+		}
+		now := time.Now().UTC()
+		if rule.spec.Type == signHMAC {
+			signHMACRequest(req, rule.spec, bodySum, now)
+		} else {
+			signSigV4Request(req, rule.spec, bodySum, now)
+		}
+
+		s.mu.Lock()
+		s.signed[rule.spec.Type]++
+		s.mu.Unlock()
+		return rule.spec.Type, nil
+	}
+	return "", nil
+}
+
+// payloadHash returns the hex SHA-256 of the request body. Bodies which
+// can't be read twice, i.e. when they aren't spooled, are not hashed.
+func payloadHash(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return hex.EncodeToString(sha256.New().Sum(nil)), nil
+	}
+	if req.GetBody == nil {
+		return unsignedSum, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// signHMACRequest sets the header of spec to the hex HMAC-SHA256 of
+//
+//	timestamp \n method \n request URI \n body SHA-256
+//
+// along with the timestamp and key ID headers.
+func signHMACRequest(req *http.Request, spec signingRuleSpec, bodySum string, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(spec.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", timestamp, req.Method, req.URL.RequestURI(), bodySum)
+
+	req.Header.Set(spec.Header, hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set(spec.Header+"-Timestamp", timestamp)
+	if spec.KeyID != "" {
+		req.Header.Set(spec.Header+"-Key-Id", spec.KeyID)
+	}
+}
+
+// signSigV4Request signs req with AWS Signature Version 4. Path and query
+// are rewritten in their canonical encoding, so the request sent is the
+// one signed.
+func signSigV4Request(req *http.Request, spec signingRuleSpec, bodySum string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + spec.Region + "/" + spec.Service + "/aws4_request"
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if spec.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", bodySum)
+	}
+	if spec.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", spec.SessionToken)
+	}
+
+	// S3 paths are encoded once, those of other services twice.
+	escapedPath := awsEscapePath(req.URL.Path)
+	canonicalPath := escapedPath
+	if spec.Service != "s3" {
+		canonicalPath = awsEscapePath(escapedPath)
+	}
+	req.URL.RawPath = escapedPath
+	req.URL.RawQuery = awsCanonicalQuery(req.URL.Query())
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical bytes.Buffer
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, canonicalPath, req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signedHeaders, bodySum)
+
+	canonicalSum := sha256.Sum256(canonical.Bytes())
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + spec.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), spec.Region, spec.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		spec.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but the unreserved characters of
+// RFC 3986, as SigV4 requires.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func awsEscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	escaped := make(map[string][]string, len(query))
+	names := make([]string, 0, len(query))
+	for name, values := range query {
+		name = awsEscape(name)
+		names = append(names, name)
+		for _, value := range values {
+			escaped[name] = append(escaped[name], awsEscape(value))
+		}
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(query))
+	for _, name := range names {
+		values := escaped[name]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (s *requestSigner) writeMetrics(pw metricsWriter) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pw.header("http2socks_signed_requests_total", "counter", "Requests signed by the proxy by signature type.")
+	for _, typ := range []string{signHMAC, signSigV4} {
+		pw.sample("http2socks_signed_requests_total", map[string]string{"type": typ}, float64(s.signed[typ]))
+	}
+}
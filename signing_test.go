@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const emptySum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestSignSigV4Request(t *testing.T) {
+	// The get-vanilla cases of the AWS Signature Version 4 test suite.
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	spec := signingRuleSpec{
+		Region:          "us-east-1",
+		Service:         "service",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	tests := []struct {
+		name      string
+		url       string
+		uri       string
+		signature string
+	}{
+		{"vanilla", "http://example.amazonaws.com/", "/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"query order", "http://example.amazonaws.com/?Param2=value2&Param1=value1", "/?Param1=value1&Param2=value2", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		req.Header.Set("Authorization", "Basic stale")
+		signSigV4Request(req, spec, emptySum, now)
+
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + tt.signature
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s: Authorization = %q, want %q", tt.name, got, want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: X-Amz-Date = %q", tt.name, got)
+		}
+		if got := req.URL.RequestURI(); got != tt.uri {
+			t.Errorf("%s: request URI %q, want %q", tt.name, got, tt.uri)
+		}
+	}
+
+	// S3 signs the payload hash, and session tokens are signed as well.
+	s3 := spec
+	s3.Service, s3.SessionToken = "s3", "token"
+	req := httptest.NewRequest(http.MethodGet, "http://bucket.s3.amazonaws.com/a%20b", nil)
+	signSigV4Request(req, s3, unsignedSum, now)
+	if got := req.Header.Get("X-Amz-Content-Sha256"); got != unsignedSum {
+		t.Errorf("X-Amz-Content-Sha256 = %q, want %q", got, unsignedSum)
+	}
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "token" {
+		t.Errorf("X-Amz-Security-Token = %q, want token", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token,") {
+		t.Errorf("Authorization = %q, want the session token and payload hash signed", got)
+	}
+	if got := req.URL.EscapedPath(); got != "/a%20b" {
+		t.Errorf("escaped path %q, want /a%%20b", got)
+	}
+}
+
+func TestAWSEscape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"AZaz09-_.~", "AZaz09-_.~"},
+		{"a b", "a%20b"},
+		{"a+b=c&d", "a%2Bb%3Dc%26d"},
+		{"/", "%2F"},
+		{"ሴ", "%E1%88%B4"},
+	}
+	for _, tt := range tests {
+		if got := awsEscape(tt.in); got != tt.want {
+			t.Errorf("awsEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	paths := []struct {
+		in   string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/a b/c", "/a%20b/c"},
+		{"/a%b", "/a%25b"},
+	}
+	for _, tt := range paths {
+		if got := awsEscapePath(tt.in); got != tt.want {
+			t.Errorf("awsEscapePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	queries := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"b=2&a=1", "a=1&b=2"},
+		{"a=2&a=1", "a=1&a=2"},
+		{"a", "a="},
+		{"k=a+b", "k=a%20b"},
+		{"k%2A=%7E", "k%2A=~"},
+	}
+	for _, tt := range queries {
+		query, err := url.ParseQuery(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := awsCanonicalQuery(query); got != tt.want {
+			t.Errorf("awsCanonicalQuery(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSignHMACRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	req := httptest.NewRequest(http.MethodPost, "http://api.example.com/v1/items?id=7", nil)
+	signHMACRequest(req, signingRuleSpec{Header: "X-Sig", KeyID: "key-1", Secret: "secret"}, emptySum, now)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000\nPOST\n/v1/items?id=7\n" + emptySum))
+	if got, want := req.Header.Get("X-Sig"), hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("X-Sig = %q, want %q", got, want)
+	}
+	if got := req.Header.Get("X-Sig-Timestamp"); got != "1700000000" {
+		t.Errorf("X-Sig-Timestamp = %q, want 1700000000", got)
+	}
+	if got := req.Header.Get("X-Sig-Key-Id"); got != "key-1" {
+		t.Errorf("X-Sig-Key-Id = %q, want key-1", got)
+	}
+}
+
+func TestPayloadHash(t *testing.T) {
+	body := "hello"
+	sum := sha256.Sum256([]byte(body))
+
+	// Unlike httptest's, requests of http.NewRequest can read bodies twice.
+	spooled, err := http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+	tests := []struct {
+		name string
+		req  *http.Request
+		want string
+	}{
+		{"no body", httptest.NewRequest(http.MethodGet, "http://example.com/", nil), emptySum},
+		{"spooled", spooled, hex.EncodeToString(sum[:])},
+		{"streamed", streamed, unsignedSum},
+	}
+	for _, tt := range tests {
+		got, err := payloadHash(tt.req)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: payloadHash = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestRequestSigner(t *testing.T) {
+	t.Setenv("TEST_SIGNING_SECRET", "from-env")
+	dir := t.TempDir()
+	file := filepath.Join(dir, "signing.json")
+	rules := `[
+		{"destination": "api.example.com", "path": "/v1/*", "type": "hmac", "secret": "env:TEST_SIGNING_SECRET"},
+		{"destination": "*.amazonaws.com", "type": "aws-sigv4", "region": "us-east-1", "service": "s3",
+		 "access_key_id": "AKID", "secret_access_key": "secret"}
+	]`
+	if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadSigningRules(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret := s.rules[0].spec.Secret; secret != "from-env" {
+		t.Errorf("secret %q, want the environment variable's", secret)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://api.example.com/v1/items", signHMAC},
+		{"http://api.example.com/v2/items", ""},
+		{"http://bucket.s3.amazonaws.com/key", signSigV4},
+		{"http://other.example.com/v1/items", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		got, err := s.sign(req, req.URL.Hostname())
+		if err != nil || got != tt.want {
+			t.Errorf("sign(%s) = %q, %v, want %q", tt.url, got, err, tt.want)
+		}
+	}
+	if s.signed[signHMAC] != 1 || s.signed[signSigV4] != 1 {
+		t.Errorf("signed %v, want one request of each type", s.signed)
+	}
+
+	var none *requestSigner
+	if got, err := none.sign(httptest.NewRequest(http.MethodGet, "http://api.example.com/v1/", nil), "api.example.com"); got != "" || err != nil {
+		t.Errorf("nil signer signed: %q, %v", got, err)
+	}
+}
+
+func TestNewSigningRuleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec signingRuleSpec
+	}{
+		{"relative path", signingRuleSpec{Destination: "example.com", Path: "v1", Type: signHMAC, Secret: "s"}},
+		{"no destination", signingRuleSpec{Type: signHMAC, Secret: "s"}},
+		{"unknown type", signingRuleSpec{Destination: "example.com", Type: "basic"}},
+		{"no secret", signingRuleSpec{Destination: "example.com", Type: signHMAC}},
+		{"unset variable", signingRuleSpec{Destination: "example.com", Type: signHMAC, Secret: "env:TEST_SIGNING_UNSET"}},
+		{"missing file", signingRuleSpec{Destination: "example.com", Type: signHMAC, Secret: "file:/nonexistent/secret"}},
+		{"no region", signingRuleSpec{Destination: "example.com", Type: signSigV4, Service: "s3", AccessKeyID: "a", SecretAccessKey: "b"}},
+		{"no keys", signingRuleSpec{Destination: "example.com", Type: signSigV4, Region: "us-east-1", Service: "s3"}},
+	}
+	for _, tt := range tests {
+		if _, err := newSigningRule(tt.spec, nil); err == nil {
+			t.Errorf("%s: newSigningRule succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const socksVersion5 = 0x05
+
+const (
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+)
+
+// probeSocks connects to a SOCKS5 server and runs the method negotiation and,
+// when credentials are given, username/password authentication (RFC 1929).
+// No CONNECT command is sent, so the check doesn't depend on any target host.
+// The server is reached through the via proxies, if any. An HTTP proxy is
+// only connected to. TLS connections use tlsConfig.
+func probeSocks(ctx context.Context, via []proxyHop, e socksEndpoint, tlsConfig *tls.Config) error {
+	d, err := chainDialer(via, tlsConfig, &net.Dialer{})
+	if err != nil {
+		return err
+	}
+	conn, err := d.DialContext(ctx, e.network(), e.server)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+
+	_, err = proxyHandshake(ctx, conn, e, tlsConfig)
+	return err
+}
+
+// proxyHandshake runs the handshakes with the upstream proxy that come
+// before any CONNECT: TLS for servers connected to over TLS, then the
+// SOCKS5 method negotiation for SOCKS5 servers. Of SSH servers only the
+// banner is read. It returns the connection
+// to go on with, which is closed along with conn.
+func proxyHandshake(ctx context.Context, conn net.Conn, e socksEndpoint, tlsConfig *tls.Config) (net.Conn, error) {
+	if e.tls {
+		tlsConn, err := tlsHandshake(ctx, conn, e.server, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	switch {
+	case e.connect:
+		return conn, nil
+	case e.ssh:
+		return conn, sshBanner(conn)
+	}
+	return conn, socksHandshake(conn, e.user, e.password)
+}
+
+func socksHandshake(conn net.Conn, user, password string) error {
+	greeting := []byte{socksVersion5, 1, socksAuthNone}
+	if user != "" {
+		greeting = []byte{socksVersion5, 2, socksAuthNone, socksAuthPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion5 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthPassword:
+		if user == "" {
+			return errors.New("SOCKS server requires username/password authentication")
+		}
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS username or password too long")
+		}
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS username/password authentication failed")
+		}
+		return nil
+	case socksAuthNoAcceptable:
+		return errors.New("SOCKS server accepted none of the offered authentication methods")
+	default:
+		return fmt.Errorf("unsupported SOCKS authentication method %d", reply[1])
+	}
+}
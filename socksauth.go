@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// socksAuthLogInterval is how often rejected SOCKS5 credentials are logged.
+const socksAuthLogInterval = time.Minute
+
+var errSocksAuthPaused = errors.New("SOCKS5 proxy rejected the credentials, new connections are paused")
+
+// socksAuthGuard notices when the SOCKS5 proxy starts rejecting the
+// credentials at runtime, e.g. because they expired. With pause set, new
+// connections are refused for that long after a rejection, so clients get
+// 503 with Retry-After while the credentials are rotated instead of a
+// failing dial each. The pause is kept on the upstream generation, so a
+// reload with new credentials ends it.
+type socksAuthGuard struct {
+	pause     time.Duration
+	upstreams *upstreams
+
+	failures atomic.Int64
+	paused   atomic.Int64
+	lastLog  atomic.Int64 // unix nanoseconds
+}
+
+// socksAuthFailure reports whether err of a SOCKS5 dial means the proxy
+// rejected the credentials.
+func socksAuthFailure(err error) bool {
+	if errors.Is(err, errChaosAuth) || errors.Is(err, errConnectAuth) {
+		return true
+	}
+	// The SOCKS5 client doesn't export its errors.
+	msg := err.Error()
+	return strings.Contains(msg, "username/password authentication failed") ||
+		strings.Contains(msg, "no acceptable authentication methods") ||
+		strings.Contains(msg, "ssh: unable to authenticate")
+}
+
+// upstreamErrorKind returns the error kind of a failed upstream request.
+func upstreamErrorKind(err error) string {
+	if socksAuthFailure(err) {
+		return errorUpstreamAuth
+	}
+	return errorUpstream
+}
+
+// failed records a rejection of the credentials by u.
+func (g *socksAuthGuard) failed(u *upstream, server string, err error) {
+	g.failures.Add(1)
+	now := time.Now()
+	if g.pause > 0 {
+		u.authPausedUntil.Store(now.Add(g.pause).UnixNano())
+	}
+
+	last := g.lastLog.Load()
+	if now.UnixNano()-last < int64(socksAuthLogInterval) || !g.lastLog.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	if g.pause > 0 {
+		log.Printf("upstream proxy %s rejected the credentials, pausing new connections for %v (%d rejections so far): %v", server, g.pause, g.failures.Load(), err)
+	} else {
+		log.Printf("upstream proxy %s rejected the credentials (%d rejections so far): %v", server, g.failures.Load(), err)
+	}
+}
+
+// pausedFor returns how long new connections through u are still paused.
+func (u *upstream) pausedFor() time.Duration {
+	return time.Until(time.Unix(0, u.authPausedUntil.Load()))
+}
+
+// retryAfter returns the remaining pause when err was caused by it.
+func (g *socksAuthGuard) retryAfter(err error) (time.Duration, bool) {
+	if !errors.Is(err, errSocksAuthPaused) {
+		return 0, false
+	}
+	return max(g.upstreams.current.Load().pausedFor(), time.Second), true
+}
+
+func (g *socksAuthGuard) writeMetrics(pw metricsWriter) {
+	pw.counter("http2socks_upstream_auth_failures_total", "Connections the SOCKS5 proxy refused because it rejected the credentials.", g.failures.Load())
+	pw.counter("http2socks_upstream_auth_paused_total", "Connections refused while paused after rejected credentials.", g.paused.Load())
+	paused := 0.0
+	if g.upstreams.current.Load().pausedFor() > 0 {
+		paused = 1
+	}
+	pw.gauge("http2socks_upstream_auth_paused", "Whether new connections are paused after the SOCKS5 proxy rejected the credentials.", paused)
+}
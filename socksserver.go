@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// socksServerTimeout bounds the SOCKS5 negotiation of a client.
+const socksServerTimeout = 10 * time.Second
+
+const (
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded        = 0x00
+	socksReplyFailure          = 0x01
+	socksReplyNotAllowed       = 0x02
+	socksReplyHostUnreachable  = 0x04
+	socksReplyCmdNotSupported  = 0x07
+	socksReplyAddrNotSupported = 0x08
+)
+
+// socksServer serves SOCKS5 CONNECT (RFC 1928) on the SOCKS listener. Each
+// request is handed to the proxy as a CONNECT request, so rules, proxy
+// authentication, logs and metrics are those of HTTP tunnels.
+type socksServer struct {
+	proxy *forwardProxy
+}
+
+func (s *socksServer) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *socksServer) serveConn(conn net.Conn) {
+	ctx := withSession(context.Background(), conn)
+	_ = conn.SetDeadline(time.Now().Add(socksServerTimeout))
+	req, err := s.readRequest(ctx, conn)
+	if err != nil {
+		sessionLogger(ctx).Printf("SOCKS5 client %s: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	w := &socksResponseWriter{conn: conn, header: http.Header{}}
+	s.proxy.ServeHTTP(w, req)
+	if !w.hijacked {
+		_ = writeSocksReply(conn, socksReplyCode(w.status))
+		_ = conn.Close()
+	}
+}
+
+// readRequest runs the method negotiation with the client, authenticating
+// it when proxy users are configured, and reads its CONNECT request. It
+// answers requests which can't be served itself.
+func (s *socksServer) readRequest(ctx context.Context, conn net.Conn) (*http.Request, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion5 {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	req = req.WithContext(ctx)
+
+	method := byte(socksAuthNone)
+	if s.proxy.users != nil {
+		method = socksAuthPassword
+	}
+	if !slices.Contains(methods, method) {
+		_, _ = conn.Write([]byte{socksVersion5, socksAuthNoAcceptable})
+		return nil, errors.New("no acceptable authentication method offered")
+	}
+	if _, err := conn.Write([]byte{socksVersion5, method}); err != nil {
+		return nil, err
+	}
+	if method == socksAuthPassword {
+		user, password, err := readSocksCredentials(conn)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+		// The destination isn't known before the authentication.
+		name, _, err := s.proxy.authenticate(sessionLogger(ctx), req, "")
+		if err != nil {
+			s.proxy.stats.countError(errorAuth)
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return nil, err
+		}
+		if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+			return nil, err
+		}
+		identity := anonymousIdentity(req)
+		identity.name, identity.method = name, identityBasic
+		req = req.WithContext(withIdentity(ctx, identity))
+	}
+
+	target, err := readSocksTarget(conn)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = target
+	req.RequestURI = target
+	req.URL = &url.URL{Host: target}
+	return req, nil
+}
+
+// readSocksCredentials reads the username/password request of RFC 1929.
+func readSocksCredentials(conn net.Conn) (string, string, error) {
+	var fields [2]string
+	buf := make([]byte, 255)
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		return "", "", err
+	}
+	for i := range fields {
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", "", err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return "", "", err
+		}
+		fields[i] = string(buf[:n])
+	}
+	return fields[0], fields[1], nil
+}
+
+// readSocksTarget reads the request of the client and returns its
+// destination as host:port. Anything but CONNECT is refused.
+func readSocksTarget(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion5 {
+		return "", fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		_ = writeSocksReply(conn, socksReplyCmdNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		_ = writeSocksReply(conn, socksReplyAddrNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSocksReply answers the request of the client with code. The bound
+// address isn't told.
+func writeSocksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion5, code, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode returns the reply to a request the proxy answered with
+// status instead of tunneling it.
+func socksReplyCode(status int) byte {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return socksReplyNotAllowed
+	case http.StatusServiceUnavailable:
+		return socksReplyHostUnreachable
+	default:
+		return socksReplyFailure
+	}
+}
+
+// socksResponseWriter takes the response of the proxy to a CONNECT request
+// of a SOCKS5 client. The tunnel hijacks the client connection once the
+// success reply was sent, error responses are turned into replies by
+// socksServer.
+type socksResponseWriter struct {
+	conn     net.Conn
+	header   http.Header
+	status   int
+	hijacked bool
+}
+
+func (w *socksResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *socksResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write drops the body, SOCKS5 replies have none.
+func (w *socksResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+func (w *socksResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.status != http.StatusOK {
+		return nil, nil, fmt.Errorf("response status %d is no tunnel", w.status)
+	}
+	if err := writeSocksReply(w.conn, socksReplySucceeded); err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return w.conn, nil, nil
+}
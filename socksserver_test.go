@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tcpPair returns both ends of a loopback TCP connection, which unlike
+// net.Pipe buffers what isn't read yet.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	if client, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func testProxyUsers(t *testing.T) *proxyUsers {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(file, []byte("alice:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := newProxyUsers(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func TestSocksServerReadRequest(t *testing.T) {
+	users := testProxyUsers(t)
+	connect := func(addr ...byte) []byte {
+		return append([]byte{socksVersion5, socksCmdConnect, 0x00}, addr...)
+	}
+	domain := connect(append([]byte{socksAddrDomain, 11}, "example.com\x01\xbb"...)...)
+	refused := func(code byte) []byte {
+		return []byte{socksVersion5, code, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	credentials := func(user, password string) []byte {
+		b := append([]byte{0x01, byte(len(user))}, user...)
+		return append(append(b, byte(len(password))), password...)
+	}
+
+	tests := []struct {
+		name   string
+		users  bool
+		in     [][]byte
+		target string
+		reply  []byte
+	}{
+		{
+			name:   "domain",
+			in:     [][]byte{{socksVersion5, 1, socksAuthNone}, domain},
+			target: "example.com:443",
+			reply:  []byte{socksVersion5, socksAuthNone},
+		},
+		{
+			name:   "IPv4",
+			in:     [][]byte{{socksVersion5, 2, socksAuthPassword, socksAuthNone}, connect(socksAddrIPv4, 10, 0, 0, 1, 0, 80)},
+			target: "10.0.0.1:80",
+			reply:  []byte{socksVersion5, socksAuthNone},
+		},
+		{
+			name:   "IPv6",
+			in:     [][]byte{{socksVersion5, 1, socksAuthNone}, connect(socksAddrIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb)},
+			target: "[2001:db8::1]:443",
+			reply:  []byte{socksVersion5, socksAuthNone},
+		},
+		{
+			name: "SOCKS4",
+			in:   [][]byte{{0x04, socksCmdConnect, 0, 80, 10, 0, 0, 1, 0}},
+		},
+		{
+			name:  "no acceptable method",
+			in:    [][]byte{{socksVersion5, 1, socksAuthPassword}},
+			reply: []byte{socksVersion5, socksAuthNoAcceptable},
+		},
+		{
+			name:  "BIND",
+			in:    [][]byte{{socksVersion5, 1, socksAuthNone}, {socksVersion5, 0x02, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80}},
+			reply: append([]byte{socksVersion5, socksAuthNone}, refused(socksReplyCmdNotSupported)...),
+		},
+		{
+			name:  "address type",
+			in:    [][]byte{{socksVersion5, 1, socksAuthNone}, connect(0x05, 0, 80)},
+			reply: append([]byte{socksVersion5, socksAuthNone}, refused(socksReplyAddrNotSupported)...),
+		},
+		{
+			name:  "truncated",
+			in:    [][]byte{{socksVersion5, 1, socksAuthNone}, connect(socksAddrDomain, 11, 'e')},
+			reply: []byte{socksVersion5, socksAuthNone},
+		},
+		{
+			name:   "password",
+			users:  true,
+			in:     [][]byte{{socksVersion5, 2, socksAuthNone, socksAuthPassword}, credentials("alice", "secret"), domain},
+			target: "example.com:443",
+			reply:  []byte{socksVersion5, socksAuthPassword, 0x01, 0x00},
+		},
+		{
+			name:  "wrong password",
+			users: true,
+			in:    [][]byte{{socksVersion5, 1, socksAuthPassword}, credentials("alice", "wrong"), domain},
+			reply: []byte{socksVersion5, socksAuthPassword, 0x01, 0x01},
+		},
+		{
+			name:  "password required",
+			users: true,
+			in:    [][]byte{{socksVersion5, 1, socksAuthNone}, domain},
+			reply: []byte{socksVersion5, socksAuthNoAcceptable},
+		},
+	}
+	for _, tt := range tests {
+		p := &forwardProxy{stats: newProxyStats()}
+		if tt.users {
+			p.users = users
+		}
+		req, reply, err := socksNegotiate(t, &socksServer{proxy: p}, tt.in...)
+
+		switch {
+		case tt.target == "" && err == nil:
+			t.Errorf("%s: readRequest succeeded with %s, want an error", tt.name, req.Host)
+		case tt.target != "" && err != nil:
+			t.Errorf("%s: readRequest: %v", tt.name, err)
+		case tt.target != "" && (req.Method != http.MethodConnect || req.Host != tt.target || req.URL.Host != tt.target):
+			t.Errorf("%s: request %s %s (URL host %s), want CONNECT %s", tt.name, req.Method, req.Host, req.URL.Host, tt.target)
+		}
+		if !bytes.Equal(reply, tt.reply) {
+			t.Errorf("%s: replied %v, want %v", tt.name, reply, tt.reply)
+		}
+		if tt.users && err == nil && userFromContext(req.Context()) != "alice" {
+			t.Errorf("%s: request of user %q, want alice", tt.name, userFromContext(req.Context()))
+		}
+	}
+}
+
+// socksNegotiate sends in to s and returns the request it read and what
+// it replied.
+func socksNegotiate(t *testing.T, s *socksServer, in ...[]byte) (*http.Request, []byte, error) {
+	t.Helper()
+	client, server := tcpPair(t)
+	if _, err := client.Write(bytes.Join(in, nil)); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.(*net.TCPConn).CloseWrite()
+
+	req, err := s.readRequest(withSession(context.Background(), server), server)
+	_ = server.Close()
+	reply, _ := io.ReadAll(client)
+	return req, reply, err
+}
+
+func TestSocksServerAuthLockout(t *testing.T) {
+	login := func(password string) [][]byte {
+		auth := append([]byte{0x01, 5}, "alice"...)
+		auth = append(append(auth, byte(len(password))), password...)
+		return [][]byte{{socksVersion5, 1, socksAuthPassword}, auth, {socksVersion5, socksCmdConnect, 0x00, socksAddrIPv4, 10, 0, 0, 1, 0, 80}}
+	}
+	users := testProxyUsers(t)
+	for _, mode := range []string{policyModeEnforce, policyModeAudit} {
+		p := &forwardProxy{
+			stats:  newProxyStats(),
+			users:  users,
+			policy: newPolicy(mode),
+			limits: newClientLimits(&Config{AuthLockoutFailures: 2, AuthLockoutWindow: time.Minute}, nil),
+		}
+		s := &socksServer{proxy: p}
+		for i := 0; i < 2; i++ {
+			if _, _, err := socksNegotiate(t, s, login("wrong")...); err == nil {
+				t.Fatalf("%s: wrong password accepted", mode)
+			}
+		}
+
+		_, reply, err := socksNegotiate(t, s, login("secret")...)
+		if mode == policyModeAudit {
+			if err != nil {
+				t.Errorf("%s: locked out: %v", mode, err)
+			}
+			continue
+		}
+		if !errors.Is(err, errAuthLockout) || !bytes.Equal(reply, []byte{socksVersion5, socksAuthPassword, 0x01, 0x01}) {
+			t.Errorf("%s: replied %v, %v, want a failed authentication and %v", mode, reply, err, errAuthLockout)
+		}
+	}
+}
+
+func TestSocksReplyCode(t *testing.T) {
+	tests := []struct {
+		status int
+		want   byte
+	}{
+		{http.StatusForbidden, socksReplyNotAllowed},
+		{http.StatusProxyAuthRequired, socksReplyNotAllowed},
+		{http.StatusServiceUnavailable, socksReplyHostUnreachable},
+		{http.StatusBadGateway, socksReplyFailure},
+		{http.StatusBadRequest, socksReplyFailure},
+	}
+	for _, tt := range tests {
+		if got := socksReplyCode(tt.status); got != tt.want {
+			t.Errorf("socksReplyCode(%d) = %d, want %d", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestSocksResponseWriter(t *testing.T) {
+	client, server := tcpPair(t)
+	w := &socksResponseWriter{conn: server, header: http.Header{}}
+	w.WriteHeader(http.StatusForbidden)
+	w.WriteHeader(http.StatusOK)
+	if _, _, err := w.Hijack(); err == nil || w.hijacked {
+		t.Error("hijacked a refused request")
+	}
+
+	w = &socksResponseWriter{conn: server, header: http.Header{}}
+	w.WriteHeader(http.StatusOK)
+	conn, _, err := w.Hijack()
+	if err != nil || conn != server || !w.hijacked {
+		t.Fatalf("Hijack = %v, %v", conn, err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{socksVersion5, socksReplySucceeded, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0}; !bytes.Equal(reply, want) {
+		t.Errorf("replied %v, want %v", reply, want)
+	}
+}
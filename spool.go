@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// spooler buffers request bodies of the plain path before they are sent,
+// in memory up to a limit and in a temporary file beyond that. A buffered
+// body can be sent again, which retries of requests need, and large uploads
+// don't pin memory while the upstream is slow.
+type spooler struct {
+	memory  int64
+	maxSize int64
+	dir     string
+
+	spooled   atomic.Int64
+	diskBytes atomic.Int64
+}
+
+// spooledBody is a buffered request body. close removes its file.
+type spooledBody struct {
+	s    *spooler
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+// spool reads body to its end. Bodies over the max size fail with
+// errBodyTooLarge.
+func (s *spooler) spool(body io.Reader) (*spooledBody, error) {
+	var mem bytes.Buffer
+	n, err := io.Copy(&mem, io.LimitReader(body, s.memory+1))
+	if err != nil {
+		return nil, err
+	}
+	sb := &spooledBody{s: s, mem: mem.Bytes(), size: n}
+	if n <= s.memory {
+		return sb, nil
+	}
+
+	sb.file, err = os.CreateTemp(s.dir, "http2socks-body-*")
+	if err != nil {
+		return nil, err
+	}
+	// The file is removed on close, also when spooling fails below.
+	written, err := io.Copy(sb.file, io.LimitReader(body, s.maxSize-n+1))
+	s.diskBytes.Add(written)
+	sb.size += written
+	if err == nil && sb.size > s.maxSize {
+		err = errBodyTooLarge
+	}
+	if err != nil {
+		sb.close()
+		return nil, err
+	}
+	s.spooled.Add(1)
+	return sb, nil
+}
+
+// reader returns a new reader of the whole body.
+func (sb *spooledBody) reader() io.ReadCloser {
+	if sb.file == nil {
+		return io.NopCloser(bytes.NewReader(sb.mem))
+	}
+	return io.NopCloser(io.MultiReader(
+		bytes.NewReader(sb.mem),
+		io.NewSectionReader(sb.file, 0, sb.size-int64(len(sb.mem))),
+	))
+}
+
+func (sb *spooledBody) close() {
+	if sb.file == nil {
+		return
+	}
+	info, err := sb.file.Stat()
+	if err == nil {
+		sb.s.diskBytes.Add(-info.Size())
+	}
+	_ = sb.file.Close()
+	_ = os.Remove(sb.file.Name())
+	sb.file = nil
+}
+
+func (s *spooler) writeMetrics(pw metricsWriter) {
+	if s == nil {
+		return
+	}
+	pw.counter("http2socks_spooled_bodies_total", "Request bodies spooled to disk.", s.spooled.Load())
+	pw.gauge("http2socks_spool_disk_bytes", "Bytes of request bodies currently spooled to disk.", float64(s.diskBytes.Load()))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// sshDefaultPort is the port of ssh:// URLs without one.
+const sshDefaultPort = "22"
+
+// newSSHClientConfig returns the config of connections to SSH servers as
+// user, authenticating with the private key in keyFile and password, if
+// set, and verifying host keys against knownHostsFile.
+func newSSHClientConfig(user, password, keyFile, knownHostsFile string) (*ssh.ClientConfig, error) {
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: hostKeys,
+	}
+	if keyFile != "" {
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyFile, err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+	return config, nil
+}
+
+// sshDialer opens connections to destinations through an SSH server, as
+// "ssh -D" does, which then resolves their names. All connections share
+// one SSH connection, which is made again once it broke.
+type sshDialer struct {
+	addr    string
+	config  *ssh.ClientConfig
+	forward proxy.Dialer
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func (d *sshDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	for retried := false; ; retried = true {
+		client, err := d.connect(ctx)
+		if err != nil {
+			return nil, &net.OpError{Op: "ssh", Net: network, Addr: hopAddr(d.addr), Err: err}
+		}
+		conn, err := dialSSH(ctx, client, network, addr)
+		var openErr *ssh.OpenChannelError
+		if err == nil || errors.As(err, &openErr) || ctx.Err() != nil || retried {
+			return conn, err
+		}
+		// The SSH connection broke, a new one is made once.
+		d.drop(client)
+	}
+}
+
+// connect returns the SSH connection, made first if there is none.
+func (d *sshDialer) connect(ctx context.Context) (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client != nil {
+		return d.client, nil
+	}
+	conn, err := dialContext(ctx, d.forward, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	d.client = client
+	go func() {
+		_ = client.Wait()
+		d.drop(client)
+	}()
+	return client, nil
+}
+
+// drop forgets client if it's still the SSH connection and closes it.
+func (d *sshDialer) drop(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mu.Unlock()
+	_ = client.Close()
+}
+
+// dialSSH opens a connection to addr through client, bounded by ctx.
+func dialSSH(ctx context.Context, client *ssh.Client, network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial(network, addr)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// sshBanner reads the version banner an SSH server sends first.
+func sshBanner(conn net.Conn) error {
+	line, err := bufio.NewReaderSize(conn, 256).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "SSH-") {
+		return fmt.Errorf("not an SSH server: %q", strings.TrimSpace(line))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// startupMinBackoff is the wait before probing the upstream again
+	// after the first failed startup probe, doubled up to
+	// startupMaxBackoff.
+	startupMinBackoff = time.Second
+	startupMaxBackoff = 30 * time.Second
+)
+
+// startupGate holds proxied requests back with 503 and Retry-After until
+// a server of the upstream first answered a handshake, so the proxy can
+// start before its SOCKS5 proxy is up.
+type startupGate struct {
+	ready   atomic.Bool
+	retryAt atomic.Int64 // unix nanoseconds of the next probe
+	probes  atomic.Int64
+	waiting atomic.Int64
+}
+
+// wait probes the servers of the current upstream with backoff until one
+// answers or ctx is done.
+func (g *startupGate) wait(ctx context.Context, us *upstreams) {
+	start := time.Now()
+	backoff := startupMinBackoff
+	for {
+		u := us.current.Load()
+		err := probeUpstream(ctx, u)
+		g.probes.Add(1)
+		if err == nil {
+			g.ready.Store(true)
+			log.Printf("upstream %s is reachable after %v, serving requests", u.addresses(), time.Since(start).Round(time.Millisecond))
+			return
+		}
+		log.Printf("waiting for upstream %s, probing again in %v: %v", u.addresses(), backoff, err)
+		g.retryAt.Store(time.Now().Add(backoff).UnixNano())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, startupMaxBackoff)
+	}
+}
+
+// probeUpstream returns nil when a server of u answers a handshake, the
+// error of the last one otherwise.
+func probeUpstream(ctx context.Context, u *upstream) error {
+	tlsConfig, err := u.tlsConfig()
+	if err != nil {
+		return err
+	}
+	for _, s := range u.servers {
+		probeCtx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+		err = probeSocks(probeCtx, u.via, s.socksEndpoint, tlsConfig)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// hold answers the request with 503 while the upstream wasn't reachable
+// yet and reports whether it did.
+func (g *startupGate) hold(w http.ResponseWriter) bool {
+	if g == nil || g.ready.Load() {
+		return false
+	}
+	g.waiting.Add(1)
+	wait := time.Until(time.Unix(0, g.retryAt.Load()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(wait.Round(time.Second).Seconds()), 1)))
+	http.Error(w, "waiting for the upstream proxy", http.StatusServiceUnavailable)
+	return true
+}
+
+func (g *startupGate) writeMetrics(pw metricsWriter) {
+	if g == nil {
+		return
+	}
+
+	ready := 0.0
+	if g.ready.Load() {
+		ready = 1
+	}
+	pw.gauge("http2socks_upstream_ready", "Whether the upstream was reachable since startup.", ready)
+	pw.counter("http2socks_upstream_startup_probes_total", "Probes of the upstream while waiting for it at startup.", g.probes.Load())
+	pw.counter("http2socks_upstream_startup_held_total", "Requests answered with 503 while waiting for the upstream at startup.", g.waiting.Load())
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyStats collects runtime statistics of the proxy.
+type proxyStats struct {
+	started time.Time
+
+	upstreamConnsTotal     atomic.Int64
+	upstreamRequestsTotal  atomic.Int64
+	upstreamRequestsReused atomic.Int64
+
+	nextConnID atomic.Uint64
+	openConns  sync.Map // uint64 -> *trackedConn
+
+	requestsTotal atomic.Int64
+	tunnelsTotal  atomic.Int64
+	tunnelsOpen   atomic.Int64
+	tunnelsPeak   atomic.Int64
+
+	// requestsReused counts requests received over a client connection
+	// which carried earlier requests.
+	requestsReused atomic.Int64
+
+	// bytesSent and bytesReceived count payload to and from destinations.
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+
+	errorsMu sync.Mutex
+	errors   map[string]int64
+}
+
+// Kinds of failed requests counted by proxyStats.
+const (
+	errorBadRequest   = "bad_request"
+	errorAuth         = "auth"
+	errorDenied       = "denied"
+	errorLimit        = "limit"
+	errorUpstream     = "upstream"
+	errorUpstreamAuth = "upstream_auth"
+	errorIntegrity    = "integrity"
+)
+
+func newProxyStats() *proxyStats {
+	return &proxyStats{
+		started: time.Now(),
+		errors:  map[string]int64{},
+	}
+}
+
+func (s *proxyStats) countError(kind string) {
+	s.errorsMu.Lock()
+	s.errors[kind]++
+	s.errorsMu.Unlock()
+}
+
+func (s *proxyStats) errorCounts() map[string]int64 {
+	s.errorsMu.Lock()
+	defer s.errorsMu.Unlock()
+
+	res := make(map[string]int64, len(s.errors))
+	for kind, n := range s.errors {
+		res[kind] = n
+	}
+	return res
+}
+
+// tunnelOpened counts an established CONNECT tunnel and returns the func
+// to call when it's closed.
+func (s *proxyStats) tunnelOpened() func() {
+	s.tunnelsTotal.Add(1)
+	open := s.tunnelsOpen.Add(1)
+	for {
+		peak := s.tunnelsPeak.Load()
+		if open <= peak || s.tunnelsPeak.CompareAndSwap(peak, open) {
+			break
+		}
+	}
+	return func() { s.tunnelsOpen.Add(-1) }
+}
+
+// trackedConn is a pooled upstream connection of the HTTP transport. It
+// counts the requests carried over it.
+type trackedConn struct {
+	net.Conn
+
+	id       uint64
+	created  time.Time
+	requests atomic.Int64
+
+	stats     *proxyStats
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stats.openConns.Delete(c.id)
+	})
+	return c.Conn.Close()
+}
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// trackDial wraps dial so that every connection it opens is tracked.
+func (s *proxyStats) trackDial(dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tc := &trackedConn{
+			Conn:    conn,
+			id:      s.nextConnID.Add(1),
+			created: time.Now(),
+			stats:   s,
+		}
+		s.upstreamConnsTotal.Add(1)
+		s.openConns.Store(tc.id, tc)
+		return tc, nil
+	}
+}
+
+// withConnTrace returns ctx with a client trace counting which upstream
+// connection carries the request and whether it was reused.
+func (s *proxyStats) withConnTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.upstreamRequestsTotal.Add(1)
+			if info.Reused {
+				s.upstreamRequestsReused.Add(1)
+			}
+			if tc, ok := info.Conn.(*trackedConn); ok {
+				tc.requests.Add(1)
+			}
+		},
+	})
+}
+
+type upstreamConnStats struct {
+	ID       uint64  `json:"id"`
+	Local    string  `json:"local"`
+	Age      float64 `json:"age_seconds"`
+	Requests int64   `json:"requests"`
+}
+
+type upstreamStats struct {
+	ConnsTotal      int64               `json:"conns_total"`
+	ConnsOpen       int                 `json:"conns_open"`
+	RequestsTotal   int64               `json:"requests_total"`
+	RequestsReused  int64               `json:"requests_reused"`
+	ReuseRatio      float64             `json:"reuse_ratio"`
+	RequestsPerConn float64             `json:"requests_per_conn"`
+	Conns           []upstreamConnStats `json:"conns"`
+
+	Generations []upstreamGenerationStats `json:"generations,omitempty"`
+}
+
+func (s *proxyStats) upstream() upstreamStats {
+	res := upstreamStats{
+		ConnsTotal:     s.upstreamConnsTotal.Load(),
+		RequestsTotal:  s.upstreamRequestsTotal.Load(),
+		RequestsReused: s.upstreamRequestsReused.Load(),
+		Conns:          []upstreamConnStats{},
+	}
+	if res.RequestsTotal > 0 {
+		res.ReuseRatio = float64(res.RequestsReused) / float64(res.RequestsTotal)
+	}
+	if res.ConnsTotal > 0 {
+		res.RequestsPerConn = float64(res.RequestsTotal) / float64(res.ConnsTotal)
+	}
+
+	now := time.Now()
+	s.openConns.Range(func(_, v any) bool {
+		tc := v.(*trackedConn) //nolint:errcheck // only *trackedConn is stored
+		res.Conns = append(res.Conns, upstreamConnStats{
+			ID:       tc.id,
+			Local:    tc.LocalAddr().String(),
+			Age:      now.Sub(tc.created).Seconds(),
+			Requests: tc.requests.Load(),
+		})
+		return true
+	})
+	sort.Slice(res.Conns, func(i, j int) bool { return res.Conns[i].ID < res.Conns[j].ID })
+	res.ConnsOpen = len(res.Conns)
+	return res
+}
+
+func (s *proxyStats) writeMetrics(pw metricsWriter) {
+	up := s.upstream()
+	pw.counter("http2socks_upstream_conns_total", "Pooled connections opened to the SOCKS upstream.", up.ConnsTotal)
+	pw.gauge("http2socks_upstream_conns_open", "Pooled connections to the SOCKS upstream currently open.", float64(up.ConnsOpen))
+	pw.counter("http2socks_upstream_requests_total", "Requests sent over pooled upstream connections.", up.RequestsTotal)
+	pw.counter("http2socks_upstream_requests_reused_total", "Requests sent over a reused pooled upstream connection.", up.RequestsReused)
+
+	pw.counter("http2socks_requests_total", "Proxy requests received, including CONNECT.", s.requestsTotal.Load())
+	pw.counter("http2socks_requests_reused_session_total", "Proxy requests received over a client connection which carried earlier requests.", s.requestsReused.Load())
+	pw.counter("http2socks_client_sessions_total", "Client connections accepted, each a session.", int64(sessionCounter.Load()))
+	pw.counter("http2socks_tunnels_total", "CONNECT tunnels established.", s.tunnelsTotal.Load())
+	pw.gauge("http2socks_tunnels_open", "CONNECT tunnels currently open.", float64(s.tunnelsOpen.Load()))
+	pw.gauge("http2socks_tunnels_peak", "Highest number of simultaneously open CONNECT tunnels.", float64(s.tunnelsPeak.Load()))
+	pw.counter("http2socks_bytes_sent_total", "Payload bytes sent to destinations.", s.bytesSent.Load())
+	pw.counter("http2socks_bytes_received_total", "Payload bytes received from destinations.", s.bytesReceived.Load())
+
+	errs := s.errorCounts()
+	kinds := make([]string, 0, len(errs))
+	for kind := range errs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	pw.header("http2socks_request_errors_total", "counter", "Failed proxy requests by kind.")
+	for _, kind := range kinds {
+		pw.sample("http2socks_request_errors_total", map[string]string{"kind": kind}, float64(errs[kind]))
+	}
+}
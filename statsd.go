@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics backends. Prometheus metrics are always served on the admin API,
+// the StatsD backends additionally push them.
+const (
+	metricsPrometheus = "prometheus"
+	metricsStatsd     = "statsd"
+	metricsDogstatsd  = "dogstatsd"
+)
+
+// statsdMaxPacket keeps UDP packets below the usual path MTU.
+const statsdMaxPacket = 1432
+
+// statsdPusher periodically sends the metrics of the proxy to a StatsD
+// server. Counters are sent as the increase since the previous push,
+// labels become name segments or, with DogStatsD, tags.
+type statsdPusher struct {
+	p        *forwardProxy
+	addr     string
+	prefix   string
+	tags     bool
+	interval time.Duration
+
+	last map[string]float64
+}
+
+func newStatsdPusher(p *forwardProxy, cfg *Config) *statsdPusher {
+	return &statsdPusher{
+		p:        p,
+		addr:     cfg.StatsdAddress,
+		prefix:   cfg.StatsdPrefix,
+		tags:     cfg.MetricsBackend == metricsDogstatsd,
+		interval: cfg.StatsdInterval,
+		last:     map[string]float64{},
+	}
+}
+
+func (s *statsdPusher) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.push(); err != nil {
+				log.Printf("push of metrics to %s failed: %v", s.addr, err)
+			}
+		}
+	}
+}
+
+func (s *statsdPusher) push() error {
+	sw := &statsdWriter{pusher: s}
+	s.p.writeMetrics(sw)
+
+	conn, err := net.Dial("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	var packet bytes.Buffer
+	for _, line := range sw.lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write(packet.Bytes())
+	}
+	return err
+}
+
+// statsdWriter translates metrics into StatsD lines.
+type statsdWriter struct {
+	pusher *statsdPusher
+	typ    string
+	lines  []string
+}
+
+func (sw *statsdWriter) header(_, typ, _ string) {
+	sw.typ = typ
+}
+
+func (sw *statsdWriter) counter(name, help string, v int64) {
+	sw.header(name, "counter", help)
+	sw.sample(name, nil, float64(v))
+}
+
+func (sw *statsdWriter) gauge(name, help string, v float64) {
+	sw.header(name, "gauge", help)
+	sw.sample(name, nil, v)
+}
+
+func (sw *statsdWriter) sample(name string, labels map[string]string, v float64) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(sw.pusher.prefix)
+	b.WriteString(name)
+	if !sw.pusher.tags {
+		for _, k := range keys {
+			b.WriteString("." + k + "." + statsdNameReplacer.Replace(labels[k]))
+		}
+	}
+	// Counters are tracked per label set, also when labels become tags.
+	key := b.String()
+	if sw.pusher.tags {
+		for _, k := range keys {
+			key += "," + k + "=" + labels[k]
+		}
+	}
+
+	kind := "g"
+	if sw.typ == "counter" {
+		kind = "c"
+		// A counter lower than before was reset, e.g. by a restart of a
+		// component, and counts from zero again.
+		delta := v
+		if last, ok := sw.pusher.last[key]; ok && v >= last {
+			delta = v - last
+		}
+		sw.pusher.last[key] = v
+		v = delta
+	}
+
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	b.WriteString("|" + kind)
+	if sw.pusher.tags && len(keys) > 0 {
+		b.WriteString("|#")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(k + ":" + statsdTagReplacer.Replace(labels[k]))
+		}
+	}
+	sw.lines = append(sw.lines, b.String())
+}
+
+// statsdNameReplacer and statsdTagReplacer replace characters with a
+// meaning in the StatsD line format. Dots separate name segments, but are
+// fine in tags.
+var (
+	statsdNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", ".", "_", " ", "_", "\n", "_")
+	statsdTagReplacer  = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+)
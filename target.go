@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// connectTarget is a parsed authority-form target of a CONNECT request.
+type connectTarget struct {
+	// Host is a lower-cased hostname or an IP literal in canonical form,
+	// without brackets and zone. It's used for matching and as the address
+	// sent to the SOCKS server.
+	Host string
+	// Zone is the IPv6 zone of a link-local literal, if any.
+	Zone string
+	Port string
+}
+
+// parseConnectTarget parses host:port as received in a CONNECT request.
+// IPv6 literals must be bracketed ("[::1]:443") and may carry a zone
+// ("[fe80::1%eth0]:443"). IPv4-mapped IPv6 literals are unmapped, so
+// "[::ffff:10.0.0.1]:443" and "10.0.0.1:443" are the same target. Zones
+// may be percent-encoded as in URLs ("[fe80::1%25eth0]:443", RFC 6874).
+func parseConnectTarget(hostport string) (connectTarget, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return connectTarget{}, fmt.Errorf("invalid CONNECT target %q: %w", hostport, err)
+	}
+	if addr, zone, ok := strings.Cut(host, "%25"); ok && strings.Contains(addr, ":") {
+		zone, err := url.PathUnescape(zone)
+		if err != nil {
+			return connectTarget{}, fmt.Errorf("invalid CONNECT target %q: bad zone: %w", hostport, err)
+		}
+		host = addr + "%" + zone
+	}
+	if strings.HasPrefix(hostport, "[") && !strings.Contains(host, ":") {
+		return connectTarget{}, fmt.Errorf("invalid CONNECT target %q: brackets around a host other than an IPv6 address", hostport)
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return connectTarget{}, fmt.Errorf("invalid CONNECT target %q: bad port %q", hostport, port)
+	}
+
+	h, zone, err := normalizeHost(host)
+	if err != nil {
+		return connectTarget{}, fmt.Errorf("invalid CONNECT target %q: %w", hostport, err)
+	}
+
+	return connectTarget{Host: h, Zone: zone, Port: strconv.FormatUint(n, 10)}, nil
+}
+
+// String returns the target in host:port form, keeping the zone. This is
+// the address to dial directly.
+func (t connectTarget) String() string {
+	host := t.Host
+	if t.Zone != "" {
+		host += "%" + t.Zone
+	}
+	return net.JoinHostPort(host, t.Port)
+}
+
+// socksAddr returns the target address to be sent to the SOCKS server. A zone
+// names an interface of this host and means nothing to the SOCKS server, so
+// such targets can't be forwarded.
+func (t connectTarget) socksAddr() (string, error) {
+	if t.Zone != "" {
+		return "", fmt.Errorf("target %s has an IPv6 zone and can't be reached through SOCKS", t)
+	}
+	return net.JoinHostPort(t.Host, t.Port), nil
+}
+
+// normalizeHost brings a host (without port and brackets) to the canonical
+// form used for matching: IP literals are canonicalized and unmapped, with
+// their zone returned separately, hostnames are lower-cased and stripped of
+// the trailing dot.
+func normalizeHost(host string) (string, string, error) {
+	if host == "" {
+		return "", "", errors.New("empty host")
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		zone := addr.Zone()
+		return addr.WithZone("").Unmap().String(), zone, nil
+	}
+	if strings.ContainsAny(host, ":%[]") {
+		return "", "", fmt.Errorf("bad IP literal %q", host)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return "", "", errors.New("empty host")
+	}
+	return host, "", nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import "testing"
+
+func TestParseConnectTarget(t *testing.T) {
+	tests := []struct {
+		hostport string
+		want     connectTarget
+		addr     string
+		socks    string
+	}{
+		{"example.com:443", connectTarget{Host: "example.com", Port: "443"}, "example.com:443", "example.com:443"},
+		{"Example.COM.:443", connectTarget{Host: "example.com", Port: "443"}, "example.com:443", "example.com:443"},
+		{"10.0.0.1:8443", connectTarget{Host: "10.0.0.1", Port: "8443"}, "10.0.0.1:8443", "10.0.0.1:8443"},
+		{"[::1]:443", connectTarget{Host: "::1", Port: "443"}, "[::1]:443", "[::1]:443"},
+		{"[2001:DB8:0:0::1]:443", connectTarget{Host: "2001:db8::1", Port: "443"}, "[2001:db8::1]:443", "[2001:db8::1]:443"},
+		{"[::ffff:10.0.0.1]:443", connectTarget{Host: "10.0.0.1", Port: "443"}, "10.0.0.1:443", "10.0.0.1:443"},
+		{"[fe80::1%eth0]:443", connectTarget{Host: "fe80::1", Zone: "eth0", Port: "443"}, "[fe80::1%eth0]:443", ""},
+		{"[fe80::1%25eth0]:443", connectTarget{Host: "fe80::1", Zone: "eth0", Port: "443"}, "[fe80::1%eth0]:443", ""},
+		{"[fe80::1%25en%2D1]:443", connectTarget{Host: "fe80::1", Zone: "en-1", Port: "443"}, "[fe80::1%en-1]:443", ""},
+		{"example.com:0443", connectTarget{Host: "example.com", Port: "443"}, "example.com:443", "example.com:443"},
+	}
+	for _, tt := range tests {
+		got, err := parseConnectTarget(tt.hostport)
+		if err != nil {
+			t.Errorf("parseConnectTarget(%q): %v", tt.hostport, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseConnectTarget(%q) = %+v, want %+v", tt.hostport, got, tt.want)
+		}
+		if addr := got.String(); addr != tt.addr {
+			t.Errorf("parseConnectTarget(%q).String() = %q, want %q", tt.hostport, addr, tt.addr)
+		}
+		socks, err := got.socksAddr()
+		if tt.socks == "" {
+			if err == nil {
+				t.Errorf("parseConnectTarget(%q).socksAddr() = %q, want an error for the zone", tt.hostport, socks)
+			}
+		} else if socks != tt.socks || err != nil {
+			t.Errorf("parseConnectTarget(%q).socksAddr() = %q, %v, want %q", tt.hostport, socks, err, tt.socks)
+		}
+	}
+}
+
+func TestParseConnectTargetInvalid(t *testing.T) {
+	for _, hostport := range []string{
+		"",
+		"example.com",
+		"example.com:",
+		"example.com:0",
+		"example.com:65536",
+		"example.com:https",
+		":443",
+		"::1:443",
+		"[::1]",
+		"[example.com]:443",
+		"[10.0.0.1]:443",
+		"[fe80::1%25%zz]:443",
+		"exa%mple.com:443",
+	} {
+		if got, err := parseConnectTarget(hostport); err == nil {
+			t.Errorf("parseConnectTarget(%q) = %+v, want an error", hostport, got)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host, want, zone string
+	}{
+		{"Example.COM", "example.com", ""},
+		{"example.com.", "example.com", ""},
+		{"10.0.0.1", "10.0.0.1", ""},
+		{"::FFFF:10.0.0.1", "10.0.0.1", ""},
+		{"2001:db8:0::1", "2001:db8::1", ""},
+		{"fe80::1%eth0", "fe80::1", "eth0"},
+	}
+	for _, tt := range tests {
+		got, zone, err := normalizeHost(tt.host)
+		if err != nil || got != tt.want || zone != tt.zone {
+			t.Errorf("normalizeHost(%q) = %q, %q, %v, want %q, %q", tt.host, got, zone, err, tt.want, tt.zone)
+		}
+	}
+	for _, host := range []string{"", ".", "[::1]", "a:b"} {
+		if got, _, err := normalizeHost(host); err == nil {
+			t.Errorf("normalizeHost(%q) = %q, want an error", host, got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyTiming collects where the time of a proxied request is spent, for
+// the Server-Timing header.
+type proxyTiming struct {
+	mu    sync.Mutex
+	dial  time.Duration
+	socks time.Duration
+	ttfb  time.Duration
+	wrote time.Time
+}
+
+type timingKey struct{}
+
+func withTiming(ctx context.Context) (context.Context, *proxyTiming) {
+	t := &proxyTiming{}
+	return context.WithValue(ctx, timingKey{}, t), t
+}
+
+func timingFromContext(ctx context.Context) *proxyTiming {
+	t, _ := ctx.Value(timingKey{}).(*proxyTiming)
+	return t
+}
+
+// trace returns ctx with a client trace measuring the time from the
+// written request to the first response byte.
+func (t *proxyTiming) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			t.wrote = time.Now()
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			if !t.wrote.IsZero() {
+				t.ttfb = time.Since(t.wrote)
+			}
+			t.mu.Unlock()
+		},
+	})
+}
+
+// header formats the collected durations as Server-Timing metrics. Dial
+// and SOCKS handshake are missing when the request reused a connection.
+func (t *proxyTiming) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var metrics []string
+	add := func(name string, d time.Duration) {
+		if d > 0 {
+			metrics = append(metrics, serverTimingMetric(name, d))
+		}
+	}
+	add("dial", t.dial)
+	add("socks", t.socks)
+	add("ttfb", t.ttfb)
+	return strings.Join(metrics, ", ")
+}
+
+func serverTimingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, ms(d))
+}
+
+// dialed records a connection made through the upstream, which took total
+// including the SOCKS handshake.
+func (t *proxyTiming) dialed(total time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if total > t.dial {
+		t.socks = total - t.dial
+	}
+}
+
+// timedDialer measures the TCP connect to the SOCKS server for the timing
+// of the context.
+type timedDialer struct {
+	forward proxy.Dialer
+}
+
+func (d timedDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d timedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if cd, ok := d.forward.(proxy.ContextDialer); ok {
+		conn, err = cd.DialContext(ctx, network, addr)
+	} else {
+		conn, err = d.forward.Dial(network, addr)
+	}
+
+	if t := timingFromContext(ctx); t != nil && err == nil {
+		t.mu.Lock()
+		if t.dial == 0 {
+			t.dial = time.Since(start)
+		}
+		t.mu.Unlock()
+	}
+	return conn, err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listenerTLS is the TLS config of the proxy listener with its
+// certificates, session ticket keys and handshake counters.
+type listenerTLS struct {
+	config *tls.Config
+
+	certs   *listenerCerts
+	tickets *ticketKeys
+
+	handshakes atomic.Int64
+	resumed    atomic.Int64
+}
+
+// newListenerTLS loads the listener certificates and the CA certificates
+// client certificates are verified against. OCSP responses are fetched
+// with client.
+func newListenerTLS(cfg *Config, client func() (*http.Client, error)) (*listenerTLS, error) {
+	certs, err := newListenerCerts(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+
+	lt := &listenerTLS{certs: certs}
+	lt.config = &tls.Config{
+		GetCertificate:         certs.getCertificate,
+		MinVersion:             tls.VersionTLS12,
+		SessionTicketsDisabled: !cfg.TLSSessionTickets,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			lt.handshakes.Add(1)
+			if cs.DidResume {
+				lt.resumed.Add(1)
+			}
+			return nil
+		},
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", cfg.TLSClientCAFile)
+		}
+		// Clients without a certificate may still authenticate with
+		// proxy credentials.
+		lt.config.ClientCAs = pool
+		lt.config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if cfg.TLSSessionTickets {
+		lt.tickets = &ticketKeys{
+			config:   lt.config,
+			file:     cfg.TLSTicketKeysFile,
+			rotation: cfg.TLSTicketKeyRotation,
+		}
+		if err := lt.tickets.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return lt, nil
+}
+
+func (lt *listenerTLS) writeMetrics(pw metricsWriter) {
+	if lt == nil {
+		return
+	}
+	pw.counter("http2socks_tls_handshakes_total", "TLS handshakes of clients on the proxy listener.", lt.handshakes.Load())
+	pw.counter("http2socks_tls_handshakes_resumed_total", "TLS handshakes which resumed a session.", lt.resumed.Load())
+	if lt.tickets != nil {
+		pw.counter("http2socks_tls_ticket_key_rotations_total", "Rotations of the session ticket keys.", lt.tickets.rotations.Load())
+	}
+	lt.certs.writeMetrics(pw)
+}
+
+// ticketKeys rotates the session ticket keys of a TLS config. New keys are
+// random, or read from a file shared by several instances so tickets issued
+// by one are accepted by the others.
+type ticketKeys struct {
+	config   *tls.Config
+	file     string
+	rotation time.Duration
+
+	mu   sync.Mutex
+	keys [][32]byte
+
+	rotations atomic.Int64
+}
+
+// ticketKeysKept is the number of random keys kept. Tickets stay valid for
+// up to that many rotation intervals.
+const ticketKeysKept = 3
+
+func (tk *ticketKeys) run(ctx context.Context) {
+	ticker := time.NewTicker(tk.rotation)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := tk.rotate(); err != nil {
+				log.Printf("rotation of TLS session ticket keys failed, keeping the previous ones: %v", err)
+			}
+		}
+	}
+}
+
+// rotate makes a new key the one tickets are encrypted with. Previous keys
+// still decrypt tickets issued with them.
+func (tk *ticketKeys) rotate() error {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if tk.file != "" {
+		keys, err := readTicketKeys(tk.file)
+		if err != nil {
+			return err
+		}
+		tk.keys = keys
+	} else {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		tk.keys = append([][32]byte{key}, tk.keys...)
+		if len(tk.keys) > ticketKeysKept {
+			tk.keys = tk.keys[:ticketKeysKept]
+		}
+	}
+
+	tk.config.SetSessionTicketKeys(tk.keys)
+	tk.rotations.Add(1)
+	return nil
+}
+
+// readTicketKeys reads base64 encoded 32 byte keys, one per line. The
+// first key encrypts new tickets.
+func readTicketKeys(file string) ([][32]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var keys [][32]byte
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("%s:%d: ticket key must be 32 base64 encoded bytes", file, n)
+		}
+		var key [32]byte
+		copy(key[:], raw)
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no ticket keys", file)
+	}
+	return keys, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Events of tunnel records.
+const (
+	tunnelStart = "start"
+	tunnelEnd   = "end"
+)
+
+// tunnelRecord is the metadata of a CONNECT tunnel, published when it's
+// established and again when it's closed, with the server name the client
+// sent (TLS tunnels only), bytes and duration.
+type tunnelRecord struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Session       string    `json:"session"`
+	Client        string    `json:"client"`
+	User          string    `json:"user,omitempty"`
+	Destination   string    `json:"destination"`
+	Category      string    `json:"category,omitempty"`
+	SNI           string    `json:"sni,omitempty"`
+	BytesSent     int64     `json:"bytes_sent,omitempty"`
+	BytesReceived int64     `json:"bytes_received,omitempty"`
+	DurationMs    float64   `json:"duration_ms,omitempty"`
+}
+
+func newTunnelRecord(req *http.Request, destination string) tunnelRecord {
+	return tunnelRecord{
+		Time:        time.Now(),
+		Event:       tunnelStart,
+		Session:     sessionID(req.Context()),
+		Client:      req.RemoteAddr,
+		User:        userFromContext(req.Context()),
+		Destination: destination,
+		Category:    categoryFromContext(req.Context()),
+	}
+}
+
+// ended returns the record of the tunnel closed now.
+func (r tunnelRecord) ended(sni string, sent, received int64) tunnelRecord {
+	now := time.Now()
+	r.DurationMs = ms(now.Sub(r.Time))
+	r.Time, r.Event = now, tunnelEnd
+	r.SNI, r.BytesSent, r.BytesReceived = sni, sent, received
+	return r
+}
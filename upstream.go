@@ -0,0 +1,810 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// upstream are the SOCKS servers connections are made through, balanced
+// over with the balance strategy. Every config change of the upstream
+// creates a new generation. Connections made through a previous generation
+// stay on it until they are closed, so established tunnels survive an
+// upstream switch while new connections use the new one.
+type upstream struct {
+	generation uint64
+	servers    []*upstreamServer
+	balance    string
+	keepAlive  time.Duration
+
+	// isolation derives the credentials of SOCKS5 servers without any per
+	// destination or per client.
+	isolation string
+
+	// tlsCAFile, tlsCertFile and tlsKeyFile configure TLS to the servers.
+	tlsCAFile   string
+	tlsCertFile string
+	tlsKeyFile  string
+
+	// sshKeyFile and sshKnownHostsFile configure SSH servers.
+	sshKeyFile        string
+	sshKnownHostsFile string
+
+	// resolve is the policy for proxy host names with several addresses,
+	// resolved again every resolveInterval.
+	resolve         string
+	resolveInterval time.Duration
+
+	// next is the round-robin position in schedule, the order servers
+	// are taken in by their weights.
+	next     atomic.Uint64
+	schedule []int
+
+	// fastest is the server preferred by the fastest strategy.
+	fastest atomic.Int32
+
+	// maxConns is how many connections each server may have open, zero
+	// for no limit. Connections wait up to maxConnsWait for a server below
+	// it.
+	maxConns        int
+	maxConnsWait    time.Duration
+	budgetWaits     atomic.Int64
+	budgetExhausted atomic.Int64
+
+	// routes and users send connections to destinations and of proxy users
+	// through named servers.
+	routes    upstreamRoutes
+	routeSpec map[string]string
+	users     map[string]string
+	namedSpec map[string]string
+
+	// via are proxies the servers are reached through.
+	via     []proxyHop
+	viaSpec []string
+
+	// chain are further proxies connections to destinations matched by
+	// chainHosts are relayed through after the server.
+	chain      []proxyHop
+	chainSpec  []string
+	chainHosts []string
+	groups     map[string]string
+	chainMatch *hostMatcher
+
+	open atomic.Int64
+
+	// lastDial is the result of the latest connection attempt.
+	lastDial atomic.Pointer[dialResult]
+
+	// authPausedUntil is when new connections may be made again after the
+	// credentials were rejected, in unix nanoseconds.
+	authPausedUntil atomic.Int64
+}
+
+type dialResult struct {
+	time time.Time
+	err  error
+}
+
+// upstreamServer is a SOCKS server of an upstream.
+type upstreamServer struct {
+	socksEndpoint
+
+	// resolver picks the address of a server given by name, nil leaves it
+	// to the system resolver.
+	resolver *serverResolver
+
+	// weight is the share of connections the server gets.
+	weight int
+
+	// name selects the server with upstreamHeader, empty when unnamed.
+	name string
+
+	// reserved servers are named upstreams which aren't balanced over,
+	// connections only go through them when routed or selected.
+	reserved bool
+
+	// latency is the moving average of the handshake time of health
+	// probes in nanoseconds, zero until one succeeded.
+	latency atomic.Int64
+
+	// open counts connections through the server, including those being
+	// dialed.
+	open atomic.Int64
+
+	// down takes the server out of rotation after it couldn't be reached,
+	// until a health probe at retryAt succeeds.
+	down     atomic.Bool
+	downs    atomic.Int64
+	mu       sync.Mutex
+	failures int
+	retryAt  time.Time
+}
+
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceLeastConnections = "least-connections"
+	balanceFastest          = "fastest"
+	balanceAffinity         = "affinity"
+)
+
+func (u *upstream) sameAs(cfg *Config) bool {
+	endpoints, _ := parseSocksProxies(cfg)
+	weights := socksWeights(cfg, true)
+	return slices.EqualFunc(u.servers, endpoints, func(s *upstreamServer, e socksEndpoint) bool { return s.socksEndpoint == e }) &&
+		slices.EqualFunc(u.servers, weights, func(s *upstreamServer, w int) bool { return s.weight == w }) &&
+		slices.EqualFunc(u.servers, socksNames(cfg), func(s *upstreamServer, name string) bool { return s.name == name }) &&
+		u.balance == cfg.SocksBalance &&
+		u.maxConns == cfg.SocksMaxConns &&
+		u.maxConnsWait == cfg.SocksMaxConnsWait &&
+		u.keepAlive == cfg.SocksKeepAlive &&
+		u.isolation == cfg.SocksIsolation &&
+		u.tlsCAFile == cfg.SocksCAFile &&
+		u.tlsCertFile == cfg.SocksTLSCertFile &&
+		u.tlsKeyFile == cfg.SocksTLSKeyFile &&
+		u.sshKeyFile == cfg.SocksSSHKeyFile &&
+		u.sshKnownHostsFile == cfg.SocksSSHKnownHostsFile &&
+		u.resolve == cfg.SocksResolve &&
+		u.resolveInterval == cfg.SocksResolveInterval &&
+		slices.Equal(u.viaSpec, cfg.SocksVia) &&
+		slices.Equal(u.chainSpec, cfg.SocksChain) &&
+		slices.Equal(u.chainHosts, cfg.SocksChainHosts) &&
+		maps.Equal(u.groups, cfg.HostGroups) &&
+		maps.Equal(u.namedSpec, cfg.Upstreams) &&
+		maps.Equal(u.routeSpec, cfg.UpstreamRoutes) &&
+		maps.Equal(u.users, cfg.UserUpstreams)
+}
+
+// chained reports whether connections to host go through the chain.
+func (u *upstream) chained(host string) bool {
+	if len(u.chain) == 0 {
+		return false
+	}
+	return u.chainMatch.empty() || u.chainMatch.match(host)
+}
+
+// pick returns the index of the server the next connection goes through,
+// skipping those in tried and those at the connection limit, and counts
+// the connection as open on it. Servers which are down are only picked
+// when no other is left. It returns -1 when no server is left. key
+// identifies the client for affinity.
+func (u *upstream) pick(tried []bool, key string) int {
+	n := len(u.servers)
+	start := u.schedule[u.next.Add(1)%uint64(len(u.schedule))]
+	if u.balance == balanceFastest {
+		// The others follow in order when the fastest is down.
+		start = int(u.fastest.Load())
+	}
+	for {
+		best := -1
+		for _, healthy := range []bool{true, false} {
+			for j := 0; j < n; j++ {
+				// With least-connections ties go round-robin by starting
+				// the search at the next position.
+				k := (start + j) % n
+				if tried[k] || healthy && u.servers[k].down.Load() || u.full(u.servers[k]) {
+					continue
+				}
+				if best < 0 || u.better(k, best, key) {
+					best = k
+				}
+				if u.balance != balanceLeastConnections && u.balance != balanceAffinity {
+					break
+				}
+			}
+			if best >= 0 {
+				break
+			}
+		}
+		if best < 0 {
+			return -1
+		}
+		// Another connection may have taken the last slot meanwhile.
+		if u.servers[best].reserve(u.maxConns) {
+			return best
+		}
+	}
+}
+
+// weightedSchedule returns the order of servers with weights in which each
+// one appears as often as its weight, spread out as evenly as possible
+// (smooth weighted round-robin).
+func weightedSchedule(weights []int) []int {
+	var total int
+	for _, w := range weights {
+		total += w
+	}
+	current := make([]int, len(weights))
+	schedule := make([]int, 0, total)
+	for len(schedule) < total {
+		best := 0
+		for i, w := range weights {
+			current[i] += w
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// better reports whether server i is to be preferred over server j by
+// least-connections, comparing open connections per weight, or by
+// affinity.
+func (u *upstream) better(i, j int, key string) bool {
+	si, sj := u.servers[i], u.servers[j]
+	if u.balance == balanceAffinity {
+		return si.affinity(key) > sj.affinity(key)
+	}
+	return si.open.Load()*int64(sj.weight) < sj.open.Load()*int64(si.weight)
+}
+
+// affinity returns the score of the server for the client with key, the
+// highest one taking its connections (weighted rendezvous hashing). While
+// a server is down only its clients move to others.
+func (s *upstreamServer) affinity(key string) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(s.server))
+	// A uniform value in (0, 1).
+	x := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -float64(s.weight) / math.Log(x)
+}
+
+// addresses returns the addresses of the servers for logs and stats.
+func (u *upstream) addresses() string {
+	addrs := make([]string, len(u.servers))
+	for i, s := range u.servers {
+		addrs[i] = s.server
+	}
+	return strings.Join(addrs, ",")
+}
+
+// socksEndpoint is a SOCKS5 proxy of the config.
+type socksEndpoint struct {
+	server   string
+	user     string
+	password string
+
+	// localDNS resolves destinations before connecting (socks5:// URLs)
+	// instead of leaving it to the SOCKS server.
+	localDNS bool
+
+	// connect makes the server an HTTP proxy tunneling with CONNECT
+	// (http:// and https:// URLs). tls connects to the server over TLS,
+	// for https:// URLs and with socks_tls.
+	connect bool
+	tls     bool
+
+	// unix makes server the path of a Unix domain socket (unix:// URLs).
+	unix bool
+
+	// ssh makes the server an SSH server connections are forwarded
+	// through (ssh:// URLs).
+	ssh bool
+}
+
+// network returns the network the server is dialed on.
+func (e socksEndpoint) network() string {
+	if e.unix {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Values of socks_dns.
+const (
+	dnsAuto   = "auto"
+	dnsLocal  = "local"
+	dnsRemote = "remote"
+)
+
+// socksDefaultPort is the port of socks5:// URLs without one.
+const socksDefaultPort = "1080"
+
+// parseSocksProxy parses the SOCKS5 proxy given as host:port or as a
+// socks5:// or socks5h:// URL with optional credentials, the syntax of
+// ALL_PROXY variables, or as unix:// URL of a Unix domain socket. An
+// http:// or https:// URL makes it an HTTP proxy instead, an ssh:// URL an
+// SSH server. Credentials are either in the URL or in user and password.
+func parseSocksProxy(s, user, password string) (socksEndpoint, error) {
+	e := socksEndpoint{server: s, user: user, password: password}
+	if path, ok := strings.CutPrefix(s, "unix://"); ok {
+		if path == "" {
+			return socksEndpoint{}, fmt.Errorf("SOCKS5 proxy unix:// URL must have a socket path")
+		}
+		e.server, e.unix = path, true
+	} else if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return socksEndpoint{}, fmt.Errorf("bad SOCKS5 proxy URL: %w", err)
+		}
+		switch u.Scheme {
+		case "socks5":
+			e.localDNS = true
+		case "socks5h":
+		case "https":
+			e.tls = true
+			fallthrough
+		case "http":
+			e.connect = true
+		case "ssh":
+			e.ssh = true
+		default:
+			return socksEndpoint{}, fmt.Errorf("SOCKS5 proxy URL scheme must be socks5, socks5h, unix, http, https or ssh, not %q", u.Scheme)
+		}
+		if u.Path != "" && u.Path != "/" {
+			return socksEndpoint{}, fmt.Errorf("SOCKS5 proxy URL must not have a path")
+		}
+
+		e.server = u.Host
+		switch {
+		case u.Port() != "":
+		case e.connect:
+			return socksEndpoint{}, fmt.Errorf("HTTP proxy URL must have a port")
+		case e.ssh:
+			e.server = net.JoinHostPort(u.Hostname(), sshDefaultPort)
+		default:
+			e.server = net.JoinHostPort(u.Hostname(), socksDefaultPort)
+		}
+		if u.User != nil {
+			if user != "" || password != "" {
+				return socksEndpoint{}, fmt.Errorf("SOCKS5 proxy credentials must be set either in the URL or separately")
+			}
+			e.user = u.User.Username()
+			e.password, _ = u.User.Password()
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(e.server); err != nil && !e.unix {
+		return socksEndpoint{}, fmt.Errorf("SOCKS5 proxy must be host:port or a socks5:// URL: %w", err)
+	}
+	// SSH servers take a key instead of the password.
+	if e.ssh {
+		if e.user == "" {
+			return socksEndpoint{}, fmt.Errorf("SSH server %s needs a user", e.server)
+		}
+		return e, nil
+	}
+	// Without credentials the SOCKS5 proxy is used anonymously.
+	if (e.user == "") != (e.password == "") {
+		return socksEndpoint{}, fmt.Errorf("SOCKS5 proxy user and SOCKS5 proxy password must be set together")
+	}
+	return e, nil
+}
+
+// parseSocksProxies parses socks_proxy and socks_proxies, which share the
+// separately set credentials, followed by the reserved named upstreams, and
+// applies socks_dns to them. Proxies given by the name of an upstream are
+// that one, with the credentials of its URL.
+func parseSocksProxies(cfg *Config) ([]socksEndpoint, error) {
+	reserved := reservedUpstreams(cfg)
+	endpoints := make([]socksEndpoint, 0, 1+len(cfg.SocksProxies)+len(reserved))
+	for _, s := range append(append([]string{cfg.SocksProxy}, cfg.SocksProxies...), reserved...) {
+		user, password := cfg.SocksProxyUser, cfg.SocksProxyPassword
+		if named, ok := cfg.Upstreams[s]; ok {
+			s, user, password = named, "", ""
+		}
+		e, err := parseSocksProxy(s, user, password)
+		if err != nil {
+			return nil, err
+		}
+		if e.unix && len(cfg.SocksVia) > 0 {
+			return nil, fmt.Errorf("SOCKS5 proxy %s is a Unix socket, which can't be reached through socks_via", e.server)
+		}
+		if e.ssh && cfg.SocksSSHKnownHostsFile == "" {
+			return nil, fmt.Errorf("SSH server %s needs socks_ssh_known_hosts_file to verify its host key", e.server)
+		}
+		if e.ssh && e.password == "" && cfg.SocksSSHKeyFile == "" {
+			return nil, fmt.Errorf("SSH server %s needs a password or socks_ssh_key_file", e.server)
+		}
+		if cfg.SocksTLS && !e.connect && !e.ssh {
+			if e.unix {
+				return nil, fmt.Errorf("SOCKS5 proxy %s is a Unix socket, which isn't connected to over TLS", e.server)
+			}
+			e.tls = true
+		}
+		switch cfg.SocksDNS {
+		case dnsLocal:
+			e.localDNS = true
+		case dnsRemote:
+			if e.localDNS {
+				return nil, fmt.Errorf("proxy %s resolves names locally (socks5://), which socks_dns=remote forbids; use socks5h://", e.server)
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// reservedUpstreams returns the names of the named upstreams which aren't
+// socks_proxy or one of socks_proxies, in order.
+func reservedUpstreams(cfg *Config) []string {
+	var names []string
+	for name := range cfg.Upstreams {
+		if name != cfg.SocksProxy && !slices.Contains(cfg.SocksProxies, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// socksWeights returns the weights of the proxies of parseSocksProxies,
+// those of the balanced ones when reserved is false.
+func socksWeights(cfg *Config, reserved bool) []int {
+	weights := make([]int, 1+len(cfg.SocksProxies))
+	for i := range weights {
+		weights[i] = 1
+	}
+	if len(cfg.SocksWeights) > 0 {
+		weights = slices.Clone(cfg.SocksWeights)
+	}
+	if reserved {
+		for range reservedUpstreams(cfg) {
+			weights = append(weights, 1)
+		}
+	}
+	return weights
+}
+
+// socksNames returns the names of the proxies of parseSocksProxies. Those
+// given by the name of an upstream are named so unless socks_names names
+// them.
+func socksNames(cfg *Config) []string {
+	names := make([]string, 0, 1+len(cfg.SocksProxies))
+	for i, s := range append([]string{cfg.SocksProxy}, cfg.SocksProxies...) {
+		switch {
+		case len(cfg.SocksNames) > 0:
+			names = append(names, cfg.SocksNames[i])
+		case cfg.Upstreams[s] != "":
+			names = append(names, s)
+		default:
+			names = append(names, "")
+		}
+	}
+	return append(names, reservedUpstreams(cfg)...)
+}
+
+// upstreams holds the current upstream and the previous generations which
+// still carry open connections.
+type upstreams struct {
+	current atomic.Pointer[upstream]
+
+	mu          sync.Mutex
+	generations []*upstream
+	last        uint64
+}
+
+func newUpstreams(cfg *Config) *upstreams {
+	us := &upstreams{}
+	us.update(cfg)
+	return us
+}
+
+// update makes the upstream of cfg current. It reports whether this
+// started a new generation.
+func (us *upstreams) update(cfg *Config) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if cur := us.current.Load(); cur != nil && cur.sameAs(cfg) {
+		return false
+	}
+
+	// The config is validated, so the proxies, the chain and its hosts
+	// parse.
+	endpoints, _ := parseSocksProxies(cfg)
+	via, _ := parseProxyChain(cfg.SocksVia)
+	chain, _ := parseProxyChain(cfg.SocksChain)
+	chainMatch, _ := newHostMatcher(cfg.SocksChainHosts, cfg.HostGroups)
+	routes, _ := newUpstreamRoutes(cfg.UpstreamRoutes)
+
+	us.last++
+	u := &upstream{
+		generation: us.last,
+		balance:    cfg.SocksBalance,
+		keepAlive:  cfg.SocksKeepAlive,
+		chain:      chain,
+		via:        via,
+		viaSpec:    cfg.SocksVia,
+		chainSpec:  cfg.SocksChain,
+		chainHosts: cfg.SocksChainHosts,
+		groups:     cfg.HostGroups,
+		chainMatch: chainMatch,
+
+		tlsCAFile:   cfg.SocksCAFile,
+		tlsCertFile: cfg.SocksTLSCertFile,
+		tlsKeyFile:  cfg.SocksTLSKeyFile,
+
+		sshKeyFile:        cfg.SocksSSHKeyFile,
+		sshKnownHostsFile: cfg.SocksSSHKnownHostsFile,
+
+		resolve:         cfg.SocksResolve,
+		resolveInterval: cfg.SocksResolveInterval,
+
+		isolation: cfg.SocksIsolation,
+
+		maxConns:     cfg.SocksMaxConns,
+		maxConnsWait: cfg.SocksMaxConnsWait,
+
+		routes:    routes,
+		routeSpec: cfg.UpstreamRoutes,
+		users:     cfg.UserUpstreams,
+		namedSpec: cfg.Upstreams,
+	}
+	weights, names := socksWeights(cfg, true), socksNames(cfg)
+	for i, e := range endpoints {
+		u.servers = append(u.servers, &upstreamServer{
+			socksEndpoint: e,
+			weight:        weights[i],
+			name:          names[i],
+			reserved:      i > len(cfg.SocksProxies),
+			resolver:      newServerResolver(e.server, cfg.SocksResolve, cfg.SocksResolveInterval),
+		})
+	}
+	u.schedule = weightedSchedule(socksWeights(cfg, false))
+	us.current.Store(u)
+	us.generations = append(us.generations, u)
+	us.pruneLocked()
+	return true
+}
+
+// pruneLocked forgets previous generations without open connections.
+func (us *upstreams) pruneLocked() {
+	cur := us.current.Load()
+	kept := us.generations[:0]
+	for _, u := range us.generations {
+		if u == cur || u.open.Load() > 0 {
+			kept = append(kept, u)
+		}
+	}
+	us.generations = kept
+}
+
+type upstreamGenerationStats struct {
+	Generation uint64 `json:"generation"`
+	Server     string `json:"server"`
+	Current    bool   `json:"current"`
+	OpenConns  int64  `json:"open_conns"`
+}
+
+func (us *upstreams) stats() []upstreamGenerationStats {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.pruneLocked()
+	cur := us.current.Load()
+	res := make([]upstreamGenerationStats, 0, len(us.generations))
+	for _, u := range us.generations {
+		res = append(res, upstreamGenerationStats{
+			Generation: u.generation,
+			Server:     u.addresses(),
+			Current:    u == cur,
+			OpenConns:  u.open.Load(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Generation < res[j].Generation })
+	return res
+}
+
+func (us *upstreams) writeMetrics(pw metricsWriter) {
+	gens := us.stats()
+	pw.gauge("http2socks_upstream_generation", "Generation of the current upstream config.", float64(us.current.Load().generation))
+	pw.header("http2socks_upstream_generation_open_conns", "gauge", "Open connections per upstream config generation.")
+	for _, g := range gens {
+		pw.sample("http2socks_upstream_generation_open_conns", map[string]string{
+			"generation": formatUint(g.Generation),
+			"server":     g.Server,
+		}, float64(g.OpenConns))
+	}
+
+	cur := us.current.Load()
+	cur.writeBudgetMetrics(pw)
+	if len(cur.servers) < 2 {
+		return
+	}
+	pw.header("http2socks_upstream_server_open_conns", "gauge", "Open connections per SOCKS5 server of the current upstream.")
+	for _, s := range cur.servers {
+		pw.sample("http2socks_upstream_server_open_conns", map[string]string{"server": s.server}, float64(s.open.Load()))
+	}
+	pw.header("http2socks_upstream_server_weight", "gauge", "Weight of a SOCKS5 server of the current upstream.")
+	for _, s := range cur.servers {
+		pw.sample("http2socks_upstream_server_weight", map[string]string{"server": s.server}, float64(s.weight))
+	}
+	pw.header("http2socks_upstream_server_latency_seconds", "gauge", "Moving average of the handshake time of health probes of a SOCKS5 server of the current upstream.")
+	for _, s := range cur.servers {
+		if latency := s.latency.Load(); latency > 0 {
+			pw.sample("http2socks_upstream_server_latency_seconds", map[string]string{"server": s.server}, time.Duration(latency).Seconds())
+		}
+	}
+	if cur.balance == balanceFastest {
+		pw.header("http2socks_upstream_server_fastest", "gauge", "Whether a SOCKS5 server of the current upstream is the one preferred as the fastest.")
+		for i, s := range cur.servers {
+			fastest := 0.0
+			if int(cur.fastest.Load()) == i {
+				fastest = 1
+			}
+			pw.sample("http2socks_upstream_server_fastest", map[string]string{"server": s.server}, fastest)
+		}
+	}
+	pw.header("http2socks_upstream_server_up", "gauge", "Whether a SOCKS5 server of the current upstream is in rotation.")
+	for _, s := range cur.servers {
+		up := 1.0
+		if s.down.Load() {
+			up = 0
+		}
+		pw.sample("http2socks_upstream_server_up", map[string]string{"server": s.server}, up)
+	}
+	pw.header("http2socks_upstream_server_down_total", "counter", "Times a SOCKS5 server of the current upstream was taken out of rotation.")
+	for _, s := range cur.servers {
+		pw.sample("http2socks_upstream_server_down_total", map[string]string{"server": s.server}, float64(s.downs.Load()))
+	}
+}
+
+// upstreamDialer dials through a server of an upstream and counts the
+// connections open on them. servers has the dialers of the upstream
+// servers in order. With markDown servers which can't be reached are taken
+// out of rotation until a health probe succeeds. Rejected credentials are
+// reported to auth.
+type upstreamDialer struct {
+	upstream *upstream
+	servers  []serverDialer
+	connMap  *connMapLog
+	markDown bool
+	auth     *socksAuthGuard
+	rebind   *rebindGuard
+}
+
+// serverDialer dials through one upstream server. Destinations routed
+// through the upstream chain are dialed with chained. Dialed connections
+// are recorded in connMap.
+type serverDialer struct {
+	dialer  proxy.ContextDialer
+	chained proxy.ContextDialer
+}
+
+// DialContext fails over to the other servers when the one picked can't
+// be reached. A server selected for the request or routed to is the only
+// one tried.
+func (d upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.upstream.pausedFor() > 0 {
+		d.auth.paused.Add(1)
+		return nil, errSocksAuthPaused
+	}
+
+	tried := make([]bool, len(d.servers))
+	var key string
+	if d.upstream.balance == balanceAffinity {
+		key = affinityKey(ctx)
+	}
+	name, ok := selectedServer(ctx)
+	if !ok {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			name, ok = d.upstream.routes.match(strings.ToLower(host))
+		}
+	}
+	if ok {
+		i := d.upstream.serverIndex(name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown upstream server %q", name)
+		}
+		for j := range tried {
+			tried[j] = j != i
+		}
+	} else {
+		for j, s := range d.upstream.servers {
+			tried[j] = s.reserved
+		}
+	}
+	for {
+		i := d.upstream.pick(tried, key)
+		if i < 0 {
+			// The servers left are at their connection limit.
+			var err error
+			if i, err = d.upstream.waitPick(ctx, tried, key); err != nil {
+				return nil, err
+			}
+		}
+		tried[i] = true
+		server, sd := d.upstream.servers[i], d.servers[i]
+		conn, err := d.dial(ctx, server, sd, network, addr)
+		if err == nil {
+			d.upstream.open.Add(1)
+			return &upstreamConn{Conn: conn, upstream: d.upstream, server: server}, nil
+		}
+		server.open.Add(-1)
+
+		if socksAuthFailure(err) {
+			d.auth.failed(d.upstream, server.server, err)
+			return nil, err
+		}
+		if len(d.servers) == 1 || !unreachable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		if d.markDown {
+			server.markDown(err)
+		}
+		if !slices.Contains(tried, false) {
+			return nil, err
+		}
+	}
+}
+
+func (d upstreamDialer) dial(ctx context.Context, server *upstreamServer, sd serverDialer, network, addr string) (net.Conn, error) {
+	dialer := sd.dialer
+	if sd.chained != nil {
+		if host, _, err := net.SplitHostPort(addr); err == nil && d.upstream.chained(strings.ToLower(host)) {
+			dialer = sd.chained
+		}
+	}
+
+	start := time.Now()
+	target := addr
+	if server.localDNS {
+		var err error
+		if target, err = d.rebind.resolve(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := dialer.DialContext(ctx, network, target)
+	d.upstream.lastDial.Store(&dialResult{time: time.Now(), err: err})
+	if err != nil {
+		return nil, err
+	}
+	if t := timingFromContext(ctx); t != nil {
+		t.dialed(time.Since(start))
+	}
+	d.connMap.record(ctx, conn, server.server, addr)
+	return conn, nil
+}
+
+// resolveLocally replaces the host of addr by its first IP address.
+func resolveLocally(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	return net.JoinHostPort(addrs[0].Unmap().String(), port), nil
+}
+
+type upstreamConn struct {
+	net.Conn
+
+	upstream  *upstream
+	server    *upstreamServer
+	closeOnce sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.upstream.open.Add(-1)
+		c.server.open.Add(-1)
+	})
+	return c.Conn.Close()
+}
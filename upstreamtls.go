@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/net/proxy"
+)
+
+// newUpstreamTLSConfig returns the TLS config of connections to SOCKS5
+// servers over TLS and to https:// proxies: server certificates are
+// verified against the CA certificates in caFile, or the system roots when
+// it's empty, and the client certificate of certFile and keyFile is
+// presented when they are set.
+func newUpstreamTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// tlsConfig returns the TLS config of the servers of u.
+func (u *upstream) tlsConfig() (*tls.Config, error) {
+	return newUpstreamTLSConfig(u.tlsCAFile, u.tlsCertFile, u.tlsKeyFile)
+}
+
+// tlsDialer wraps connections of forward in TLS, verifying the host name
+// dialed.
+type tlsDialer struct {
+	config  *tls.Config
+	forward proxy.Dialer
+}
+
+func (d tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d tlsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := dialContext(ctx, d.forward, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := tlsHandshake(ctx, conn, addr, d.config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, &net.OpError{Op: "tls", Net: network, Addr: hopAddr(addr), Err: err}
+	}
+	return tlsConn, nil
+}
+
+// tlsHandshake runs the TLS handshake with the server at addr over conn.
+func tlsHandshake(ctx context.Context, conn net.Conn, addr string, config *tls.Config) (*tls.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
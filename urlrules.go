@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	urlRuleAllow = "allow"
+	urlRuleDeny  = "deny"
+)
+
+// urlRule allows or denies plain HTTP requests to destinations matching
+// hosts whose URL path matches path, a pattern where * matches any
+// characters including slashes. A pattern with ? also matches the query.
+type urlRule struct {
+	text  string
+	allow bool
+	hosts *hostMatcher
+	path  string
+}
+
+// urlRules are checked in order and the first matching rule applies.
+// Requests matching no rule are allowed.
+type urlRules []urlRule
+
+// parseURLRules parses rules of the form "allow|deny destination path",
+// e.g. "deny api.example.com /admin/*".
+func parseURLRules(specs []string, groups map[string]string) (urlRules, error) {
+	rules := make(urlRules, 0, len(specs))
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("URL rule %q: must be action, destination and path", spec)
+		}
+		action, host, pattern := fields[0], fields[1], fields[2]
+		if action != urlRuleAllow && action != urlRuleDeny {
+			return nil, fmt.Errorf("URL rule %q: action must be %s or %s", spec, urlRuleAllow, urlRuleDeny)
+		}
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("URL rule %q: path must start with /", spec)
+		}
+		hosts, err := newHostMatcher([]string{host}, groups)
+		if err != nil {
+			return nil, fmt.Errorf("URL rule %q: %w", spec, err)
+		}
+		rules = append(rules, urlRule{
+			text:  strings.Join(fields, " "),
+			allow: action == urlRuleAllow,
+			hosts: hosts,
+			path:  pattern,
+		})
+	}
+	return rules, nil
+}
+
+// match returns the first rule matching a request for u to host.
+func (rs urlRules) match(host string, u *url.URL) (urlRule, bool) {
+	if len(rs) == 0 {
+		return urlRule{}, false
+	}
+
+	for _, r := range rs {
+		if r.hosts.match(host) && matchURLPath(r.path, u) {
+			return r, true
+		}
+	}
+	return urlRule{}, false
+}
+
+// matchURLPath reports whether the path of u matches pattern, a pattern
+// with ? also matching the query.
+func matchURLPath(pattern string, u *url.URL) bool {
+	// Cleaning the path keeps /v1/../admin from passing as /v1/*.
+	p := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && p != "/" {
+		p += "/"
+	}
+	if strings.Contains(pattern, "?") {
+		p += "?" + u.RawQuery
+	}
+	return globMatch(pattern, p)
+}
+
+// globMatch reports whether s matches pattern, in which * matches any
+// sequence of characters.
+func globMatch(pattern, s string) bool {
+	// After a star, rest is the pattern following it and next the position
+	// in s it's tried at when matching fails.
+	starred, rest, next := false, "", 0
+	for i := 0; i < len(s); {
+		switch {
+		case len(pattern) > 0 && pattern[0] == '*':
+			starred, rest, next = true, pattern[1:], i
+			pattern = rest
+		case len(pattern) > 0 && pattern[0] == s[i]:
+			pattern = pattern[1:]
+			i++
+		case starred:
+			// Let the star match one more character.
+			next++
+			i = next
+			pattern = rest
+		default:
+			return false
+		}
+	}
+	return strings.Trim(pattern, "*") == ""
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// verifyTimeout bounds each path of verify.
+const verifyTimeout = 30 * time.Second
+
+type verifyDNS struct {
+	Host string `json:"host"`
+	// ResolvedBy is where the upstream resolves the host: "proxy" or
+	// "socks server". The local lookup is made either way, as a hint when
+	// the name doesn't resolve upstream.
+	ResolvedBy string   `json:"resolved_by"`
+	Addresses  []string `json:"addresses,omitempty"`
+	LookupMs   float64  `json:"lookup_ms,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type verifyPath struct {
+	Status int `json:"status,omitempty"`
+	// DialMs is the connection through the SOCKS5 server: connect,
+	// negotiation and CONNECT command.
+	DialMs         float64 `json:"dial_ms,omitempty"`
+	TLSHandshakeMs float64 `json:"tls_handshake_ms,omitempty"`
+	TLSVersion     string  `json:"tls_version,omitempty"`
+	TTFBMs         float64 `json:"ttfb_ms,omitempty"`
+	TotalMs        float64 `json:"total_ms"`
+	BodyBytes      int64   `json:"body_bytes"`
+	BodySHA256     string  `json:"body_sha256,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+type verifyReport struct {
+	URL      string     `json:"url"`
+	Upstream string     `json:"upstream"`
+	DNS      verifyDNS  `json:"dns"`
+	Plain    verifyPath `json:"plain"`
+	Connect  verifyPath `json:"connect"`
+	// SameBody tells whether both paths got the same body, which dynamic
+	// pages don't.
+	SameBody bool `json:"same_body"`
+}
+
+// runVerify is the verify command: it requests the URL given as the last
+// argument through the configured upstream, once the way plain requests
+// are proxied and once through a tunnel like CONNECT requests, and prints
+// what each step took as JSON for support tickets. The other arguments are
+// the usual flags. It returns the exit code, 1 when a path failed.
+func runVerify(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[len(args)-1], "-") {
+		fmt.Fprintln(os.Stderr, "usage: http2socks verify [flags] URL")
+		return 2
+	}
+	target, err := url.Parse(args[len(args)-1])
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		fmt.Fprintf(os.Stderr, "verify: %q is not an http or https URL\n", args[len(args)-1])
+		return 2
+	}
+
+	// The flags are those of the proxy.
+	os.Args = append(os.Args[:1], args[:len(args)-1]...)
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify:", err)
+		return 2
+	}
+	p := &forwardProxy{
+		upstreams:       newUpstreams(config),
+		stats:           newProxyStats(),
+		recycler:        &poolRecycler{},
+		maxIdleConns:    config.UpstreamMaxIdleConns,
+		idleConnTimeout: config.UpstreamIdleConnTimeout,
+
+		requestTimeout:        config.RequestTimeout,
+		responseHeaderTimeout: config.ResponseHeaderTimeout,
+	}
+	if p.serverNames, err = newServerNames(config.OriginServerNames); err != nil {
+		fmt.Fprintln(os.Stderr, "verify:", err)
+		return 2
+	}
+
+	u := p.upstreams.current.Load()
+	report := verifyReport{
+		URL:      target.String(),
+		Upstream: u.addresses(),
+		DNS:      verifyLookup(target.Hostname(), u.servers[0].localDNS),
+		Plain:    p.verifyPlain(target),
+		Connect:  p.verifyConnect(target),
+	}
+	report.SameBody = report.Plain.Error == "" && report.Connect.Error == "" &&
+		report.Plain.BodySHA256 == report.Connect.BodySHA256
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(report); err != nil {
+		fmt.Fprintln(os.Stderr, "verify:", err)
+		return 1
+	}
+	if report.Plain.Error != "" || report.Connect.Error != "" {
+		return 1
+	}
+	return 0
+}
+
+func verifyLookup(host string, localDNS bool) verifyDNS {
+	res := verifyDNS{Host: host, ResolvedBy: "socks server"}
+	if localDNS {
+		res.ResolvedBy = "proxy"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	res.LookupMs = ms(time.Since(start))
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Addresses = addrs
+	return res
+}
+
+// verifyPlain requests target with the client of plain requests.
+func (p *forwardProxy) verifyPlain(target *url.URL) verifyPath {
+	client, err := p.getHTTPClient()
+	if err != nil {
+		return verifyPath{Error: err.Error()}
+	}
+	return verifyRequest(client, target)
+}
+
+// verifyConnect opens a tunnel to target through the SOCKS5 server and
+// requests it over the tunnel.
+func (p *forwardProxy) verifyConnect(target *url.URL) verifyPath {
+	dialer, err := p.getSocksDialer()
+	if err != nil {
+		return verifyPath{Error: err.Error()}
+	}
+	addr := target.Host
+	if target.Port() == "" {
+		addr = net.JoinHostPort(target.Hostname(), map[string]string{"http": "80", "https": "443"}[target.Scheme])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	dial := time.Since(start)
+	if err != nil {
+		return verifyPath{DialMs: ms(dial), TotalMs: ms(dial), Error: err.Error()}
+	}
+
+	used := false
+	transport := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			if used {
+				return nil, errors.New("tunnel already used")
+			}
+			used = true
+			return conn, nil
+		},
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		DisableKeepAlives:   true,
+	}
+	defer transport.CloseIdleConnections()
+	res := verifyRequest(&http.Client{Timeout: verifyTimeout, Transport: transport}, target)
+	// The connection was given to the client ready.
+	res.DialMs = ms(dial)
+	res.TotalMs += ms(dial)
+	return res
+}
+
+// verifyRequest gets target with client and times it.
+func verifyRequest(client *http.Client, target *url.URL) verifyPath {
+	var (
+		res                           verifyPath
+		start, gotConn, tlsStart      time.Time
+		tlsDone, wrote, firstByteTime time.Time
+	)
+	trace := &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { gotConn = time.Now() },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByteTime = time.Now() },
+	}
+
+	ctx, cancel := context.WithTimeout(httptrace.WithClientTrace(context.Background(), trace), verifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	start = time.Now()
+	resp, err := client.Do(req)
+	if !gotConn.IsZero() {
+		// The TLS handshake is part of getting the connection.
+		connected := gotConn
+		if !tlsStart.IsZero() {
+			connected = tlsStart
+		}
+		res.DialMs = ms(connected.Sub(start))
+	}
+	if !tlsStart.IsZero() && !tlsDone.IsZero() {
+		res.TLSHandshakeMs = ms(tlsDone.Sub(tlsStart))
+	}
+	if !wrote.IsZero() && !firstByteTime.IsZero() {
+		res.TTFBMs = ms(firstByteTime.Sub(wrote))
+	}
+	if err != nil {
+		res.TotalMs = ms(time.Since(start))
+		res.Error = err.Error()
+		return res
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	res.Status = resp.StatusCode
+	if resp.TLS != nil {
+		res.TLSVersion = tls.VersionName(resp.TLS.Version)
+	}
+
+	h := sha256.New()
+	res.BodyBytes, err = io.Copy(h, resp.Body)
+	res.TotalMs = ms(time.Since(start))
+	if err != nil {
+		res.Error = "reading body: " + err.Error()
+		return res
+	}
+	res.BodySHA256 = hex.EncodeToString(h.Sum(nil))
+	return res
+}